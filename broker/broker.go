@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/automuteus/galactus/pkg/redisutil"
 	"github.com/automuteus/utils/pkg/rediskey"
 	"github.com/automuteus/utils/pkg/task"
 	"github.com/go-redis/redis/v8"
@@ -12,6 +15,7 @@ import (
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -20,30 +24,77 @@ import (
 const ConnectCodeLength = 8
 
 type Broker struct {
-	client *redis.Client
+	client redis.UniversalClient
 
 	// map of socket IDs to connection codes
 	connections map[string]string
 
 	ackKillChannels map[string]chan bool
 	connectionsLock sync.RWMutex
+
+	// encoding of the jobs pushed for automuteus
+	jobEncoder jobcodec.Encoder
+
+	// jobs waiting for Redis to come back
+	fallback *fallbackQueue
+
+	// queue length above which low-priority jobs are dropped
+	jobQueueHighWater int64
+	// how long a repeated event is recognized as a duplicate
+	jobDedupWindow time.Duration
+	// reports connect codes whose events are dropped; nil drops none
+	denied func(ctx context.Context, connCode string) bool
 }
 
-func NewBroker(redisAddr, redisUser, redisPass string) *Broker {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Username: redisUser,
-		Password: redisPass,
-		DB:       0, // use default DB
-	})
+func NewBroker(cfg config.Config) *Broker {
+	rdb := redisutil.NewClient(cfg.Redis)
+
+	jobFormat, err := jobcodec.ParseFormat(os.Getenv("JOB_ENCODING"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Using job encoding " + jobFormat.String())
+
+	compressThreshold := 0
+	num, err := strconv.ParseInt(os.Getenv("JOB_COMPRESS_THRESHOLD"), 10, 64)
+	if err == nil {
+		log.Printf("Read from env; using JOB_COMPRESS_THRESHOLD=%d\n", num)
+		compressThreshold = int(num)
+	}
+
+	fallbackSize := DefaultFallbackQueueSize
+	num, err = strconv.ParseInt(os.Getenv("FALLBACK_QUEUE_SIZE"), 10, 64)
+	if err == nil && num >= 0 {
+		log.Printf("Read from env; using FALLBACK_QUEUE_SIZE=%d\n", num)
+		fallbackSize = int(num)
+	}
+
+	jobDedupWindow := DefaultJobDedupWindow
+	if cfg.JobDedupWindow > 0 {
+		jobDedupWindow = time.Duration(cfg.JobDedupWindow)
+	}
+
 	return &Broker{
 		client:          rdb,
 		connections:     map[string]string{},
 		ackKillChannels: map[string]chan bool{},
 		connectionsLock: sync.RWMutex{},
+		jobEncoder: jobcodec.Encoder{
+			Format:            jobFormat,
+			CompressThreshold: compressThreshold,
+		},
+		fallback:          newFallbackQueue(fallbackSize),
+		jobQueueHighWater: cfg.JobQueueHighWaterOrDefault(),
+		jobDedupWindow:    jobDedupWindow,
 	}
 }
 
+// SetDenyFilter drops the events of every connect code denied reports, before they're queued. Must be called before
+// Start
+func (broker *Broker) SetDenyFilter(denied func(ctx context.Context, connCode string) bool) {
+	broker.denied = denied
+}
+
 func (broker *Broker) TasksListener(server *socketio.Server, connectCode string, killchan <-chan bool) {
 	pubsub := broker.client.Subscribe(context.Background(), rediskey.TasksSubscribe(connectCode))
 	log.Println("Task listener OPEN for " + connectCode)
@@ -70,6 +121,19 @@ func (broker *Broker) TasksListener(server *socketio.Server, connectCode string,
 	}
 }
 
+// captureEvent queues an event from a socket that has sent its connect code
+func (broker *Broker) captureEvent(s socketio.Conn, event, msg string) {
+	broker.connectionsLock.RLock()
+	cCode, ok := broker.connections[s.ID()]
+	broker.connectionsLock.RUnlock()
+	if !ok {
+		return
+	}
+	if err := broker.CaptureEvent(context.Background(), cCode, event, msg); err != nil {
+		log.Println(err)
+	}
+}
+
 func (broker *Broker) Start(port string) {
 	server, err := socketio.NewServer(nil)
 	if err != nil {
@@ -94,7 +158,7 @@ func (broker *Broker) Start(port string) {
 			broker.ackKillChannels[s.ID()] = killChannel
 			broker.connectionsLock.Unlock()
 
-			err := task.PushJob(context.Background(), broker.client, msg, task.ConnectionJob, "true")
+			err := broker.pushJob(context.Background(), msg, task.ConnectionJob, "true")
 			if err != nil {
 				log.Println(err)
 			}
@@ -120,88 +184,34 @@ func (broker *Broker) Start(port string) {
 		broker.connectionsLock.RUnlock()
 	})
 
+	// capture bots send either the bare task ID, or a JSON object with the task ID and a failure code
 	server.OnEvent("/", "taskFailed", func(s socketio.Conn, msg string) {
-		log.Printf("Received failure for task ID: \"%s\"", msg)
+		failure := ack.FromFailure(msg)
+		log.Printf("Received failure for task ID: \"%s\" with code %s", failure.TaskID, failure.Code)
 
-		broker.client.Publish(context.Background(), rediskey.CompleteTask(msg), "false")
+		broker.client.Publish(context.Background(), rediskey.CompleteTask(failure.TaskID), failure.Marshal())
 	})
 
 	server.OnEvent("/", "taskComplete", func(s socketio.Conn, msg string) {
 		log.Printf("Received success for task ID: \"%s\"", msg)
 
-		broker.client.Publish(context.Background(), rediskey.CompleteTask(msg), "true")
+		broker.client.Publish(context.Background(), rediskey.CompleteTask(msg), ack.Ack{TaskID: msg, Success: true}.Marshal())
 	})
 
 	server.OnEvent("/", "lobby", func(s socketio.Conn, msg string) {
 		log.Println("lobby:", msg)
-
-		// validation
-		var lobby game.Lobby
-		err := json.Unmarshal([]byte(msg), &lobby)
-		if err != nil {
-			log.Println(err)
-		} else {
-			broker.connectionsLock.RLock()
-			if cCode, ok := broker.connections[s.ID()]; ok {
-				err := task.PushJob(context.Background(), broker.client, cCode, task.LobbyJob, msg)
-				if err != nil {
-					log.Println(err)
-				}
-				err = broker.client.Set(context.Background(), rediskey.RoomCodesForConnCode(cCode), lobby.LobbyCode, time.Minute*15).Err()
-				if err != nil {
-					log.Println(err)
-				} else {
-					log.Printf("Updated room code %s for connect code %s in Redis", lobby.LobbyCode, cCode)
-				}
-			}
-			broker.connectionsLock.RUnlock()
-		}
+		broker.captureEvent(s, CaptureEventLobby, msg)
 	})
 	server.OnEvent("/", "state", func(s socketio.Conn, msg string) {
 		log.Println("phase received from capture: ", msg)
-		_, err := strconv.Atoi(msg)
-		if err != nil {
-			log.Println(err)
-		} else {
-			broker.connectionsLock.RLock()
-			if cCode, ok := broker.connections[s.ID()]; ok {
-				err := task.PushJob(context.Background(), broker.client, cCode, task.StateJob, msg)
-				if err != nil {
-					log.Println(err)
-				}
-				err = broker.client.Expire(context.Background(), rediskey.RoomCodesForConnCode(cCode), time.Minute*15).Err()
-				if !errors.Is(err, redis.Nil) && err != nil {
-					log.Println(err)
-				}
-			}
-			broker.connectionsLock.RUnlock()
-		}
+		broker.captureEvent(s, CaptureEventState, msg)
 	})
 	server.OnEvent("/", "player", func(s socketio.Conn, msg string) {
 		log.Println("player received from capture: ", msg)
-
-		broker.connectionsLock.RLock()
-		if cCode, ok := broker.connections[s.ID()]; ok {
-			err := task.PushJob(context.Background(), broker.client, cCode, task.PlayerJob, msg)
-			if err != nil {
-				log.Println(err)
-			}
-			err = broker.client.Expire(context.Background(), rediskey.RoomCodesForConnCode(cCode), time.Minute*15).Err()
-			if !errors.Is(err, redis.Nil) && err != nil {
-				log.Println(err)
-			}
-		}
-		broker.connectionsLock.RUnlock()
+		broker.captureEvent(s, CaptureEventPlayer, msg)
 	})
 	server.OnEvent("/", "gameover", func(s socketio.Conn, msg string) {
-		broker.connectionsLock.RLock()
-		if cCode, ok := broker.connections[s.ID()]; ok {
-			err := task.PushJob(context.Background(), broker.client, cCode, task.GameOverJob, msg)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-		broker.connectionsLock.RUnlock()
+		broker.captureEvent(s, CaptureEventGameOver, msg)
 	})
 	server.OnError("/", func(s socketio.Conn, e error) {
 		log.Println("meet error:", e)
@@ -211,7 +221,7 @@ func (broker *Broker) Start(port string) {
 
 		broker.connectionsLock.RLock()
 		if cCode, ok := broker.connections[s.ID()]; ok {
-			err := task.PushJob(context.Background(), broker.client, cCode, task.ConnectionJob, "false")
+			err := broker.pushJob(context.Background(), cCode, task.ConnectionJob, "false")
 			if err != nil {
 				log.Println(err)
 			}
@@ -243,11 +253,11 @@ func (broker *Broker) Start(port string) {
 		broker.connectionsLock.RUnlock()
 
 		// default to listing active games in the last 15 mins
-		activeGames := rediskey.GetActiveGames(context.Background(), broker.client, 900)
-		version, commit := rediskey.GetVersionAndCommit(context.Background(), broker.client)
-		totalGuilds := rediskey.GetGuildCounter(context.Background(), broker.client)
-		totalUsers := rediskey.GetTotalUsers(context.Background(), broker.client)
-		totalGames := rediskey.GetTotalGames(context.Background(), broker.client)
+		activeGames := getActiveGames(context.Background(), broker.client, 900)
+		version, commit := getVersionAndCommit(context.Background(), broker.client)
+		totalGuilds := getGuildCounter(context.Background(), broker.client)
+		totalUsers := getTotalUsers(context.Background(), broker.client)
+		totalGames := getTotalGames(context.Background(), broker.client)
 
 		data := map[string]interface{}{
 			"version":           version,
@@ -290,6 +300,8 @@ func (broker *Broker) Start(port string) {
 			w.Write(jbytes)
 		}
 	})
+	go broker.FlushFallbackQueue(context.Background())
+
 	log.Printf("Message broker is running on port %s...\n", port)
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
@@ -312,7 +324,7 @@ func errorResponse(w http.ResponseWriter) {
 
 // anytime a bot "acks", then push a notification
 func (broker *Broker) AckWorker(ctx context.Context, connCode string, killChan <-chan bool) {
-	pubsub := task.AckSubscribe(ctx, broker.client, connCode)
+	pubsub := broker.client.Subscribe(ctx, rediskey.JobNamespace+connCode+":ack")
 	channel := pubsub.Channel()
 	defer pubsub.Close()
 
@@ -321,7 +333,7 @@ func (broker *Broker) AckWorker(ctx context.Context, connCode string, killChan <
 		case <-killChan:
 			return
 		case <-channel:
-			err := task.PushJob(ctx, broker.client, connCode, task.ConnectionJob, "true")
+			err := broker.pushJob(ctx, connCode, task.ConnectionJob, "true")
 			if err != nil {
 				log.Println(err)
 			}
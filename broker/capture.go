@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"strconv"
+	"time"
+)
+
+// capture events, named as capture clients send them over socket.io
+const (
+	CaptureEventConnection = "connection"
+	CaptureEventLobby      = "lobby"
+	CaptureEventState      = "state"
+	CaptureEventPlayer     = "player"
+	CaptureEventGameOver   = "gameover"
+)
+
+// RoomCodeTTL is how long a connect code's lobby code is kept after its last lobby, state or player event
+const RoomCodeTTL = time.Minute * 15
+
+// ErrInvalidEvent is returned for capture events that are unknown or carry a payload the workers couldn't use
+var ErrInvalidEvent = errors.New("invalid capture event")
+
+// CaptureEvent validates an event from a capture client and queues it for the workers. Events arrive over the
+// broker's socket.io connections, or over HTTP through galactus
+func (broker *Broker) CaptureEvent(ctx context.Context, connCode, event, payload string) error {
+	switch event {
+	case CaptureEventConnection:
+		if payload != "true" && payload != "false" {
+			return fmt.Errorf("%w: connection must be true or false", ErrInvalidEvent)
+		}
+		return broker.pushJob(ctx, connCode, task.ConnectionJob, payload)
+
+	case CaptureEventLobby:
+		var lobby game.Lobby
+		if err := json.Unmarshal([]byte(payload), &lobby); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+		}
+		if err := broker.pushJob(ctx, connCode, task.LobbyJob, payload); err != nil {
+			return err
+		}
+		err := broker.client.Set(ctx, rediskey.RoomCodesForConnCode(connCode), lobby.LobbyCode, RoomCodeTTL).Err()
+		if err != nil {
+			log.Println(err)
+		} else {
+			log.Printf("Updated room code %s for connect code %s in Redis", lobby.LobbyCode, connCode)
+		}
+		return nil
+
+	case CaptureEventState:
+		if _, err := strconv.Atoi(payload); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+		}
+		if err := broker.pushJob(ctx, connCode, task.StateJob, payload); err != nil {
+			return err
+		}
+		broker.refreshRoomCode(ctx, connCode)
+		return nil
+
+	case CaptureEventPlayer:
+		// players and game results are only checked to be JSON, so new fields from capture clients keep flowing
+		if !json.Valid([]byte(payload)) {
+			return fmt.Errorf("%w: player isn't JSON", ErrInvalidEvent)
+		}
+		if err := broker.pushJob(ctx, connCode, task.PlayerJob, payload); err != nil {
+			return err
+		}
+		broker.refreshRoomCode(ctx, connCode)
+		return nil
+
+	case CaptureEventGameOver:
+		if !json.Valid([]byte(payload)) {
+			return fmt.Errorf("%w: gameover isn't JSON", ErrInvalidEvent)
+		}
+		return broker.pushJob(ctx, connCode, task.GameOverJob, payload)
+	}
+	return fmt.Errorf("%w: unknown event \"%s\"", ErrInvalidEvent, event)
+}
+
+func (broker *Broker) refreshRoomCode(ctx context.Context, connCode string) {
+	err := broker.client.Expire(ctx, rediskey.RoomCodesForConnCode(connCode), RoomCodeTTL).Err()
+	if !errors.Is(err, redis.Nil) && err != nil {
+		log.Println(err)
+	}
+}
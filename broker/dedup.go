@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/automuteus/utils/pkg/game"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"time"
+)
+
+const DefaultJobDedupWindow = 10 * time.Second
+
+var jobsDeduplicatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_broker_jobs_deduplicated_total",
+	Help: "Jobs dropped because they repeated the previous event of the same kind, like a capture client replaying its state after reconnecting, by job type",
+}, []string{"type"})
+
+// stores the hash of the latest event of a kind, returning 1 if it's the same as the one before it
+var dedupScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 0
+`)
+
+// dedupKey identifies the kind of event a job repeats: the lobby, the game state, or one player's state. Connection
+// jobs aren't deduplicated, since a reconnect always changes the connection
+func dedupKey(connCode string, jobType task.JobType, payload string) string {
+	key := "galactus:dedup:{" + connCode + "}:" + jobcodec.TypeName(jobType)
+	switch jobType {
+	case task.ConnectionJob:
+		return ""
+	case task.PlayerJob:
+		var player game.Player
+		if err := json.Unmarshal([]byte(payload), &player); err != nil {
+			return ""
+		}
+		return key + ":" + player.Name
+	}
+	return key
+}
+
+// duplicateJob reports whether the job repeats the previous event of its kind for the connect code within the dedup
+// window. A capture client that reconnects replays its lobby, game state and players, which workers have already seen.
+// An event that changes something and then changes it back isn't a duplicate, since the change in between was recorded
+func (broker *Broker) duplicateJob(ctx context.Context, connCode string, jobType task.JobType, payload string) bool {
+	key := dedupKey(connCode, jobType, payload)
+	if key == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(payload))
+	dup, err := dedupScript.Run(ctx, broker.client, []string{key},
+		hex.EncodeToString(sum[:]), broker.jobDedupWindow.Milliseconds()).Int()
+	if err != nil {
+		// better a duplicate than a lost event
+		log.Println(err)
+		return false
+	}
+	if dup == 1 {
+		jobsDeduplicatedTotal.WithLabelValues(jobcodec.TypeName(jobType)).Inc()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"sync"
+	"time"
+)
+
+const DefaultFallbackQueueSize = 1000
+const FallbackFlushInterval = time.Second
+
+var (
+	fallbackQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "galactus_broker_fallback_queue_length",
+		Help: "Jobs buffered in memory while Redis is unreachable",
+	})
+	fallbackQueuedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "galactus_broker_fallback_queued_total",
+		Help: "Jobs that were buffered in memory because Redis was unreachable",
+	})
+	fallbackDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "galactus_broker_fallback_dropped_total",
+		Help: "Buffered jobs that were dropped because the fallback queue was full",
+	})
+)
+
+type pendingJob struct {
+	connCode string
+	jBytes   []byte
+}
+
+// fallbackQueue holds encoded jobs while Redis is unreachable, so capture events aren't lost during a blip. Once it
+// holds anything, new jobs are queued behind it too, so jobs for a game always reach Redis in the order they happened
+type fallbackQueue struct {
+	jobs    []pendingJob
+	maxSize int
+	lock    sync.Mutex
+}
+
+func newFallbackQueue(maxSize int) *fallbackQueue {
+	return &fallbackQueue{
+		jobs:    []pendingJob{},
+		maxSize: maxSize,
+	}
+}
+
+func (queue *fallbackQueue) empty() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.jobs) == 0
+}
+
+// push returns false if the queue is disabled (size 0) and the job wasn't buffered
+func (queue *fallbackQueue) push(job pendingJob) bool {
+	if queue.maxSize < 1 {
+		return false
+	}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if len(queue.jobs) == 0 {
+		log.Println("Redis is unreachable; buffering jobs in memory")
+	}
+	// drop the oldest job; the newest state of a game is worth more than the oldest
+	if len(queue.jobs) >= queue.maxSize {
+		queue.jobs = queue.jobs[1:]
+		fallbackDroppedTotal.Inc()
+	}
+	queue.jobs = append(queue.jobs, job)
+	fallbackQueuedTotal.Inc()
+	fallbackQueueLength.Set(float64(len(queue.jobs)))
+	return true
+}
+
+func (queue *fallbackQueue) peek() (pendingJob, bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if len(queue.jobs) == 0 {
+		return pendingJob{}, false
+	}
+	return queue.jobs[0], true
+}
+
+// pop removes the job returned by peek; it stays queued while it's being pushed, so new jobs can't overtake it
+func (queue *fallbackQueue) pop() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if len(queue.jobs) > 0 {
+		queue.jobs = queue.jobs[1:]
+	}
+	fallbackQueueLength.Set(float64(len(queue.jobs)))
+}
+
+// FlushFallbackQueue pushes any jobs buffered during a Redis outage, in order, once Redis is reachable again
+func (broker *Broker) FlushFallbackQueue(ctx context.Context) {
+	ticker := time.NewTicker(FallbackFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			broker.flushFallbackQueue(ctx)
+		}
+	}
+}
+
+func (broker *Broker) flushFallbackQueue(ctx context.Context) {
+	if broker.fallback.empty() || broker.client.Ping(ctx).Err() != nil {
+		return
+	}
+	flushed := 0
+	for {
+		job, ok := broker.fallback.peek()
+		if !ok {
+			log.Printf("Redis is reachable again; flushed %d buffered jobs\n", flushed)
+			return
+		}
+		if err := broker.rpushJob(ctx, job.connCode, job.jBytes); err != nil {
+			log.Println(err)
+			return
+		}
+		broker.fallback.pop()
+		flushed++
+	}
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"time"
+)
+
+var jobsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_broker_jobs_dropped_total",
+	Help: "Low-priority jobs dropped because the connect code's queue was above the high-water mark, by job type",
+}, []string{"type"})
+
+// lowPriorityJob reports whether a job can be dropped when workers fall behind. Lobby jobs only carry the latest lobby
+// code and region, so the next one replaces anything that was dropped; everything else changes game state
+func lowPriorityJob(jobType task.JobType) bool {
+	return jobType == task.LobbyJob
+}
+
+// overHighWater reports whether the connect code's queue is at or above the high-water mark. If Redis can't say, the
+// job is queued as usual
+func (broker *Broker) overHighWater(ctx context.Context, connCode string) bool {
+	count, err := broker.client.LLen(ctx, rediskey.JobNamespace+connCode).Result()
+	if err != nil {
+		return false
+	}
+	return count >= broker.jobQueueHighWater
+}
+
+// pushJob queues a job for automuteus in the broker's configured encoding, stamped with the time it was queued. With the
+// default JSON encoding, legacy workers read it just like a job from task.PushJob. If Redis is unreachable, the job is
+// buffered in memory and pushed once it's back
+func (broker *Broker) pushJob(ctx context.Context, connCode string, jobType task.JobType, payload string) error {
+	if broker.denied != nil && broker.denied(ctx, connCode) {
+		log.Printf("Connect code %s is on a denied guild; dropping %s job\n", connCode, jobcodec.TypeName(jobType))
+		return nil
+	}
+	if lowPriorityJob(jobType) && broker.fallback.empty() && broker.overHighWater(ctx, connCode) {
+		log.Printf("Job queue for %s is above the high-water mark of %d; dropping %s job\n", connCode, broker.jobQueueHighWater, jobcodec.TypeName(jobType))
+		jobsDroppedTotal.WithLabelValues(jobcodec.TypeName(jobType)).Inc()
+		return nil
+	}
+	if broker.fallback.empty() && broker.duplicateJob(ctx, connCode, jobType, payload) {
+		log.Printf("Dropping duplicate %s job for %s\n", jobcodec.TypeName(jobType), connCode)
+		return nil
+	}
+
+	jBytes, err := broker.jobEncoder.Encode(jobcodec.NewQueuedJob(jobType, payload, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	job := pendingJob{connCode: connCode, jBytes: jBytes}
+	// don't let this job overtake the ones still waiting for Redis
+	if !broker.fallback.empty() && broker.fallback.push(job) {
+		return nil
+	}
+
+	err = broker.rpushJob(ctx, connCode, jBytes)
+	if err != nil && ctx.Err() == nil && broker.fallback.push(job) {
+		return nil
+	}
+	return err
+}
+
+func (broker *Broker) rpushJob(ctx context.Context, connCode string, jBytes []byte) error {
+	count, err := broker.client.RPush(ctx, rediskey.JobNamespace+connCode, jBytes).Result()
+	if err != nil {
+		return err
+	}
+	broker.client.Publish(ctx, rediskey.JobNamespace+connCode+":notify", true)
+	if count == broker.jobQueueHighWater {
+		log.Printf("Job queue for %s reached the high-water mark of %d; workers are falling behind\n", connCode, count)
+	}
+
+	// new list
+	if count < 2 {
+		broker.client.Expire(ctx, rediskey.JobNamespace+connCode, task.JobTTLSeconds*time.Second)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"time"
+)
+
+// these mirror the getters in utils/pkg/rediskey, which only accept a *redis.Client and so can't be used with Redis
+// Cluster
+
+func getVersionAndCommit(ctx context.Context, client redis.UniversalClient) (string, string) {
+	v, err := client.Get(ctx, rediskey.Version).Result()
+	if err != nil {
+		log.Println(err)
+	}
+	c, err := client.Get(ctx, rediskey.Commit).Result()
+	if err != nil {
+		log.Println(err)
+	}
+	return v, c
+}
+
+func getGuildCounter(ctx context.Context, client redis.UniversalClient) int64 {
+	count, err := client.SCard(ctx, rediskey.TotalGuildsSet).Result()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	return count
+}
+
+func getActiveGames(ctx context.Context, client redis.UniversalClient, secs int64) int64 {
+	now := time.Now()
+	before := now.Add(-(time.Second * time.Duration(secs)))
+	count, err := client.ZCount(ctx, rediskey.ActiveGamesZSet, fmt.Sprintf("%d", before.Unix()), fmt.Sprintf("%d", now.Unix())).Result()
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	return count
+}
+
+func getTotalGames(ctx context.Context, client redis.UniversalClient) int64 {
+	v, err := client.Get(ctx, rediskey.TotalGames).Int64()
+	if err == nil {
+		return v
+	}
+	return rediskey.NotFound
+}
+
+func getTotalUsers(ctx context.Context, client redis.UniversalClient) int64 {
+	v, err := client.Get(ctx, rediskey.TotalUsers).Int64()
+	if err == nil {
+		return v
+	}
+	return rediskey.NotFound
+}
@@ -0,0 +1,98 @@
+// Command loadtest runs galactus against a fake Discord and sends it modify requests and jobs, exiting non-zero if
+// throughput or latency miss the given thresholds. It needs a Redis it can write to, configured like galactus itself
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/automuteus/galactus/loadtest"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/galactus/pkg/redisutil"
+	"github.com/automuteus/utils/pkg/premium"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	duration := flag.Duration("duration", 30*time.Second, "how long to send load for")
+	concurrency := flag.Int("concurrency", 16, "modify requests in flight at once")
+	guilds := flag.Int("guilds", 10, "fake guilds to spread the requests over")
+	users := flag.Int("users", 10, "users per modify request")
+	premiumTier := flag.Int("premium", int(premium.GoldTier), "premium tier of the fake guilds, and of their modify requests")
+	secondaryBots := flag.Int("secondary-bots", 3, "fake secondary bots to register")
+	latency := flag.Duration("discord-latency", 20*time.Millisecond, "latency the fake Discord adds to every REST call")
+	rateLimitEvery := flag.Int64("discord-ratelimit-every", 0, "answer every nth member edit with a 429; 0 never does")
+	producers := flag.Int("job-producers", 2, "goroutines queueing jobs")
+	consumers := flag.Int("job-consumers", 4, "goroutines popping jobs through galactus; 0 skips the job queue")
+	minModify := flag.Float64("min-modify-rps", 0, "fail below this many modify requests per second")
+	maxP99 := flag.Duration("max-modify-p99", 0, "fail if the modify p99 latency is above this")
+	maxErrors := flag.Float64("max-error-rate", 0, "fail if more than this fraction of calls fail")
+	minJobs := flag.Float64("min-jobs-rps", 0, "fail below this many jobs popped per second")
+	flag.Parse()
+
+	// the fake Discord accepts any token
+	if os.Getenv("DISCORD_BOT_TOKEN") == "" {
+		os.Setenv("DISCORD_BOT_TOKEN", "fake-primary-token")
+	}
+	cfg, err := config.Load(os.Getenv("GALACTUS_CONFIG_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	guildIDs := make([]string, 0, *guilds)
+	for i := 0; i < *guilds; i++ {
+		guildIDs = append(guildIDs, strconv.Itoa(100000000000000000+i))
+	}
+	discord := loadtest.NewFakeDiscord(loadtest.FakeDiscordConfig{
+		Guilds:         guildIDs,
+		Latency:        *latency,
+		RateLimitEvery: *rateLimitEvery,
+	})
+	ctx := context.Background()
+	harness, err := loadtest.Start(ctx, cfg, discord, *secondaryBots)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer harness.Close()
+	if err := harness.SetPremium(ctx, guildIDs, premium.Tier(*premiumTier)); err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := loadtest.Run(ctx, harness.Client, redisutil.NewClient(cfg.Redis), loadtest.LoadConfig{
+		Duration:        *duration,
+		Concurrency:     *concurrency,
+		Guilds:          guildIDs,
+		ConnectCode:     "LOADTEST",
+		UsersPerRequest: *users,
+		Premium:         premium.Tier(*premiumTier),
+		JobProducers:    *producers,
+		JobConsumers:    *consumers,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := struct {
+		loadtest.Report
+		Discord loadtest.FakeDiscordStats `json:"discord"`
+	}{report, discord.Stats()}
+	jBytes, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(jBytes, '\n'))
+
+	err = report.Check(loadtest.Thresholds{
+		MinModifyPerSecond: *minModify,
+		MaxModifyP99:       *maxP99,
+		MaxErrorRate:       *maxErrors,
+		MinJobsPerSecond:   *minJobs,
+	})
+	if err != nil {
+		harness.Close()
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,370 @@
+package galactus
+
+import (
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const AdminKeyHeader = "X-Admin-Key"
+
+const ErrorCodeUnauthorized = "UNAUTHORIZED"
+
+const (
+	DefaultAdminGuildsPageSize = 100
+	MaxAdminGuildsPageSize     = 1000
+)
+
+// adminRoutes are operator endpoints, served under /admin when an admin key is configured
+func (tokenProvider *TokenProvider) adminRoutes(config ServerConfig) []route {
+	return []route{
+		{
+			Path:     "/sessions",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminSessionsHandler,
+			Summary:  "List the secondary bot sessions; pass ?guildID= to include each token's rate limit state on a guild",
+			Response: AdminSessionsResponse{},
+		},
+		{
+			Path:     "/permissions",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  etagged(tokenProvider.adminPermissionsHandler),
+			Summary:  "List the secondary tokens that are missing mute/deafen permissions, and on which guilds",
+			Response: AdminPermissionsResponse{},
+		},
+		{
+			Path:     "/guilds",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  etagged(tokenProvider.adminGuildsHandler),
+			Summary:  "List the primary bot's guilds on this shard, ordered by ID; page with ?after=<guildID>&limit=",
+			Response: AdminGuildsResponse{},
+		},
+		{
+			Path:    "/guilds/{guildID}",
+			Methods: []string{http.MethodDelete},
+			Class:   RouteClassDefault,
+			Handler: tokenProvider.adminLeaveGuildHandler,
+			Summary: "Make the primary bot leave a guild",
+		},
+		{
+			Path:     "/runtime",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminRuntimeHandler,
+			Summary:  "Goroutine count, heap and GC stats, and the sizes of galactus' in-memory maps",
+			Response: AdminRuntimeResponse{},
+		},
+		{
+			Path:     "/replay",
+			Methods:  []string{http.MethodPost},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminReplayHandler(config),
+			Summary:  "Queue archived gateway events from ?from= (to ?until=, of ?guildID=) for the workers again, from ?source=stream or kafka",
+			Response: ReplayResponse{},
+		},
+		{
+			Path:    "/reload",
+			Methods: []string{http.MethodPost},
+			Class:   RouteClassDefault,
+			Handler: tokenProvider.adminReloadHandler,
+			Summary: "Re-read the config file, applying worker counts, the ack timeout, premium limits and rate limits",
+		},
+		{
+			Path:     "/shards",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminShardsHandler,
+			Summary:  "Gateway health of each of the primary bot's shards served by this instance",
+			Response: AdminShardsResponse{},
+		},
+		{
+			Path:     "/errors",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  adminErrorsHandler,
+			Summary:  "The latest 5xx responses this instance sent, most recent first",
+			Response: AdminErrorsResponse{},
+		},
+		{
+			Path:    "/ui",
+			Methods: []string{http.MethodGet},
+			Class:   RouteClassDefault,
+			Handler: dashboardHandler,
+			Summary: "A status page built on the other admin endpoints; browsers authenticate with the admin key as the basic auth password",
+		},
+		{
+			Path:     "/presence",
+			Methods:  []string{http.MethodGet, http.MethodPost},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminPresenceHandler(config),
+			Summary:  "Get or set the primary bot's status and activity on every shard; it's kept across reconnects and restarts",
+			Request:  Presence{},
+			Response: Presence{},
+		},
+		{
+			Path:     "/keys",
+			Methods:  []string{http.MethodGet, http.MethodPost},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminAPIKeysHandler(config),
+			Summary:  "List the API keys (GET), or mint one with roles worker, bot and/or admin (POST); the key is only returned once",
+			Request:  MintAPIKeyRequest{},
+			Response: MintAPIKeyResponse{},
+		},
+		{
+			Path:     "/denylist",
+			Methods:  []string{http.MethodGet},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminDenyListHandler,
+			Summary:  "List the guilds and users on the deny lists, with why and until when",
+			Response: DenyListResponse{},
+		},
+		{
+			Path:     "/denylist/{list}",
+			Methods:  []string{http.MethodPost},
+			Class:    RouteClassDefault,
+			Handler:  tokenProvider.adminDenyHandler(config),
+			Summary:  "Add a guild (guilds) or user (users) to a deny list, permanently or for ttlSeconds",
+			Request:  DenyRequest{},
+			Response: DenyEntry{},
+		},
+		{
+			Path:    "/denylist/{list}/{id}",
+			Methods: []string{http.MethodDelete},
+			Class:   RouteClassDefault,
+			Handler: tokenProvider.adminUndenyHandler,
+			Summary: "Remove a guild or user from a deny list",
+		},
+		{
+			Path:    "/keys/{keyID}",
+			Methods: []string{http.MethodDelete},
+			Class:   RouteClassDefault,
+			Handler: tokenProvider.adminRevokeAPIKeyHandler,
+			Summary: "Revoke an API key by its ID",
+		},
+	}
+}
+
+func registerAdminRoutes(r *mux.Router, key string, auth func(http.Handler) http.Handler, limiter *APIRateLimiter, routes []route) {
+	if key == "" {
+		log.Println("No ADMIN_API_KEY specified; admin endpoints are disabled")
+		return
+	}
+	sub := r.PathPrefix("/admin").Subrouter()
+	for _, rt := range routes {
+		sub.Handle(rt.Path, auth(limiter.limit(rt.Class, rt.Handler))).Methods(rt.Methods...)
+	}
+	// profiles take their own time, so they aren't rate limited
+	sub.PathPrefix("/debug/pprof/").Handler(auth(http.StripPrefix("/admin", pprofHandler())))
+}
+
+type AdminSessionsResponse struct {
+	Sessions []AdminSession `json:"sessions"`
+	// PrimaryBreaker is the primary bot's circuit breaker
+	PrimaryBreaker BreakerInfo `json:"primaryBreaker"`
+	// Removed are the sessions the supervisor gave up restarting
+	Removed []RemovedSession `json:"removed"`
+}
+
+type AdminSession struct {
+	HashedToken string             `json:"hashedToken"`
+	Guilds      int                `json:"guilds"`
+	RateLimit   TokenRateLimitInfo `json:"rateLimit"`
+	Breaker     BreakerInfo        `json:"breaker"`
+	Health      SessionHealth      `json:"health"`
+}
+
+type TokenRateLimitInfo struct {
+	WindowMs int64 `json:"windowMs"`
+	Requests int64 `json:"requests"`
+	Burst    int64 `json:"burst"`
+
+	// only set when a guildID is requested
+	GuildID       string `json:"guildID,omitempty"`
+	Remaining     *int64 `json:"remaining,omitempty"`
+	BlacklistedMs int64  `json:"blacklistedMs,omitempty"`
+}
+
+func (tokenProvider *TokenProvider) adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	guildID := r.URL.Query().Get("guildID")
+
+	active := tokenProvider.sessions.snapshot()
+	sessions := make([]AdminSession, 0, len(active))
+	for hToken, sess := range active {
+		sessions = append(sessions, AdminSession{
+			HashedToken: hToken,
+			Guilds:      len(sess.State.Guilds),
+			Health:      tokenProvider.supervisor.health(hToken, sess),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].HashedToken < sessions[j].HashedToken
+	})
+
+	settings := tokenProvider.getSettings()
+	limit := settings.tokenRateLimit
+	now := time.Now()
+	for i := range sessions {
+		sessions[i].Breaker = tokenProvider.breakers.get(sessions[i].HashedToken).info(settings.breaker, now)
+		info := TokenRateLimitInfo{
+			WindowMs: limit.Window.Milliseconds(),
+			Requests: limit.Requests,
+			Burst:    limit.Burst,
+		}
+		if guildID != "" {
+			remaining, blacklisted, err := tokenProvider.guildTokenRateLimitState(r.Context(), guildID, sessions[i].HashedToken)
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read rate limit state")
+				return
+			}
+			info.GuildID = guildID
+			info.Remaining = &remaining
+			info.BlacklistedMs = blacklisted.Milliseconds()
+		}
+		sessions[i].RateLimit = info
+	}
+
+	writeJSON(w, http.StatusOK, AdminSessionsResponse{
+		Sessions:       sessions,
+		PrimaryBreaker: tokenProvider.breakers.get("").info(settings.breaker, now),
+		Removed:        tokenProvider.supervisor.removedSessions(),
+	})
+}
+
+type AdminGuildsResponse struct {
+	ShardID   int `json:"shardID"`
+	NumShards int `json:"numShards"`
+	// Shards are every shard this instance serves, starting with ShardID
+	Shards []int        `json:"shards"`
+	Guilds []AdminGuild `json:"guilds"`
+	// Next is the after= for the next page; empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+type AdminGuild struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	MemberCount int    `json:"memberCount"`
+	Unavailable bool   `json:"unavailable,omitempty"`
+}
+
+// snowflakeLess orders IDs numerically without parsing them; a shorter snowflake is always an older one
+func snowflakeLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func (tokenProvider *TokenProvider) adminGuildsHandler(w http.ResponseWriter, r *http.Request) {
+	after := r.URL.Query().Get("after")
+	limit := DefaultAdminGuildsPageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		num, err := strconv.Atoi(l)
+		if err != nil || num < 1 || num > MaxAdminGuildsPageSize {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxAdminGuildsPageSize))
+			return
+		}
+		limit = num
+	}
+
+	sess := tokenProvider.primarySession
+	guilds := []AdminGuild{}
+	var shards []int
+	for _, shard := range tokenProvider.gatewaySessions() {
+		shards = append(shards, shard.ShardID)
+		shard.State.RLock()
+		for _, guild := range shard.State.Guilds {
+			if after != "" && !snowflakeLess(after, guild.ID) {
+				continue
+			}
+			guilds = append(guilds, AdminGuild{
+				ID:          guild.ID,
+				Name:        guild.Name,
+				MemberCount: guild.MemberCount,
+				Unavailable: guild.Unavailable,
+			})
+		}
+		shard.State.RUnlock()
+	}
+	sort.Slice(guilds, func(i, j int) bool {
+		return snowflakeLess(guilds[i].ID, guilds[j].ID)
+	})
+
+	resp := AdminGuildsResponse{
+		ShardID:   sess.ShardID,
+		NumShards: sess.ShardCount,
+		Shards:    shards,
+		Guilds:    guilds,
+	}
+	if len(guilds) > limit {
+		resp.Guilds = guilds[:limit]
+		resp.Next = guilds[limit-1].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (tokenProvider *TokenProvider) adminLeaveGuildHandler(w http.ResponseWriter, r *http.Request) {
+	guildID := mux.Vars(r)["guildID"]
+	err := tokenProvider.primarySession.GuildLeave(guildID)
+	if err != nil {
+		log.Println(err)
+		writeDiscordError(w, r, err)
+		return
+	}
+	log.Println("Primary bot left guild " + guildID + " on admin request")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type AdminShardsResponse struct {
+	Shards []AdminShard `json:"shards"`
+	// Standbys are the standby bots, and FailedOver whether they're taking the primary's mutes
+	Standbys   []StandbyBot `json:"standbys"`
+	FailedOver bool         `json:"failedOver"`
+}
+
+type AdminShard struct {
+	ShardID   int  `json:"shardID"`
+	Connected bool `json:"connected"`
+	Guilds    int  `json:"guilds"`
+	// HeartbeatLatencyMs is the time between the last heartbeat and its ack
+	HeartbeatLatencyMs int64     `json:"heartbeatLatencyMs"`
+	LastHeartbeatAck   time.Time `json:"lastHeartbeatAck"`
+}
+
+func (tokenProvider *TokenProvider) adminShardsHandler(w http.ResponseWriter, r *http.Request) {
+	shards := []AdminShard{}
+	for _, sess := range tokenProvider.gatewaySessions() {
+		sess.RLock()
+		shard := AdminShard{
+			ShardID:            sess.ShardID,
+			Connected:          sess.DataReady,
+			HeartbeatLatencyMs: sess.LastHeartbeatAck.Sub(sess.LastHeartbeatSent).Milliseconds(),
+			LastHeartbeatAck:   sess.LastHeartbeatAck,
+		}
+		sess.RUnlock()
+		sess.State.RLock()
+		shard.Guilds = len(sess.State.Guilds)
+		sess.State.RUnlock()
+		shards = append(shards, shard)
+	}
+	writeJSON(w, http.StatusOK, AdminShardsResponse{
+		Shards:     shards,
+		Standbys:   tokenProvider.standbyInfo(),
+		FailedOver: tokenProvider.failover.active(),
+	})
+}
+
+type AdminErrorsResponse struct {
+	Errors []RecentError `json:"errors"`
+}
+
+func adminErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, AdminErrorsResponse{Errors: latestErrors()})
+}
@@ -0,0 +1,273 @@
+package galactus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Role is what an API key is allowed to do
+type Role string
+
+const (
+	// RoleWorker pulls jobs and reports on its load
+	RoleWorker Role = "worker"
+	// RoleBot acts on Discord: modifying users, registering games, and sending messages
+	RoleBot Role = "bot"
+	// RoleAdmin can call every route, including adding tokens and the /admin endpoints
+	RoleAdmin Role = "admin"
+)
+
+var (
+	workerRoles = []Role{RoleWorker}
+	botRoles    = []Role{RoleBot}
+	adminRoles  = []Role{RoleAdmin}
+)
+
+const (
+	ErrorCodeForbidden     = "FORBIDDEN"
+	ErrorCodeInvalidAPIKey = "INVALID_API_KEY"
+)
+
+// apiKeysKey maps API key IDs to their APIKey, with the hash of the key itself
+const apiKeysKey = "galactus:apikeys"
+
+// APIKey is a minted key, without the key itself; only its hash is kept. Times are unix ms
+type APIKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Roles     []Role `json:"roles"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+type apiKeyRecord struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+type MintAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Roles []Role `json:"roles"`
+}
+
+type MintAPIKeyResponse struct {
+	// Key is only ever returned here; send it in the X-API-Key header
+	Key    string `json:"key"`
+	APIKey APIKey `json:"apiKey"`
+}
+
+type APIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+func validRole(role Role) bool {
+	return role == RoleWorker || role == RoleBot || role == RoleAdmin
+}
+
+// apiKeyID is also how clientKey tells API keys apart for rate limiting
+func apiKeyID(key string) string {
+	return hashToken(key)[0:16]
+}
+
+func (key APIKey) hasRole(roles []Role) bool {
+	for _, have := range key.Roles {
+		if have == RoleAdmin {
+			return true
+		}
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return len(roles) == 0
+}
+
+// APIKeyFromContext returns the API key the request was authenticated with, if any
+func APIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(APIKey)
+	return key, ok
+}
+
+// lookupAPIKey returns the minted key, or nil if it was never minted or has been revoked
+func (tokenProvider *TokenProvider) lookupAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	v, err := tokenProvider.client.HGet(ctx, apiKeysKey, apiKeyID(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var record apiKeyRecord
+	if err := json.Unmarshal(v, &record); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(record.Hash), []byte(hashToken(key))) != 1 {
+		return nil, nil
+	}
+	return &record.APIKey, nil
+}
+
+// requireRoles only lets through requests with an API key holding one of the roles, or any key if roles is empty.
+// Unless API keys are required, requests without one are let through too
+func (tokenProvider *TokenProvider) requireRoles(config ServerConfig, roles []Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get(api.APIKeyHeader)
+		if provided == "" {
+			if config.RequireAPIKeys {
+				writeError(w, r, http.StatusUnauthorized, ErrorCodeUnauthorized, "missing "+api.APIKeyHeader)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := tokenProvider.lookupAPIKey(r.Context(), provided)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusServiceUnavailable, ErrorCodeInternal, "failed to check the API key")
+			return
+		}
+		if key == nil {
+			writeError(w, r, http.StatusUnauthorized, ErrorCodeInvalidAPIKey, "unknown or revoked "+api.APIKeyHeader)
+			return
+		}
+		if !key.hasRole(roles) {
+			writeError(w, r, http.StatusForbidden, ErrorCodeForbidden, "this API key's roles can't call this route")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, *key)))
+	})
+}
+
+// adminAuth only lets through requests that carry the admin key, in the header or as the password of HTTP basic auth,
+// or an API key with the admin role. Browsers can't set the headers, so the dashboard relies on basic auth, which they
+// prompt for and resend on its fetches
+func (tokenProvider *TokenProvider) adminAuth(adminKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get(AdminKeyHeader)
+		if _, password, ok := r.BasicAuth(); provided == "" && ok {
+			provided = password
+		}
+		if provided != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(adminKey)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if provided == "" {
+			provided = r.Header.Get(api.APIKeyHeader)
+		}
+		if provided != "" {
+			key, err := tokenProvider.lookupAPIKey(r.Context(), provided)
+			if err != nil {
+				log.Println(err)
+			} else if key != nil && key.hasRole(adminRoles) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, *key)))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="galactus admin"`)
+		writeError(w, r, http.StatusUnauthorized, ErrorCodeUnauthorized, "missing or invalid "+AdminKeyHeader)
+	})
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// adminAPIKeysHandler lists the API keys (GET), or mints one (POST), returning the key itself only this once
+func (tokenProvider *TokenProvider) adminAPIKeysHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			values, err := tokenProvider.client.HGetAll(r.Context(), apiKeysKey).Result()
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the API keys")
+				return
+			}
+			keys := make([]APIKey, 0, len(values))
+			for _, v := range values {
+				var record apiKeyRecord
+				if err := json.Unmarshal([]byte(v), &record); err != nil {
+					log.Println(err)
+					continue
+				}
+				keys = append(keys, record.APIKey)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i].CreatedAt < keys[j].CreatedAt
+			})
+			writeJSON(w, http.StatusOK, APIKeysResponse{Keys: keys})
+			return
+		}
+
+		var request MintAPIKeyRequest
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		if request.Name == "" || len(request.Roles) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "name and roles are required")
+			return
+		}
+		for _, role := range request.Roles {
+			if !validRole(role) {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "unknown role \""+string(role)+"\"")
+				return
+			}
+		}
+		key, err := newAPIKey()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to mint the API key")
+			return
+		}
+		record := apiKeyRecord{
+			APIKey: APIKey{
+				ID:        apiKeyID(key),
+				Name:      request.Name,
+				Roles:     request.Roles,
+				CreatedAt: nowMs(),
+			},
+			Hash: hashToken(key),
+		}
+		jBytes, err := json.Marshal(record)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to mint the API key")
+			return
+		}
+		if err := tokenProvider.client.HSet(r.Context(), apiKeysKey, record.ID, jBytes).Err(); err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to mint the API key")
+			return
+		}
+		log.Printf("Minted API key %s (%s) with roles %v\n", record.ID, record.Name, record.Roles)
+		writeJSON(w, http.StatusCreated, MintAPIKeyResponse{Key: key, APIKey: record.APIKey})
+	}
+}
+
+// adminRevokeAPIKeyHandler revokes an API key by its ID; requests with it fail from then on, on every instance
+func (tokenProvider *TokenProvider) adminRevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID := mux.Vars(r)["keyID"]
+	removed, err := tokenProvider.client.HDel(r.Context(), apiKeysKey, keyID).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to revoke the API key")
+		return
+	}
+	if removed == 0 {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no API key has the ID "+keyID)
+		return
+	}
+	log.Printf("Revoked API key %s\n", keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
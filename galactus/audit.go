@@ -0,0 +1,209 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultAuditLogMaxLen is roughly how many modifications are kept per guild; the oldest are trimmed first
+	DefaultAuditLogMaxLen = 1000
+	// DefaultAuditLogRetention is how long a guild's audit log is kept after its latest modification
+	DefaultAuditLogRetention = 7 * 24 * time.Hour
+)
+
+const (
+	DefaultAuditPageSize = 100
+	MaxAuditPageSize     = 1000
+)
+
+// how a modification was applied
+const (
+	AuditMethodWorker   = "worker"
+	AuditMethodCapture  = "capture"
+	AuditMethodOfficial = "official"
+)
+
+const (
+	AuditOutcomeApplied = "applied"
+	AuditOutcomeFailed  = "failed"
+	// the capture client reported a failure no other method could fix, like the user not being in voice
+	AuditOutcomeRejected   = "rejected"
+	AuditOutcomeSuperseded = "superseded"
+	AuditOutcomeCancelled  = "cancelled"
+	// the request's deadline passed before the user was modified
+	AuditOutcomeTimedOut = "timed_out"
+	// the user is on the deny list
+	AuditOutcomeDenied = "denied"
+)
+
+// AuditEntry records what happened to one user of a modify request
+type AuditEntry struct {
+	// ID identifies the entry in the store it was read back from: a Redis stream ID, or a Postgres row ID
+	ID          string    `json:"id,omitempty"`
+	Time        time.Time `json:"time"`
+	GuildID     string    `json:"guildID"`
+	UserID      uint64    `json:"userID"`
+	ConnectCode string    `json:"connectCode,omitempty"`
+	Mute        bool      `json:"mute"`
+	Deaf        bool      `json:"deaf"`
+	// Method is empty if no method was attempted
+	Method    string   `json:"method,omitempty"`
+	Outcome   string   `json:"outcome"`
+	LatencyMs int64    `json:"latencyMs"`
+	Code      ack.Code `json:"code,omitempty"`
+	Message   string   `json:"message,omitempty"`
+}
+
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// auditLogKey holds a guild's audit log, as a Redis stream so entries are ordered by time and cheaply capped
+func auditLogKey(guildID string) string {
+	return "galactus:audit:{" + guildID + "}"
+}
+
+// recordAudit appends the entries to the guild's audit log, trimming it to about maxLen entries, and saves them to
+// storage if it's configured
+func (tokenProvider *TokenProvider) recordAudit(guildID string, entries []AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	tokenProvider.storeInBackground(func(ctx context.Context, storage Storage) error {
+		return storage.RecordAudit(ctx, entries)
+	})
+	settings := tokenProvider.getSettings()
+	if settings.auditLogMaxLen == 0 {
+		return
+	}
+	ctx := context.Background()
+	key := auditLogKey(guildID)
+	pipe := tokenProvider.client.Pipeline()
+	for _, entry := range entries {
+		jBytes, err := json.Marshal(entry)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream:       key,
+			MaxLenApprox: settings.auditLogMaxLen,
+			Values:       map[string]interface{}{"entry": jBytes},
+		})
+	}
+	pipe.PExpire(ctx, key, settings.auditLogRetention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+// parseAuditTime accepts unix milliseconds or RFC 3339
+func parseAuditTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// streamID is the stream ID bound for a time, or def if it's zero
+func streamID(t time.Time, def string) string {
+	if t.IsZero() {
+		return def
+	}
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// redisAuditEntries reads a query from the guild's audit log in Redis
+func (tokenProvider *TokenProvider) redisAuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	key := auditLogKey(query.GuildID)
+	start, end := streamID(query.Until, "+"), streamID(query.Since, "-")
+	// the log is capped, so reading the whole range is bounded; filtering by user has to happen here
+	var msgs []redis.XMessage
+	var err error
+	if query.UserID == 0 {
+		msgs, err = tokenProvider.client.XRevRangeN(ctx, key, start, end, int64(query.Limit)).Result()
+	} else {
+		msgs, err = tokenProvider.client.XRevRange(ctx, key, start, end).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	for _, msg := range msgs {
+		v, _ := msg.Values["entry"].(string)
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(v), &entry); err != nil {
+			log.Println(err)
+			continue
+		}
+		if query.UserID != 0 && entry.UserID != query.UserID {
+			continue
+		}
+		entry.ID = msg.ID
+		entries = append(entries, entry)
+		if len(entries) == query.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// auditHandler lists a guild's modifications, most recent first. ?since= and ?until= bound the time range, in unix ms
+// or RFC 3339, ?userID= only lists one user's, and ?limit= caps the number of entries. With storage configured, the
+// entries come from there, so they go back further than Redis keeps them
+func (tokenProvider *TokenProvider) auditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	auditQuery := AuditQuery{
+		GuildID: mux.Vars(r)["guildID"],
+		Limit:   DefaultAuditPageSize,
+	}
+	var err error
+	if until := query.Get("until"); until != "" {
+		if auditQuery.Until, err = parseAuditTime(until); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "until must be unix milliseconds or RFC 3339")
+			return
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		if auditQuery.Since, err = parseAuditTime(since); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "since must be unix milliseconds or RFC 3339")
+			return
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		num, err := strconv.Atoi(l)
+		if err != nil || num < 1 || num > MaxAuditPageSize {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxAuditPageSize))
+			return
+		}
+		auditQuery.Limit = num
+	}
+	if u := query.Get("userID"); u != "" {
+		if auditQuery.UserID, err = strconv.ParseUint(u, 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "userID must be a snowflake")
+			return
+		}
+	}
+
+	var entries []AuditEntry
+	if tokenProvider.storage != nil {
+		entries, err = tokenProvider.storage.AuditEntries(r.Context(), auditQuery)
+	} else {
+		entries, err = tokenProvider.redisAuditEntries(r.Context(), auditQuery)
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the audit log")
+		return
+	}
+	writeJSON(w, http.StatusOK, AuditResponse{Entries: entries})
+}
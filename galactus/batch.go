@@ -0,0 +1,110 @@
+package galactus
+
+import (
+	"context"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// modifyBatch applies each guild's modifications concurrently, at most maxWorkers guilds at a time. A guild's
+// requests are applied one after another, in the order given, so they only take one of its concurrency quota at a time
+func (tokenProvider *TokenProvider) modifyBatch(ctx context.Context, batch api.BatchModifyRequest, deadline time.Time) api.BatchModifyResponse {
+	results := make([]api.GuildModifyResult, len(batch.Requests))
+	sem := make(chan struct{}, tokenProvider.getSettings().maxWorkers)
+	wg := sync.WaitGroup{}
+
+	// guild ID -> the indexes of its requests, in order
+	guildRequests := make(map[string][]int)
+	guildIDs := make([]string, 0, len(batch.Requests))
+	for i, request := range batch.Requests {
+		results[i] = api.GuildModifyResult{
+			GuildID:     request.GuildID,
+			ConnectCode: request.ConnectCode,
+		}
+		if _, ok := guildRequests[request.GuildID]; !ok {
+			guildIDs = append(guildIDs, request.GuildID)
+		}
+		guildRequests[request.GuildID] = append(guildRequests[request.GuildID], i)
+	}
+
+	for _, guildID := range guildIDs {
+		indexes := guildRequests[guildID]
+		gid, err := strconv.ParseUint(guildID, 10, 64)
+		if err != nil {
+			for _, i := range indexes {
+				results[i].Error = "invalid guildID"
+			}
+			continue
+		}
+		if tokenProvider.guildDenied(ctx, guildID) {
+			for _, i := range indexes {
+				results[i].Error = "guild is on the deny list"
+			}
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(guildID string, gid uint64, indexes []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			tier := tokenProvider.guildTier(ctx, guildID)
+			for _, i := range indexes {
+				release, quotaErr := tokenProvider.acquireGuildQuota(ctx, guildID, tier)
+				if quotaErr != nil {
+					results[i].Error = quotaErr.Error()
+					continue
+				}
+				request := batch.Requests[i]
+				results[i].ModifyResponse = tokenProvider.modifyUsers(ctx, guildID, gid, request.ConnectCode, request.UserModifyRequest, deadline)
+				release()
+			}
+		}(guildID, gid, indexes)
+	}
+	wg.Wait()
+
+	return api.BatchModifyResponse{Results: results}
+}
+
+func (tokenProvider *TokenProvider) modifyBatchHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tokenProvider.outage.isActive() {
+			writeOutageError(w, r)
+			return
+		}
+		start := time.Now()
+		batch := api.BatchModifyRequest{}
+		if !readJSONBody(w, r, config, &batch) {
+			return
+		}
+		// one invalid request fails the whole batch, before any guild is modified
+		var errs []api.FieldError
+		for i, request := range batch.Requests {
+			errs = append(errs, validateUserModifyRequest(request.UserModifyRequest, fmt.Sprintf("requests[%d].", i))...)
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, errs)
+			return
+		}
+		deadline, err := modifyDeadline(r, start, batch.MaxDurationMs)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		resp := tokenProvider.modifyBatch(ctx, batch, deadline)
+		for _, result := range resp.Results {
+			localizeModifyErrors(r, result.GuildID, result.Errors)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
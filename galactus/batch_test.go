@@ -0,0 +1,82 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/bwmarrin/discordgo"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a batch with two requests for the same guild applies them in order, one at a time, so a guild allowed only one
+// request in flight gets both
+func TestModifyBatchAppliesAGuildsRequestsInOrder(t *testing.T) {
+	cfg := config.Config{}
+	cfg.MuteRouting.Order = []string{AuditMethodWorker}
+	concurrent := int64(1)
+	cfg.GuildQuota.Concurrent = &concurrent
+	tokenProvider, _ := newTestTokenProvider(t, cfg)
+	tokenProvider.warmup.status.Ready = true
+
+	var mutes []bool
+	var mutesLock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var edit struct {
+			Mute bool `json:"mute"`
+		}
+		json.NewDecoder(r.Body).Decode(&edit)
+		mutesLock.Lock()
+		mutes = append(mutes, edit.Mute)
+		mutesLock.Unlock()
+		// slow enough that requests run side by side would overlap
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	guilds := discordgo.EndpointGuilds
+	discordgo.EndpointGuilds = server.URL + "/guilds/"
+	t.Cleanup(func() {
+		discordgo.EndpointGuilds = guilds
+		server.Close()
+	})
+
+	ctx := context.Background()
+	sess, err := discordgo.New("Bot fake-secondary-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hToken := hashToken("fake-secondary-token")
+	tokenProvider.sessions.add(hToken, sess)
+	if err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey("100"), hToken).Err(); err != nil {
+		t.Fatal(err)
+	}
+	err = tokenProvider.storeGuildSettings(ctx, api.GuildSettings{GuildID: "100", Settings: []byte(`{"premium": 3}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := api.BatchModifyRequest{}
+	for _, mute := range []bool{true, false} {
+		batch.Requests = append(batch.Requests, api.GuildModifyRequest{
+			GuildID:           "100",
+			ConnectCode:       "CODE",
+			UserModifyRequest: task.UserModifyRequest{Premium: premium.GoldTier, Users: []task.UserModify{{UserID: 1, Mute: mute}}},
+		})
+	}
+	resp := tokenProvider.modifyBatch(ctx, batch, time.Time{})
+	for i, result := range resp.Results {
+		if result.Error != "" || result.Worker != 1 {
+			t.Fatalf("request %d got error %q and %d users modified, want it applied", i, result.Error, result.Worker)
+		}
+	}
+	if len(mutes) != 2 || !mutes[0] || mutes[1] {
+		t.Fatalf("Discord got mutes %v, want the mute and then the unmute", mutes)
+	}
+}
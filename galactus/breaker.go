@@ -0,0 +1,261 @@
+package galactus
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerFailureThreshold is how many Discord failures in a row open a token's breaker
+	DefaultBreakerFailureThreshold = 5
+	// DefaultBreakerOpenDuration is how long an open breaker fails calls before letting probes through
+	DefaultBreakerOpenDuration = 30 * time.Second
+	// DefaultBreakerHalfOpenProbes is how many probes have to succeed to close the breaker again
+	DefaultBreakerHalfOpenProbes = 1
+)
+
+const ErrorCodeCircuitOpen = "CIRCUIT_OPEN"
+
+// ErrCircuitOpen is returned instead of calling Discord with a token whose breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open for this bot token")
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+var (
+	breakerTripsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_circuit_breaker_trips_total",
+		Help: "Times a bot token's circuit breaker opened",
+	}, []string{"session"})
+	breakerRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_circuit_breaker_rejections_total",
+		Help: "Discord REST calls failed fast because the token's circuit breaker was open",
+	}, []string{"session"})
+)
+
+type breakerSettings struct {
+	// 0 disables the breakers
+	failureThreshold int64
+	openDuration     time.Duration
+	halfOpenProbes   int64
+}
+
+// BreakerInfo is a circuit breaker's state, as reported by /admin/sessions
+type BreakerInfo struct {
+	State string `json:"state"`
+	// ConsecutiveFailures counts the failures since the last success while closed
+	ConsecutiveFailures int64 `json:"consecutiveFailures"`
+	// RetryInMs is how long until an open breaker lets probes through
+	RetryInMs int64 `json:"retryInMs,omitempty"`
+}
+
+// circuitBreaker stops calls to Discord with a token after it fails repeatedly. Once open for long enough, it lets a
+// few probe calls through (half-open), closing if they all succeed and opening again if any fails
+type circuitBreaker struct {
+	lock     sync.Mutex
+	state    string
+	failures int64
+	openedAt time.Time
+	// probes let through while half-open that haven't finished, and those that succeeded
+	probes    int64
+	successes int64
+	// numbers the half-open periods, so a probe's result only counts toward the period it was let through in
+	halfOpens uint64
+}
+
+// transition moves an open breaker to half-open once it's been open long enough
+func (breaker *circuitBreaker) transition(s breakerSettings, now time.Time) {
+	if breaker.state == BreakerOpen && now.Sub(breaker.openedAt) >= s.openDuration {
+		breaker.state = BreakerHalfOpen
+		breaker.probes = 0
+		breaker.successes = 0
+		breaker.halfOpens++
+	}
+}
+
+// available reports whether a call would be let through, without taking a probe
+func (breaker *circuitBreaker) available(s breakerSettings, now time.Time) bool {
+	if s.failureThreshold == 0 {
+		return true
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.transition(s, now)
+	switch breaker.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return breaker.probes+breaker.successes < s.halfOpenProbes
+	}
+	return true
+}
+
+// allow reports whether a call can go ahead, and if it's a probe, the half-open period it's one for; 0 otherwise.
+// Every allowed call has to be followed by record, with that period
+func (breaker *circuitBreaker) allow(s breakerSettings, now time.Time) (bool, uint64) {
+	if s.failureThreshold == 0 {
+		return true, 0
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.transition(s, now)
+	switch breaker.state {
+	case BreakerOpen:
+		return false, 0
+	case BreakerHalfOpen:
+		if breaker.probes+breaker.successes >= s.halfOpenProbes {
+			return false, 0
+		}
+		breaker.probes++
+		return true, breaker.halfOpens
+	}
+	return true, 0
+}
+
+// record counts the outcome of an allowed call, and returns whether it opened the breaker
+func (breaker *circuitBreaker) record(s breakerSettings, probe uint64, failed bool, now time.Time) bool {
+	if s.failureThreshold == 0 {
+		return false
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	switch breaker.state {
+	case BreakerHalfOpen:
+		if probe != breaker.halfOpens {
+			// let through while closed, or as a probe before the breaker last opened; only this period's probes count
+			return false
+		}
+		breaker.probes--
+		if failed {
+			breaker.open(now)
+			return true
+		}
+		breaker.successes++
+		if breaker.successes >= s.halfOpenProbes {
+			breaker.state = BreakerClosed
+			breaker.failures = 0
+		}
+	case BreakerOpen:
+		// a call that started before the breaker opened; it can't change anything now
+	default:
+		if !failed {
+			breaker.failures = 0
+			return false
+		}
+		breaker.failures++
+		if breaker.failures >= s.failureThreshold {
+			breaker.open(now)
+			return true
+		}
+	}
+	return false
+}
+
+func (breaker *circuitBreaker) open(now time.Time) {
+	breaker.state = BreakerOpen
+	breaker.openedAt = now
+	breaker.failures = 0
+}
+
+func (breaker *circuitBreaker) info(s breakerSettings, now time.Time) BreakerInfo {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.transition(s, now)
+	info := BreakerInfo{
+		State:               breaker.state,
+		ConsecutiveFailures: breaker.failures,
+	}
+	if breaker.state == BreakerOpen {
+		info.RetryInMs = (s.openDuration - now.Sub(breaker.openedAt)).Milliseconds()
+	}
+	return info
+}
+
+// circuitBreakers holds a breaker per hashed token; the primary bot's is under ""
+type circuitBreakers struct {
+	lock     sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{breakers: make(map[string]*circuitBreaker)}
+}
+
+func (breakers *circuitBreakers) get(hashedToken string) *circuitBreaker {
+	breakers.lock.Lock()
+	defer breakers.lock.Unlock()
+	breaker, ok := breakers.breakers[hashedToken]
+	if !ok {
+		breaker = &circuitBreaker{state: BreakerClosed}
+		breakers.breakers[hashedToken] = breaker
+	}
+	return breaker
+}
+
+// isDiscordFailure is whether a response means Discord itself is struggling, rather than rejecting the request: a 5xx,
+// a 429 that isn't for a single route (global, or from Cloudflare without rate limit headers), or no response at all
+func isDiscordFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return resp.Header.Get("X-RateLimit-Global") == "true" || resp.Header.Get("X-RateLimit-Bucket") == ""
+	}
+	return false
+}
+
+// breakerTransport puts a token's breaker in front of every REST call its sessions make, including discordgo's own
+// retries, and feeds their outcomes to the outage detector
+type breakerTransport struct {
+	tokenProvider *TokenProvider
+	hashedToken   string
+	next          http.RoundTripper
+}
+
+// newBreakerTransport wraps the session's HTTP transport; hashedToken is empty for the primary bot
+func (tokenProvider *TokenProvider) newBreakerTransport(hashedToken string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if tokenProvider.faults != nil {
+		next = faultTransport{faults: tokenProvider.faults, next: next}
+	}
+	return breakerTransport{tokenProvider: tokenProvider, hashedToken: hashedToken, next: next}
+}
+
+func (transport breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := transport.tokenProvider.getSettings().breaker
+	breaker := transport.tokenProvider.breakers.get(transport.hashedToken)
+	session := "secondary"
+	if transport.hashedToken == "" {
+		session = "primary"
+	}
+	allowed, probe := breaker.allow(s, time.Now())
+	if !allowed {
+		breakerRejectionsTotal.WithLabelValues(session).Inc()
+		return nil, ErrCircuitOpen
+	}
+	resp, err := transport.next.RoundTrip(req)
+	failed := isDiscordFailure(resp, err)
+	transport.tokenProvider.recordDiscordCall(failed)
+	if breaker.record(s, probe, failed, time.Now()) {
+		breakerTripsTotal.WithLabelValues(session).Inc()
+		name := transport.hashedToken
+		if name == "" {
+			name = "the primary bot"
+		}
+		log.Printf("Discord keeps failing; opening the circuit breaker for %s for %s\n", name, s.openDuration)
+	}
+	return resp, err
+}
@@ -0,0 +1,154 @@
+package galactus
+
+import (
+	"errors"
+	"github.com/automuteus/galactus/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// okTransport stands in for Discord, answering every call that gets through with a 204
+type okTransport struct {
+	calls *int
+}
+
+func (transport okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	*transport.calls++
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+}
+
+// newFaultyBreakerTransport is a secondary token's breaker in front of seeded faults in front of Discord, with outage
+// detection off so only the breaker reacts
+func newFaultyBreakerTransport(t *testing.T, faults config.FaultConfig, breaker config.CircuitBreakerConfig) (*TokenProvider, http.RoundTripper, *int) {
+	t.Helper()
+	noOutages := int64(0)
+	cfg := config.Config{Faults: faults, CircuitBreaker: breaker}
+	cfg.Outage.ErrorPercent = &noOutages
+	tokenProvider, _ := newTestTokenProvider(t, cfg)
+	calls := 0
+	return tokenProvider, tokenProvider.newBreakerTransport("token", okTransport{calls: &calls}), &calls
+}
+
+// breakerOutcome runs one call through the transport, naming how it went
+func breakerOutcome(t *testing.T, transport http.RoundTripper) string {
+	t.Helper()
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodPatch, "http://discord.test/api/v8/guilds/1/members/2", nil))
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return BreakerOpen
+	case errors.Is(err, ErrInjectedDisconnect):
+		return faultDisconnect
+	case err != nil:
+		t.Fatal(err)
+	case resp.StatusCode == http.StatusInternalServerError:
+		return faultError
+	}
+	return "ok"
+}
+
+func TestBreakerOpensOnInjectedFaults(t *testing.T) {
+	threshold := int64(3)
+	tokenProvider, transport, calls := newFaultyBreakerTransport(t,
+		config.FaultConfig{Enabled: true, Seed: 1, Discord: config.FaultRule{ErrorPercent: 100}},
+		config.CircuitBreakerConfig{FailureThreshold: &threshold, OpenDuration: config.Duration(50 * time.Millisecond)})
+	breaker := tokenProvider.breakers.get("token")
+	s := tokenProvider.getSettings().breaker
+
+	for i := int64(0); i < threshold; i++ {
+		if got := breakerOutcome(t, transport); got != faultError {
+			t.Fatalf("call %d: got %s, want an injected error", i, got)
+		}
+	}
+	if state := breaker.info(s, time.Now()).State; state != BreakerOpen {
+		t.Fatalf("got a %s breaker after %d failures, want it open", state, threshold)
+	}
+	if got := breakerOutcome(t, transport); got != BreakerOpen {
+		t.Fatalf("got %s from an open breaker, want the call failed fast", got)
+	}
+
+	// Discord recovers; once the breaker has been open long enough, a probe closes it
+	tokenProvider.faults.config.Discord.ErrorPercent = 0
+	time.Sleep(60 * time.Millisecond)
+	if got := breakerOutcome(t, transport); got != "ok" {
+		t.Fatalf("got %s from the probe, want it let through", got)
+	}
+	if state := breaker.info(s, time.Now()).State; state != BreakerClosed {
+		t.Fatalf("got a %s breaker after a successful probe, want it closed", state)
+	}
+	if *calls != 1 {
+		t.Fatalf("Discord got %d calls, want only the probe", *calls)
+	}
+}
+
+// the same seed fails the same calls, so the breaker trips and recovers at the same points every run
+func TestBreakerFaultsAreRepeatable(t *testing.T) {
+	run := func(seed int64) []string {
+		threshold := int64(2)
+		_, transport, calls := newFaultyBreakerTransport(t,
+			config.FaultConfig{Enabled: true, Seed: seed, Discord: config.FaultRule{ErrorPercent: 40, DisconnectPercent: 10}},
+			// open for as little as possible, so the breaker goes half-open on the next call
+			config.CircuitBreakerConfig{FailureThreshold: &threshold, OpenDuration: config.Duration(time.Nanosecond)})
+		outcomes := make([]string, 0, 200)
+		counts := map[string]int{}
+		for i := 0; i < 200; i++ {
+			outcome := breakerOutcome(t, transport)
+			outcomes = append(outcomes, outcome)
+			counts[outcome]++
+		}
+		if counts["ok"] != *calls {
+			t.Fatalf("seed %d: %d calls succeeded, but Discord got %d", seed, counts["ok"], *calls)
+		}
+		if counts[faultError] == 0 || counts[faultDisconnect] == 0 || counts["ok"] == 0 {
+			t.Fatalf("seed %d: got %v, want errors, disconnects and successes", seed, counts)
+		}
+		return outcomes
+	}
+
+	first, second := run(42), run(42)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("the same seed injected different faults")
+	}
+	if reflect.DeepEqual(first, run(43)) {
+		t.Fatal("different seeds injected the same faults")
+	}
+}
+
+// calls let through before the breaker opened finish while it's half-open; they mustn't count as probes
+func TestBreakerOnlyCountsProbes(t *testing.T) {
+	s := breakerSettings{failureThreshold: 2, openDuration: time.Second, halfOpenProbes: 1}
+	breaker := &circuitBreaker{state: BreakerClosed}
+	start := time.Now()
+
+	inFlight := make([]uint64, 0, 3)
+	for i := 0; i < 3; i++ {
+		_, probe := breaker.allow(s, start)
+		inFlight = append(inFlight, probe)
+	}
+	breaker.record(s, inFlight[0], true, start)
+	if !breaker.record(s, inFlight[1], true, start) {
+		t.Fatal("the breaker didn't open after 2 failures")
+	}
+
+	halfOpen := start.Add(s.openDuration)
+	allowed, probe := breaker.allow(s, halfOpen)
+	if !allowed || probe == 0 {
+		t.Fatal("the half-open breaker didn't let a probe through")
+	}
+	// the last call from before the breaker opened succeeds, and then fails; neither decides anything
+	breaker.record(s, inFlight[2], false, halfOpen)
+	breaker.record(s, inFlight[2], true, halfOpen)
+	if state := breaker.info(s, halfOpen).State; state != BreakerHalfOpen {
+		t.Fatalf("got a %s breaker from a call that wasn't a probe, want it still half-open", state)
+	}
+	if allowed, _ := breaker.allow(s, halfOpen); allowed {
+		t.Fatalf("let a second probe through with halfOpenProbes %d", s.halfOpenProbes)
+	}
+
+	breaker.record(s, probe, false, halfOpen)
+	if breaker.info(s, halfOpen).State != BreakerClosed {
+		t.Fatal("the probe succeeded, but the breaker didn't close")
+	}
+}
@@ -0,0 +1,98 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/broker"
+	"github.com/gorilla/mux"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// CaptureEventRateLimit is per connect code. The burst covers a lobby filling up, when every player is sent at once
+var CaptureEventRateLimit = RateLimit{PerSecond: 10, Burst: 30}
+
+func captureEventRateLimitKey(connectCode string) string {
+	return "galactus:ratelimit:capture:" + connectCode
+}
+
+// CaptureEventRequest is an event from a capture client, with the same name and payload it would send over socket.io
+type CaptureEventRequest struct {
+	// Event is connection, lobby, state, player or gameover
+	Event   string `json:"event"`
+	Payload string `json:"payload"`
+}
+
+// SetBroker gives galactus the broker to queue capture events from /capture with, and has the broker drop the events
+// of denied guilds. Must be called before Run and the broker's Start
+func (tokenProvider *TokenProvider) SetBroker(b *broker.Broker) {
+	tokenProvider.broker = b
+	b.SetDenyFilter(tokenProvider.connectCodeDenied)
+}
+
+// captureEventHandler queues an event a capture client sent over HTTP, for clients that can't hold a socket.io
+// connection to the broker. The connect code has to belong to a registered game, and the client has to present its
+// capture token
+func (tokenProvider *TokenProvider) captureEventHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		connectCode := mux.Vars(r)["connectCode"]
+		if !connectCodePattern.MatchString(connectCode) {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "invalid connect code")
+			return
+		}
+		if tokenProvider.broker == nil {
+			writeError(w, r, http.StatusServiceUnavailable, ErrorCodeInternal, "capture events aren't being accepted")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		game, err := tokenProvider.getGame(ctx, connectCode)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the game")
+			return
+		}
+		if game == nil {
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no game is registered for "+connectCode)
+			return
+		}
+		if !validCaptureToken(r, game) {
+			writeError(w, r, http.StatusUnauthorized, ErrorCodeUnauthorized, "missing or invalid capture token")
+			return
+		}
+		if tokenProvider.guildDenied(ctx, game.GuildID) {
+			writeError(w, r, http.StatusForbidden, ErrorCodeGuildDenied, "guild "+game.GuildID+" is on the deny list")
+			return
+		}
+
+		allowed, _, wait, err := takeToken(ctx, tokenProvider.client, captureEventRateLimitKey(connectCode), CaptureEventRateLimit)
+		if err != nil {
+			log.Println(err)
+		} else if !allowed {
+			retryAfter := int64(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			writeError(w, r, http.StatusTooManyRequests, ErrorCodeRateLimited,
+				fmt.Sprintf("too many events for %s; retry in %ds", connectCode, retryAfter))
+			return
+		}
+
+		var request CaptureEventRequest
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		err = tokenProvider.broker.CaptureEvent(ctx, connectCode, request.Event, request.Payload)
+		if errors.Is(err, broker.ErrInvalidEvent) {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		} else if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to queue the event")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,42 @@
+package galactus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// outcomes of a mute/deafen task sent to capture clients
+const (
+	captureResultSuccess   = "success"
+	captureResultFailed    = "failed"
+	captureResultTimeout   = "timeout"
+	captureResultCancelled = "cancelled"
+	// the capture client was blacklisted or out of tokens, so no task was sent
+	captureResultSkipped = "skipped"
+)
+
+// why a capture client was blacklisted
+const (
+	captureBlacklistUnresponsive       = "unresponsive"
+	captureBlacklistRateLimited        = "rate_limited"
+	captureBlacklistMissingPermissions = "missing_permissions"
+	captureBlacklistFailed             = "failed"
+)
+
+var (
+	captureAckLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "galactus_capture_ack_latency_seconds",
+		Help: "Time from publishing a task to capture clients until they ack it, successfully or not",
+		// ACK_TIMEOUT_MS defaults to 1s, so most of the resolution is below that
+		Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 1.5, 2, 3, 5},
+	})
+	captureTasksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_capture_tasks_total",
+		Help: "Mute/deafen tasks attempted through capture clients, by result",
+	}, []string{"result"})
+	// connect codes are unbounded, so they're logged rather than used as a label
+	captureBlacklistsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_capture_blacklists_total",
+		Help: "Times a capture client was blacklisted, by reason",
+	}, []string{"reason"})
+)
@@ -0,0 +1,321 @@
+package galactus
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CaptureSocketPingInterval is how often capture sockets are pinged; one that misses two pings is dropped
+	CaptureSocketPingInterval = 30 * time.Second
+	captureSocketWriteWait    = 10 * time.Second
+	// tasks are small; anything bigger than this from a capture client isn't an ack
+	captureSocketReadLimit  = 4096
+	captureSocketSendBuffer = 16
+)
+
+// capture socket message types
+const (
+	CaptureMessageModify = "modify"
+	CaptureMessageAck    = "ack"
+)
+
+// CaptureMessage is sent both ways over a capture socket: galactus sends a modify task, and the capture client answers
+// with an ack carrying the task's ID
+type CaptureMessage struct {
+	Type string `json:"type"`
+	// Task is a task.ModifyTask
+	Task json.RawMessage `json:"task,omitempty"`
+	// Ack is an ack.Ack
+	Ack json.RawMessage `json:"ack,omitempty"`
+}
+
+// capture clients aren't browsers, so they don't send an Origin; the default check still turns away pages that try
+var captureSocketUpgrader = websocket.Upgrader{}
+
+var captureSocketsConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "galactus_capture_sockets",
+	Help: "Capture clients connected to this instance over WebSocket",
+})
+
+type captureSocket struct {
+	connectCode string
+	conn        *websocket.Conn
+	send        chan []byte
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newCaptureSocket(connectCode string, conn *websocket.Conn) *captureSocket {
+	return &captureSocket{
+		connectCode: connectCode,
+		conn:        conn,
+		send:        make(chan []byte, captureSocketSendBuffer),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (sock *captureSocket) close() {
+	sock.closeOnce.Do(func() {
+		close(sock.closed)
+		sock.conn.Close()
+	})
+}
+
+// push queues a message for the socket, or returns false if it's closed or too far behind to take it
+func (sock *captureSocket) push(msg CaptureMessage) bool {
+	jBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	select {
+	case sock.send <- jBytes:
+		return true
+	case <-sock.closed:
+		return false
+	default:
+		log.Printf("Capture socket for %s isn't keeping up; dropping a %s message\n", sock.connectCode, msg.Type)
+		return false
+	}
+}
+
+// writeLoop is the socket's only writer, since a websocket.Conn doesn't allow concurrent writes
+func (sock *captureSocket) writeLoop() {
+	ticker := time.NewTicker(CaptureSocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case jBytes := <-sock.send:
+			sock.conn.SetWriteDeadline(time.Now().Add(captureSocketWriteWait))
+			if err := sock.conn.WriteMessage(websocket.TextMessage, jBytes); err != nil {
+				log.Println(err)
+				sock.close()
+				return
+			}
+		case <-ticker.C:
+			if err := sock.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(captureSocketWriteWait)); err != nil {
+				sock.close()
+				return
+			}
+		case <-sock.closed:
+			return
+		}
+	}
+}
+
+// forwardTasks sends the tasks published for the socket's connect code, by other instances or by this one when it
+// has no socket for the code, until the socket closes
+func (sock *captureSocket) forwardTasks(channel <-chan *redis.Message) {
+	for {
+		select {
+		case msg, ok := <-channel:
+			if !ok {
+				return
+			}
+			if !json.Valid([]byte(msg.Payload)) {
+				log.Println("Ignoring a malformed task for " + sock.connectCode)
+				continue
+			}
+			sock.push(CaptureMessage{Type: CaptureMessageModify, Task: json.RawMessage(msg.Payload)})
+		case <-sock.closed:
+			return
+		}
+	}
+}
+
+// addCaptureSocket makes sock the connect code's socket on this instance. A capture client that reconnects replaces
+// its old socket, which is closed
+func (tokenProvider *TokenProvider) addCaptureSocket(sock *captureSocket) {
+	tokenProvider.captureSocketsLock.Lock()
+	old := tokenProvider.captureSockets[sock.connectCode]
+	tokenProvider.captureSockets[sock.connectCode] = sock
+	tokenProvider.captureSocketsLock.Unlock()
+	if old != nil {
+		log.Println("Replacing the capture socket for " + sock.connectCode)
+		old.close()
+	} else {
+		captureSocketsConnected.Inc()
+	}
+}
+
+func (tokenProvider *TokenProvider) removeCaptureSocket(sock *captureSocket) {
+	tokenProvider.captureSocketsLock.Lock()
+	if tokenProvider.captureSockets[sock.connectCode] == sock {
+		delete(tokenProvider.captureSockets, sock.connectCode)
+		captureSocketsConnected.Dec()
+	}
+	tokenProvider.captureSocketsLock.Unlock()
+	sock.close()
+}
+
+func (tokenProvider *TokenProvider) getCaptureSocket(connectCode string) *captureSocket {
+	tokenProvider.captureSocketsLock.Lock()
+	defer tokenProvider.captureSocketsLock.Unlock()
+	return tokenProvider.captureSockets[connectCode]
+}
+
+func (tokenProvider *TokenProvider) closeCaptureSockets() {
+	tokenProvider.captureSocketsLock.Lock()
+	sockets := make([]*captureSocket, 0, len(tokenProvider.captureSockets))
+	for _, sock := range tokenProvider.captureSockets {
+		sockets = append(sockets, sock)
+	}
+	tokenProvider.captureSocketsLock.Unlock()
+	for _, sock := range sockets {
+		sock.close()
+	}
+}
+
+// pushCaptureTask sends a task straight to a capture socket on this instance and waits for its ack, skipping the Redis
+// round trip
+func (tokenProvider *TokenProvider) pushCaptureTask(ctx context.Context, sock *captureSocket, taskObj task.ModifyTask, jBytes []byte, waitTime time.Duration) (ack.Ack, bool) {
+	acks := make(chan ack.Ack, 1)
+	tokenProvider.captureSocketsLock.Lock()
+	tokenProvider.pendingCaptureAcks[taskObj.TaskID] = acks
+	tokenProvider.captureSocketsLock.Unlock()
+	defer func() {
+		tokenProvider.captureSocketsLock.Lock()
+		delete(tokenProvider.pendingCaptureAcks, taskObj.TaskID)
+		tokenProvider.captureSocketsLock.Unlock()
+	}()
+
+	if !sock.push(CaptureMessage{Type: CaptureMessageModify, Task: jBytes}) {
+		return ack.Ack{}, false
+	}
+	t := time.NewTimer(waitTime)
+	defer t.Stop()
+	select {
+	case res := <-acks:
+		return res, true
+	case <-t.C:
+	case <-ctx.Done():
+	case <-sock.closed:
+	}
+	return ack.Ack{}, false
+}
+
+// deliverCaptureAck hands an ack to the request on this instance waiting for it, or publishes it for the instance that
+// sent the task
+func (tokenProvider *TokenProvider) deliverCaptureAck(res ack.Ack) {
+	tokenProvider.captureSocketsLock.Lock()
+	acks, ok := tokenProvider.pendingCaptureAcks[res.TaskID]
+	delete(tokenProvider.pendingCaptureAcks, res.TaskID)
+	tokenProvider.captureSocketsLock.Unlock()
+	if ok {
+		acks <- res
+		return
+	}
+	err := tokenProvider.client.Publish(context.Background(), rediskey.CompleteTask(res.TaskID), res.Marshal()).Err()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (tokenProvider *TokenProvider) readCaptureSocket(sock *captureSocket) {
+	sock.conn.SetReadLimit(captureSocketReadLimit)
+	sock.conn.SetReadDeadline(time.Now().Add(2 * CaptureSocketPingInterval))
+	sock.conn.SetPongHandler(func(string) error {
+		return sock.conn.SetReadDeadline(time.Now().Add(2 * CaptureSocketPingInterval))
+	})
+	for {
+		_, data, err := sock.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Capture socket for %s closed: %s\n", sock.connectCode, err)
+			}
+			return
+		}
+		var msg CaptureMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Malformed message from the capture socket for %s: %s\n", sock.connectCode, err)
+			continue
+		}
+		if msg.Type != CaptureMessageAck {
+			log.Printf("Unexpected \"%s\" message from the capture socket for %s\n", msg.Type, sock.connectCode)
+			continue
+		}
+		res := ack.Parse(string(msg.Ack))
+		if res.TaskID == "" {
+			log.Println("Ignoring an ack without a task ID from the capture socket for " + sock.connectCode)
+			continue
+		}
+		tokenProvider.deliverCaptureAck(res)
+	}
+}
+
+// captureToken is the game's capture token from an Authorization: Bearer header, or ?token= for clients that can't set
+// headers on a WebSocket handshake
+func captureToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// validCaptureToken reports whether the request presents the game's capture token
+func validCaptureToken(r *http.Request, game *Game) bool {
+	provided := captureToken(r)
+	return game.CaptureToken != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(game.CaptureToken)) == 1
+}
+
+// captureSocketHandler upgrades a capture client's connection to a WebSocket that galactus pushes modify tasks down and
+// the client acks them on. The connect code has to be a registered game, and the client has to present its capture
+// token
+func (tokenProvider *TokenProvider) captureSocketHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		connectCode := mux.Vars(r)["connectCode"]
+		if !connectCodePattern.MatchString(connectCode) {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "invalid connect code")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		game, err := tokenProvider.getGame(ctx, connectCode)
+		cancel()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the game")
+			return
+		}
+		if game == nil {
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no game is registered for "+connectCode)
+			return
+		}
+		if !validCaptureToken(r, game) {
+			writeError(w, r, http.StatusUnauthorized, ErrorCodeUnauthorized, "missing or invalid capture token")
+			return
+		}
+
+		conn, err := captureSocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already answered the request
+			log.Println(err)
+			return
+		}
+		sock := newCaptureSocket(connectCode, conn)
+		tokenProvider.addCaptureSocket(sock)
+		defer tokenProvider.removeCaptureSocket(sock)
+		log.Println("Capture socket OPEN for " + connectCode)
+		defer log.Println("Capture socket CLOSE for " + connectCode)
+
+		pubsub := tokenProvider.client.Subscribe(context.Background(), rediskey.TasksSubscribe(connectCode))
+		defer pubsub.Close()
+		go sock.writeLoop()
+		go sock.forwardTasks(pubsub.Channel())
+		tokenProvider.readCaptureSocket(sock)
+	}
+}
@@ -0,0 +1,71 @@
+package galactus
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strings"
+)
+
+// why messages weren't forwarded for not being commands
+const (
+	messageFilteredPrefix = "prefix"
+	messageFilteredBot    = "bot"
+)
+
+var messagesFilteredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_gateway_messages_filtered_total",
+	Help: "Guild messages that weren't forwarded because they couldn't be commands, by reason (prefix or bot)",
+}, []string{"reason"})
+
+// commandPrefixes are the guild's own command prefixes, or the global ones if it has none
+func (guild guildGatewaySettings) commandPrefixes(global []string) []string {
+	var prefixes []string
+	if guild.CommandPrefix != "" {
+		prefixes = append(prefixes, guild.CommandPrefix)
+	}
+	for _, prefix := range guild.CommandPrefixes {
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return global
+	}
+	return prefixes
+}
+
+// startsWithCommand returns whether content starts with one of the prefixes, ignoring case, or with a mention of the bot
+func startsWithCommand(content, botID string, prefixes []string) bool {
+	content = strings.TrimLeft(content, " \t\n")
+	if botID != "" && (strings.HasPrefix(content, "<@"+botID+">") || strings.HasPrefix(content, "<@!"+botID+">")) {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if len(content) >= len(prefix) && strings.EqualFold(content[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// couldBeCommand returns whether a message could be a command for the bot, so only those are forwarded. Without any
+// prefixes for the guild, every message could be
+func couldBeCommand(s *discordgo.Session, m *discordgo.Message, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	if m.Author != nil && m.Author.Bot {
+		messagesFilteredTotal.WithLabelValues(messageFilteredBot).Inc()
+		return false
+	}
+	botID := ""
+	if s.State != nil && s.State.User != nil {
+		botID = s.State.User.ID
+	}
+	if !startsWithCommand(m.Content, botID, prefixes) {
+		messagesFilteredTotal.WithLabelValues(messageFilteredPrefix).Inc()
+		return false
+	}
+	return true
+}
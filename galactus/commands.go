@@ -0,0 +1,159 @@
+package galactus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"os"
+)
+
+// discordgo still speaks v6, which doesn't have application commands
+var discordAPIv8 = discordgo.EndpointDiscord + "api/v8/"
+
+// ApplicationCommand is a slash command, as Discord defines it
+type ApplicationCommand struct {
+	ID                string                     `json:"id,omitempty"`
+	ApplicationID     string                     `json:"application_id,omitempty"`
+	GuildID           string                     `json:"guild_id,omitempty"`
+	Name              string                     `json:"name"`
+	Description       string                     `json:"description"`
+	Options           []ApplicationCommandOption `json:"options,omitempty"`
+	DefaultPermission *bool                      `json:"default_permission,omitempty"`
+}
+
+type ApplicationCommandOption struct {
+	Type        int                              `json:"type"`
+	Name        string                           `json:"name"`
+	Description string                           `json:"description"`
+	Required    bool                             `json:"required,omitempty"`
+	Choices     []ApplicationCommandOptionChoice `json:"choices,omitempty"`
+	Options     []ApplicationCommandOption       `json:"options,omitempty"`
+}
+
+type ApplicationCommandOptionChoice struct {
+	Name string `json:"name"`
+	// a string, integer or number, depending on the option's type
+	Value interface{} `json:"value"`
+}
+
+func (command ApplicationCommand) validate() error {
+	if command.Name == "" || command.Description == "" {
+		return errors.New("commands need a name and a description")
+	}
+	return nil
+}
+
+// applicationID is the primary bot's application, which is the bot user's ID unless DISCORD_APPLICATION_ID says otherwise
+func (tokenProvider *TokenProvider) applicationID() (string, error) {
+	if id := os.Getenv("DISCORD_APPLICATION_ID"); id != "" {
+		return id, nil
+	}
+	if state := tokenProvider.primarySession.State; state != nil && state.User != nil {
+		return state.User.ID, nil
+	}
+	user, err := tokenProvider.primarySession.User("@me")
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// commandsEndpoint is the global commands endpoint, or the guild's if guildID isn't empty
+func commandsEndpoint(applicationID, guildID string) string {
+	if guildID == "" {
+		return discordAPIv8 + "applications/" + applicationID + "/commands"
+	}
+	return discordAPIv8 + "applications/" + applicationID + "/guilds/" + guildID + "/commands"
+}
+
+// commandsHandler lists (GET), creates (POST) or bulk syncs (PUT) the primary bot's commands. A bulk sync replaces every
+// command with the manifest in the body, deleting any that aren't in it. ?guildID= manages a guild's commands instead of
+// the global ones
+func (tokenProvider *TokenProvider) commandsHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		switch r.Method {
+		case http.MethodPost:
+			command := ApplicationCommand{}
+			if !readJSONBody(w, r, config, &command) {
+				return
+			}
+			if err := command.validate(); err != nil {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+				return
+			}
+			data = command
+		case http.MethodPut:
+			var manifest []ApplicationCommand
+			if !readJSONBody(w, r, config, &manifest) {
+				return
+			}
+			for i, command := range manifest {
+				if err := command.validate(); err != nil {
+					writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("command %d: %s", i, err))
+					return
+				}
+			}
+			if manifest == nil {
+				// an empty manifest deletes every command; null would be rejected by Discord
+				manifest = []ApplicationCommand{}
+			}
+			data = manifest
+		}
+		tokenProvider.commandRequest(w, r, "", data)
+	}
+}
+
+// commandHandler updates (PATCH) or deletes (DELETE) one of the primary bot's commands
+func (tokenProvider *TokenProvider) commandHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data interface{}
+		if r.Method == http.MethodPatch {
+			command := ApplicationCommand{}
+			if !readJSONBody(w, r, config, &command) {
+				return
+			}
+			data = command
+		}
+		tokenProvider.commandRequest(w, r, "/"+mux.Vars(r)["commandID"], data)
+	}
+}
+
+// readJSONBody decodes the request body into v, responding with the error if it can't
+func readJSONBody(w http.ResponseWriter, r *http.Request, config ServerConfig, v interface{}) bool {
+	if err := decodeJSON(w, r, config, v); err != nil {
+		writeBodyError(w, r, config, err)
+		return false
+	}
+	return true
+}
+
+// commandRequest forwards the request to Discord, writing back Discord's response body
+func (tokenProvider *TokenProvider) commandRequest(w http.ResponseWriter, r *http.Request, suffix string, data interface{}) {
+	appID, err := tokenProvider.applicationID()
+	if err != nil {
+		log.Println(err)
+		writeDiscordError(w, r, err)
+		return
+	}
+
+	url := commandsEndpoint(appID, r.URL.Query().Get("guildID")) + suffix
+	resp, err := tokenProvider.primarySession.RequestWithBucketID(r.Method, url, data, "")
+	if err != nil {
+		log.Println(err)
+		writeDiscordError(w, r, err)
+		return
+	}
+	if len(resp) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(resp); err != nil {
+		log.Println(err)
+	}
+}
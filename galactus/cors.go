@@ -0,0 +1,77 @@
+package galactus
+
+import (
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSMaxAge is how long browsers cache a preflight response
+const DefaultCORSMaxAge = 10 * time.Minute
+
+var (
+	DefaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	DefaultCORSHeaders = []string{"Content-Type", "Authorization", AdminKeyHeader, api.APIKeyHeader, api.RequestIDHeader,
+		api.IdempotencyKeyHeader, MaxDurationHeader}
+	// corsExposedHeaders are the response headers dashboards need to read
+	corsExposedHeaders = []string{api.RequestIDHeader, "ETag", "Retry-After"}
+)
+
+// corsMiddleware lets browsers on the allowed origins call galactus, answering preflight requests itself. It wraps the
+// whole router, since preflight OPTIONS requests don't match any route. Without allowed origins, it does nothing
+func corsMiddleware(cfg config.CORSConfig, next http.Handler) http.Handler {
+	if len(cfg.AllowedOrigins) == 0 {
+		return next
+	}
+	anyOrigin := false
+	origins := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	methods := DefaultCORSMethods
+	if len(cfg.AllowedMethods) > 0 {
+		methods = cfg.AllowedMethods
+	}
+	headers := DefaultCORSHeaders
+	if len(cfg.AllowedHeaders) > 0 {
+		headers = cfg.AllowedHeaders
+	}
+	maxAge := DefaultCORSMaxAge
+	if cfg.MaxAge > 0 {
+		maxAge = time.Duration(cfg.MaxAge)
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	exposeHeaders := strings.Join(corsExposedHeaders, ", ")
+	maxAgeSeconds := strconv.Itoa(int(maxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !anyOrigin && !origins[origin] {
+			// without the allow headers, the browser keeps the response from the page
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			w.Header().Set("Access-Control-Max-Age", maxAgeSeconds)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", exposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,274 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MaxDenyTTL bounds temporary bans; anything longer should be permanent
+const MaxDenyTTL = time.Hour * 24 * 365
+
+const (
+	// ErrorCodeGuildDenied is returned for requests on behalf of a guild on the deny list
+	ErrorCodeGuildDenied = "GUILD_DENIED"
+	// ErrorCodeUserDenied is the code of the users a modify request skipped for being on the deny list
+	ErrorCodeUserDenied = "USER_DENIED"
+)
+
+const (
+	DenyListGuilds = "guilds"
+	DenyListUsers  = "users"
+)
+
+var deniedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_denied_total",
+	Help: "Requests, events and users turned away for being on a deny list, by list (guilds or users)",
+}, []string{"list"})
+
+// denyListKey is a hash of entries by ID, and denyListExpiryKey orders the same IDs by when they expire, like games.
+// A list's keys share a hash tag so they can be updated together on Redis Cluster
+func denyListKey(list string) string {
+	return "galactus:denylist:{" + list + "}"
+}
+
+func denyListExpiryKey(list string) string {
+	return "galactus:denylist:{" + list + "}:expiry"
+}
+
+// DenyEntry is a guild or user galactus turns away
+type DenyEntry struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+	// unix ms; ExpiresAt is 0 for a permanent entry
+	AddedAt   int64 `json:"addedAt"`
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+// DenyRequest is the body of POST /admin/denylist/{list}
+type DenyRequest struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+	// TTLSeconds makes a temporary ban; 0 is permanent
+	TTLSeconds int64 `json:"ttlSeconds,omitempty"`
+}
+
+type DenyListResponse struct {
+	Guilds []DenyEntry `json:"guilds"`
+	Users  []DenyEntry `json:"users"`
+}
+
+func validDenyList(list string) bool {
+	return list == DenyListGuilds || list == DenyListUsers
+}
+
+// denied returns whether an ID is on a list. If Redis can't say, it isn't, so a Redis outage doesn't turn everyone away
+func (tokenProvider *TokenProvider) denied(ctx context.Context, list, id string) bool {
+	expiresAt, err := tokenProvider.client.ZScore(ctx, denyListExpiryKey(list), id).Result()
+	if err == redis.Nil {
+		return false
+	} else if err != nil {
+		log.Println(err)
+		return false
+	}
+	if expiresAt <= float64(nowMs()) {
+		return false
+	}
+	deniedTotal.WithLabelValues(list).Inc()
+	return true
+}
+
+func (tokenProvider *TokenProvider) guildDenied(ctx context.Context, guildID string) bool {
+	return tokenProvider.denied(ctx, DenyListGuilds, guildID)
+}
+
+// connectCodeDenied returns whether the game registered for a connect code is on a denied guild, for the broker to drop
+// its capture events. Connect codes without a game aren't denied
+func (tokenProvider *TokenProvider) connectCodeDenied(ctx context.Context, connectCode string) bool {
+	game, err := tokenProvider.getGame(ctx, connectCode)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return game != nil && tokenProvider.guildDenied(ctx, game.GuildID)
+}
+
+// dropDeniedUsers removes the users on the deny list from a modify request, returning them separately
+func (tokenProvider *TokenProvider) dropDeniedUsers(ctx context.Context, request task.UserModifyRequest) (task.UserModifyRequest, []task.UserModify) {
+	if len(request.Users) == 0 {
+		return request, nil
+	}
+	pipe := tokenProvider.client.Pipeline()
+	scores := make([]*redis.FloatCmd, len(request.Users))
+	for i, user := range request.Users {
+		scores[i] = pipe.ZScore(ctx, denyListExpiryKey(DenyListUsers), strconv.FormatUint(user.UserID, 10))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Println(err)
+		return request, nil
+	}
+
+	now := float64(nowMs())
+	var denied []task.UserModify
+	allowed := make([]task.UserModify, 0, len(request.Users))
+	for i, user := range request.Users {
+		if expiresAt, err := scores[i].Result(); err == nil && expiresAt > now {
+			deniedTotal.WithLabelValues(DenyListUsers).Inc()
+			denied = append(denied, user)
+			continue
+		}
+		allowed = append(allowed, user)
+	}
+	if len(denied) == 0 {
+		return request, nil
+	}
+	request.Users = allowed
+	return request, denied
+}
+
+func deniedUserError(userID uint64) api.UserModifyError {
+	return api.UserModifyError{UserID: userID, Code: ack.Code(ErrorCodeUserDenied), Message: "user is on the deny list"}
+}
+
+// denyListEntries returns a list's active entries, ordered by when they expire, forgetting the ones that have expired
+func (tokenProvider *TokenProvider) denyListEntries(ctx context.Context, list string) ([]DenyEntry, error) {
+	now := strconv.FormatInt(nowMs(), 10)
+	expired, err := tokenProvider.client.ZRangeByScore(ctx, denyListExpiryKey(list), &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) > 0 {
+		members := make([]interface{}, len(expired))
+		for i, id := range expired {
+			members[i] = id
+		}
+		pipe := tokenProvider.client.TxPipeline()
+		pipe.ZRem(ctx, denyListExpiryKey(list), members...)
+		pipe.HDel(ctx, denyListKey(list), expired...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	ids, err := tokenProvider.client.ZRange(ctx, denyListExpiryKey(list), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DenyEntry, 0, len(ids))
+	if len(ids) == 0 {
+		return entries, nil
+	}
+	values, err := tokenProvider.client.HMGet(ctx, denyListKey(list), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		entry := DenyEntry{ID: ids[i]}
+		if s, ok := v.(string); ok {
+			if err := json.Unmarshal([]byte(s), &entry); err != nil {
+				log.Println(err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// adminDenyListHandler returns every active deny list entry
+func (tokenProvider *TokenProvider) adminDenyListHandler(w http.ResponseWriter, r *http.Request) {
+	var resp DenyListResponse
+	var err error
+	if resp.Guilds, err = tokenProvider.denyListEntries(r.Context(), DenyListGuilds); err == nil {
+		resp.Users, err = tokenProvider.denyListEntries(r.Context(), DenyListUsers)
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the deny lists")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// adminDenyHandler adds a guild or user to a deny list, or replaces its entry, on every instance at once
+func (tokenProvider *TokenProvider) adminDenyHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := mux.Vars(r)["list"]
+		if !validDenyList(list) {
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no deny list is named "+list)
+			return
+		}
+		var request DenyRequest
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		if _, err := strconv.ParseUint(request.ID, 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "id must be a snowflake")
+			return
+		}
+		ttl := time.Duration(request.TTLSeconds) * time.Second
+		if ttl < 0 || ttl > MaxDenyTTL {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest,
+				fmt.Sprintf("ttlSeconds must be between 0 (permanent) and %d", int64(MaxDenyTTL.Seconds())))
+			return
+		}
+
+		entry := DenyEntry{ID: request.ID, Reason: request.Reason, AddedAt: nowMs()}
+		score := math.Inf(1)
+		if ttl > 0 {
+			entry.ExpiresAt = entry.AddedAt + ttl.Milliseconds()
+			score = float64(entry.ExpiresAt)
+		}
+		jBytes, err := json.Marshal(entry)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		pipe := tokenProvider.client.TxPipeline()
+		pipe.HSet(r.Context(), denyListKey(list), entry.ID, jBytes)
+		pipe.ZAdd(r.Context(), denyListExpiryKey(list), &redis.Z{Score: score, Member: entry.ID})
+		if _, err := pipe.Exec(r.Context()); err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to update the deny list")
+			return
+		}
+		log.Printf("Added %s to the %s deny list (%s)\n", entry.ID, list, entry.Reason)
+		writeJSON(w, http.StatusOK, entry)
+	}
+}
+
+// adminUndenyHandler removes a guild or user from a deny list
+func (tokenProvider *TokenProvider) adminUndenyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	list, id := vars["list"], vars["id"]
+	if !validDenyList(list) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no deny list is named "+list)
+		return
+	}
+	pipe := tokenProvider.client.TxPipeline()
+	removed := pipe.ZRem(r.Context(), denyListExpiryKey(list), id)
+	pipe.HDel(r.Context(), denyListKey(list), id)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to update the deny list")
+		return
+	}
+	if removed.Val() == 0 {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, id+" isn't on the "+list+" deny list")
+		return
+	}
+	log.Printf("Removed %s from the %s deny list\n", id, list)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package galactus
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"strings"
+	"time"
+)
+
+var discordRateLimitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_discord_rate_limits_total",
+	Help: "429 responses received from Discord",
+}, []string{"session"})
+
+// rateLimitHandler blacklists a secondary token on a guild for exactly as long as Discord tells us to back off, so
+// other requests move on to other tokens instead of queueing behind discordgo's retry. hashedToken is empty for the
+// primary session, which has nothing to fall back to.
+//
+// discordgo v0.22 dispatches RateLimit by value, which never matches the typed *RateLimit handler, so this has to be
+// registered as an interface{} handler
+func (tokenProvider *TokenProvider) rateLimitHandler(hashedToken string) func(*discordgo.Session, interface{}) {
+	return func(sess *discordgo.Session, i interface{}) {
+		var rl *discordgo.RateLimit
+		switch v := i.(type) {
+		case discordgo.RateLimit:
+			rl = &v
+		case *discordgo.RateLimit:
+			rl = v
+		default:
+			return
+		}
+		if rl.TooManyRequests == nil {
+			return
+		}
+		// API v6 reports retry_after in milliseconds
+		retryAfter := rl.RetryAfter * time.Millisecond
+		log.Printf("Discord rate limit on %s: %s, retry after %s\n", rl.URL, rl.Message, retryAfter)
+
+		if hashedToken == "" {
+			discordRateLimitsTotal.WithLabelValues("primary").Inc()
+			return
+		}
+		discordRateLimitsTotal.WithLabelValues("secondary").Inc()
+
+		guildID := memberEditGuildID(rl.URL)
+		if guildID == "" || retryAfter <= 0 {
+			return
+		}
+		err := tokenProvider.BlacklistTokenForDuration(context.Background(), guildID, hashedToken, retryAfter)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		tokenProvider.publishEvent(EventTokenBlacklist, BlacklistEvent{
+			GuildID:     guildID,
+			HashedToken: hashedToken,
+			DurationMs:  retryAfter.Milliseconds(),
+			Reason:      "rate_limited",
+		})
+	}
+}
+
+// memberEditGuildID returns the guild ID of a guild member endpoint URL, like .../guilds/<guildID>/members/<userID>,
+// or "" for any other endpoint
+func memberEditGuildID(url string) string {
+	i := strings.Index(url, "/guilds/")
+	if i < 0 {
+		return ""
+	}
+	parts := strings.Split(url[i+len("/guilds/"):], "/")
+	if len(parts) < 2 || parts[1] != "members" {
+		return ""
+	}
+	return parts[0]
+}
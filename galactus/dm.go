@@ -0,0 +1,124 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DMUserRateLimit bounds how many DMs galactus sends a single user, so a misbehaving worker can't spam anyone
+var DMUserRateLimit = RateLimit{PerSecond: 0.2, Burst: 3}
+
+// DMChannelTTL is how long a user's DM channel ID is cached. DM channels don't change, so this only bounds Redis usage
+const DMChannelTTL = time.Hour * 24 * 7
+
+const ErrorCodeDMOptedOut = "DM_OPTED_OUT"
+
+// users who asked not to be DMed; a single set, since it's only ever checked by member
+const dmOptOutKey = "galactus:dm:optout"
+
+func dmChannelKey(userID string) string {
+	return "galactus:dm:channel:" + userID
+}
+
+func dmRateLimitKey(userID string) string {
+	return "galactus:ratelimit:dm:" + userID
+}
+
+// dmChannel returns the user's DM channel with the primary bot, opening it if it isn't cached
+func (tokenProvider *TokenProvider) dmChannel(ctx context.Context, userID string) (string, error) {
+	channelID, err := tokenProvider.client.Get(ctx, dmChannelKey(userID)).Result()
+	if err == nil {
+		return channelID, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		log.Println(err)
+	}
+	channel, err := tokenProvider.primarySession.UserChannelCreate(userID)
+	if err != nil {
+		return "", err
+	}
+	err = tokenProvider.client.Set(ctx, dmChannelKey(userID), channel.ID, DMChannelTTL).Err()
+	if err != nil {
+		log.Println(err)
+	}
+	return channel.ID, nil
+}
+
+// dmHandler sends a direct message to a user with the primary bot, unless they've opted out
+func (tokenProvider *TokenProvider) dmHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := mux.Vars(r)["userID"]
+
+		request := MessageRequest{}
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		if request.Content == "" && request.Embed == nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "a message needs content or an embed")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		optedOut, err := tokenProvider.client.SIsMember(ctx, dmOptOutKey, userID).Result()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to check the user's DM preference")
+			return
+		}
+		if optedOut {
+			writeError(w, r, http.StatusForbidden, ErrorCodeDMOptedOut, "the user has opted out of DMs")
+			return
+		}
+
+		allowed, _, wait, err := takeToken(ctx, tokenProvider.client, dmRateLimitKey(userID), DMUserRateLimit)
+		if err != nil {
+			log.Println(err)
+		} else if !allowed {
+			retryAfter := int64(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			writeError(w, r, http.StatusTooManyRequests, ErrorCodeRateLimited,
+				fmt.Sprintf("too many DMs to this user; retry in %ds", retryAfter))
+			return
+		}
+
+		channelID, err := tokenProvider.dmChannel(ctx, userID)
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		result := tokenProvider.sendMessage(ctx, channelID, "", request)
+		if result.Error != "" {
+			writeJSON(w, http.StatusBadGateway, result)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// dmOptOutHandler opts a user out of DMs (PUT), or back in (DELETE)
+func (tokenProvider *TokenProvider) dmOptOutHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	var err error
+	if r.Method == http.MethodDelete {
+		err = tokenProvider.client.SRem(r.Context(), dmOptOutKey, userID).Err()
+	} else {
+		err = tokenProvider.client.SAdd(r.Context(), dmOptOutKey, userID).Err()
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to update the user's DM preference")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/utils/pkg/task"
+	"net/http"
+)
+
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get(api.DryRunQueryParam) == "true"
+}
+
+// dryRunModify picks the method each user would be modified with, in the same order and with the same token selection
+// as modifyUsers. Rate limits are taken like a real request's, so dry runs can be used to load test them, but nothing
+// is sent to Discord or the capture bot, and nothing is recorded in the stats or audit log
+func (tokenProvider *TokenProvider) dryRunModify(ctx context.Context, guildID string, gid uint64, connectCode string, userModifications task.UserModifyRequest) api.ModifyResponse {
+	settings := tokenProvider.getSettings()
+	limit := settings.premiumBots[tokenProvider.guildTier(ctx, guildID)]
+	tokens := tokenProvider.getAllTokensForGuild(ctx, guildID)
+	order := tokenProvider.muteOrder(settings, guildID, connectCode)
+
+	userModifications, denied := tokenProvider.dropDeniedUsers(ctx, userModifications)
+	resp := api.ModifyResponse{DryRun: make([]api.DryRunUser, 0, len(userModifications.Users))}
+	for _, request := range denied {
+		resp.Errors = append(resp.Errors, deniedUserError(request.UserID))
+	}
+	for _, request := range userModifications.Users {
+		user := api.DryRunUser{UserID: request.UserID}
+		for _, method := range order {
+			hToken, reason := tokenProvider.dryRunMethod(ctx, method, guildID, gid, connectCode, tokens, limit)
+			if reason != "" {
+				user.Skipped = append(user.Skipped, api.DryRunSkip{Method: method, Reason: reason})
+				continue
+			}
+			user.Method = method
+			user.HashedToken = hToken
+			break
+		}
+		switch user.Method {
+		case AuditMethodWorker:
+			resp.Worker++
+		case AuditMethodCapture:
+			resp.Capture++
+		case AuditMethodOfficial:
+			resp.Official++
+		}
+		resp.DryRun = append(resp.DryRun, user)
+	}
+	return resp
+}
+
+// dryRunMethod returns the bot a method would use, or why it would be passed over
+func (tokenProvider *TokenProvider) dryRunMethod(ctx context.Context, method, guildID string, gid uint64, connectCode string, tokens []string, limit int) (string, string) {
+	switch method {
+	case AuditMethodWorker:
+		if len(tokens) == 0 || limit <= 0 {
+			return "", "the guild has no access to secondary bots"
+		}
+		sess, hToken := tokenProvider.getAnySession(ctx, guildID, tokens, limit)
+		if sess == nil {
+			return "", "every secondary bot is rate-limited, unhealthy or has no session"
+		}
+		return hToken, ""
+	case AuditMethodCapture:
+		if !tokenProvider.TakeGuildTokenRateLimit(ctx, guildID, connectCode) {
+			return "", "the capture bot is rate-limited or blacklisted"
+		}
+		return "", ""
+	case AuditMethodOfficial:
+		_, hToken := tokenProvider.officialSession(gid)
+		return hToken, ""
+	}
+	return "", "unknown method"
+}
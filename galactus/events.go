@@ -0,0 +1,193 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"net/http"
+	"time"
+)
+
+// events are published to every instance, so a dashboard connected to any galactus sees them all
+const eventsChannel = "galactus:events"
+
+const (
+	EventQueueDepth       = "queueDepth"
+	EventShardConnect     = "shardConnect"
+	EventShardDisconnect  = "shardDisconnect"
+	EventTokenBlacklist   = "tokenBlacklist"
+	EventCaptureBlacklist = "captureBlacklist"
+	EventCaptureTimeout   = "captureTimeout"
+	EventDiscordOutage    = "discordOutage"
+	EventDiscordRecovered = "discordRecovered"
+)
+
+const (
+	// EventStreamQueuePollInterval is how often each stream checks the queue depth, sending an event when it changed
+	EventStreamQueuePollInterval = 5 * time.Second
+	// EventStreamKeepAlive is how often a comment is sent on an idle stream, so proxies don't close it
+	EventStreamKeepAlive = 15 * time.Second
+	// EventStreamRetry is how long browsers wait before reconnecting a stream that ended
+	EventStreamRetry = 2 * time.Second
+)
+
+// OpsEvent is an operational event sent on /events/stream. The SSE event name is its Type
+type OpsEvent struct {
+	Type string `json:"type"`
+	// unix ms
+	Time       int64       `json:"time"`
+	InstanceID string      `json:"instanceID"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+type QueueDepthEvent struct {
+	Pending int64 `json:"pending"`
+	Queues  int64 `json:"queues"`
+}
+
+type ShardEvent struct {
+	ShardID int `json:"shardID"`
+}
+
+// BlacklistEvent reports a secondary token, identified by its hash, or a capture client, identified by its connect
+// code, being skipped on a guild
+type BlacklistEvent struct {
+	GuildID     string `json:"guildID"`
+	HashedToken string `json:"hashedToken,omitempty"`
+	ConnectCode string `json:"connectCode,omitempty"`
+	DurationMs  int64  `json:"durationMs"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type CaptureTimeoutEvent struct {
+	GuildID     string `json:"guildID"`
+	ConnectCode string `json:"connectCode"`
+}
+
+func (tokenProvider *TokenProvider) newEvent(eventType string, data interface{}) OpsEvent {
+	return OpsEvent{
+		Type:       eventType,
+		Time:       time.Now().UnixNano() / int64(time.Millisecond),
+		InstanceID: tokenProvider.instanceID,
+		Data:       data,
+	}
+}
+
+// publishEvent sends an event to the streams on every instance. Events are best-effort; nothing waits on them
+func (tokenProvider *TokenProvider) publishEvent(eventType string, data interface{}) {
+	jBytes, err := json.Marshal(tokenProvider.newEvent(eventType, data))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := tokenProvider.client.Publish(context.Background(), eventsChannel, jBytes).Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+// addShardEventHandlers publishes the primary bot's shards connecting to and disconnecting from the gateway
+func (tokenProvider *TokenProvider) addShardEventHandlers(sess *discordgo.Session) {
+	sess.AddHandler(func(s *discordgo.Session, c *discordgo.Connect) {
+		tokenProvider.publishEvent(EventShardConnect, ShardEvent{ShardID: s.ShardID})
+	})
+	sess.AddHandler(func(s *discordgo.Session, d *discordgo.Disconnect) {
+		tokenProvider.publishEvent(EventShardDisconnect, ShardEvent{ShardID: s.ShardID})
+	})
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, eventType string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	if err == nil {
+		flusher.Flush()
+	}
+	return err
+}
+
+// eventStreamHandler streams operational events as Server-Sent Events. The stream ends shortly before the server's
+// write timeout would cut it off, and the client reconnects after EventStreamRetry
+func (tokenProvider *TokenProvider) eventStreamHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "streaming is not supported")
+			return
+		}
+		ctx := r.Context()
+		pubsub := tokenProvider.client.Subscribe(ctx, eventsChannel)
+		defer pubsub.Close()
+		events := pubsub.Channel()
+
+		var end <-chan time.Time
+		if config.WriteTimeout > 0 {
+			end = time.After(config.WriteTimeout * 9 / 10)
+		}
+		keepAlive := time.NewTicker(EventStreamKeepAlive)
+		defer keepAlive.Stop()
+		queuePoll := time.NewTicker(EventStreamQueuePollInterval)
+		defer queuePoll.Stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// nginx buffers responses by default, which holds events back
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", EventStreamRetry.Milliseconds())
+		flusher.Flush()
+
+		lastDepth := QueueDepthEvent{Pending: -1}
+		sendQueueDepth := func() error {
+			lengths, err := tokenProvider.jobQueueLengths(ctx, "")
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			depth := QueueDepthEvent{Queues: int64(len(lengths))}
+			for _, length := range lengths {
+				depth.Pending += length
+			}
+			if depth == lastDepth {
+				return nil
+			}
+			lastDepth = depth
+			jBytes, err := json.Marshal(tokenProvider.newEvent(EventQueueDepth, depth))
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			return writeEvent(w, flusher, EventQueueDepth, jBytes)
+		}
+
+		if sendQueueDepth() != nil {
+			return
+		}
+		for {
+			var err error
+			select {
+			case <-ctx.Done():
+				return
+			case <-end:
+				return
+			case msg, ok := <-events:
+				if !ok {
+					return
+				}
+				var event OpsEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					log.Println(err)
+					continue
+				}
+				err = writeEvent(w, flusher, event.Type, []byte(msg.Payload))
+			case <-queuePoll.C:
+				err = sendQueueDepth()
+			case <-keepAlive.C:
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
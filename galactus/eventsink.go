@@ -0,0 +1,263 @@
+package galactus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEventSinkBuffer is how many events can wait for each sink before new ones are dropped
+	DefaultEventSinkBuffer = 1000
+	// EventSinkBatchSize bounds how many buffered events are handed to a sink at once
+	EventSinkBatchSize = 100
+	// HTTPEventSinkTimeout bounds each batch posted by the HTTP sink
+	HTTPEventSinkTimeout = 10 * time.Second
+)
+
+var (
+	eventSinkSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_event_sink_sent_total",
+		Help: "Gateway events handed to each event sink",
+	}, []string{"sink"})
+	eventSinkDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_event_sink_dropped_total",
+		Help: "Gateway events dropped because an event sink's buffer was full",
+	}, []string{"sink"})
+	eventSinkErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_event_sink_errors_total",
+		Help: "Batches of gateway events an event sink failed to send",
+	}, []string{"sink"})
+)
+
+// EventSink gets a copy of every gateway event queued for the workers, like to archive them for analytics. Each sink is
+// sent batches from its own goroutine, so a slow sink only holds up itself; once its buffer is full, events are dropped
+type EventSink interface {
+	// Name labels the sink's metrics and logs
+	Name() string
+	Send(ctx context.Context, events []api.GatewayEvent) error
+	// Close is called once every buffered event was sent
+	Close() error
+}
+
+type eventSinkWorker struct {
+	sink   EventSink
+	events chan api.GatewayEvent
+}
+
+// eventSinks fan gateway events out to every sink without blocking the gateway handlers
+type eventSinks struct {
+	sync.RWMutex
+	workers []*eventSinkWorker
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// AddEventSink starts sending gateway events to sink, with room for buffer events to wait; 0 uses
+// DefaultEventSinkBuffer. Sinks are closed along with the TokenProvider
+func (tokenProvider *TokenProvider) AddEventSink(sink EventSink, buffer int) {
+	if buffer <= 0 {
+		buffer = DefaultEventSinkBuffer
+	}
+	sinks := tokenProvider.eventSinks
+	sinks.Lock()
+	defer sinks.Unlock()
+	if sinks.closed {
+		return
+	}
+	worker := &eventSinkWorker{sink: sink, events: make(chan api.GatewayEvent, buffer)}
+	sinks.workers = append(sinks.workers, worker)
+	sinks.wg.Add(1)
+	go func() {
+		defer sinks.wg.Done()
+		worker.run()
+	}()
+	log.Printf("Sending gateway events to the %s event sink\n", sink.Name())
+}
+
+// send hands an event to every sink, dropping it for the ones whose buffers are full
+func (sinks *eventSinks) send(event api.GatewayEvent) {
+	sinks.RLock()
+	defer sinks.RUnlock()
+	if sinks.closed {
+		return
+	}
+	for _, worker := range sinks.workers {
+		select {
+		case worker.events <- event:
+		default:
+			eventSinkDroppedTotal.WithLabelValues(worker.sink.Name()).Inc()
+		}
+	}
+}
+
+// close sends the buffered events, then closes every sink
+func (sinks *eventSinks) close() {
+	sinks.Lock()
+	if sinks.closed {
+		sinks.Unlock()
+		return
+	}
+	sinks.closed = true
+	for _, worker := range sinks.workers {
+		close(worker.events)
+	}
+	sinks.Unlock()
+	sinks.wg.Wait()
+}
+
+// run sends the sink whatever has been buffered each time it's ready for more, until the buffer is closed
+func (worker *eventSinkWorker) run() {
+	name := worker.sink.Name()
+	batch := make([]api.GatewayEvent, 0, EventSinkBatchSize)
+	for event := range worker.events {
+		batch = append(batch[:0], event)
+	drain:
+		for len(batch) < EventSinkBatchSize {
+			select {
+			case event, ok := <-worker.events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+		if err := worker.sink.Send(context.Background(), batch); err != nil {
+			log.Printf("The %s event sink failed to send %d events: %s\n", name, len(batch), err)
+			eventSinkErrorsTotal.WithLabelValues(name).Inc()
+			continue
+		}
+		eventSinkSentTotal.WithLabelValues(name).Add(float64(len(batch)))
+	}
+	if err := worker.sink.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// writeEventLines writes events as newline-delimited JSON
+func writeEventLines(w io.Writer, events []api.GatewayEvent) error {
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileEventSink appends events to a file as newline-delimited JSON, for a log shipper to pick up
+type FileEventSink struct {
+	file *os.File
+}
+
+func NewFileEventSink(path string) (*FileEventSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileEventSink{file: file}, nil
+}
+
+func (sink *FileEventSink) Name() string {
+	return "file"
+}
+
+func (sink *FileEventSink) Send(ctx context.Context, events []api.GatewayEvent) error {
+	// one write per batch, so a shipper tailing the file doesn't see half a line
+	w := bufio.NewWriterSize(sink.file, 64*1024)
+	if err := writeEventLines(w, events); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (sink *FileEventSink) Close() error {
+	return sink.file.Close()
+}
+
+// HTTPEventSink posts each batch of events to a URL as newline-delimited JSON, like to an ingestion endpoint
+type HTTPEventSink struct {
+	url string
+	// Authorization is sent as is, if it's set
+	authorization string
+	client        *http.Client
+}
+
+func NewHTTPEventSink(url, authorization string) *HTTPEventSink {
+	return &HTTPEventSink{
+		url:           url,
+		authorization: authorization,
+		client:        &http.Client{Timeout: HTTPEventSinkTimeout},
+	}
+}
+
+func (sink *HTTPEventSink) Name() string {
+	return "http"
+}
+
+func (sink *HTTPEventSink) Send(ctx context.Context, events []api.GatewayEvent) error {
+	var body bytes.Buffer
+	if err := writeEventLines(&body, events); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if sink.authorization != "" {
+		req.Header.Set("Authorization", sink.authorization)
+	}
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", sink.url, resp.Status)
+	}
+	return nil
+}
+
+func (sink *HTTPEventSink) Close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
+
+// addConfiguredEventSinks adds the sinks set up in the config
+func (tokenProvider *TokenProvider) addConfiguredEventSinks(cfg config.EventSinksConfig) error {
+	if cfg.File != "" {
+		sink, err := NewFileEventSink(cfg.File)
+		if err != nil {
+			return err
+		}
+		tokenProvider.AddEventSink(sink, cfg.Buffer)
+	}
+	if cfg.HTTP.URL != "" {
+		tokenProvider.AddEventSink(NewHTTPEventSink(cfg.HTTP.URL, cfg.HTTP.Authorization), cfg.Buffer)
+	}
+	if cfg.ArchiveMaxLen > 0 {
+		tokenProvider.archiveSink = NewRedisStreamEventSink(tokenProvider.client, cfg.ArchiveMaxLen)
+		tokenProvider.AddEventSink(tokenProvider.archiveSink, cfg.Buffer)
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		tokenProvider.kafkaSink = NewKafkaEventSink(cfg.Kafka)
+		tokenProvider.AddEventSink(tokenProvider.kafkaSink, cfg.Buffer)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	faultTargetRedis   = "redis"
+	faultTargetDiscord = "discord"
+	faultTargetGateway = "gateway"
+
+	faultLatency    = "latency"
+	faultError      = "error"
+	faultDisconnect = "disconnect"
+)
+
+var (
+	// ErrInjectedRedisFault is the error of Redis commands failed by fault injection
+	ErrInjectedRedisFault = errors.New("injected fault: Redis error")
+	// ErrInjectedDisconnect is the error of calls that fault injection failed as if the connection dropped
+	ErrInjectedDisconnect = errors.New("injected fault: connection reset")
+)
+
+var faultsInjectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_faults_injected_total",
+	Help: "Faults injected into galactus' own calls, by target (redis, discord or gateway) and kind (latency, error or disconnect)",
+}, []string{"target", "kind"})
+
+// faultInjector fails some of galactus' Redis and Discord calls on purpose, so circuit breakers, retries and fallbacks
+// can be seen working. With a seed, the same calls fail in the same order every run
+type faultInjector struct {
+	sync.Mutex
+	config config.FaultConfig
+	random *rand.Rand
+}
+
+// newFaultInjector returns nil unless fault injection is enabled
+func newFaultInjector(cfg config.FaultConfig) *faultInjector {
+	if !cfg.Enabled {
+		return nil
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("FAULT INJECTION IS ENABLED (seed %d); Redis and Discord calls will fail on purpose\n", seed)
+	return &faultInjector{config: cfg, random: rand.New(rand.NewSource(seed))}
+}
+
+// roll picks the fault for one call: faultError, faultDisconnect, or "" to let it through
+func (faults *faultInjector) roll(target string, rule config.FaultRule) string {
+	faults.Lock()
+	n := faults.random.Int63n(100)
+	faults.Unlock()
+	switch {
+	case n < rule.ErrorPercent:
+		faultsInjectedTotal.WithLabelValues(target, faultError).Inc()
+		return faultError
+	case n < rule.ErrorPercent+rule.DisconnectPercent:
+		faultsInjectedTotal.WithLabelValues(target, faultDisconnect).Inc()
+		return faultDisconnect
+	}
+	return ""
+}
+
+// delay waits out the rule's latency, or until ctx is done
+func (faults *faultInjector) delay(ctx context.Context, target string, rule config.FaultRule) error {
+	if rule.Latency <= 0 {
+		return nil
+	}
+	faultsInjectedTotal.WithLabelValues(target, faultLatency).Inc()
+	t := time.NewTimer(time.Duration(rule.Latency))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// redisFaultHook injects faults before Redis commands and pipelines are sent
+type redisFaultHook struct {
+	faults *faultInjector
+}
+
+func (hook redisFaultHook) inject(ctx context.Context) error {
+	rule := hook.faults.config.Redis
+	if err := hook.faults.delay(ctx, faultTargetRedis, rule); err != nil {
+		return err
+	}
+	switch hook.faults.roll(faultTargetRedis, rule) {
+	case faultError:
+		return ErrInjectedRedisFault
+	case faultDisconnect:
+		return ErrInjectedDisconnect
+	}
+	return nil
+}
+
+func (hook redisFaultHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, hook.inject(ctx)
+}
+
+func (hook redisFaultHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (hook redisFaultHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, hook.inject(ctx)
+}
+
+func (hook redisFaultHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// faultTransport injects faults into a Discord session's REST calls. It sits under the circuit breaker, so the
+// breaker sees the faults like any other failure
+type faultTransport struct {
+	faults *faultInjector
+	next   http.RoundTripper
+}
+
+func (transport faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rule := transport.faults.config.Discord
+	if err := transport.faults.delay(req.Context(), faultTargetDiscord, rule); err != nil {
+		return nil, err
+	}
+	switch transport.faults.roll(faultTargetDiscord, rule) {
+	case faultError:
+		body := `{"message": "injected fault", "code": 0}`
+		return &http.Response{
+			Status:        "500 Internal Server Error",
+			StatusCode:    http.StatusInternalServerError,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	case faultDisconnect:
+		if req.Body != nil {
+			io.Copy(io.Discard, req.Body)
+			req.Body.Close()
+		}
+		return nil, ErrInjectedDisconnect
+	}
+	return transport.next.RoundTrip(req)
+}
+
+// DisconnectGatewaysPeriodically drops the gateway connection of a random secondary session every
+// GatewayDisconnectInterval, for the supervisor to notice and restart. It does nothing unless that's configured
+func (tokenProvider *TokenProvider) DisconnectGatewaysPeriodically() {
+	faults := tokenProvider.faults
+	if faults == nil || faults.config.GatewayDisconnectInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(faults.config.GatewayDisconnectInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		sessions := tokenProvider.sessions.snapshot()
+		if len(sessions) == 0 {
+			continue
+		}
+		hTokens := make([]string, 0, len(sessions))
+		for hToken := range sessions {
+			hTokens = append(hTokens, hToken)
+		}
+		// map order isn't repeatable, so pick from the sorted tokens
+		sort.Strings(hTokens)
+		faults.Lock()
+		hToken := hTokens[faults.random.Intn(len(hTokens))]
+		faults.Unlock()
+
+		faultsInjectedTotal.WithLabelValues(faultTargetGateway, faultDisconnect).Inc()
+		log.Println("Injected fault: dropping the gateway connection of secondary session " + hToken)
+		// the session stays registered, like one whose connection died, so the supervisor has to notice
+		if err := sessions[hToken].Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
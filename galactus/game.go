@@ -0,0 +1,279 @@
+package galactus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/redisutil"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultGameTTL is how long a registered game lasts without being refreshed
+	DefaultGameTTL = time.Hour
+	MaxGameTTL     = 24 * time.Hour
+	// GameExpiryInterval is how often the leader cleans up after games that expired without being ended
+	GameExpiryInterval = time.Minute
+)
+
+const ErrorCodeConflict = "CONFLICT"
+
+// connect codes are generated by automuteus, but they end up in Redis keys, so anything unusual is turned away
+var connectCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// registered games, and when each expires. They share a hash tag so they can be updated together on Redis Cluster
+const (
+	gamesKey      = "galactus:{games}"
+	gameExpiryKey = "galactus:{games}:expiry"
+)
+
+type GameRequest struct {
+	GuildID string `json:"guildID"`
+	// TTLSeconds defaults to an hour, and can be up to a day
+	TTLSeconds int64 `json:"ttlSeconds,omitempty"`
+}
+
+// Game is a registered connect code. Times are unix ms
+type Game struct {
+	ConnectCode  string `json:"connectCode"`
+	GuildID      string `json:"guildID"`
+	RegisteredAt int64  `json:"registeredAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	// CaptureToken authenticates the game's capture client on /capture/{connectCode}/ws and
+	// /capture/{connectCode}/event. It's made when the game is
+	// registered and kept for as long as the game lasts
+	CaptureToken string `json:"captureToken"`
+}
+
+func newCaptureToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// getGame returns the registered game for a connect code, or nil if it isn't registered or has expired
+func (tokenProvider *TokenProvider) getGame(ctx context.Context, connectCode string) (*Game, error) {
+	v, err := tokenProvider.client.HGet(ctx, gamesKey, connectCode).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var game Game
+	if err := json.Unmarshal(v, &game); err != nil {
+		return nil, err
+	}
+	if game.ExpiresAt <= nowMs() {
+		return nil, nil
+	}
+	return &game, nil
+}
+
+// guildGames returns the games registered on a guild, including any that expired but haven't been cleaned up yet
+func (tokenProvider *TokenProvider) guildGames(ctx context.Context, guildID string) ([]Game, error) {
+	values, err := tokenProvider.client.HGetAll(ctx, gamesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	var games []Game
+	for _, v := range values {
+		var game Game
+		if err := json.Unmarshal([]byte(v), &game); err != nil {
+			log.Println(err)
+			continue
+		}
+		if game.GuildID == guildID {
+			games = append(games, game)
+		}
+	}
+	return games, nil
+}
+
+func (tokenProvider *TokenProvider) saveGame(ctx context.Context, game Game) error {
+	jBytes, err := json.Marshal(game)
+	if err != nil {
+		return err
+	}
+	pipe := tokenProvider.client.TxPipeline()
+	pipe.HSet(ctx, gamesKey, game.ConnectCode, jBytes)
+	pipe.ZAdd(ctx, gameExpiryKey, &redis.Z{Score: float64(game.ExpiresAt), Member: game.ConnectCode})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// endGame forgets a game and everything galactus keeps for its connect code: the queued jobs, the broker's
+// deduplication state, and the capture client's blacklist and rate limits. Original nicknames are kept, since they're
+// restored after the game ends
+func (tokenProvider *TokenProvider) endGame(ctx context.Context, game Game) error {
+	pipe := tokenProvider.client.TxPipeline()
+	pipe.HDel(ctx, gamesKey, game.ConnectCode)
+	pipe.ZRem(ctx, gameExpiryKey, game.ConnectCode)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	keys := []string{
+		rediskey.JobNamespace + game.ConnectCode,
+		rediskey.GuildTokenLock(game.GuildID, game.ConnectCode),
+		tokenRateLimitKey(game.GuildID, game.ConnectCode),
+		captureEventRateLimitKey(game.ConnectCode),
+	}
+	dedupKeys, err := redisutil.ScanKeys(ctx, tokenProvider.client, "galactus:dedup:{"+game.ConnectCode+"}:*")
+	if err != nil {
+		return err
+	}
+	keys = append(keys, dedupKeys...)
+	// the keys live in different slots, so they're deleted one by one rather than in a single DEL
+	delPipe := tokenProvider.client.Pipeline()
+	for _, key := range keys {
+		delPipe.Del(ctx, key)
+	}
+	_, err = delPipe.Exec(ctx)
+	return err
+}
+
+// ExpireGamesPeriodically ends the games whose TTL ran out without being refreshed or ended. Only the leader sweeps
+func (tokenProvider *TokenProvider) ExpireGamesPeriodically(interval time.Duration) {
+	tokenProvider.leader.runSingleton("expire games", interval, func() {
+		tokenProvider.expireGames(context.Background())
+	})
+}
+
+func (tokenProvider *TokenProvider) expireGames(ctx context.Context) {
+	codes, err := tokenProvider.client.ZRangeByScore(ctx, gameExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(nowMs(), 10),
+	}).Result()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, connectCode := range codes {
+		v, err := tokenProvider.client.HGet(ctx, gamesKey, connectCode).Bytes()
+		if err != nil && err != redis.Nil {
+			log.Println(err)
+			continue
+		}
+		game := Game{ConnectCode: connectCode}
+		if err == nil {
+			if err := json.Unmarshal(v, &game); err != nil {
+				log.Println(err)
+			}
+			// refreshed since the sweep read the expiry set
+			if game.ExpiresAt > nowMs() {
+				continue
+			}
+		}
+		if err := tokenProvider.endGame(ctx, game); err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Game %s on guild %s expired; cleaned up after it\n", connectCode, game.GuildID)
+	}
+}
+
+// gameHandler registers or refreshes (POST), returns (GET), or ends (DELETE) the game for a connect code. A connect
+// code is bound to the guild it was registered on; registering it again on another guild is a conflict
+func (tokenProvider *TokenProvider) gameHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		connectCode := mux.Vars(r)["connectCode"]
+		if !connectCodePattern.MatchString(connectCode) {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "invalid connect code")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		game, err := tokenProvider.getGame(ctx, connectCode)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the game")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			if game == nil {
+				writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no game is registered for "+connectCode)
+				return
+			}
+			writeJSON(w, http.StatusOK, game)
+
+		case http.MethodDelete:
+			if game == nil {
+				writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no game is registered for "+connectCode)
+				return
+			}
+			if err := tokenProvider.endGame(ctx, *game); err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to end the game")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			var request GameRequest
+			if !readJSONBody(w, r, config, &request) {
+				return
+			}
+			if request.GuildID == "" {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "guildID is required")
+				return
+			}
+			ttl := DefaultGameTTL
+			if request.TTLSeconds != 0 {
+				ttl = time.Duration(request.TTLSeconds) * time.Second
+				if ttl <= 0 || ttl > MaxGameTTL {
+					writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest,
+						fmt.Sprintf("ttlSeconds must be between 1 and %d", int64(MaxGameTTL.Seconds())))
+					return
+				}
+			}
+
+			status := http.StatusOK
+			if game == nil {
+				game = &Game{
+					ConnectCode:  connectCode,
+					GuildID:      request.GuildID,
+					RegisteredAt: nowMs(),
+				}
+				status = http.StatusCreated
+			} else if game.GuildID != request.GuildID {
+				writeError(w, r, http.StatusConflict, ErrorCodeConflict, connectCode+" is registered on another guild")
+				return
+			}
+			// new games get their token here, and games registered before capture tokens existed on their next refresh
+			if game.CaptureToken == "" {
+				captureToken, err := newCaptureToken()
+				if err != nil {
+					log.Println(err)
+					writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to register the game")
+					return
+				}
+				game.CaptureToken = captureToken
+			}
+			game.ExpiresAt = nowMs() + ttl.Milliseconds()
+			if err := tokenProvider.saveGame(ctx, *game); err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to register the game")
+				return
+			}
+			writeJSON(w, status, game)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayEventsKey is the list of gateway events waiting for a worker, oldest first
+const GatewayEventsKey = "galactus:gateway:events"
+
+// DefaultGatewayEventsMaxLen bounds the queue while no worker is reading it
+const DefaultGatewayEventsMaxLen = 10000
+
+// DefaultGatewayEventDedupWindow covers a shard resuming, when Discord sends again the events it can't be sure were
+// received
+const DefaultGatewayEventDedupWindow = 5 * time.Minute
+
+// DefaultGatewayEventMaxAges are how long each type of event can wait before popGatewayEvent skips it. Interactions
+// have to be answered within 3 seconds of being sent, and a command answered a minute late only confuses; guild joins
+// and leaves are always delivered
+var DefaultGatewayEventMaxAges = map[string]time.Duration{
+	GatewayEventInteractionCreate: 3 * time.Second,
+	GatewayEventMessageCreate:     time.Minute,
+}
+
+// GatewayGuildCacheTTL is how long a guild's details are kept for enriching its guildDelete. They're refreshed whenever
+// the guild becomes available, so only guilds on shards that haven't reconnected in that long go without
+const GatewayGuildCacheTTL = 7 * 24 * time.Hour
+
+const (
+	// GatewayEventGuildCreate is forwarded when the bot joins a guild, not when its guilds become available on connect
+	GatewayEventGuildCreate = "guildCreate"
+	// GatewayEventGuildDelete is forwarded when the bot leaves or is removed from a guild, not during an outage
+	GatewayEventGuildDelete = "guildDelete"
+	// GatewayEventMessageCreate is a message sent in a guild, and needs the guildMessages intent
+	GatewayEventMessageCreate = "messageCreate"
+	// GatewayEventInteractionCreate is a slash command or component interaction, with Discord's interaction as its data
+	GatewayEventInteractionCreate = "interactionCreate"
+)
+
+// the fields guild events can be enriched with
+const (
+	GuildEventEnrichName        = "name"
+	GuildEventEnrichMemberCount = "memberCount"
+	GuildEventEnrichOwner       = "owner"
+)
+
+// gatewayEventsNone in either list forwards or adds nothing, rather than the defaults
+const gatewayEventsNone = "none"
+
+var DefaultGatewayEvents = []string{GatewayEventGuildCreate, GatewayEventGuildDelete}
+
+// SlashCommandGatewayEvents are the only events forwarded in slash-command-only mode
+var SlashCommandGatewayEvents = []string{GatewayEventInteractionCreate}
+
+var gatewayEventTypes = map[string]bool{
+	GatewayEventGuildCreate:       true,
+	GatewayEventGuildDelete:       true,
+	GatewayEventMessageCreate:     true,
+	GatewayEventInteractionCreate: true,
+}
+
+var guildEventEnrichFields = []string{GuildEventEnrichName, GuildEventEnrichMemberCount, GuildEventEnrichOwner}
+
+var (
+	gatewayEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_gateway_events_total",
+		Help: "Gateway events queued for the workers, by type",
+	}, []string{"type"})
+	gatewayEventsDeduplicatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_gateway_events_deduplicated_total",
+		Help: "Gateway events that weren't queued because Discord had already sent them, like after a shard resumed, by type",
+	}, []string{"type"})
+	staleGatewayEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_gateway_events_stale_total",
+		Help: "Gateway events skipped because they waited in the queue longer than their type's max age, by type",
+	}, []string{"type"})
+)
+
+// GuildEvent is the data of guildCreate and guildDelete events. Which of the other fields are set depends on
+// GATEWAY_EVENT_ENRICH, and on what galactus has cached; they're never fetched from Discord
+type GuildEvent struct {
+	GuildID     string        `json:"guildID"`
+	Name        string        `json:"name,omitempty"`
+	MemberCount int           `json:"memberCount,omitempty"`
+	OwnerID     string        `json:"ownerID,omitempty"`
+	Owner       *CachedMember `json:"owner,omitempty"`
+}
+
+// gatewayEventSettings are the events forwarded, the fields guild events are enriched with, and how much of each
+// guild's low-value events are forwarded unless its settings say otherwise
+type gatewayEventSettings struct {
+	forward        map[string]bool
+	enrich         map[string]bool
+	maxLen         int64
+	sampleRate     float64
+	guildPerMinute int64
+	// only messages starting with one of these, or a mention of the bot, are forwarded, unless a guild has its own
+	commandPrefixes []string
+	dedupWindow     time.Duration
+	maxAges         map[string]time.Duration
+}
+
+// gatewayEventList returns the named items, def if there are none, or none for gatewayEventsNone
+func gatewayEventList(names, def []string) []string {
+	if len(names) == 0 {
+		return def
+	}
+	if len(names) == 1 && names[0] == gatewayEventsNone {
+		return nil
+	}
+	return names
+}
+
+func newGatewayEventSettings(cfg config.GatewayEventsConfig, slashCommandsOnly bool) gatewayEventSettings {
+	s := gatewayEventSettings{
+		forward:        make(map[string]bool),
+		enrich:         make(map[string]bool),
+		maxLen:         DefaultGatewayEventsMaxLen,
+		sampleRate:     1,
+		guildPerMinute: cfg.GuildPerMinute,
+		dedupWindow:    DefaultGatewayEventDedupWindow,
+	}
+	if cfg.DedupWindow > 0 {
+		s.dedupWindow = time.Duration(cfg.DedupWindow)
+	}
+	if cfg.SampleRate != nil {
+		s.sampleRate = *cfg.SampleRate
+	}
+	for _, prefix := range cfg.CommandPrefixes {
+		if prefix != "" {
+			s.commandPrefixes = append(s.commandPrefixes, prefix)
+		}
+	}
+	defaults := DefaultGatewayEvents
+	if slashCommandsOnly {
+		defaults = SlashCommandGatewayEvents
+	}
+	for _, eventType := range gatewayEventList(cfg.Forward, defaults) {
+		s.forward[eventType] = true
+	}
+	for _, field := range gatewayEventList(cfg.Enrich, guildEventEnrichFields) {
+		s.enrich[field] = true
+	}
+	if cfg.MaxLen > 0 {
+		s.maxLen = cfg.MaxLen
+	}
+	s.maxAges = make(map[string]time.Duration, len(DefaultGatewayEventMaxAges))
+	for eventType, age := range DefaultGatewayEventMaxAges {
+		s.maxAges[eventType] = age
+	}
+	for name, age := range cfg.MaxAge {
+		if eventType, ok := gatewayEventType(name); ok {
+			s.maxAges[eventType] = time.Duration(age)
+		}
+	}
+	return s
+}
+
+// gatewayEventType returns the event type a name refers to, ignoring case and underscores, so GATEWAY_EVENT_MAX_AGE_*
+// can name types in upper case
+func gatewayEventType(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "_", "")
+	for eventType := range gatewayEventTypes {
+		if strings.EqualFold(name, eventType) {
+			return eventType, true
+		}
+	}
+	return "", false
+}
+
+// validateGatewayEvents checks the forwarded event types, the event types given Kafka topics and the enrichment fields,
+// like validateIntents
+func validateGatewayEvents(cfg config.Config) error {
+	check := func(env string, names []string, known func(string) bool) error {
+		for _, name := range names {
+			if name == gatewayEventsNone && len(names) > 1 {
+				return fmt.Errorf("%s can't combine %s with anything else", env, gatewayEventsNone)
+			}
+			if name != gatewayEventsNone && !known(name) {
+				return fmt.Errorf("unknown %s \"%s\"", env, name)
+			}
+		}
+		return nil
+	}
+	err := check("GATEWAY_EVENTS", cfg.GatewayEvents.Forward, func(name string) bool {
+		return gatewayEventTypes[name]
+	})
+	if err != nil {
+		return err
+	}
+	for _, eventType := range cfg.GatewayEvents.Forward {
+		if cfg.Intents.SlashCommandsOnly && eventType != GatewayEventInteractionCreate && eventType != gatewayEventsNone {
+			return fmt.Errorf("GATEWAY_EVENTS includes %s, but SLASH_COMMANDS_ONLY only forwards %s", eventType, GatewayEventInteractionCreate)
+		}
+		if eventType == GatewayEventMessageCreate && primaryIntents(cfg.Intents)&discordgo.IntentsGuildMessages == 0 {
+			return fmt.Errorf("GATEWAY_EVENTS includes %s, which needs the guildMessages intent in GATEWAY_INTENTS", eventType)
+		}
+	}
+	for name := range cfg.GatewayEvents.MaxAge {
+		if _, ok := gatewayEventType(name); !ok {
+			return fmt.Errorf("unknown gateway event \"%s\" in GATEWAY_EVENT_MAX_AGE", name)
+		}
+	}
+	for eventType := range cfg.EventSinks.Kafka.Topics {
+		if !gatewayEventTypes[eventType] {
+			return fmt.Errorf("unknown gateway event \"%s\" in EVENT_SINK_KAFKA_TOPICS", eventType)
+		}
+	}
+	return check("GATEWAY_EVENT_ENRICH", cfg.GatewayEvents.Enrich, func(name string) bool {
+		for _, field := range guildEventEnrichFields {
+			if name == field {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// pendingGuilds are the guilds a session will get a GuildCreate for without the bot joining them: the unavailable ones
+// listed in READY, and those that went unavailable since
+type pendingGuilds struct {
+	sync.Mutex
+	ids map[string]bool
+}
+
+func newPendingGuilds() *pendingGuilds {
+	return &pendingGuilds{ids: make(map[string]bool)}
+}
+
+func (pending *pendingGuilds) add(guildIDs ...string) {
+	pending.Lock()
+	defer pending.Unlock()
+	for _, guildID := range guildIDs {
+		pending.ids[guildID] = true
+	}
+}
+
+// remove returns whether the guild was pending
+func (pending *pendingGuilds) remove(guildID string) bool {
+	pending.Lock()
+	defer pending.Unlock()
+	ok := pending.ids[guildID]
+	delete(pending.ids, guildID)
+	return ok
+}
+
+// gatewayGuildKey holds what a guild's guildDelete is enriched with, since the session has forgotten the guild by then
+func gatewayGuildKey(guildID string) string {
+	return "galactus:gateway:guild:" + guildID
+}
+
+// pushGatewayEvent queues an event for the workers, dropping the oldest once the queue is full, and hands it to the
+// event sinks
+func (tokenProvider *TokenProvider) pushGatewayEvent(ctx context.Context, eventType, guildID, dedupID string, shardID int, data interface{}) {
+	if tokenProvider.duplicateGatewayEvent(ctx, eventType, dedupID) {
+		return
+	}
+	jData, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	event := api.GatewayEvent{
+		ID:      newRequestID(),
+		Type:    eventType,
+		GuildID: guildID,
+		ShardID: shardID,
+		Time:    nowMs(),
+		Data:    jData,
+	}
+	tokenProvider.eventSinks.send(event)
+	jBytes, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	pipe := tokenProvider.client.TxPipeline()
+	pipe.RPush(ctx, GatewayEventsKey, jBytes)
+	pipe.LTrim(ctx, GatewayEventsKey, -tokenProvider.getSettings().gatewayEvents.maxLen, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println(err)
+		return
+	}
+	gatewayEventsTotal.WithLabelValues(eventType).Inc()
+}
+
+func gatewayEventSeenKey(eventType, dedupID string) string {
+	return "galactus:gateway:seen:" + eventType + ":" + dedupID
+}
+
+// duplicateGatewayEvent reports whether an event with the same type and Discord ID was already queued within the dedup
+// window. Shards resuming after a reconnect, on this instance or another that took over its shards, are sent again the
+// events Discord can't be sure were received, and workers would otherwise handle them twice. Events without an ID
+// aren't deduplicated
+func (tokenProvider *TokenProvider) duplicateGatewayEvent(ctx context.Context, eventType, dedupID string) bool {
+	if dedupID == "" {
+		return false
+	}
+	window := tokenProvider.getSettings().gatewayEvents.dedupWindow
+	first, err := tokenProvider.client.SetNX(ctx, gatewayEventSeenKey(eventType, dedupID), 1, window).Result()
+	if err != nil {
+		// better a duplicate than a lost event
+		log.Println(err)
+		return false
+	}
+	if !first {
+		gatewayEventsDeduplicatedTotal.WithLabelValues(eventType).Inc()
+	}
+	return !first
+}
+
+// guildEvent enriches a guild event with the fields that are configured, from the guild itself and the member cache
+func (tokenProvider *TokenProvider) guildEvent(ctx context.Context, guild GuildEvent, members []*discordgo.Member) GuildEvent {
+	enrich := tokenProvider.getSettings().gatewayEvents.enrich
+	event := GuildEvent{GuildID: guild.GuildID}
+	if enrich[GuildEventEnrichName] {
+		event.Name = guild.Name
+	}
+	if enrich[GuildEventEnrichMemberCount] {
+		event.MemberCount = guild.MemberCount
+	}
+	if enrich[GuildEventEnrichOwner] && guild.OwnerID != "" {
+		event.OwnerID = guild.OwnerID
+		for _, member := range members {
+			if member != nil && member.User != nil && member.User.ID == guild.OwnerID {
+				owner := newCachedMember(member)
+				event.Owner = &owner
+				break
+			}
+		}
+		if event.Owner == nil {
+			event.Owner = tokenProvider.cachedMember(ctx, guild.GuildID, guild.OwnerID)
+		}
+	}
+	return event
+}
+
+// addGatewayEventHandlers forwards the primary bot's gateway events to the workers
+func (tokenProvider *TokenProvider) addGatewayEventHandlers(sess *discordgo.Session) {
+	sess.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		// the state keeps READY's guilds and fills them in as their GuildCreates arrive, under its lock
+		if s.State != nil {
+			s.State.RLock()
+			defer s.State.RUnlock()
+		}
+		guildIDs := make([]string, 0, len(r.Guilds))
+		for _, guild := range r.Guilds {
+			guildIDs = append(guildIDs, guild.ID)
+		}
+		tokenProvider.pendingGuilds.add(guildIDs...)
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildCreate) {
+		if m.Guild == nil || m.Unavailable {
+			return
+		}
+		joined := !tokenProvider.pendingGuilds.remove(m.ID)
+		forward := tokenProvider.getSettings().gatewayEvents.forward
+		guild := GuildEvent{GuildID: m.ID, Name: m.Name, MemberCount: m.MemberCount, OwnerID: m.OwnerID}
+		ctx := context.Background()
+		if forward[GatewayEventGuildDelete] {
+			jBytes, err := json.Marshal(guild)
+			if err == nil {
+				err = tokenProvider.client.Set(ctx, gatewayGuildKey(m.ID), jBytes, GatewayGuildCacheTTL).Err()
+			}
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		if joined {
+			// the bot leaving again isn't a duplicate of the last time it left
+			tokenProvider.client.Del(ctx, gatewayEventSeenKey(GatewayEventGuildDelete, m.ID))
+		}
+		if joined && forward[GatewayEventGuildCreate] {
+			// each join has its own joined_at, so rejoining isn't a duplicate either
+			dedupID := m.ID + ":" + string(m.JoinedAt)
+			tokenProvider.pushGatewayEvent(ctx, GatewayEventGuildCreate, m.ID, dedupID, s.ShardID, tokenProvider.guildEvent(ctx, guild, m.Members))
+		}
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildDelete) {
+		if m.Guild == nil {
+			return
+		}
+		if m.Unavailable {
+			tokenProvider.pendingGuilds.add(m.ID)
+			return
+		}
+		if !tokenProvider.getSettings().gatewayEvents.forward[GatewayEventGuildDelete] {
+			return
+		}
+		ctx := context.Background()
+		guild := GuildEvent{GuildID: m.ID}
+		pipe := tokenProvider.client.TxPipeline()
+		cached := pipe.Get(ctx, gatewayGuildKey(m.ID))
+		pipe.Del(ctx, gatewayGuildKey(m.ID))
+		pipe.Exec(ctx)
+		jBytes, err := cached.Bytes()
+		if err == nil {
+			err = json.Unmarshal(jBytes, &guild)
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			log.Println(err)
+		}
+		tokenProvider.pushGatewayEvent(ctx, GatewayEventGuildDelete, m.ID, m.ID, s.ShardID, tokenProvider.guildEvent(ctx, guild, nil))
+	})
+	tokenProvider.addMessageEventHandlers(sess)
+	tokenProvider.addInteractionEventHandlers(sess)
+}
+
+// addMessageEventHandlers forwards the primary bot's guild messages that could be commands, sampled for each guild
+func (tokenProvider *TokenProvider) addMessageEventHandlers(sess *discordgo.Session) {
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		settings := tokenProvider.getSettings().gatewayEvents
+		if m.Message == nil || m.GuildID == "" || !settings.forward[GatewayEventMessageCreate] {
+			return
+		}
+		ctx := context.Background()
+		guild := tokenProvider.loadGuildGatewaySettings(ctx, m.GuildID)
+		if !couldBeCommand(s, m.Message, guild.commandPrefixes(settings.commandPrefixes)) {
+			return
+		}
+		if !tokenProvider.sampleGatewayEvent(ctx, GatewayEventMessageCreate, m.GuildID, guild) {
+			return
+		}
+		tokenProvider.pushGatewayEvent(ctx, GatewayEventMessageCreate, m.GuildID, m.ID, s.ShardID, m.Message)
+	})
+}
+
+// interactionCreateEvent is the gateway's name for interactions, which this discordgo doesn't have a type for
+const interactionCreateEvent = "INTERACTION_CREATE"
+
+// addInteractionEventHandlers forwards the primary bot's interactions as Discord sent them. They're never sampled or
+// throttled, since each one is a user waiting on a response
+func (tokenProvider *TokenProvider) addInteractionEventHandlers(sess *discordgo.Session) {
+	sess.AddHandler(func(s *discordgo.Session, e *discordgo.Event) {
+		if e.Type != interactionCreateEvent || !tokenProvider.getSettings().gatewayEvents.forward[GatewayEventInteractionCreate] {
+			return
+		}
+		// empty for interactions in DMs
+		var interaction struct {
+			ID      string `json:"id"`
+			GuildID string `json:"guild_id"`
+		}
+		if err := json.Unmarshal(e.RawData, &interaction); err != nil {
+			log.Println(err)
+			return
+		}
+		tokenProvider.pushGatewayEvent(context.Background(), GatewayEventInteractionCreate, interaction.GuildID, interaction.ID, s.ShardID, e.RawData)
+	})
+}
+
+// popGatewayEvent returns the oldest queued gateway event, skipping any that are older than their type's max age, or
+// nil if there are none. Events replayed from an archive are delivered however old they are. Duplicates were already
+// dropped when they were pushed
+func (tokenProvider *TokenProvider) popGatewayEvent(ctx context.Context) (*api.GatewayEvent, error) {
+	maxAges := tokenProvider.getSettings().gatewayEvents.maxAges
+	for {
+		jBytes, err := tokenProvider.client.LPop(ctx, GatewayEventsKey).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var event api.GatewayEvent
+		if err := json.Unmarshal(jBytes, &event); err != nil {
+			return nil, err
+		}
+		maxAge := maxAges[event.Type]
+		if age := time.Duration(nowMs()-event.Time) * time.Millisecond; !event.Replayed && maxAge > 0 && age > maxAge {
+			log.Printf("Skipping %s gateway event %s that was queued %s ago\n", event.Type, event.ID, age)
+			staleGatewayEventsTotal.WithLabelValues(event.Type).Inc()
+			continue
+		}
+		return &event, nil
+	}
+}
+
+func (tokenProvider *TokenProvider) requestGatewayEventHandler(w http.ResponseWriter, r *http.Request) {
+	event, err := tokenProvider.popGatewayEvent(r.Context())
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to pop gateway event")
+		return
+	}
+	if event == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, event)
+}
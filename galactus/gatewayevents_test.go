@@ -0,0 +1,71 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestPopGatewayEventSkipsStaleEvents(t *testing.T) {
+	tokenProvider, _ := newTestTokenProvider(t, config.Config{})
+	ctx := context.Background()
+	now := nowMs()
+	queued := []api.GatewayEvent{
+		{ID: "late-interaction", Type: GatewayEventInteractionCreate, Time: now - 5000},
+		{ID: "late-message", Type: GatewayEventMessageCreate, Time: now - 2*time.Minute.Milliseconds()},
+		{ID: "old-guild", Type: GatewayEventGuildCreate, Time: now - time.Hour.Milliseconds()},
+		{ID: "replayed-interaction", Type: GatewayEventInteractionCreate, Time: now - time.Hour.Milliseconds(), Replayed: true},
+		{ID: "fresh-interaction", Type: GatewayEventInteractionCreate, Time: now},
+	}
+	for _, event := range queued {
+		jBytes, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tokenProvider.client.RPush(ctx, GatewayEventsKey, jBytes).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for {
+		event, err := tokenProvider.popGatewayEvent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event == nil {
+			break
+		}
+		got = append(got, event.ID)
+	}
+	want := []string{"old-guild", "replayed-interaction", "fresh-interaction"}
+	if len(got) != len(want) {
+		t.Fatalf("popped %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("popped %v, want %v", got, want)
+		}
+	}
+}
+
+// Discord sends an interaction again after a shard resumes; workers only get it once
+func TestPushGatewayEventDropsDuplicates(t *testing.T) {
+	tokenProvider, _ := newTestTokenProvider(t, config.Config{})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		tokenProvider.pushGatewayEvent(ctx, GatewayEventInteractionCreate, "1", "interaction-1", 0, map[string]string{"id": "interaction-1"})
+	}
+	tokenProvider.pushGatewayEvent(ctx, GatewayEventInteractionCreate, "1", "interaction-2", 0, map[string]string{"id": "interaction-2"})
+
+	n, err := tokenProvider.client.LLen(ctx, GatewayEventsKey).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("queued %d events, want the 2 distinct interactions", n)
+	}
+}
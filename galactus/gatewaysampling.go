@@ -0,0 +1,101 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"math/rand"
+)
+
+// lowValueGatewayEvents are sampled and throttled for each guild, so a chatty guild can't crowd the queue. Guild joins
+// and leaves are always forwarded
+var lowValueGatewayEvents = map[string]bool{
+	GatewayEventMessageCreate: true,
+}
+
+// why low-value events weren't forwarded
+const (
+	gatewayEventSampled   = "sampled"
+	gatewayEventThrottled = "throttled"
+)
+
+var gatewayEventsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_gateway_events_dropped_total",
+	Help: "Low-value gateway events that weren't forwarded, by type and reason (sampled or throttled)",
+}, []string{"type", "reason"})
+
+// GuildGatewayEventSettings are what a guild's settings can hold under "gatewayEvents" to override the global sampling
+// of its low-value events, like {"gatewayEvents": {"sampleRate": 0.1, "perMinute": 30}}
+type GuildGatewayEventSettings struct {
+	SampleRate *float64 `json:"sampleRate,omitempty"`
+	// PerMinute of 0 doesn't throttle the guild
+	PerMinute *int64 `json:"perMinute,omitempty"`
+}
+
+// gatewaySampling is how much of a guild's low-value events are forwarded
+type gatewaySampling struct {
+	sampleRate float64
+	perMinute  int64
+}
+
+func gatewaySamplingKey(guildID string) string {
+	return "galactus:ratelimit:gateway:" + guildID
+}
+
+// guildGatewaySettings are the parts of a guild's settings that change which of its events are forwarded
+type guildGatewaySettings struct {
+	GatewayEvents   GuildGatewayEventSettings `json:"gatewayEvents"`
+	CommandPrefix   string                    `json:"commandPrefix"`
+	CommandPrefixes []string                  `json:"commandPrefixes"`
+}
+
+// loadGuildGatewaySettings reads a guild's settings from the settings cache. Guilds without any, or with settings that
+// aren't shaped like this, just don't override anything
+func (tokenProvider *TokenProvider) loadGuildGatewaySettings(ctx context.Context, guildID string) guildGatewaySettings {
+	var guild guildGatewaySettings
+	settings, err := tokenProvider.guildSettings(ctx, guildID)
+	if err != nil {
+		log.Println(err)
+	} else if settings != nil {
+		json.Unmarshal(settings.Settings, &guild)
+	}
+	return guild
+}
+
+// sampling applies the guild's settings over the global sampling
+func (guild guildGatewaySettings) sampling(s gatewayEventSettings) gatewaySampling {
+	sampling := gatewaySampling{sampleRate: s.sampleRate, perMinute: s.guildPerMinute}
+	if rate := guild.GatewayEvents.SampleRate; rate != nil && *rate >= 0 && *rate <= 1 {
+		sampling.sampleRate = *rate
+	}
+	if perMinute := guild.GatewayEvents.PerMinute; perMinute != nil && *perMinute >= 0 {
+		sampling.perMinute = *perMinute
+	}
+	return sampling
+}
+
+// sampleGatewayEvent returns whether a guild's event should be forwarded. Like the other rate limits, events are let
+// through if Redis can't say
+func (tokenProvider *TokenProvider) sampleGatewayEvent(ctx context.Context, eventType, guildID string, guild guildGatewaySettings) bool {
+	if !lowValueGatewayEvents[eventType] || guildID == "" {
+		return true
+	}
+	sampling := guild.sampling(tokenProvider.getSettings().gatewayEvents)
+	if sampling.sampleRate < 1 && rand.Float64() >= sampling.sampleRate {
+		gatewayEventsDroppedTotal.WithLabelValues(eventType, gatewayEventSampled).Inc()
+		return false
+	}
+	if sampling.perMinute > 0 {
+		limit := RateLimit{PerSecond: float64(sampling.perMinute) / 60, Burst: sampling.perMinute}
+		allowed, _, _, err := takeToken(ctx, tokenProvider.client, gatewaySamplingKey(guildID), limit)
+		if err != nil {
+			log.Println(err)
+		} else if !allowed {
+			gatewayEventsDroppedTotal.WithLabelValues(eventType, gatewayEventThrottled).Inc()
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/galactuspb"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// JobPollInterval is how often SubscribeJobs checks the queue even without a notification, in case one was missed
+const JobPollInterval = time.Second * 5
+
+type grpcServer struct {
+	galactuspb.UnimplementedGalactusServer
+	tokenProvider *TokenProvider
+	config        ServerConfig
+}
+
+// grpcMethodRoles are the API key roles that can call each method, like the matching HTTP routes. Methods missing from
+// it need the admin role
+var grpcMethodRoles = map[string][]Role{
+	"/galactus.v1.Galactus/ModifyUsers":   botRoles,
+	"/galactus.v1.Galactus/PopJob":        workerRoles,
+	"/galactus.v1.Galactus/SubscribeJobs": workerRoles,
+}
+
+// RunGRPC serves the gRPC API on addr, alongside the HTTP API started by Run, with the same certificate, client CA and
+// API keys
+func (tokenProvider *TokenProvider) RunGRPC(config ServerConfig, addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(tokenProvider.grpcUnaryAuth(config)),
+		grpc.StreamInterceptor(tokenProvider.grpcStreamAuth(config)),
+	}
+	if config.useTLS() {
+		tlsConfig, err := config.grpcTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	galactuspb.RegisterGalactusServer(server, &grpcServer{tokenProvider: tokenProvider, config: config})
+
+	log.Println("Galactus gRPC service is running on " + addr + "...")
+	log.Fatal(server.Serve(lis))
+}
+
+// grpcRequiresAPIKeys is whether gRPC calls need an API key. Signing only covers the HTTP routes, so a deployment that
+// signs its requests gets API keys required on gRPC instead, unless mTLS already authenticates every gRPC client
+func (config ServerConfig) grpcRequiresAPIKeys() bool {
+	return config.RequireAPIKeys || (config.useSigning() && !config.useMTLS())
+}
+
+// grpcAuth checks the API key in the call's metadata against the method's roles, like requireRoles does for HTTP, and
+// returns the context carrying the key
+func (tokenProvider *TokenProvider) grpcAuth(ctx context.Context, config ServerConfig, method string) (context.Context, error) {
+	roles, ok := grpcMethodRoles[method]
+	if !ok {
+		roles = adminRoles
+	}
+	provided := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(api.APIKeyHeader); len(values) > 0 {
+			provided = values[0]
+		}
+	}
+	if provided == "" {
+		if config.grpcRequiresAPIKeys() {
+			return nil, status.Error(codes.Unauthenticated, "missing "+api.APIKeyHeader)
+		}
+		return ctx, nil
+	}
+	key, err := tokenProvider.lookupAPIKey(ctx, provided)
+	if err != nil {
+		log.Println(err)
+		return nil, status.Error(codes.Unavailable, "failed to check the API key")
+	}
+	if key == nil {
+		return nil, status.Error(codes.Unauthenticated, "unknown or revoked "+api.APIKeyHeader)
+	}
+	if !key.hasRole(roles) {
+		return nil, status.Error(codes.PermissionDenied, "this API key's roles can't call this method")
+	}
+	return context.WithValue(ctx, apiKeyContextKey, *key), nil
+}
+
+func (tokenProvider *TokenProvider) grpcUnaryAuth(config ServerConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := tokenProvider.grpcAuth(ctx, config, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authedServerStream hands the stream's handler the context carrying its API key
+type authedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream authedServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (tokenProvider *TokenProvider) grpcStreamAuth(config ServerConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := tokenProvider.grpcAuth(stream.Context(), config, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, authedServerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func (s *grpcServer) ModifyUsers(ctx context.Context, req *galactuspb.ModifyUsersRequest) (*galactuspb.ModifyUsersResponse, error) {
+	gid, err := strconv.ParseUint(req.GuildId, 10, 64)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid guild_id")
+	}
+	if s.tokenProvider.outage.isActive() {
+		return nil, status.Error(codes.Unavailable, ErrorCodeDiscordOutage)
+	}
+	// bounded like the HTTP route, so the users still waiting when it passes come back in TimedOut
+	ctx, cancel := context.WithTimeout(ctx, s.config.RequestTimeout)
+	defer cancel()
+	if s.tokenProvider.guildDenied(ctx, req.GuildId) {
+		return nil, status.Error(codes.PermissionDenied, ErrorCodeGuildDenied)
+	}
+
+	userModifications := task.UserModifyRequest{
+		Premium: premium.Tier(req.Premium),
+		Users:   make([]task.UserModify, len(req.Users)),
+	}
+	for i, u := range req.Users {
+		userModifications.Users[i] = task.UserModify{
+			UserID: u.UserId,
+			Mute:   u.Mute,
+			Deaf:   u.Deaf,
+		}
+	}
+
+	if errs := validateUserModifyRequest(userModifications, ""); len(errs) > 0 {
+		return nil, status.Error(codes.InvalidArgument, validationMessage(errs))
+	}
+
+	release, quotaErr := s.tokenProvider.acquireGuildQuota(ctx, req.GuildId, s.tokenProvider.guildTier(ctx, req.GuildId))
+	if quotaErr != nil {
+		return nil, status.Error(codes.ResourceExhausted, quotaErr.Error())
+	}
+	defer release()
+
+	resp := s.tokenProvider.modifyUsers(ctx, req.GuildId, gid, req.ConnectCode, userModifications, time.Time{})
+	return modifyResponseToProto(resp), nil
+}
+
+func (s *grpcServer) PopJob(ctx context.Context, req *galactuspb.PopJobRequest) (*galactuspb.PopJobResponse, error) {
+	job, err := s.tokenProvider.popJob(ctx, req.ConnectCode)
+	if err != nil {
+		log.Println(err)
+		return nil, status.Error(codes.Unavailable, "failed to pop job")
+	}
+	if job == nil {
+		return &galactuspb.PopJobResponse{}, nil
+	}
+	return &galactuspb.PopJobResponse{Job: jobcodec.ToProto(*job)}, nil
+}
+
+// SubscribeJobs drains the queue for the connect code, then waits for the broker's notification that a new job was
+// pushed, instead of the worker polling for jobs
+func (s *grpcServer) SubscribeJobs(req *galactuspb.SubscribeJobsRequest, stream galactuspb.Galactus_SubscribeJobsServer) error {
+	ctx := stream.Context()
+	pubsub := s.tokenProvider.client.Subscribe(ctx, rediskey.JobNamespace+req.ConnectCode+":notify")
+	defer pubsub.Close()
+	notifications := pubsub.Channel()
+
+	ticker := time.NewTicker(JobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job, err := s.tokenProvider.popJob(ctx, req.ConnectCode)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Println(err)
+				return status.Error(codes.Unavailable, "failed to pop job")
+			}
+			if job == nil {
+				break
+			}
+			err = stream.Send(jobcodec.ToProto(*job))
+			if err != nil {
+				// the job is lost to this subscriber, but it's already popped; nothing more we can do
+				log.Println(err)
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-notifications:
+		case <-ticker.C:
+		}
+	}
+}
+
+func modifyResponseToProto(resp api.ModifyResponse) *galactuspb.ModifyUsersResponse {
+	errs := make([]*galactuspb.UserModifyError, len(resp.Errors))
+	for i, e := range resp.Errors {
+		errs[i] = &galactuspb.UserModifyError{
+			UserId:  e.UserID,
+			Code:    string(e.Code),
+			Message: e.Message,
+		}
+	}
+	return &galactuspb.ModifyUsersResponse{
+		Worker:     resp.Worker,
+		Capture:    resp.Capture,
+		Official:   resp.Official,
+		RateLimit:  resp.RateLimit,
+		Errors:     errs,
+		Superseded: resp.Superseded,
+		TimedOut:   resp.TimedOut,
+	}
+}
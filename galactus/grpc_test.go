@@ -0,0 +1,23 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// signing only covers HTTP, so a signed deployment mustn't take unauthenticated mutes over gRPC
+func TestGRPCAuthRequiresAPIKeysWithSigning(t *testing.T) {
+	tokenProvider, _ := newTestTokenProvider(t, config.Config{})
+	method := "/galactus.v1.Galactus/ModifyUsers"
+
+	if _, err := tokenProvider.grpcAuth(context.Background(), ServerConfig{}, method); err != nil {
+		t.Fatalf("got %v without signing or required keys, want the call let through", err)
+	}
+	_, err := tokenProvider.grpcAuth(context.Background(), ServerConfig{SigningSecret: "secret"}, method)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v with signing on and no API key, want %s", err, codes.Unauthenticated)
+	}
+}
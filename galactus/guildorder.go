@@ -0,0 +1,100 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/utils/pkg/task"
+	"sync"
+)
+
+// guildSequencer applies the modify requests for a guild one at a time, in the order they arrived. A request also
+// supersedes any earlier request's pending change for the same user, since automuteus only cares about the latest
+// state; on a quick phase flip, the stale mute is skipped rather than applied after the unmute
+type guildSequencer struct {
+	guilds map[string]*guildSequence
+	lock   sync.Mutex
+}
+
+type guildSequence struct {
+	// closed when the most recently queued request for the guild finishes
+	tail chan struct{}
+	next uint64
+	// user ID -> the sequence number of the latest request that modifies them
+	latest map[uint64]uint64
+}
+
+// guildTurn is one request's place in its guild's sequence
+type guildTurn struct {
+	sequencer *guildSequencer
+	guildID   string
+	seq       uint64
+	prev      <-chan struct{}
+	done      chan struct{}
+}
+
+func newGuildSequencer() *guildSequencer {
+	return &guildSequencer{
+		guilds: make(map[string]*guildSequence),
+	}
+}
+
+// enqueue takes the next turn for the guild, claiming each of the request's users
+func (sequencer *guildSequencer) enqueue(guildID string, users []task.UserModify) *guildTurn {
+	sequencer.lock.Lock()
+	defer sequencer.lock.Unlock()
+
+	seq, ok := sequencer.guilds[guildID]
+	if !ok {
+		tail := make(chan struct{})
+		close(tail)
+		seq = &guildSequence{
+			tail:   tail,
+			latest: make(map[uint64]uint64),
+		}
+		sequencer.guilds[guildID] = seq
+	}
+	seq.next++
+	turn := &guildTurn{
+		sequencer: sequencer,
+		guildID:   guildID,
+		seq:       seq.next,
+		prev:      seq.tail,
+		done:      make(chan struct{}),
+	}
+	seq.tail = turn.done
+	for _, user := range users {
+		seq.latest[user.UserID] = turn.seq
+	}
+	return turn
+}
+
+// wait blocks until every earlier request for the guild has finished. If the context ends first, the turn is given
+// up; later requests still wait for the earlier ones
+func (turn *guildTurn) wait(ctx context.Context) error {
+	select {
+	case <-turn.prev:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-turn.prev
+			turn.finish()
+		}()
+		return ctx.Err()
+	}
+}
+
+// superseded returns true if a later request for the guild also modifies the user
+func (turn *guildTurn) superseded(userID uint64) bool {
+	turn.sequencer.lock.Lock()
+	defer turn.sequencer.lock.Unlock()
+	return turn.sequencer.guilds[turn.guildID].latest[userID] > turn.seq
+}
+
+// finish hands the guild to the next request, forgetting the guild if no other request is queued
+func (turn *guildTurn) finish() {
+	turn.sequencer.lock.Lock()
+	defer turn.sequencer.lock.Unlock()
+	close(turn.done)
+	if seq, ok := turn.sequencer.guilds[turn.guildID]; ok && seq.tail == turn.done {
+		delete(turn.sequencer.guilds, turn.guildID)
+	}
+}
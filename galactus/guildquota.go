@@ -0,0 +1,170 @@
+package galactus
+
+import (
+	"context"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultGuildModifiesPerMinute covers several games on one guild changing phase every few seconds
+	DefaultGuildModifiesPerMinute = 120
+	// DefaultGuildConcurrentModifies is how many of a guild's modify requests can wait on each other at once; they're
+	// applied one at a time anyway
+	DefaultGuildConcurrentModifies = 10
+
+	// guildQuotaSlotTTL is how long an in-flight slot is held for a request without a deadline, if it's never released
+	guildQuotaSlotTTL = 5 * time.Minute
+)
+
+const ErrorCodeGuildQuotaExceeded = "GUILD_QUOTA_EXCEEDED"
+
+const (
+	guildQuotaRate        = "rate"
+	guildQuotaConcurrency = "concurrency"
+)
+
+var guildQuotaExceededTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_guild_quota_exceeded_total",
+	Help: "Modify requests turned away for exceeding their guild's quota, by quota (rate or concurrency)",
+}, []string{"quota"})
+
+// guildQuota is how many modify requests a guild can make; 0 disables either limit
+type guildQuota struct {
+	perMinute  int64
+	concurrent int64
+}
+
+// guildQuotas applies the configured quota, then each tier's overrides, to the defaults
+func guildQuotas(cfg config.GuildQuotaConfig) map[premium.Tier]guildQuota {
+	apply := func(quota guildQuota, override config.GuildQuota) guildQuota {
+		if override.PerMinute != nil {
+			quota.perMinute = *override.PerMinute
+		}
+		if override.Concurrent != nil {
+			quota.concurrent = *override.Concurrent
+		}
+		return quota
+	}
+	base := apply(guildQuota{
+		perMinute:  DefaultGuildModifiesPerMinute,
+		concurrent: DefaultGuildConcurrentModifies,
+	}, cfg.GuildQuota)
+	quotas := make(map[premium.Tier]guildQuota)
+	for tier := premium.FreeTier; tier <= premium.SelfHostTier; tier++ {
+		quotas[tier] = apply(base, cfg.Tiers[tier])
+	}
+	return quotas
+}
+
+func guildQuotaRateKey(guildID string) string {
+	return "galactus:quota:guild:" + guildID + ":rate"
+}
+
+func guildQuotaConcurrencyKey(guildID string) string {
+	return "galactus:quota:guild:" + guildID + ":inflight"
+}
+
+// holds a slot for a request in a guild's set of in-flight requests, unless it's full. Slots older than ARGV[3] belong
+// to requests whose instance died without releasing them.
+// Returns {acquired, slots in use}
+var guildConcurrencyScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[3])
+local inflight = redis.call("ZCARD", KEYS[1])
+if inflight >= limit then
+	return {0, inflight}
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+return {1, inflight + 1}
+`)
+
+// guildQuotaError describes the quota a request exceeded
+type guildQuotaError struct {
+	quota      string
+	limit      int64
+	retryAfter time.Duration
+	message    string
+}
+
+func (err *guildQuotaError) Error() string {
+	return err.message
+}
+
+// acquireGuildQuota counts a modify request against its guild's quota, returning a func to call once it's done, or why
+// it's over the quota. Like the other rate limits, requests are let through if Redis is unavailable
+func (tokenProvider *TokenProvider) acquireGuildQuota(ctx context.Context, guildID string, tier premium.Tier) (func(), *guildQuotaError) {
+	quota := tokenProvider.getSettings().guildQuotas[tier]
+	release := func() {}
+
+	if quota.perMinute > 0 {
+		limit := RateLimit{PerSecond: float64(quota.perMinute) / 60, Burst: quota.perMinute}
+		allowed, _, wait, err := takeToken(ctx, tokenProvider.client, guildQuotaRateKey(guildID), limit)
+		if err != nil {
+			log.Println(err)
+		} else if !allowed {
+			guildQuotaExceededTotal.WithLabelValues(guildQuotaRate).Inc()
+			return release, &guildQuotaError{
+				quota:      guildQuotaRate,
+				limit:      quota.perMinute,
+				retryAfter: wait,
+				message: fmt.Sprintf("guild %s is over its quota of %d modify requests a minute on premium tier %d; retry in %ds",
+					guildID, quota.perMinute, tier, int64(math.Ceil(wait.Seconds()))),
+			}
+		}
+	}
+
+	if quota.concurrent > 0 {
+		key := guildQuotaConcurrencyKey(guildID)
+		slot := newRequestID()
+		now := time.Now()
+		// a request can't outlive its deadline by much, so an older slot was never released
+		stale := guildQuotaSlotTTL
+		if deadline, ok := ctx.Deadline(); ok {
+			stale = 2*time.Until(deadline) + time.Second
+		}
+		res, err := guildConcurrencyScript.Run(ctx, tokenProvider.client, []string{key},
+			quota.concurrent, now.UnixNano()/int64(time.Millisecond), now.Add(-stale).UnixNano()/int64(time.Millisecond),
+			slot, stale.Milliseconds()).Result()
+		vals, ok := res.([]interface{})
+		if err != nil || !ok || len(vals) != 2 {
+			log.Println("Failed to check the guild concurrency quota:", err)
+			return release, nil
+		}
+		if acquired, _ := vals[0].(int64); acquired != 1 {
+			guildQuotaExceededTotal.WithLabelValues(guildQuotaConcurrency).Inc()
+			return release, &guildQuotaError{
+				quota:      guildQuotaConcurrency,
+				limit:      quota.concurrent,
+				retryAfter: time.Second,
+				message: fmt.Sprintf("guild %s already has %d modify requests in flight, its quota on premium tier %d; retry once one finishes",
+					guildID, quota.concurrent, tier),
+			}
+		}
+		release = func() {
+			// the request's context may be done by now
+			if err := tokenProvider.client.ZRem(context.Background(), key, slot).Err(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return release, nil
+}
+
+// writeGuildQuotaError responds with a 429 naming the quota and when to retry
+func writeGuildQuotaError(w http.ResponseWriter, r *http.Request, err *guildQuotaError) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(err.retryAfter.Seconds())), 10))
+	w.Header().Set("X-Guild-Quota", err.quota)
+	w.Header().Set("X-Guild-Quota-Limit", strconv.FormatInt(err.limit, 10))
+	writeError(w, r, http.StatusTooManyRequests, ErrorCodeGuildQuotaExceeded, err.message)
+}
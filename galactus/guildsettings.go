@@ -0,0 +1,236 @@
+package galactus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// GuildSettingsCacheTTL bounds how stale a guild's cached settings can get if its invalidation is missed, like
+	// while the pubsub connection is down
+	GuildSettingsCacheTTL = 5 * time.Minute
+
+	// published with the guild ID whenever a guild's settings change, so every instance drops its cached copy
+	guildSettingsInvalidateChannel = "galactus:guild:settings:invalidate"
+)
+
+// guildSettingsKey holds a guild's settings when there's no storage to keep them in
+func guildSettingsKey(guildID string) string {
+	return "galactus:guild:settings:" + guildID
+}
+
+var guildSettingsCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_guild_settings_cache_total",
+	Help: "Guild settings reads, by whether they were served from the cache (hit) or loaded from storage (miss)",
+}, []string{"result"})
+
+type cachedGuildSettings struct {
+	// settings is nil for a guild without any, so those aren't loaded again either
+	settings *api.GuildSettings
+	fetched  time.Time
+}
+
+// guildSettingsCache is this instance's copy of the guild settings read through it
+type guildSettingsCache struct {
+	sync.Mutex
+	entries map[string]cachedGuildSettings
+	// version changes on every invalidation, so a load that raced one isn't cached
+	version uint64
+	pruned  time.Time
+}
+
+func newGuildSettingsCache() *guildSettingsCache {
+	return &guildSettingsCache{entries: make(map[string]cachedGuildSettings)}
+}
+
+// get returns the cached settings of a guild, and whether there were any, along with the version to store a load with
+func (cache *guildSettingsCache) get(guildID string) (*api.GuildSettings, bool, uint64) {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[guildID]
+	if ok && time.Since(entry.fetched) > GuildSettingsCacheTTL {
+		delete(cache.entries, guildID)
+		ok = false
+	}
+	return entry.settings, ok, cache.version
+}
+
+// put caches settings loaded at version, unless they were invalidated since
+func (cache *guildSettingsCache) put(guildID string, settings *api.GuildSettings, version uint64) {
+	cache.Lock()
+	defer cache.Unlock()
+	if version != cache.version {
+		return
+	}
+	now := time.Now()
+	if now.Sub(cache.pruned) > GuildSettingsCacheTTL {
+		for id, entry := range cache.entries {
+			if now.Sub(entry.fetched) > GuildSettingsCacheTTL {
+				delete(cache.entries, id)
+			}
+		}
+		cache.pruned = now
+	}
+	cache.entries[guildID] = cachedGuildSettings{settings: settings, fetched: now}
+}
+
+func (cache *guildSettingsCache) invalidate(guildID string) {
+	cache.Lock()
+	defer cache.Unlock()
+	delete(cache.entries, guildID)
+	cache.version++
+}
+
+// guildSettings returns a guild's settings, or nil if it has none, reading through this instance's cache
+func (tokenProvider *TokenProvider) guildSettings(ctx context.Context, guildID string) (*api.GuildSettings, error) {
+	settings, ok, version := tokenProvider.guildSettingsCache.get(guildID)
+	if ok {
+		guildSettingsCacheTotal.WithLabelValues("hit").Inc()
+		return settings, nil
+	}
+	guildSettingsCacheTotal.WithLabelValues("miss").Inc()
+	settings, err := tokenProvider.loadGuildSettings(ctx, guildID)
+	if err != nil {
+		return nil, err
+	}
+	tokenProvider.guildSettingsCache.put(guildID, settings, version)
+	return settings, nil
+}
+
+// loadGuildSettings reads a guild's settings from storage, or Redis without it
+func (tokenProvider *TokenProvider) loadGuildSettings(ctx context.Context, guildID string) (*api.GuildSettings, error) {
+	if tokenProvider.storage != nil {
+		return tokenProvider.storage.GuildSettings(ctx, guildID)
+	}
+	jBytes, err := tokenProvider.client.Get(ctx, guildSettingsKey(guildID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var settings api.GuildSettings
+	if err := json.Unmarshal(jBytes, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (tokenProvider *TokenProvider) storeGuildSettings(ctx context.Context, settings api.GuildSettings) error {
+	if tokenProvider.storage != nil {
+		return tokenProvider.storage.SetGuildSettings(ctx, settings)
+	}
+	jBytes, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return tokenProvider.client.Set(ctx, guildSettingsKey(settings.GuildID), jBytes, 0).Err()
+}
+
+// deleteGuildSettings returns whether the guild had any settings
+func (tokenProvider *TokenProvider) deleteGuildSettings(ctx context.Context, guildID string) (bool, error) {
+	if tokenProvider.storage != nil {
+		return tokenProvider.storage.DeleteGuildSettings(ctx, guildID)
+	}
+	deleted, err := tokenProvider.client.Del(ctx, guildSettingsKey(guildID)).Result()
+	return deleted > 0, err
+}
+
+// invalidateGuildSettings drops a guild's cached settings here, then on every other instance
+func (tokenProvider *TokenProvider) invalidateGuildSettings(ctx context.Context, guildID string) error {
+	tokenProvider.guildSettingsCache.invalidate(guildID)
+	return tokenProvider.client.Publish(ctx, guildSettingsInvalidateChannel, guildID).Err()
+}
+
+// watchGuildSettings drops cached settings whenever any galactus instance changes them
+func (tokenProvider *TokenProvider) watchGuildSettings(ctx context.Context) {
+	pubsub := tokenProvider.client.Subscribe(ctx, guildSettingsInvalidateChannel)
+	defer pubsub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			tokenProvider.guildSettingsCache.invalidate(msg.Payload)
+		}
+	}
+}
+
+// guildSettingsHandler returns (GET), replaces (PUT) or deletes (DELETE) a guild's settings. Writes invalidate every
+// instance's cached copy, so workers never read settings older than the last write for long
+func (tokenProvider *TokenProvider) guildSettingsHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		guildID := mux.Vars(r)["guildID"]
+		if _, err := strconv.ParseUint(guildID, 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "guildID must be a snowflake")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		switch r.Method {
+		case http.MethodGet:
+			settings, err := tokenProvider.guildSettings(ctx, guildID)
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the guild's settings")
+				return
+			}
+			if settings == nil {
+				writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no settings are stored for guild "+guildID)
+				return
+			}
+			writeJSON(w, http.StatusOK, settings)
+
+		case http.MethodDelete:
+			deleted, err := tokenProvider.deleteGuildSettings(ctx, guildID)
+			if err == nil {
+				err = tokenProvider.invalidateGuildSettings(ctx, guildID)
+			}
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to delete the guild's settings")
+				return
+			}
+			if !deleted {
+				writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no settings are stored for guild "+guildID)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			var raw json.RawMessage
+			if !readJSONBody(w, r, config, &raw) {
+				return
+			}
+			if raw = bytes.TrimSpace(raw); len(raw) == 0 || raw[0] != '{' {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "settings must be a JSON object")
+				return
+			}
+			settings := api.GuildSettings{GuildID: guildID, Settings: raw, UpdatedAt: time.Now().UTC()}
+			err := tokenProvider.storeGuildSettings(ctx, settings)
+			if err == nil {
+				err = tokenProvider.invalidateGuildSettings(ctx, guildID)
+			}
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to store the guild's settings")
+				return
+			}
+			writeJSON(w, http.StatusOK, settings)
+		}
+	}
+}
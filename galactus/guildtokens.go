@@ -0,0 +1,177 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/redisutil"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultGuildTokenReconcileInterval = time.Hour
+
+// StaleTokenQueueSize is how many stale guild tokens can wait to be removed; more are dropped until the queue drains,
+// and removed once a later request finds them again
+const StaleTokenQueueSize = 1024
+
+// staleGuildToken is a secondary token in a guild's token set that has no session
+type staleGuildToken struct {
+	guildID string
+	hToken  string
+}
+
+// guildDelete removes the association between a secondary token and a guild the bot was kicked from or left
+func (tokenProvider *TokenProvider) guildDelete(hashedToken string) func(s *discordgo.Session, m *discordgo.GuildDelete) {
+	return func(s *discordgo.Session, m *discordgo.GuildDelete) {
+		// an unavailable guild is a Discord outage, not a removal; it'll come back with a GuildCreate
+		if m.Guild == nil || m.Unavailable {
+			return
+		}
+		err := tokenProvider.client.SRem(ctx, rediskey.GuildTokensKey(m.ID), hashedToken).Err()
+		if err != nil {
+			log.Println(err)
+		} else {
+			log.Println("Token removed for departed guild " + m.ID)
+		}
+		tokenProvider.permissions.set(hashedToken, m.ID, 0)
+	}
+}
+
+// ReconcileGuildTokensPeriodically makes the guild token sets in Redis match the guilds each secondary session is
+// actually in, catching any GuildCreate or GuildDelete that was missed while galactus was down. Every instance opens
+// every secondary session, so only the leader reconciles
+func (tokenProvider *TokenProvider) ReconcileGuildTokensPeriodically(interval time.Duration) {
+	tokenProvider.leader.runSingleton("reconcile guild tokens", interval, func() {
+		tokenProvider.reconcileGuildTokens(context.Background())
+	})
+}
+
+func (tokenProvider *TokenProvider) reconcileGuildTokens(ctx context.Context) {
+	// hashed token -> the guilds its session is in
+	sessionGuilds := make(map[string]map[string]bool)
+	for hToken, sess := range tokenProvider.sessions.snapshot() {
+		guilds := make(map[string]bool)
+		sess.State.RLock()
+		for _, guild := range sess.State.Guilds {
+			guilds[guild.ID] = true
+		}
+		sess.State.RUnlock()
+		sessionGuilds[hToken] = guilds
+	}
+
+	keys, err := redisutil.ScanKeys(ctx, tokenProvider.client, rediskey.GuildTokensKey("*"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	removed, added := 0, 0
+	// hashed token -> the guilds Redis associates it with
+	redisGuilds := make(map[string]map[string]bool)
+	for _, key := range keys {
+		guildID := strings.TrimPrefix(key, rediskey.GuildTokensKey(""))
+		hTokens, err := tokenProvider.client.SMembers(ctx, key).Result()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, hToken := range hTokens {
+			guilds, ok := sessionGuilds[hToken]
+			// tokens without a session on this instance are removed by RemoveStaleTokens once a request finds them
+			if !ok {
+				continue
+			}
+			if !guilds[guildID] {
+				err := tokenProvider.client.SRem(ctx, key, hToken).Err()
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				tokenProvider.permissions.set(hToken, guildID, 0)
+				removed++
+				continue
+			}
+			if redisGuilds[hToken] == nil {
+				redisGuilds[hToken] = make(map[string]bool)
+			}
+			redisGuilds[hToken][guildID] = true
+		}
+	}
+
+	for hToken, guilds := range sessionGuilds {
+		for guildID := range guilds {
+			if redisGuilds[hToken][guildID] {
+				continue
+			}
+			err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(guildID), hToken).Err()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			added++
+		}
+	}
+	log.Printf("Reconciled guild tokens; removed %d stale and added %d missing associations\n", removed, added)
+}
+
+// queueStaleToken hands a guild's stale token to RemoveStaleTokens without waiting
+func (tokenProvider *TokenProvider) queueStaleToken(guildID, hToken string) {
+	select {
+	case tokenProvider.staleTokens <- staleGuildToken{guildID: guildID, hToken: hToken}:
+	default:
+	}
+}
+
+// RemoveStaleTokens removes the queued stale tokens from their guilds' token sets in Redis, in batches of whatever has
+// queued up while the last batch was removed
+func (tokenProvider *TokenProvider) RemoveStaleTokens() {
+	for stale := range tokenProvider.staleTokens {
+		// the same token is usually queued by several requests on its guild
+		batch := map[staleGuildToken]bool{stale: true}
+	drain:
+		for {
+			select {
+			case stale := <-tokenProvider.staleTokens:
+				batch[stale] = true
+			default:
+				break drain
+			}
+		}
+		tokenProvider.removeStaleTokens(context.Background(), batch)
+	}
+}
+
+func (tokenProvider *TokenProvider) removeStaleTokens(ctx context.Context, batch map[staleGuildToken]bool) {
+	pipe := tokenProvider.client.Pipeline()
+	queued := 0
+	for stale := range batch {
+		// the token may have been added again since it was queued
+		if _, ok := tokenProvider.sessions.get(stale.hToken); ok {
+			continue
+		}
+		pipe.SRem(ctx, rediskey.GuildTokensKey(stale.guildID), stale.hToken)
+		queued++
+	}
+	if queued == 0 {
+		return
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Removed %d stale guild tokens\n", queued)
+}
+
+func GuildTokenReconcileIntervalFromEnv() time.Duration {
+	interval := DefaultGuildTokenReconcileInterval
+	num, err := strconv.ParseInt(os.Getenv("GUILD_TOKEN_RECONCILE_INTERVAL_SEC"), 10, 64)
+	if err == nil && num > 0 {
+		log.Printf("Read from env; using GUILD_TOKEN_RECONCILE_INTERVAL_SEC=%d\n", num)
+		interval = time.Second * time.Duration(num)
+	}
+	return interval
+}
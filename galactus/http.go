@@ -0,0 +1,227 @@
+package galactus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/config"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultReadTimeout = time.Second * 10
+
+// DefaultWriteTimeout has to be long enough for a /modify request to wait on capture bot acks for every user
+const DefaultWriteTimeout = time.Second * 30
+const DefaultIdleTimeout = time.Second * 120
+
+// DefaultRequestTimeout bounds the Redis and Discord work done on behalf of a single request
+const DefaultRequestTimeout = time.Second * 25
+const DefaultMaxBodyBytes int64 = 1 << 20
+
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errTrailingData = errors.New("unexpected data after the JSON body")
+)
+
+const (
+	ErrorCodeBodyTooLarge  = "BODY_TOO_LARGE"
+	ErrorCodeInvalidJSON   = "INVALID_JSON"
+	ErrorCodeUnprocessable = "UNPROCESSABLE_ENTITY"
+)
+
+type ServerConfig struct {
+	// Addr is the full bind address, like ":5858" or "127.0.0.1:5858"
+	Addr string
+
+	// if both are provided, the server is started with TLS
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables mTLS: the worker and admin routes require client certificates signed by this CA
+	TLSClientCAFile string
+
+	// SigningSecret lets requests signed with it through to the worker and admin routes, as an alternative to mTLS.
+	// Their timestamps can be up to SigningWindow away from now
+	SigningSecret string
+	SigningWindow time.Duration
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// RequestTimeout is the deadline placed on the context of each request
+	RequestTimeout time.Duration
+
+	// MaxBodyBytes limits the size of request bodies
+	MaxBodyBytes int64
+	// StrictJSON rejects JSON bodies with fields galactus doesn't know
+	StrictJSON bool
+
+	// AdminAPIKey is required on /admin requests, unless they carry an API key with the admin role. If empty, the admin
+	// endpoints aren't served
+	AdminAPIKey string
+	// RequireAPIKeys turns away requests without an API key from every route but the public ones
+	RequireAPIKeys bool
+
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are kept for replay
+	IdempotencyTTL time.Duration
+
+	// DiscordProxy serves the Discord REST proxy under DiscordProxyPrefix
+	DiscordProxy bool
+
+	// JobQueueHighWater is reported by /jobs; the broker drops low-priority jobs above it
+	JobQueueHighWater int64
+
+	// CORS lets browser dashboards on other origins call the API
+	CORS config.CORSConfig
+
+	// reported by /version
+	BuildInfo BuildInfo
+	// Features are enabled outside the HTTP server, like "grpc"; the server adds its own
+	Features []string
+}
+
+// NewServerConfig builds the HTTP server's config from galactus' config. Zero timeouts and limits use the defaults
+func NewServerConfig(cfg config.Config, port string) ServerConfig {
+	serverConfig := ServerConfig{
+		Addr:           cfg.BindAddr + ":" + port,
+		TLSCertFile:    cfg.HTTP.TLSCertFile,
+		TLSKeyFile:     cfg.HTTP.TLSKeyFile,
+		ReadTimeout:    DefaultReadTimeout,
+		WriteTimeout:   DefaultWriteTimeout,
+		IdleTimeout:    DefaultIdleTimeout,
+		RequestTimeout: DefaultRequestTimeout,
+		MaxBodyBytes:   DefaultMaxBodyBytes,
+		AdminAPIKey:    os.Getenv("ADMIN_API_KEY"),
+		RequireAPIKeys: os.Getenv("API_KEYS_REQUIRED") == "true",
+		IdempotencyTTL: IdempotencyTTLFromEnv(),
+		DiscordProxy:   os.Getenv("DISCORD_PROXY_ENABLED") == "true",
+
+		JobQueueHighWater: cfg.JobQueueHighWaterOrDefault(),
+		CORS:              cfg.CORS,
+		TLSClientCAFile:   cfg.HTTP.TLSClientCAFile,
+		SigningSecret:     cfg.RequestSigning.Secret,
+		SigningWindow:     DefaultSigningWindow,
+	}
+	if cfg.HTTP.ReadTimeout > 0 {
+		serverConfig.ReadTimeout = time.Duration(cfg.HTTP.ReadTimeout)
+	}
+	if cfg.HTTP.WriteTimeout > 0 {
+		serverConfig.WriteTimeout = time.Duration(cfg.HTTP.WriteTimeout)
+	}
+	if cfg.HTTP.IdleTimeout > 0 {
+		serverConfig.IdleTimeout = time.Duration(cfg.HTTP.IdleTimeout)
+	}
+	if cfg.HTTP.RequestTimeout > 0 {
+		serverConfig.RequestTimeout = time.Duration(cfg.HTTP.RequestTimeout)
+	}
+	if cfg.RequestSigning.Window > 0 {
+		serverConfig.SigningWindow = time.Duration(cfg.RequestSigning.Window)
+	}
+	if cfg.HTTP.MaxBodyBytes > 0 {
+		serverConfig.MaxBodyBytes = cfg.HTTP.MaxBodyBytes
+	}
+	serverConfig.StrictJSON = cfg.HTTP.StrictJSON
+	return serverConfig
+}
+
+func (config ServerConfig) useTLS() bool {
+	return config.TLSCertFile != "" && config.TLSKeyFile != ""
+}
+
+func (config ServerConfig) newServer(handler http.Handler) (*http.Server, error) {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:         config.Addr,
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+		TLSConfig:    tlsConfig,
+	}, nil
+}
+
+func (config ServerConfig) listenAndServe(server *http.Server) error {
+	if config.useTLS() {
+		return server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// readBody reads the whole request body, returning errBodyTooLarge if it exceeds limit. Only for bodies that are needed
+// whole, like raw tokens and signed requests; JSON bodies are streamed with decodeJSON
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// decodeJSON decodes the request body into v as it's read, so large bodies aren't held in memory twice. It fails with
+// errBodyTooLarge past config.MaxBodyBytes, io.EOF on an empty body, and on anything after the JSON value. With
+// StrictJSON, fields v doesn't have are errors too
+func decodeJSON(w http.ResponseWriter, r *http.Request, config ServerConfig, v interface{}) error {
+	body := http.MaxBytesReader(w, r.Body, config.MaxBodyBytes)
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	if config.StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return bodyTooLarge(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err != nil {
+			return bodyTooLarge(err)
+		}
+		return errTrailingData
+	}
+	return nil
+}
+
+// bodyTooLarge turns the error http.MaxBytesReader fails with into errBodyTooLarge; it has no type of its own to check
+func bodyTooLarge(err error) error {
+	if err != nil && err.Error() == "http: request body too large" {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// writeBodyError responds to a body that couldn't be read or decoded: 413 if it's too large, 422 if it's JSON that
+// doesn't fit the request type, and 400 otherwise
+func writeBodyError(w http.ResponseWriter, r *http.Request, config ServerConfig, err error) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeBodyTooLarge,
+			"request body is larger than "+strconv.FormatInt(config.MaxBodyBytes, 10)+" bytes")
+	case err == io.EOF:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidJSON, "request body is empty")
+	case errors.As(err, &syntaxErr):
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidJSON,
+			fmt.Sprintf("%s at offset %d", syntaxErr.Error(), syntaxErr.Offset))
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, errTrailingData):
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidJSON, err.Error())
+	case errors.As(err, &typeErr):
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeUnprocessable,
+			fmt.Sprintf("%s must be %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value))
+	case strings.HasPrefix(err.Error(), "json: unknown field"):
+		// DisallowUnknownFields has no error type either
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeUnprocessable, strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+	}
+}
@@ -0,0 +1,160 @@
+package galactus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+const DefaultIdempotencyTTL = time.Minute * 10
+
+// marks a key whose request is still being processed
+const idempotencyPending = "pending"
+
+// idempotencyStoreTimeout bounds storing or clearing a result, which can't use the request's context: a client that
+// timed out and went away is the one that retries
+const idempotencyStoreTimeout = 5 * time.Second
+
+type idempotentResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+func IdempotencyTTLFromEnv() time.Duration {
+	ttl := DefaultIdempotencyTTL
+	num, err := strconv.ParseInt(os.Getenv("IDEMPOTENCY_TTL_SEC"), 10, 64)
+	if err == nil && num > 0 {
+		log.Printf("Read from env; using IDEMPOTENCY_TTL_SEC=%d\n", num)
+		ttl = time.Second * time.Duration(num)
+	}
+	return ttl
+}
+
+// keys are scoped to the caller and the exact path, so the same key can't replay another guild's result
+func idempotencyKey(r *http.Request, key string) string {
+	path := r.URL.Path
+	if dryRun(r) {
+		// so a dry run's response is never replayed for the real request
+		path += "?" + api.DryRunQueryParam
+	}
+	return "galactus:idempotency:" + clientKey(r) + ":" + path + ":" + hashToken(key)
+}
+
+// idempotent stores the successful response of requests carrying an Idempotency-Key, and replays it for retries with
+// the same key instead of running the handler again. A retry that arrives while the first request is still running
+// gets a 409, since replaying nothing and running it twice would both be wrong
+func (tokenProvider *TokenProvider) idempotent(config ServerConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(api.IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		redisKey := idempotencyKey(r, key)
+
+		// the pending marker outlives the request's deadline, in case we die before clearing it
+		acquired, err := tokenProvider.client.SetNX(r.Context(), redisKey, idempotencyPending, config.RequestTimeout+config.WriteTimeout).Result()
+		if err != nil {
+			// without Redis we can't dedupe; running the request beats failing it
+			log.Println(err)
+			next(w, r)
+			return
+		}
+		if !acquired {
+			tokenProvider.replayIdempotent(w, r, redisKey)
+			return
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+		defer cancel()
+
+		if rec.statusCode() >= 200 && rec.statusCode() < 300 {
+			jBytes, err := json.Marshal(idempotentResponse{
+				Status:      rec.statusCode(),
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			})
+			if err == nil {
+				err = tokenProvider.client.Set(ctx, redisKey, jBytes, config.IdempotencyTTL).Err()
+			}
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		// failures aren't cached, so the client can retry them for real
+		err = tokenProvider.client.Del(ctx, redisKey).Err()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (tokenProvider *TokenProvider) replayIdempotent(w http.ResponseWriter, r *http.Request, redisKey string) {
+	val, err := tokenProvider.client.Get(r.Context(), redisKey).Bytes()
+	if errors.Is(err, redis.Nil) || string(val) == idempotencyPending {
+		writeError(w, r, http.StatusConflict, api.ErrorCodeIdempotencyKeyInUse, "a request with this "+api.IdempotencyKeyHeader+" is still being processed")
+		return
+	}
+	resp := idempotentResponse{}
+	if err == nil {
+		err = json.Unmarshal(val, &resp)
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the stored response")
+		return
+	}
+	if resp.ContentType != "" {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	_, err = w.Write(resp.Body)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// bodyRecorder keeps a copy of the response so it can be stored
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *bodyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *bodyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *bodyRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,49 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cancelKey carries the request's cancel func into the handler, so it can hang up mid-request
+type cancelKey struct{}
+
+// the client gives up before the handler returns, which is exactly when it retries
+func TestIdempotentStoresResultAfterClientLeaves(t *testing.T) {
+	tokenProvider, _ := newTestTokenProvider(t, config.Config{})
+	serverConfig := ServerConfig{RequestTimeout: time.Second, WriteTimeout: time.Second, IdempotencyTTL: time.Minute}
+	calls := 0
+	handler := tokenProvider.idempotent(serverConfig, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if cancel, ok := r.Context().Value(cancelKey{}).(context.CancelFunc); ok {
+			cancel()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"worker":1}`))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, cancelKey{}, cancel)
+	req := httptest.NewRequest(http.MethodPost, "/v1/modify/1/CODE", nil).WithContext(ctx)
+	req.Header.Set(api.IdempotencyKeyHeader, "retry-me")
+	handler(httptest.NewRecorder(), req)
+
+	retry := httptest.NewRequest(http.MethodPost, "/v1/modify/1/CODE", nil)
+	retry.Header.Set(api.IdempotencyKeyHeader, "retry-me")
+	rec := httptest.NewRecorder()
+	handler(rec, retry)
+	if rec.Code != http.StatusOK || rec.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Fatalf("the retry got %d (replayed %q), want the stored response", rec.Code, rec.Header().Get(IdempotentReplayedHeader))
+	}
+	if rec.Body.String() != `{"worker":1}` {
+		t.Fatalf("the retry got %q, want the first response", rec.Body.String())
+	}
+	if calls != 1 {
+		t.Fatalf("the handler ran %d times, want once", calls)
+	}
+}
@@ -0,0 +1,76 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// IdentifyRateLimit is Discord's limit on identifies in each max_concurrency bucket: 1 every 5 seconds
+var IdentifyRateLimit = RateLimit{PerSecond: 0.2, Burst: 1}
+
+// gatewayBot is the part of GET /gateway/bot that discordgo v0.22 doesn't decode
+type gatewayBot struct {
+	Shards            int `json:"shards"`
+	SessionStartLimit struct {
+		Total          int `json:"total"`
+		Remaining      int `json:"remaining"`
+		ResetAfter     int `json:"reset_after"`
+		MaxConcurrency int `json:"max_concurrency"`
+	} `json:"session_start_limit"`
+}
+
+func identifyRateLimitKey(hToken string, bucket int) string {
+	return "galactus:ratelimit:identify:" + hToken + ":" + strconv.Itoa(bucket)
+}
+
+func getGatewayBot(sess *discordgo.Session) (gatewayBot, error) {
+	var resp gatewayBot
+	body, err := sess.RequestWithBucketID(http.MethodGet, discordgo.EndpointGatewayBot, nil, discordgo.EndpointGatewayBot)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(body, &resp)
+	return resp, err
+}
+
+// waitForIdentify blocks until the session can identify without exceeding Discord's identify limits, which are shared
+// by every shard of the bot, on every galactus instance. Shards in different max_concurrency buckets don't wait on
+// each other. If the limits can't be read, the session is treated as having a single bucket
+func (tokenProvider *TokenProvider) waitForIdentify(ctx context.Context, sess *discordgo.Session) error {
+	maxConcurrency := 1
+	gateway, err := getGatewayBot(sess)
+	if err != nil {
+		log.Println(err)
+	} else {
+		if gateway.SessionStartLimit.MaxConcurrency > 1 {
+			maxConcurrency = gateway.SessionStartLimit.MaxConcurrency
+		}
+		if gateway.SessionStartLimit.Remaining == 0 && gateway.SessionStartLimit.ResetAfter > 0 {
+			wait := time.Duration(gateway.SessionStartLimit.ResetAfter) * time.Millisecond
+			log.Printf("No session starts remaining for this bot; waiting %s to identify\n", wait.Round(time.Second))
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+	}
+
+	bucket := sess.ShardID % maxConcurrency
+	return tokenProvider.waitForRateLimit(ctx, identifyRateLimitKey(hashToken(sess.Token), bucket), IdentifyRateLimit)
+}
+
+// openSession opens the session's gateway connection once its identify bucket allows it
+func (tokenProvider *TokenProvider) openSession(sess *discordgo.Session) error {
+	if err := tokenProvider.waitForIdentify(context.Background(), sess); err != nil {
+		return err
+	}
+	return sess.Open()
+}
@@ -0,0 +1,108 @@
+package galactus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/bwmarrin/discordgo"
+	"log"
+)
+
+// DefaultPrimaryIntents feed the voice state cache; the guilds intent is always requested, since sessions track their
+// guilds with it
+const DefaultPrimaryIntents = discordgo.IntentsGuilds | discordgo.IntentsGuildVoiceStates
+
+const DefaultSecondaryIntents = discordgo.IntentsGuilds
+
+// intentNames are the names intents are configured with. guildMembers and guildPresences are privileged, and have to
+// be enabled for the bot in the developer portal too
+var intentNames = map[string]discordgo.Intent{
+	"guilds":                 discordgo.IntentsGuilds,
+	"guildMembers":           discordgo.IntentsGuildMembers,
+	"guildBans":              discordgo.IntentsGuildBans,
+	"guildEmojis":            discordgo.IntentsGuildEmojis,
+	"guildIntegrations":      discordgo.IntentsGuildIntegrations,
+	"guildWebhooks":          discordgo.IntentsGuildWebhooks,
+	"guildInvites":           discordgo.IntentsGuildInvites,
+	"guildVoiceStates":       discordgo.IntentsGuildVoiceStates,
+	"guildPresences":         discordgo.IntentsGuildPresences,
+	"guildMessages":          discordgo.IntentsGuildMessages,
+	"guildMessageReactions":  discordgo.IntentsGuildMessageReactions,
+	"guildMessageTyping":     discordgo.IntentsGuildMessageTyping,
+	"directMessages":         discordgo.IntentsDirectMessages,
+	"directMessageReactions": discordgo.IntentsDirectMessageReactions,
+	"directMessageTyping":    discordgo.IntentsDirectMessageTyping,
+}
+
+// messageIntents get messages and what happens to them, which a bot that only takes slash commands has no use for
+const messageIntents = discordgo.IntentsGuildMessages | discordgo.IntentsGuildMessageReactions |
+	discordgo.IntentsGuildMessageTyping | discordgo.IntentsDirectMessages | discordgo.IntentsDirectMessageReactions |
+	discordgo.IntentsDirectMessageTyping
+
+// parseIntents combines the named intents, or returns def if there are none
+func parseIntents(names []string, def discordgo.Intent) (discordgo.Intent, error) {
+	if len(names) == 0 {
+		return def, nil
+	}
+	intents := discordgo.IntentsGuilds
+	for _, name := range names {
+		intent, ok := intentNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown gateway intent \"%s\"", name)
+		}
+		intents |= intent
+	}
+	return intents, nil
+}
+
+// validateIntents checks every configured intent name, so a typo fails at startup or reload rather than when a
+// secondary bot is added
+func validateIntents(cfg config.Config) error {
+	primary, err := parseIntents(cfg.Intents.Primary, DefaultPrimaryIntents)
+	if err != nil {
+		return err
+	}
+	secondary, err := parseIntents(cfg.Intents.Secondary, DefaultSecondaryIntents)
+	if err != nil {
+		return err
+	}
+	if cfg.Intents.SlashCommandsOnly && (primary|secondary)&messageIntents != 0 {
+		return errors.New("SLASH_COMMANDS_ONLY can't be combined with message intents in GATEWAY_INTENTS or SECONDARY_GATEWAY_INTENTS")
+	}
+	for hToken, names := range cfg.Intents.Tokens {
+		intents, err := parseIntents(names, DefaultSecondaryIntents)
+		if err != nil {
+			return fmt.Errorf("intents for token %s: %w", hToken, err)
+		}
+		if cfg.Intents.SlashCommandsOnly && intents&messageIntents != 0 {
+			return fmt.Errorf("intents for token %s: SLASH_COMMANDS_ONLY can't be combined with message intents", hToken)
+		}
+	}
+	return nil
+}
+
+func primaryIntents(cfg config.IntentsConfig) discordgo.Intent {
+	intents, err := parseIntents(cfg.Primary, DefaultPrimaryIntents)
+	if err != nil {
+		log.Println(err)
+		intents = DefaultPrimaryIntents
+	}
+	if cfg.GuildMembers {
+		intents |= discordgo.IntentsGuildMembers
+	}
+	return intents
+}
+
+// secondaryIntents are the token's own intents if it has any configured, otherwise those of every secondary bot
+func secondaryIntents(cfg config.IntentsConfig, hToken string) discordgo.Intent {
+	names, ok := cfg.Tokens[hToken]
+	if !ok {
+		names = cfg.Secondary
+	}
+	intents, err := parseIntents(names, DefaultSecondaryIntents)
+	if err != nil {
+		log.Println(err)
+		intents = DefaultSecondaryIntents
+	}
+	return intents
+}
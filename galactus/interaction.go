@@ -0,0 +1,312 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// InteractionResponseDeadline is how long after an interaction is created Discord accepts its initial response
+const InteractionResponseDeadline = time.Second * 3
+
+// InteractionTokenTTL is how long an interaction's token can be used for followups and edits
+const InteractionTokenTTL = time.Minute * 15
+
+// InteractionDeferMargin is how long before the deadline an auto-deferred interaction is deferred, to leave room for
+// the request to reach Discord
+const InteractionDeferMargin = time.Millisecond * 750
+
+const (
+	InteractionResponseChannelMessage         = 4
+	InteractionResponseDeferredChannelMessage = 5
+)
+
+const (
+	ErrorCodeInteractionExpired   = "INTERACTION_EXPIRED"
+	ErrorCodeInteractionResponded = "INTERACTION_ALREADY_RESPONDED"
+)
+
+// interaction states, stored in Redis so every galactus instance agrees on who sends the initial response
+const (
+	interactionDeferring = "deferring"
+	interactionDeferred  = "deferred"
+	interactionResponded = "responded"
+)
+
+const ephemeralMessageFlag = 1 << 6
+
+type InteractionResponse struct {
+	Type int                      `json:"type"`
+	Data *InteractionResponseData `json:"data,omitempty"`
+}
+
+type InteractionResponseData struct {
+	TTS             bool                              `json:"tts,omitempty"`
+	Content         string                            `json:"content,omitempty"`
+	Embeds          []*discordgo.MessageEmbed         `json:"embeds,omitempty"`
+	AllowedMentions *discordgo.MessageAllowedMentions `json:"allowed_mentions,omitempty"`
+	Flags           int                               `json:"flags,omitempty"`
+}
+
+type InteractionRespondResult struct {
+	// Edited is true if the interaction had already been deferred, so the response was applied as an edit of the deferred
+	// message instead
+	Edited bool `json:"edited"`
+}
+
+type AutoDeferRequest struct {
+	Ephemeral bool `json:"ephemeral"`
+}
+
+type AutoDeferResponse struct {
+	// Deadline is when Discord stops accepting an initial response; the interaction is deferred shortly before then
+	Deadline time.Time `json:"deadline"`
+}
+
+func interactionKey(interactionID string) string {
+	return "galactus:interaction:" + interactionID
+}
+
+func interactionCallbackEndpoint(interactionID, token string) string {
+	return discordAPIv8 + "interactions/" + interactionID + "/" + token + "/callback"
+}
+
+func interactionWebhookEndpoint(applicationID, token string) string {
+	return discordAPIv8 + "webhooks/" + applicationID + "/" + token
+}
+
+// interactionDeadline is derived from the interaction ID, which is a snowflake of when Discord created it
+func interactionDeadline(interactionID string) (time.Time, error) {
+	created, err := discordgo.SnowflakeTimestamp(interactionID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return created.Add(InteractionResponseDeadline), nil
+}
+
+// claimInteraction records that this request sends the interaction's initial response. If another request already has,
+// its state is returned instead
+func (tokenProvider *TokenProvider) claimInteraction(ctx context.Context, interactionID, state string) (bool, string, error) {
+	claimed, err := tokenProvider.client.SetNX(ctx, interactionKey(interactionID), state, InteractionTokenTTL).Result()
+	if err != nil || claimed {
+		return claimed, "", err
+	}
+	prev, err := tokenProvider.client.Get(ctx, interactionKey(interactionID)).Result()
+	if errors.Is(err, redis.Nil) {
+		// expired between the two calls; nothing has a claim anymore
+		return tokenProvider.claimInteraction(ctx, interactionID, state)
+	}
+	return false, prev, err
+}
+
+// waitWhileDeferring waits for an in-flight auto-defer to reach Discord, since the deferred message can't be edited
+// before then
+func (tokenProvider *TokenProvider) waitWhileDeferring(ctx context.Context, interactionID string) (string, error) {
+	for {
+		state, err := tokenProvider.client.Get(ctx, interactionKey(interactionID)).Result()
+		if err != nil || state != interactionDeferring {
+			return state, err
+		}
+		t := time.NewTimer(time.Millisecond * 50)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return "", ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// interactionRespondHandler sends an interaction's initial response. If galactus already deferred it, the response
+// is applied by editing the deferred message instead, so the worker doesn't need to know whether it was slow
+func (tokenProvider *TokenProvider) interactionRespondHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		interactionID := vars["interactionID"]
+		token := vars["token"]
+
+		response := InteractionResponse{}
+		if !readJSONBody(w, r, config, &response) {
+			return
+		}
+		if response.Type == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "an interaction response needs a type")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		state := interactionResponded
+		if response.Type == InteractionResponseDeferredChannelMessage {
+			state = interactionDeferred
+		}
+		claimed, prev, err := tokenProvider.claimInteraction(ctx, interactionID, state)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the interaction's state")
+			return
+		}
+
+		if claimed {
+			deadline, err := interactionDeadline(interactionID)
+			if err != nil {
+				tokenProvider.client.Del(ctx, interactionKey(interactionID))
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+				return
+			}
+			if time.Now().After(deadline) {
+				writeError(w, r, http.StatusGone, ErrorCodeInteractionExpired, "the interaction's response deadline has passed")
+				return
+			}
+			_, err = tokenProvider.primarySession.RequestWithBucketID(http.MethodPost, interactionCallbackEndpoint(interactionID, token), response, "")
+			if err != nil {
+				// let a retry claim it again
+				tokenProvider.client.Del(ctx, interactionKey(interactionID))
+				log.Println(err)
+				writeDiscordError(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, InteractionRespondResult{})
+			return
+		}
+
+		if prev == interactionDeferring {
+			prev, err = tokenProvider.waitWhileDeferring(ctx, interactionID)
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusServiceUnavailable, ErrorCodeInternal, "timed out waiting for the interaction to be deferred")
+				return
+			}
+		}
+		if prev != interactionDeferred || response.Data == nil {
+			writeError(w, r, http.StatusConflict, ErrorCodeInteractionResponded, "the interaction was already responded to")
+			return
+		}
+
+		appID, err := tokenProvider.applicationID()
+		if err == nil {
+			url := interactionWebhookEndpoint(appID, token) + "/messages/@original"
+			_, err = tokenProvider.primarySession.RequestWithBucketID(http.MethodPatch, url, response.Data, "")
+		}
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		tokenProvider.client.Set(ctx, interactionKey(interactionID), interactionResponded, InteractionTokenTTL)
+		writeJSON(w, http.StatusOK, InteractionRespondResult{Edited: true})
+	}
+}
+
+// interactionAutoDeferHandler defers the interaction shortly before its deadline, unless a response is sent first. It's
+// meant to be called as soon as a worker picks up an interaction it might be slow to answer
+func (tokenProvider *TokenProvider) interactionAutoDeferHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		interactionID := vars["interactionID"]
+		token := vars["token"]
+
+		// the body is optional
+		request := AutoDeferRequest{}
+		if err := decodeJSON(w, r, config, &request); err != nil && err != io.EOF {
+			writeBodyError(w, r, config, err)
+			return
+		}
+
+		deadline, err := interactionDeadline(interactionID)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		if time.Now().After(deadline) {
+			writeError(w, r, http.StatusGone, ErrorCodeInteractionExpired, "the interaction's response deadline has passed")
+			return
+		}
+
+		go tokenProvider.autoDefer(interactionID, token, deadline, request.Ephemeral)
+		writeJSON(w, http.StatusAccepted, AutoDeferResponse{Deadline: deadline})
+	}
+}
+
+func (tokenProvider *TokenProvider) autoDefer(interactionID, token string, deadline time.Time, ephemeral bool) {
+	t := time.NewTimer(time.Until(deadline.Add(-InteractionDeferMargin)))
+	<-t.C
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	claimed, _, err := tokenProvider.claimInteraction(ctx, interactionID, interactionDeferring)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !claimed {
+		// the worker was fast enough
+		return
+	}
+
+	response := InteractionResponse{Type: InteractionResponseDeferredChannelMessage}
+	if ephemeral {
+		response.Data = &InteractionResponseData{Flags: ephemeralMessageFlag}
+	}
+	state := interactionDeferred
+	_, err = tokenProvider.primarySession.RequestWithBucketID(http.MethodPost, interactionCallbackEndpoint(interactionID, token), response, "")
+	if err != nil {
+		log.Printf("Failed to auto-defer interaction %s: %s\n", interactionID, err)
+		// nothing else can respond in time now, but don't leave later requests waiting on the defer
+		state = interactionResponded
+	} else {
+		log.Printf("Auto-deferred interaction %s\n", interactionID)
+	}
+	err = tokenProvider.client.Set(context.Background(), interactionKey(interactionID), state, InteractionTokenTTL).Err()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// interactionFollowupHandler sends a followup message for an interaction, after its initial response
+func (tokenProvider *TokenProvider) interactionFollowupHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		interactionID := vars["interactionID"]
+
+		data := InteractionResponseData{}
+		if !readJSONBody(w, r, config, &data) {
+			return
+		}
+		created, err := discordgo.SnowflakeTimestamp(interactionID)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		if time.Since(created) > InteractionTokenTTL {
+			writeError(w, r, http.StatusGone, ErrorCodeInteractionExpired, "the interaction's token has expired")
+			return
+		}
+
+		appID, err := tokenProvider.applicationID()
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		url := interactionWebhookEndpoint(appID, vars["token"]) + "?wait=true"
+		resp, err := tokenProvider.primarySession.RequestWithBucketID(http.MethodPost, url, data, "")
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(resp); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/automuteus/galactus/pkg/redisutil"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ProtobufContentType = "application/x-protobuf"
+
+// DefaultJobMaxAges are how long each type of job can wait before popJob skips it. Lobby jobs are only worth delivering
+// while they're the latest lobby details; game state jobs are always delivered, since workers can't recover them
+var DefaultJobMaxAges = map[task.JobType]time.Duration{
+	task.LobbyJob: 5 * time.Minute,
+}
+
+var staleJobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_jobs_stale_total",
+	Help: "Jobs skipped because they waited in the queue longer than their type's max age, by job type",
+}, []string{"type"})
+
+// jobMaxAges applies the configured overrides to DefaultJobMaxAges
+func jobMaxAges(cfg config.Config) map[task.JobType]time.Duration {
+	ages := make(map[task.JobType]time.Duration, len(DefaultJobMaxAges))
+	for jobType, age := range DefaultJobMaxAges {
+		ages[jobType] = age
+	}
+	for name, age := range cfg.JobMaxAge {
+		jobType, ok := jobcodec.ParseType(name)
+		if !ok {
+			log.Printf("Ignoring the max age for unknown job type \"%s\"\n", name)
+			continue
+		}
+		ages[jobType] = time.Duration(age)
+	}
+	return ages
+}
+
+// popJob pops the next queued job for a connect code, in whatever encoding it was queued with, skipping any that are
+// older than their type's max age. Returns nil if there are no jobs
+func (tokenProvider *TokenProvider) popJob(ctx context.Context, connectCode string) (*jobcodec.QueuedJob, error) {
+	maxAges := tokenProvider.getSettings().jobMaxAges
+	for {
+		data, err := tokenProvider.client.LPop(ctx, rediskey.JobNamespace+connectCode).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		job, err := jobcodec.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		maxAge := maxAges[job.JobType]
+		if age := job.Age(time.Now()); maxAge > 0 && age > maxAge {
+			log.Printf("Skipping %s job for %s that was queued %s ago\n", jobcodec.TypeName(job.JobType), connectCode, age.Round(time.Second))
+			staleJobsTotal.WithLabelValues(jobcodec.TypeName(job.JobType)).Inc()
+			continue
+		}
+		tokenProvider.recordJobProcessed(ctx)
+		return &job, nil
+	}
+}
+
+func (tokenProvider *TokenProvider) requestJobHandler(w http.ResponseWriter, r *http.Request) {
+	connectCode := mux.Vars(r)["connectCode"]
+	job, err := tokenProvider.popJob(r.Context(), connectCode)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to pop job")
+		return
+	}
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// workers opt in to protobuf; everyone else gets the same JSON they'd read from Redis
+	if strings.Contains(r.Header.Get("Accept"), ProtobufContentType) {
+		b, err := proto.Marshal(jobcodec.ToProto(*job))
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to encode job")
+			return
+		}
+		w.Header().Set("Content-Type", ProtobufContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// jobQueueLengths returns the length of every connect code's job queue, or only the given one's
+func (tokenProvider *TokenProvider) jobQueueLengths(ctx context.Context, connectCode string) (map[string]int64, error) {
+	var keys []string
+	if connectCode != "" {
+		keys = []string{rediskey.JobNamespace + connectCode}
+	} else {
+		var err error
+		keys, err = redisutil.ScanKeys(ctx, tokenProvider.client, rediskey.JobNamespace+"*")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pipe := tokenProvider.client.Pipeline()
+	lens := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		lens[i] = pipe.LLen(ctx, key)
+	}
+	// a key in the namespace that isn't a list fails on its own without failing the others
+	_, err := pipe.Exec(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+
+	lengths := make(map[string]int64, len(keys))
+	for i, key := range keys {
+		if lens[i].Err() != nil || lens[i].Val() == 0 {
+			continue
+		}
+		lengths[strings.TrimPrefix(key, rediskey.JobNamespace)] = lens[i].Val()
+	}
+	return lengths, nil
+}
+
+// jobTypeCounts counts the jobs of each type queued for the connect codes. Every job has to be read to know its type,
+// but the high-water mark keeps the queues short
+func (tokenProvider *TokenProvider) jobTypeCounts(ctx context.Context, connectCodes []string) (map[string]int64, error) {
+	pipe := tokenProvider.client.Pipeline()
+	ranges := make([]*redis.StringSliceCmd, len(connectCodes))
+	for i, code := range connectCodes {
+		ranges[i] = pipe.LRange(ctx, rediskey.JobNamespace+code, 0, -1)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	for _, cmd := range ranges {
+		for _, data := range cmd.Val() {
+			job, err := jobcodec.Decode([]byte(data))
+			if err != nil {
+				counts["unknown"]++
+				continue
+			}
+			counts[jobcodec.TypeName(job.JobType)]++
+		}
+	}
+	return counts, nil
+}
+
+func (tokenProvider *TokenProvider) jobsHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lengths, err := tokenProvider.jobQueueLengths(r.Context(), r.URL.Query().Get("connectCode"))
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read job queues")
+			return
+		}
+
+		resp := api.JobsResponse{
+			Queues:    int64(len(lengths)),
+			HighWater: config.JobQueueHighWater,
+		}
+		for connectCode, length := range lengths {
+			resp.Pending += length
+			if length >= config.JobQueueHighWater {
+				resp.Backpressured = append(resp.Backpressured, connectCode)
+			}
+		}
+		sort.Strings(resp.Backpressured)
+		resp.Backpressure = len(resp.Backpressured) > 0
+
+		codes := make([]string, 0, len(lengths))
+		for connectCode := range lengths {
+			codes = append(codes, connectCode)
+		}
+		resp.ByType, err = tokenProvider.jobTypeCounts(r.Context(), codes)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read job queues")
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+const (
+	DefaultJobPeekCount = 10
+	MaxJobPeekCount     = 100
+)
+
+// PeekedJob is a queued job, and the connect code whose queue it's in
+type PeekedJob struct {
+	ConnectCode string `json:"connectCode"`
+	jobcodec.QueuedJob
+}
+
+type JobsPeekResponse struct {
+	Jobs []PeekedJob `json:"jobs"`
+}
+
+type JobsPurgeResponse struct {
+	// Purged is how many jobs were dropped, from how many queues
+	Purged int64 `json:"purged"`
+	Queues int   `json:"queues"`
+}
+
+// peekJobs returns up to n of the jobs at the front of a connect code's queue, or the n queued earliest across every
+// queue, without popping them
+func (tokenProvider *TokenProvider) peekJobs(ctx context.Context, connectCode string, n int) ([]PeekedJob, error) {
+	var codes []string
+	if connectCode != "" {
+		codes = []string{connectCode}
+	} else {
+		lengths, err := tokenProvider.jobQueueLengths(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for code := range lengths {
+			codes = append(codes, code)
+		}
+	}
+
+	pipe := tokenProvider.client.Pipeline()
+	ranges := make([]*redis.StringSliceCmd, len(codes))
+	for i, code := range codes {
+		ranges[i] = pipe.LRange(ctx, rediskey.JobNamespace+code, 0, int64(n-1))
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+
+	jobs := []PeekedJob{}
+	for i, code := range codes {
+		for _, data := range ranges[i].Val() {
+			job, err := jobcodec.Decode([]byte(data))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			jobs = append(jobs, PeekedJob{ConnectCode: code, QueuedJob: job})
+		}
+	}
+	// each queue is already in order; across queues, the earliest queued jobs are next. Unstamped jobs are the oldest
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].EnqueuedAt < jobs[j].EnqueuedAt
+	})
+	if len(jobs) > n {
+		jobs = jobs[:n]
+	}
+	return jobs, nil
+}
+
+// purgeJobs drops the queued jobs of the connect codes, returning roughly how many there were; jobs queued while
+// purging may or may not be counted
+func (tokenProvider *TokenProvider) purgeJobs(ctx context.Context, connectCodes []string) (int64, error) {
+	// the queues live in different slots, so each is measured and deleted on its own rather than in a single DEL
+	pipe := tokenProvider.client.Pipeline()
+	lens := make([]*redis.IntCmd, len(connectCodes))
+	for i, code := range connectCodes {
+		lens[i] = pipe.LLen(ctx, rediskey.JobNamespace+code)
+		pipe.Del(ctx, rediskey.JobNamespace+code)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	var purged int64
+	for _, l := range lens {
+		purged += l.Val()
+	}
+	return purged, nil
+}
+
+// jobsPeekHandler returns the next ?n= jobs, of one connect code with ?connectCode= or across all of them
+func (tokenProvider *TokenProvider) jobsPeekHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	n := DefaultJobPeekCount
+	if s := query.Get("n"); s != "" {
+		num, err := strconv.Atoi(s)
+		if err != nil || num < 1 || num > MaxJobPeekCount {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "n must be between 1 and "+strconv.Itoa(MaxJobPeekCount))
+			return
+		}
+		n = num
+	}
+	jobs, err := tokenProvider.peekJobs(r.Context(), query.Get("connectCode"), n)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read job queues")
+		return
+	}
+	writeJSON(w, http.StatusOK, JobsPeekResponse{Jobs: jobs})
+}
+
+// jobsPurgeHandler drops the queued jobs of every game registered on ?guildID=, like after the guild removes the bot
+func (tokenProvider *TokenProvider) jobsPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	guildID := r.URL.Query().Get("guildID")
+	if guildID == "" {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "guildID is required")
+		return
+	}
+	games, err := tokenProvider.guildGames(r.Context(), guildID)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the guild's games")
+		return
+	}
+	codes := make([]string, len(games))
+	for i, game := range games {
+		codes[i] = game.ConnectCode
+	}
+	purged, err := tokenProvider.purgeJobs(r.Context(), codes)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to purge job queues")
+		return
+	}
+	log.Printf("Purged %d jobs from %d queues of guild %s\n", purged, len(codes), guildID)
+	writeJSON(w, http.StatusOK, JobsPurgeResponse{Purged: purged, Queues: len(codes)})
+}
+
+// jobsPurgeAllHandler drops every queued job
+func (tokenProvider *TokenProvider) jobsPurgeAllHandler(w http.ResponseWriter, r *http.Request) {
+	lengths, err := tokenProvider.jobQueueLengths(r.Context(), "")
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read job queues")
+		return
+	}
+	codes := make([]string, 0, len(lengths))
+	for code := range lengths {
+		codes = append(codes, code)
+	}
+	purged, err := tokenProvider.purgeJobs(r.Context(), codes)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to purge job queues")
+		return
+	}
+	log.Printf("Purged all %d jobs from %d queues\n", purged, len(codes))
+	writeJSON(w, http.StatusOK, JobsPurgeResponse{Purged: purged, Queues: len(codes)})
+}
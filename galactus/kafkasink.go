@@ -0,0 +1,193 @@
+package galactus
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"log"
+	"time"
+)
+
+// KafkaDialTimeout bounds connecting to a broker to read back the history
+const KafkaDialTimeout = 10 * time.Second
+
+// KafkaEventSinkBatchTimeout is how long the producer waits to fill a batch; events already arrive in batches, so it's
+// short
+const KafkaEventSinkBatchTimeout = 10 * time.Millisecond
+
+// KafkaEventSink produces events to Kafka for durable history, keyed by guild ID so each guild's events stay in order
+// on one partition. Event types without a topic aren't produced
+type KafkaEventSink struct {
+	writer *kafka.Writer
+	// reads the history back for replays
+	dialer  *kafka.Dialer
+	brokers []string
+	// topic is for the event types not in topics
+	topic  string
+	topics map[string]string
+}
+
+func NewKafkaEventSink(cfg config.KafkaEventSinkConfig) *KafkaEventSink {
+	transport := &kafka.Transport{ClientID: "galactus"}
+	dialer := &kafka.Dialer{ClientID: "galactus", Timeout: KafkaDialTimeout, DualStack: true}
+	if cfg.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		dialer.TLS = transport.TLS
+	}
+	if cfg.Username != "" {
+		transport.SASL = plain.Mechanism{Username: cfg.Username, Password: cfg.Password}
+		dialer.SASLMechanism = transport.SASL
+	}
+	return &KafkaEventSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Balancer:     &kafka.Hash{},
+			BatchSize:    EventSinkBatchSize,
+			BatchTimeout: KafkaEventSinkBatchTimeout,
+			RequiredAcks: kafka.RequireAll,
+			Transport:    transport,
+		},
+		dialer:  dialer,
+		brokers: cfg.Brokers,
+		topic:   cfg.Topic,
+		topics:  cfg.Topics,
+	}
+}
+
+func (sink *KafkaEventSink) Name() string {
+	return "kafka"
+}
+
+// topicFor returns the topic an event type is produced to, or "" for none
+func (sink *KafkaEventSink) topicFor(eventType string) string {
+	if topic, ok := sink.topics[eventType]; ok {
+		return topic
+	}
+	return sink.topic
+}
+
+func (sink *KafkaEventSink) Send(ctx context.Context, events []api.GatewayEvent) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		topic := sink.topicFor(event.Type)
+		if topic == "" {
+			continue
+		}
+		jBytes, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		message := kafka.Message{
+			Topic: topic,
+			Value: jBytes,
+			Time:  time.Unix(0, event.Time*int64(time.Millisecond)),
+			Headers: []kafka.Header{
+				{Key: "type", Value: []byte(event.Type)},
+			},
+		}
+		// events without a guild are spread over the partitions
+		if event.GuildID != "" {
+			message.Key = []byte(event.GuildID)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return sink.writer.WriteMessages(ctx, messages...)
+}
+
+func (sink *KafkaEventSink) Close() error {
+	return sink.writer.Close()
+}
+
+// archivedEvents reads the events produced between from and until back from every topic, keeping one more than the
+// limit from each partition, so a replay knows whether it was cut short. Only the partition holding guildID's events can have them, but which one that is depends on the
+// topic's partition count, so every partition is read
+func (sink *KafkaEventSink) archivedEvents(ctx context.Context, query replayQuery) ([]api.GatewayEvent, error) {
+	topics := make(map[string]bool)
+	if sink.topic != "" {
+		topics[sink.topic] = true
+	}
+	for _, topic := range sink.topics {
+		if topic != "" {
+			topics[topic] = true
+		}
+	}
+	var events []api.GatewayEvent
+	for topic := range topics {
+		partitions, err := sink.dialer.LookupPartitions(ctx, "tcp", sink.brokers[0], topic)
+		if err != nil {
+			return nil, err
+		}
+		for _, partition := range partitions {
+			read, err := sink.partitionEvents(ctx, topic, partition.ID, query)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, read...)
+		}
+	}
+	return events, nil
+}
+
+func (sink *KafkaEventSink) partitionEvents(ctx context.Context, topic string, partition int, query replayQuery) ([]api.GatewayEvent, error) {
+	conn, err := sink.dialer.DialLeader(ctx, "tcp", sink.brokers[0], topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// -1 if nothing was produced since from
+	offset, err := conn.ReadOffset(query.from)
+	if err != nil || offset < 0 {
+		return nil, err
+	}
+	last, err := conn.ReadLastOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []api.GatewayEvent
+	for offset < last && len(events) <= query.limit {
+		if _, err := conn.Seek(offset, kafka.SeekAbsolute); err != nil {
+			return nil, err
+		}
+		batch := conn.ReadBatch(1, 10e6)
+		start := offset
+		for len(events) <= query.limit {
+			msg, err := batch.ReadMessage()
+			if err != nil {
+				break
+			}
+			offset = msg.Offset + 1
+			if !query.until.IsZero() && msg.Time.After(query.until) {
+				batch.Close()
+				return events, nil
+			}
+			if query.guildID != "" && string(msg.Key) != query.guildID {
+				continue
+			}
+			var event api.GatewayEvent
+			if err := json.Unmarshal(msg.Value, &event); err != nil {
+				log.Printf("Skipping unreadable event at %s/%d/%d: %s\n", topic, partition, msg.Offset, err)
+				continue
+			}
+			events = append(events, event)
+		}
+		if err := batch.Close(); err != nil {
+			return nil, err
+		}
+		if offset == start {
+			// nothing could be read; the rest of the partition is out of reach
+			break
+		}
+	}
+	return events, nil
+}
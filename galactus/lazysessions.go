@@ -0,0 +1,108 @@
+package galactus
+
+import (
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionIdleTTL is how long a lazily opened session stays open without being picked for a mute
+	DefaultSessionIdleTTL = 30 * time.Minute
+	// IdleSessionCheckInterval is how often idle sessions are looked for
+	IdleSessionCheckInterval = time.Minute
+)
+
+// lazySessions opens secondary sessions when a guild first needs them, instead of keeping one open for every token
+type lazySessions struct {
+	sync.Mutex
+	idleTTL time.Duration
+	// hashed tokens whose sessions are being opened
+	opening map[string]bool
+}
+
+func newLazySessions(idleTTL time.Duration) *lazySessions {
+	if idleTTL <= 0 {
+		idleTTL = DefaultSessionIdleTTL
+	}
+	return &lazySessions{
+		idleTTL: idleTTL,
+		opening: make(map[string]bool),
+	}
+}
+
+// openLazily opens the session for a guild's token in the background; the request that needed it carries on without
+// it. Tokens that are no longer registered at all are stale, and removed from the guild
+func (tokenProvider *TokenProvider) openLazily(guildID, hToken string) {
+	lazy := tokenProvider.lazySessions
+	lazy.Lock()
+	if lazy.opening[hToken] {
+		lazy.Unlock()
+		return
+	}
+	lazy.opening[hToken] = true
+	lazy.Unlock()
+
+	go func() {
+		defer func() {
+			lazy.Lock()
+			delete(lazy.opening, hToken)
+			lazy.Unlock()
+		}()
+		// counts as used now, so it isn't closed as idle as soon as it opens
+		tokenProvider.markTokenUsed(hToken)
+
+		botToken, err := tokenProvider.client.HGet(ctx, rediskey.AllTokensHSet, hToken).Result()
+		if err == redis.Nil {
+			tokenProvider.queueStaleToken(guildID, hToken)
+			return
+		} else if err != nil {
+			log.Println(err)
+			return
+		}
+		if err := tokenProvider.openAndStartSessionWithToken(botToken); err != nil {
+			log.Println(err)
+			return
+		}
+		tokenProvider.supervisor.forget(hToken)
+	}()
+}
+
+// CloseIdleSessions closes the lazily opened sessions that haven't been picked for a mute in the idle TTL. It does
+// nothing unless sessions are lazy
+func (tokenProvider *TokenProvider) CloseIdleSessions(interval time.Duration) {
+	if tokenProvider.lazySessions == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tokenProvider.closeIdleSessions(time.Now())
+	}
+}
+
+func (tokenProvider *TokenProvider) closeIdleSessions(now time.Time) {
+	idleTTL := tokenProvider.lazySessions.idleTTL
+	for hToken, sess := range tokenProvider.sessions.snapshot() {
+		tokenProvider.usageLock.Lock()
+		lastUsed, ok := tokenProvider.lastUsed[hToken]
+		if !ok {
+			// added through /addtoken; its idle time starts now
+			tokenProvider.lastUsed[hToken] = now
+		}
+		tokenProvider.usageLock.Unlock()
+		if !ok || now.Sub(lastUsed) < idleTTL {
+			continue
+		}
+
+		// the token stays in its guilds' token sets, so the next mute there opens it again
+		tokenProvider.sessions.remove(hToken, sess)
+		if err := sess.Close(); err != nil {
+			log.Println(err)
+		}
+		tokenProvider.supervisor.forget(hToken)
+		log.Printf("Closed secondary session %s after %s idle\n", hToken, now.Sub(lastUsed).Round(time.Second))
+	}
+}
@@ -0,0 +1,104 @@
+package galactus
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultLeaderLeaseTTL = 15 * time.Second
+
+const leaderKey = "galactus:leader"
+
+// leaderElection elects one galactus instance to run the background tasks that have to run exactly once, however many
+// instances there are. The leader holds a lease in Redis and renews it; if it stops, another instance takes over once
+// the lease expires
+type leaderElection struct {
+	client     redis.UniversalClient
+	instanceID string
+	ttl        time.Duration
+	// 1 while this instance holds the lease
+	leader int32
+}
+
+func newLeaderElection(client redis.UniversalClient, instanceID string, ttl time.Duration) *leaderElection {
+	return &leaderElection{
+		client:     client,
+		instanceID: instanceID,
+		ttl:        ttl,
+	}
+}
+
+func (election *leaderElection) isLeader() bool {
+	return atomic.LoadInt32(&election.leader) == 1
+}
+
+// run campaigns for the lease, then renews it, until ctx is done. Leadership is given up as soon as a renewal fails,
+// so the lease can only be held by one instance at a time
+func (election *leaderElection) run(ctx context.Context) {
+	ticker := time.NewTicker(election.ttl / 3)
+	defer ticker.Stop()
+	for {
+		election.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (election *leaderElection) campaign(ctx context.Context) {
+	var held bool
+	var err error
+	if election.isLeader() {
+		var renewed int
+		renewed, err = renewLeaseScript.Run(ctx, election.client, []string{leaderKey}, election.instanceID, election.ttl.Milliseconds()).Int()
+		held = renewed == 1
+	} else {
+		held, err = election.client.SetNX(ctx, leaderKey, election.instanceID, election.ttl).Result()
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Println(err)
+	}
+
+	was := atomic.SwapInt32(&election.leader, boolToInt32(held && err == nil)) == 1
+	if !was && election.isLeader() {
+		log.Println("Elected leader as " + election.instanceID + "; running singleton tasks")
+	} else if was && !election.isLeader() {
+		log.Println("No longer the leader; singleton tasks will run on another instance")
+	}
+}
+
+// resign releases the lease so another instance can take over without waiting for it to expire
+func (election *leaderElection) resign(ctx context.Context) {
+	if atomic.SwapInt32(&election.leader, 0) == 0 {
+		return
+	}
+	err := releaseLeaseScript.Run(ctx, election.client, []string{leaderKey}, election.instanceID).Err()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// runSingleton calls task every interval, but only while this instance is the leader
+func (election *leaderElection) runSingleton(name string, interval time.Duration, task func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !election.isLeader() {
+			continue
+		}
+		log.Println("Running singleton task " + name)
+		task()
+	}
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
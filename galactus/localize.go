@@ -0,0 +1,225 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLocale's messages are built in, and used for any code a request's locales have no message for
+const DefaultLocale = "en"
+
+// DefaultMessages are the built in messages for users, keyed by error code. Codes that only mean something to
+// automuteus itself, like BAD_REQUEST, have none
+var DefaultMessages = map[string]string{
+	string(ack.UserNotInVoice):     "That player isn't in a voice channel, so they can't be muted or deafened.",
+	string(ack.MissingPermissions): "A helper bot doesn't have permission to mute or deafen in this server.",
+	// shared by capture acks and galactus' own rate limits
+	ErrorCodeRateLimited:        "The bots are being rate limited by Discord. Try again in a moment.",
+	string(ack.Unknown):         "A player couldn't be muted or deafened.",
+	ErrorCodeDiscordOutage:      "Discord is having trouble right now, so players aren't being muted or deafened.",
+	ErrorCodeCircuitOpen:        "Discord keeps rejecting the bot's requests. Try again in a minute.",
+	ErrorCodeDiscord:            "Discord rejected the bot's request.",
+	ErrorCodeInternal:           "Something went wrong. Try again in a moment.",
+	ErrorCodeDMOptedOut:         "That player has opted out of direct messages.",
+	ErrorCodeIntentRequired:     "The bot needs the server members intent for this.",
+	ErrorCodeInteractionExpired: "That command took too long. Run it again.",
+	ErrorCodeGuildQuotaExceeded: "This server is muting players too often. Slow down for a moment.",
+	ErrorCodeGuildDenied:        "This server has been blocked from using the bot.",
+	ErrorCodeUserDenied:         "That player has been blocked from being muted by the bot.",
+}
+
+// messageCatalog holds messages keyed by lowercase locale, then error code
+type messageCatalog map[string]map[string]string
+
+// newMessageCatalog merges the configured messages over the built in ones
+func newMessageCatalog(cfg config.MessagesConfig) messageCatalog {
+	catalog := messageCatalog{DefaultLocale: make(map[string]string, len(DefaultMessages))}
+	for code, message := range DefaultMessages {
+		catalog[DefaultLocale][code] = message
+	}
+	for locale, messages := range cfg.Catalog {
+		locale = strings.ToLower(locale)
+		if catalog[locale] == nil {
+			catalog[locale] = make(map[string]string, len(messages))
+		}
+		for code, message := range messages {
+			catalog[locale][code] = message
+		}
+	}
+	return catalog
+}
+
+// find returns the message for code in locale, or the language it's a variant of, like "pt" for "pt-br"
+func (catalog messageCatalog) find(locale, code string) (string, string, bool) {
+	locale = strings.ToLower(locale)
+	if message, ok := catalog[locale][code]; ok {
+		return locale, message, true
+	}
+	if i := strings.IndexByte(locale, '-'); i > 0 {
+		if message, ok := catalog[locale[:i]][code]; ok {
+			return locale[:i], message, true
+		}
+	}
+	return "", "", false
+}
+
+// has returns whether any locale has a message for code
+func (catalog messageCatalog) has(code string) bool {
+	for _, messages := range catalog {
+		if _, ok := messages[code]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedLocales lists an Accept-Language header's locales, most preferred first
+func acceptedLocales(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{locale: locale, q: q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+	locales := make([]string, len(accepted))
+	for i, a := range accepted {
+		locales[i] = a.locale
+	}
+	return locales
+}
+
+// localizer picks the messages of one request's errors: in the locales of its Accept-Language header, then its guild's
+// language setting, then the default locale
+type localizer struct {
+	sync.Mutex
+	tokenProvider *TokenProvider
+	catalog       messageCatalog
+	defaultLocale string
+	accepted      []string
+	// the language setting of each guild looked up, so a response with many errors reads it once
+	guildLocales map[string]string
+}
+
+// localizeMiddleware gives each request a localizer, using the message catalog as of when the request arrived
+func (tokenProvider *TokenProvider) localizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := tokenProvider.getSettings()
+		loc := &localizer{
+			tokenProvider: tokenProvider,
+			catalog:       s.messages,
+			defaultLocale: s.defaultLocale,
+			accepted:      acceptedLocales(r.Header.Get("Accept-Language")),
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localizerKey, loc)))
+	})
+}
+
+// guildLocale returns the language in a guild's settings, or "" if it has none
+func (loc *localizer) guildLocale(ctx context.Context, guildID string) string {
+	loc.Lock()
+	defer loc.Unlock()
+	if locale, ok := loc.guildLocales[guildID]; ok {
+		return locale
+	}
+	locale := ""
+	settings, err := loc.tokenProvider.guildSettings(ctx, guildID)
+	if err != nil {
+		log.Println(err)
+	} else if settings != nil {
+		var language struct {
+			Language string `json:"language"`
+		}
+		// settings that aren't shaped like this just have no language
+		json.Unmarshal(settings.Settings, &language)
+		locale = language.Language
+	}
+	if loc.guildLocales == nil {
+		loc.guildLocales = make(map[string]string)
+	}
+	loc.guildLocales[guildID] = locale
+	return locale
+}
+
+// message returns the locale and message for code, or "" for both if no locale has one. guildID can be empty
+func (loc *localizer) message(ctx context.Context, guildID, code string) (string, string) {
+	if !loc.catalog.has(code) {
+		// don't look up the guild's language for nothing
+		return "", ""
+	}
+	for _, locale := range loc.accepted {
+		if locale, message, ok := loc.catalog.find(locale, code); ok {
+			return locale, message
+		}
+	}
+	if guildID != "" {
+		if locale := loc.guildLocale(ctx, guildID); locale != "" {
+			if locale, message, ok := loc.catalog.find(locale, code); ok {
+				return locale, message
+			}
+		}
+	}
+	for _, locale := range []string{loc.defaultLocale, DefaultLocale} {
+		if locale, message, ok := loc.catalog.find(locale, code); ok {
+			return locale, message
+		}
+	}
+	return "", ""
+}
+
+// localizedMessage looks up code's message for the request, if it went through localizeMiddleware
+func localizedMessage(r *http.Request, guildID, code string) (string, string) {
+	loc, ok := r.Context().Value(localizerKey).(*localizer)
+	if !ok {
+		return "", ""
+	}
+	return loc.message(r.Context(), guildID, code)
+}
+
+// localizeModifyErrors fills in the localized message of each user a modify request couldn't modify
+func localizeModifyErrors(r *http.Request, guildID string, errs []api.UserModifyError) {
+	for i := range errs {
+		errs[i].Locale, errs[i].LocalizedMessage = localizedMessage(r, guildID, string(errs[i].Code))
+	}
+}
+
+// MessagesResponse is the whole message catalog, for automuteus to localize codes it gets outside of an error response,
+// like the ones in published modify results
+type MessagesResponse struct {
+	DefaultLocale string                       `json:"defaultLocale"`
+	Messages      map[string]map[string]string `json:"messages"`
+}
+
+func (tokenProvider *TokenProvider) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	s := tokenProvider.getSettings()
+	writeJSON(w, http.StatusOK, MessagesResponse{DefaultLocale: s.defaultLocale, Messages: s.messages})
+}
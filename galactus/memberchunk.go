@@ -0,0 +1,174 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MemberChunkRateLimit keeps member requests well within the gateway's limit of 120 commands a minute per shard
+var MemberChunkRateLimit = RateLimit{PerSecond: 0.5, Burst: 5}
+
+// MemberChunkStatusTTL is how long the progress of a member request is kept after it starts
+const MemberChunkStatusTTL = time.Hour
+
+const ErrorCodeIntentRequired = "INTENT_REQUIRED"
+
+func memberChunkRateLimitKey(shardID int) string {
+	return "galactus:ratelimit:memberchunk:" + strconv.Itoa(shardID)
+}
+
+func memberChunkStatusKey(guildID string) string {
+	return "galactus:member:chunk:{" + guildID + "}"
+}
+
+// MemberChunkStatus is the progress of filling the member cache for a guild from the gateway
+type MemberChunkStatus struct {
+	GuildID     string    `json:"guildID"`
+	RequestedAt time.Time `json:"requestedAt"`
+	// ChunkCount is 0 until the first chunk arrives
+	ChunkCount int64 `json:"chunkCount"`
+	Chunks     int64 `json:"chunks"`
+	Members    int64 `json:"members"`
+	Done       bool  `json:"done"`
+}
+
+// guildSession returns the primary bot session for the shard the guild is on, or nil if this instance doesn't serve it
+func (tokenProvider *TokenProvider) guildSession(guildID string) *discordgo.Session {
+	id, err := strconv.ParseUint(guildID, 10, 64)
+	if err != nil {
+		return nil
+	}
+	for _, sess := range tokenProvider.gatewaySessions() {
+		if sess.ShardCount <= 1 || int((id>>22)%uint64(sess.ShardCount)) == sess.ShardID {
+			return sess
+		}
+	}
+	return nil
+}
+
+// requestGuildMembers asks the gateway for every member of the guild. They arrive as GuildMembersChunk events, which
+// the member cache handlers store, while addMemberChunkHandlers records the progress
+func (tokenProvider *TokenProvider) requestGuildMembers(ctx context.Context, sess *discordgo.Session, guildID string) error {
+	if err := tokenProvider.waitForRateLimit(ctx, memberChunkRateLimitKey(sess.ShardID), MemberChunkRateLimit); err != nil {
+		return err
+	}
+	key := memberChunkStatusKey(guildID)
+	pipe := tokenProvider.client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, "requestedAt", time.Now().Unix())
+	pipe.Expire(ctx, key, MemberChunkStatusTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	return sess.RequestGuildMembers(guildID, "", 0, false)
+}
+
+func (tokenProvider *TokenProvider) addMemberChunkHandlers(sess *discordgo.Session) {
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMembersChunk) {
+		ctx := context.Background()
+		key := memberChunkStatusKey(m.GuildID)
+		pipe := tokenProvider.client.Pipeline()
+		pipe.HSet(ctx, key, "chunkCount", m.ChunkCount)
+		pipe.HIncrBy(ctx, key, "chunks", 1)
+		pipe.HIncrBy(ctx, key, "members", int64(len(m.Members)))
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		if m.ChunkIndex == m.ChunkCount-1 {
+			log.Printf("Received the last of %d member chunks for guild %s\n", m.ChunkCount, m.GuildID)
+		}
+	})
+	// members of the configured guilds are requested whenever the guild becomes available
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildCreate) {
+		if !tokenProvider.chunksGuild(m.ID) {
+			return
+		}
+		err := tokenProvider.requestGuildMembers(context.Background(), s, m.ID)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func (tokenProvider *TokenProvider) chunksGuild(guildID string) bool {
+	for _, id := range tokenProvider.getSettings().memberChunkGuilds {
+		if id == guildID {
+			return true
+		}
+	}
+	return false
+}
+
+func (tokenProvider *TokenProvider) memberChunkStatus(ctx context.Context, guildID string) (MemberChunkStatus, error) {
+	status := MemberChunkStatus{GuildID: guildID}
+	fields, err := tokenProvider.client.HGetAll(ctx, memberChunkStatusKey(guildID)).Result()
+	if err != nil {
+		return status, err
+	}
+	if len(fields) == 0 {
+		return status, redis.Nil
+	}
+	requestedAt, _ := strconv.ParseInt(fields["requestedAt"], 10, 64)
+	status.RequestedAt = time.Unix(requestedAt, 0).UTC()
+	status.ChunkCount, _ = strconv.ParseInt(fields["chunkCount"], 10, 64)
+	status.Chunks, _ = strconv.ParseInt(fields["chunks"], 10, 64)
+	status.Members, _ = strconv.ParseInt(fields["members"], 10, 64)
+	status.Done = status.ChunkCount > 0 && status.Chunks >= status.ChunkCount
+	return status, nil
+}
+
+// memberChunkHandler starts filling the member cache for a guild from the gateway (POST), or reports how far it got
+// (GET). Requesting every member needs the privileged guild members intent
+func (tokenProvider *TokenProvider) memberChunkHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		guildID := mux.Vars(r)["guildID"]
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		if r.Method == http.MethodPost {
+			if primaryIntents(tokenProvider.getSettings().intents)&discordgo.IntentsGuildMembers == 0 {
+				writeError(w, r, http.StatusConflict, ErrorCodeIntentRequired, "requesting members needs the guildMembers intent")
+				return
+			}
+			sess := tokenProvider.guildSession(guildID)
+			if sess == nil {
+				writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "guild isn't on a shard this instance serves")
+				return
+			}
+			if err := tokenProvider.requestGuildMembers(ctx, sess, guildID); err != nil {
+				if ctx.Err() != nil {
+					writeError(w, r, http.StatusServiceUnavailable, ErrorCodeRateLimited, "timed out waiting for the shard's member request rate limit")
+					return
+				}
+				log.Println(err)
+				writeError(w, r, http.StatusBadGateway, ErrorCodeDiscord, err.Error())
+				return
+			}
+		}
+
+		status, err := tokenProvider.memberChunkStatus(ctx, guildID)
+		if errors.Is(err, redis.Nil) {
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "members haven't been requested for this guild")
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read member request status")
+			return
+		}
+		if r.Method == http.MethodPost {
+			writeJSON(w, http.StatusAccepted, status)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
@@ -0,0 +1,148 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+// MemberCacheTTL bounds how stale a cached member can get if an update event is missed
+const MemberCacheTTL = time.Hour
+
+// MemberFetchRateLimit bounds the REST fetches made for members that aren't cached, across all galactus instances
+var MemberFetchRateLimit = RateLimit{PerSecond: 5, Burst: 10}
+
+const memberFetchRateLimitKey = "galactus:ratelimit:memberfetch"
+
+// CachedMember is what workers need to display a player, without the rest of discordgo.Member
+type CachedMember struct {
+	UserID        string   `json:"userID"`
+	Username      string   `json:"username"`
+	Discriminator string   `json:"discriminator"`
+	Nick          string   `json:"nick,omitempty"`
+	Avatar        string   `json:"avatar,omitempty"`
+	Roles         []string `json:"roles"`
+	Bot           bool     `json:"bot,omitempty"`
+}
+
+func newCachedMember(member *discordgo.Member) CachedMember {
+	cached := CachedMember{
+		Nick:  member.Nick,
+		Roles: member.Roles,
+	}
+	if member.User != nil {
+		cached.UserID = member.User.ID
+		cached.Username = member.User.Username
+		cached.Discriminator = member.User.Discriminator
+		cached.Avatar = member.User.Avatar
+		cached.Bot = member.User.Bot
+	}
+	return cached
+}
+
+// the guild ID is the hash tag, so a guild's members live on one Redis Cluster slot
+func memberCacheKey(guildID, userID string) string {
+	return "galactus:member:{" + guildID + "}:" + userID
+}
+
+// addMemberCacheHandlers keeps the member cache up to date from the session's gateway events. Only the bot's own member
+// is sent without the guild members intent, so the cache relies mostly on REST fallbacks unless GUILD_MEMBERS_INTENT is set
+func (tokenProvider *TokenProvider) addMemberCacheHandlers(sess *discordgo.Session) {
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildCreate) {
+		tokenProvider.cacheMembers(m.ID, m.Members)
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMembersChunk) {
+		tokenProvider.cacheMembers(m.GuildID, m.Members)
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+		tokenProvider.cacheMembers(m.GuildID, []*discordgo.Member{m.Member})
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+		tokenProvider.cacheMembers(m.GuildID, []*discordgo.Member{m.Member})
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+		if m.User == nil {
+			return
+		}
+		err := tokenProvider.client.Del(context.Background(), memberCacheKey(m.GuildID, m.User.ID)).Err()
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func (tokenProvider *TokenProvider) cacheMembers(guildID string, members []*discordgo.Member) {
+	if len(members) == 0 {
+		return
+	}
+	pipe := tokenProvider.client.Pipeline()
+	for _, member := range members {
+		if member == nil || member.User == nil {
+			continue
+		}
+		jBytes, err := json.Marshal(newCachedMember(member))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		pipe.Set(context.Background(), memberCacheKey(guildID, member.User.ID), jBytes, MemberCacheTTL)
+	}
+	_, err := pipe.Exec(context.Background())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// cachedMember returns the member from the cache, or nil on a miss
+func (tokenProvider *TokenProvider) cachedMember(ctx context.Context, guildID, userID string) *CachedMember {
+	val, err := tokenProvider.client.Get(ctx, memberCacheKey(guildID, userID)).Bytes()
+	if err == nil {
+		cached := CachedMember{}
+		if err := json.Unmarshal(val, &cached); err == nil {
+			return &cached
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		log.Println(err)
+	}
+	return nil
+}
+
+// getMember returns the member from the cache, or fetches and caches it on a miss
+func (tokenProvider *TokenProvider) getMember(ctx context.Context, guildID, userID string) (*CachedMember, error) {
+	if cached := tokenProvider.cachedMember(ctx, guildID, userID); cached != nil {
+		return cached, nil
+	}
+
+	if err := tokenProvider.waitForRateLimit(ctx, memberFetchRateLimitKey, MemberFetchRateLimit); err != nil {
+		return nil, err
+	}
+	member, err := tokenProvider.primarySession.GuildMember(guildID, userID)
+	if err != nil {
+		return nil, err
+	}
+	tokenProvider.cacheMembers(guildID, []*discordgo.Member{member})
+	cached := newCachedMember(member)
+	return &cached, nil
+}
+
+func (tokenProvider *TokenProvider) memberHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		member, err := tokenProvider.getMember(ctx, vars["guildID"], vars["userID"])
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, member)
+	}
+}
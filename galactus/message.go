@@ -0,0 +1,205 @@
+package galactus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ChannelMessageRateLimit is Discord's limit on messages sent to a channel by one bot: 5 every 5 seconds
+var ChannelMessageRateLimit = RateLimit{PerSecond: 1, Burst: 5}
+
+// MessageJobTTL is how long the result of an async message request can be fetched
+const MessageJobTTL = time.Minute * 10
+
+const messageJobPending = "pending"
+
+// MessageRequest is the body of the message endpoints. Add ?async=true to get a job ID back immediately, instead of
+// waiting for the message to be sent
+type MessageRequest struct {
+	Content string                  `json:"content,omitempty"`
+	Embed   *discordgo.MessageEmbed `json:"embed,omitempty"`
+}
+
+type MessageResult struct {
+	ChannelID string `json:"channelID"`
+	MessageID string `json:"messageID,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type MessageJobResponse struct {
+	JobID string `json:"jobID"`
+}
+
+func channelMessageRateLimitKey(channelID string) string {
+	return "galactus:ratelimit:channel:" + channelID
+}
+
+func messageJobKey(jobID string) string {
+	return "galactus:message:job:" + jobID
+}
+
+// waitForRateLimit blocks until the bucket at key has room. Discord's limits are per bot, so buckets are shared by every
+// galactus instance through Redis
+func (tokenProvider *TokenProvider) waitForRateLimit(ctx context.Context, key string, limit RateLimit) error {
+	for {
+		allowed, _, wait, err := takeToken(ctx, tokenProvider.client, key, limit)
+		if err != nil {
+			// discordgo still handles Discord's 429s
+			log.Println(err)
+			return nil
+		}
+		if allowed {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// sendMessage sends, or edits if messageID isn't empty, a message with the primary session. Messages for a channel are
+// sent one at a time, in the order they were requested
+func (tokenProvider *TokenProvider) sendMessage(ctx context.Context, channelID, messageID string, request MessageRequest) MessageResult {
+	result := MessageResult{ChannelID: channelID}
+
+	// the guild sequencer orders anything keyed by ID; here, it's the channel's messages
+	turn := tokenProvider.channelSequencer.enqueue(channelID, nil)
+	if err := turn.wait(ctx); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer turn.finish()
+
+	if err := tokenProvider.waitForRateLimit(ctx, channelMessageRateLimitKey(channelID), ChannelMessageRateLimit); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var msg *discordgo.Message
+	var err error
+	if messageID == "" {
+		msg, err = tokenProvider.primarySession.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content: request.Content,
+			Embed:   request.Embed,
+		})
+	} else {
+		edit := discordgo.NewMessageEdit(channelID, messageID)
+		if request.Content != "" {
+			edit.SetContent(request.Content)
+		}
+		if request.Embed != nil {
+			edit.SetEmbed(request.Embed)
+		}
+		msg, err = tokenProvider.primarySession.ChannelMessageEditComplex(edit)
+	}
+	if err != nil {
+		log.Println(err)
+		result.Error = err.Error()
+		return result
+	}
+	result.MessageID = msg.ID
+	return result
+}
+
+func (tokenProvider *TokenProvider) messageHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		channelID := vars["channelID"]
+		messageID := vars["messageID"]
+
+		request := MessageRequest{}
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		if request.Content == "" && request.Embed == nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "a message needs content or an embed")
+			return
+		}
+
+		if r.URL.Query().Get("async") == "true" {
+			tokenProvider.sendMessageAsync(w, r, config, channelID, messageID, request)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+		result := tokenProvider.sendMessage(ctx, channelID, messageID, request)
+		if result.Error != "" {
+			writeJSON(w, http.StatusBadGateway, result)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func (tokenProvider *TokenProvider) sendMessageAsync(w http.ResponseWriter, r *http.Request, config ServerConfig, channelID, messageID string, request MessageRequest) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to create a job ID")
+		return
+	}
+	jobID := hex.EncodeToString(b)
+	err := tokenProvider.client.Set(r.Context(), messageJobKey(jobID), messageJobPending, MessageJobTTL).Err()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to store the job")
+		return
+	}
+
+	go func() {
+		// the job outlives the request that created it
+		ctx, cancel := context.WithTimeout(context.Background(), MessageJobTTL)
+		defer cancel()
+		result := tokenProvider.sendMessage(ctx, channelID, messageID, request)
+		jBytes, err := json.Marshal(result)
+		if err == nil {
+			err = tokenProvider.client.Set(ctx, messageJobKey(jobID), jBytes, MessageJobTTL).Err()
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	writeJSON(w, http.StatusAccepted, MessageJobResponse{JobID: jobID})
+}
+
+// messageJobHandler returns the result of an async message request, or 202 if it hasn't been sent yet
+func (tokenProvider *TokenProvider) messageJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["jobID"]
+	val, err := tokenProvider.client.Get(r.Context(), messageJobKey(jobID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no message job "+jobID)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the job")
+		return
+	}
+	if string(val) == messageJobPending {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	result := MessageResult{}
+	err = json.Unmarshal(val, &result)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the job")
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
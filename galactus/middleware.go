@@ -0,0 +1,170 @@
+package galactus
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// max length of a caller-provided request ID; anything longer is replaced
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	clientIdentityKey
+	apiKeyContextKey
+	localizerKey
+)
+
+// RequestIDFromContext returns the ID assigned to the request by requestIDMiddleware, if any
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Println(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware propagates the caller's X-Request-ID, or assigns a new one
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(api.RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		w.Header().Set(api.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// recoveryMiddleware turns a panic in any handler into a 500 instead of killing the connection
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				// let net/http handle its own sentinel for aborting a response
+				if err, ok := rec.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+					panic(rec)
+				}
+				log.Printf("panic serving request_id=%s: %v\n%s", RequestIDFromContext(r.Context()), rec, debug.Stack())
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessLogger writes access logs as JSON, one entry per request, for log pipelines to index
+var accessLogger = newAccessLogger()
+
+func newAccessLogger() *zap.Logger {
+	cfg := zap.NewProductionConfig()
+	// every request gets an entry, not a sample of them
+	cfg.Sampling = nil
+	cfg.DisableCaller = true
+	logger, err := cfg.Build()
+	if err != nil {
+		log.Println(err)
+		return zap.NewNop()
+	}
+	return logger.Named("access")
+}
+
+// accessLogMiddleware logs one structured entry per request
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		accessLogger.Info("request",
+			zap.String("request_id", RequestIDFromContext(r.Context())),
+			zap.String("method", r.Method),
+			// the route template rather than the path, which carries webhook and interaction tokens
+			zap.String("route", routeName(r)),
+			zap.Int("status", rec.statusCode()),
+			zap.Int("bytes", rec.bytes),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("remote", r.RemoteAddr),
+			zap.String("client", ClientIdentityFromContext(r.Context())),
+		)
+	})
+}
+
+// routeName returns the path template of the matched route, so access logs can be grouped without IDs in the path
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return tmpl
+}
+
+// statusRecorder records the status and size of a response. It passes through Flush and Hijack so streaming and
+// websocket handlers keep working behind the middleware
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
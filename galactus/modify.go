@@ -3,22 +3,264 @@ package galactus
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/api"
 	"github.com/automuteus/utils/pkg/rediskey"
 	"github.com/automuteus/utils/pkg/task"
+	"github.com/bwmarrin/discordgo"
 	"log"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func (tokenProvider *TokenProvider) attemptOnSecondaryTokens(guildID, userID string, tokens []string, limit int, request task.UserModify) bool {
+// MaxDurationHeader is the alternative to a modify request's maxDurationMs, for clients that can't change the body
+const MaxDurationHeader = "X-Max-Duration-Ms"
+
+// ModifyRequest is the body of /modify: a task.UserModifyRequest, with an optional deadline
+type ModifyRequest struct {
+	task.UserModifyRequest
+	// MaxDurationMs is how long galactus has to apply the modifications, from when the request arrived. Users it hasn't
+	// gotten to by then are reported as timed out rather than modified late
+	MaxDurationMs int64 `json:"maxDurationMs,omitempty"`
+}
+
+// modifyDeadline returns the deadline for a modify request that arrived at start, from maxDurationMs or the header,
+// or a zero time without one
+func modifyDeadline(r *http.Request, start time.Time, maxDurationMs int64) (time.Time, error) {
+	if maxDurationMs == 0 {
+		if h := r.Header.Get(MaxDurationHeader); h != "" {
+			num, err := strconv.ParseInt(h, 10, 64)
+			if err != nil {
+				return time.Time{}, errors.New(MaxDurationHeader + " must be an integer")
+			}
+			maxDurationMs = num
+		}
+	}
+	if maxDurationMs < 0 {
+		return time.Time{}, errors.New("maxDurationMs can't be negative")
+	}
+	if maxDurationMs == 0 {
+		return time.Time{}, nil
+	}
+	return start.Add(time.Duration(maxDurationMs) * time.Millisecond), nil
+}
+
+// modifyUsers applies every modification in the request, trying secondary bots, then the capture bot, then the primary
+// bot for each user, unless the mute order is configured or adapted to the guild differently. Requests for the same
+// guild are applied one at a time, in arrival order. Past a non-zero deadline, no more users or methods are attempted.
+// The results are published for the connect code once every user was attempted
+func (tokenProvider *TokenProvider) modifyUsers(ctx context.Context, guildID string, gid uint64, connectCode string, userModifications task.UserModifyRequest, deadline time.Time) api.ModifyResponse {
+	requestStart := time.Now()
+	userModifications, denied := tokenProvider.dropDeniedUsers(ctx, userModifications)
+	turn := tokenProvider.guildSequencer.enqueue(guildID, userModifications.Users)
+	if err := turn.wait(ctx); err != nil {
+		log.Printf("Request context ended (%s) while waiting for earlier requests on guild %s\n", err, guildID)
+		// none of the users were attempted, and an empty response would read as success
+		resp := api.ModifyResponse{TimedOut: make([]uint64, 0, len(userModifications.Users))}
+		for _, request := range userModifications.Users {
+			resp.TimedOut = append(resp.TimedOut, request.UserID)
+		}
+		for _, request := range denied {
+			resp.Errors = append(resp.Errors, deniedUserError(request.UserID))
+		}
+		return resp
+	}
+	defer turn.finish()
+
+	settings := tokenProvider.getSettings()
+	// secondary bots, dedicated workers and ack timeouts go by the tier galactus resolves, not the one the request claims
+	tier := tokenProvider.guildTier(ctx, guildID)
+	limit := settings.premiumBots[tier]
+	ackTimeout := settings.ackTimeout(tier)
+	tokens := tokenProvider.getAllTokensForGuild(ctx, guildID)
+	order := tokenProvider.muteOrder(settings, guildID, connectCode)
+
+	wg := sync.WaitGroup{}
+
+	mdsc := task.MuteDeafenSuccessCounts{
+		Worker:    0,
+		Capture:   0,
+		Official:  0,
+		RateLimit: 0,
+	}
+	var errs []api.UserModifyError
+	var superseded int64
+	var timedOut []uint64
+	var audit []AuditEntry
+	mdscLock := sync.Mutex{}
+
+	recordAudit := func(request task.UserModify, start time.Time, method, outcome string, userErr *api.UserModifyError, err error) {
+		entry := AuditEntry{
+			Time:        start,
+			GuildID:     guildID,
+			UserID:      request.UserID,
+			ConnectCode: connectCode,
+			Mute:        request.Mute,
+			Deaf:        request.Deaf,
+			Method:      method,
+			Outcome:     outcome,
+			LatencyMs:   time.Since(start).Milliseconds(),
+		}
+		if userErr != nil {
+			entry.Code = userErr.Code
+			entry.Message = userErr.Message
+		} else if err != nil {
+			entry.Message = err.Error()
+		}
+		mdscLock.Lock()
+		audit = append(audit, entry)
+		mdscLock.Unlock()
+	}
+
+	for _, request := range denied {
+		userErr := deniedUserError(request.UserID)
+		errs = append(errs, userErr)
+		recordAudit(request, requestStart, "", AuditOutcomeDenied, &userErr, nil)
+	}
+
+	// pastDeadline records the user as timed out if the request's deadline has passed
+	pastDeadline := func(request task.UserModify, start time.Time, method string) bool {
+		if deadline.IsZero() || time.Now().Before(deadline) {
+			return false
+		}
+		log.Printf("Deadline passed; not modifying user %d on guild %s\n", request.UserID, guildID)
+		mdscLock.Lock()
+		timedOut = append(timedOut, request.UserID)
+		mdscLock.Unlock()
+		recordAudit(request, start, method, AuditOutcomeTimedOut, nil, nil)
+		return true
+	}
+
+	modifyUser := func(request task.UserModify) {
+		start := time.Now()
+		if ctx.Err() != nil {
+			log.Printf("Request context ended (%s); skipping modify for user %d\n", ctx.Err(), request.UserID)
+			recordAudit(request, start, "", AuditOutcomeCancelled, nil, ctx.Err())
+			return
+		}
+		// checked right before the user is modified, so a request that arrives mid-batch drops the rest of this one's
+		// stale changes
+		if turn.superseded(request.UserID) {
+			log.Printf("A newer request modifies user %d on guild %s; skipping\n", request.UserID, guildID)
+			mdscLock.Lock()
+			superseded++
+			mdscLock.Unlock()
+			recordAudit(request, start, "", AuditOutcomeSuperseded, nil, nil)
+			return
+		}
+		userIDStr := strconv.FormatUint(request.UserID, 10)
+		// the method attempted last, and why it failed, for the audit entry if none of them work
+		lastMethod := ""
+		var lastErr error
+		for _, method := range order {
+			if pastDeadline(request, start, lastMethod) {
+				return
+			}
+			attempted := time.Now()
+			switch method {
+			case AuditMethodWorker:
+				success := tokenProvider.attemptOnSecondaryTokens(ctx, guildID, userIDStr, tokens, limit, request)
+				// a guild without secondary bots says nothing about how well they work
+				if len(tokens) > 0 && limit > 0 {
+					tokenProvider.mutePaths.record(method, guildID, connectCode, success, time.Since(attempted))
+				}
+				if success {
+					mdscLock.Lock()
+					mdsc.Worker++
+					mdscLock.Unlock()
+					recordAudit(request, start, method, AuditOutcomeApplied, nil, nil)
+					return
+				}
+
+			case AuditMethodCapture:
+				success, userErr := tokenProvider.attemptOnCaptureBot(ctx, guildID, connectCode, gid, ackTimeout, request)
+				// a user the capture client reports isn't in voice still means the capture client is working
+				tokenProvider.mutePaths.record(method, guildID, connectCode, success || userErr != nil, time.Since(attempted))
+				if success {
+					mdscLock.Lock()
+					mdsc.Capture++
+					mdscLock.Unlock()
+					recordAudit(request, start, method, AuditOutcomeApplied, nil, nil)
+					return
+				}
+				if userErr != nil {
+					// no other method can succeed either, so report it back instead of trying them
+					mdscLock.Lock()
+					errs = append(errs, *userErr)
+					mdscLock.Unlock()
+					recordAudit(request, start, method, AuditOutcomeRejected, userErr, nil)
+					return
+				}
+
+			case AuditMethodOfficial:
+				log.Printf("Applying mute=%v, deaf=%v using primary bot\n", request.Mute, request.Deaf)
+				sess, hToken := tokenProvider.officialSession(gid)
+				err := tokenProvider.applyMuteDeaf(ctx, sess, hToken, guildID, userIDStr, request.Mute, request.Deaf)
+				tokenProvider.mutePaths.record(method, guildID, connectCode, err == nil, time.Since(attempted))
+				if err == nil {
+					mdscLock.Lock()
+					mdsc.Official++
+					mdscLock.Unlock()
+					recordAudit(request, start, method, AuditOutcomeApplied, nil, nil)
+					return
+				}
+				log.Println(err)
+				lastErr = err
+			}
+			lastMethod = method
+		}
+		recordAudit(request, start, lastMethod, AuditOutcomeFailed, nil, lastErr)
+	}
+
+	// the work runs on the shared pool, or the tier's dedicated workers, but at most maxWorkers of this request's users
+	// are in flight at once, so one large request can't starve the others
+	inFlight := make(chan struct{}, settings.maxWorkers)
+	for _, modifyReq := range userModifications.Users {
+		request := modifyReq
+		wg.Add(1)
+		inFlight <- struct{}{}
+		err := tokenProvider.workers.submit(ctx, tier, settings.queueWait(tier), func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			modifyUser(request)
+		})
+		if err != nil {
+			log.Printf("Request context ended (%s); skipping modify for user %d\n", err, request.UserID)
+			recordAudit(request, time.Now(), "", AuditOutcomeCancelled, nil, err)
+			<-inFlight
+			wg.Done()
+		}
+	}
+	wg.Wait()
+
+	resp := api.ModifyResponse{
+		MuteDeafenSuccessCounts: mdsc,
+		Errors:                  errs,
+		Superseded:              superseded,
+		TimedOut:                timedOut,
+	}
+	tokenProvider.recordModifyStats(guildID, resp)
+	tokenProvider.recordAudit(guildID, audit)
+	tokenProvider.publishModifyResult(guildID, connectCode, requestStart, resp, audit)
+	return resp
+}
+
+func (tokenProvider *TokenProvider) attemptOnSecondaryTokens(ctx context.Context, guildID, userID string, tokens []string, limit int, request task.UserModify) bool {
 	if tokens != nil && limit > 0 {
-		sess, hToken := tokenProvider.getAnySession(guildID, tokens, limit)
+		sess, hToken := tokenProvider.getAnySession(ctx, guildID, tokens, limit)
 		if sess != nil {
-			err := task.ApplyMuteDeaf(sess, guildID, userID, request.Mute, request.Deaf)
+			err := tokenProvider.applyMuteDeaf(ctx, sess, hToken, guildID, userID, request.Mute, request.Deaf)
 			if err != nil {
 				log.Println("Failed to apply mute to player with error:")
 				log.Println(err)
 			} else {
 				log.Printf("Successfully applied mute=%v, deaf=%v to User %d using secondary bot: %s\n", request.Mute, request.Deaf, request.UserID, hToken)
+				tokenProvider.recordTokenUsage(guildID, hToken)
 				return true
 			}
 		} else {
@@ -30,9 +272,19 @@ func (tokenProvider *TokenProvider) attemptOnSecondaryTokens(guildID, userID str
 	return false
 }
 
-func (tokenProvider *TokenProvider) attemptOnCaptureBot(guildID, connectCode string, gid uint64, timeout time.Duration, request task.UserModify) bool {
+// applyMuteDeaf wraps task.ApplyMuteDeaf with the retry policy; discordgo requests can't be cancelled, so the best we
+// can do is not start one for a request that has already been abandoned. hashedToken is empty for the primary bot
+func (tokenProvider *TokenProvider) applyMuteDeaf(ctx context.Context, sess *discordgo.Session, hashedToken, guildID, userID string, mute, deaf bool) error {
+	return tokenProvider.retryDiscord(ctx, hashedToken, func() error {
+		return task.ApplyMuteDeaf(sess, guildID, userID, mute, deaf)
+	})
+}
+
+// attemptOnCaptureBot returns true if the capture bot applied the modification. If the capture bot reported a failure
+// that no other method can fix (like the user not being in voice), it's returned so the caller can skip the primary bot
+func (tokenProvider *TokenProvider) attemptOnCaptureBot(ctx context.Context, guildID, connectCode string, gid uint64, timeout time.Duration, request task.UserModify) (bool, *api.UserModifyError) {
 	// this is cheeky, but use the connect code as part of the lock; don't issue too many requests on the capture client w/ this code
-	if tokenProvider.IncrAndTestGuildTokenComboLock(guildID, connectCode) {
+	if tokenProvider.TakeGuildTokenRateLimit(ctx, guildID, connectCode) {
 		// if the secondary token didn't work, then next we try the client-side capture request
 		taskObj := task.NewModifyTask(gid, request.UserID, task.PatchParams{
 			Deaf: request.Deaf,
@@ -41,31 +293,85 @@ func (tokenProvider *TokenProvider) attemptOnCaptureBot(guildID, connectCode str
 		jBytes, err := json.Marshal(taskObj)
 		if err != nil {
 			log.Println(err)
-			return false
+			return false, nil
 		}
-		acked := make(chan bool)
-		// now we wait for an ack with respect to actually performing the mute
-		pubsub := tokenProvider.client.Subscribe(context.Background(), rediskey.CompleteTask(taskObj.TaskID))
-		err = tokenProvider.client.Publish(context.Background(), rediskey.TasksSubscribe(connectCode), jBytes).Err()
-		if err != nil {
-			log.Println("Error in publishing task to " + rediskey.TasksSubscribe(connectCode))
-			log.Println(err)
+		var res ack.Ack
+		var acked bool
+		published := time.Now()
+		if sock := tokenProvider.getCaptureSocket(connectCode); sock != nil {
+			// the capture client is connected to this instance, so the task goes straight to it
+			res, acked = tokenProvider.pushCaptureTask(ctx, sock, taskObj, jBytes, timeout)
 		} else {
-			go tokenProvider.waitForAck(pubsub, timeout, acked)
-			res := <-acked
-			if res {
-				log.Println("Successful mute/deafen using client capture bot!")
+			// now we wait for an ack with respect to actually performing the mute
+			pubsub := tokenProvider.client.Subscribe(ctx, rediskey.CompleteTask(taskObj.TaskID))
+			err = tokenProvider.client.Publish(ctx, rediskey.TasksSubscribe(connectCode), jBytes).Err()
+			if err != nil {
+				log.Println("Error in publishing task to " + rediskey.TasksSubscribe(connectCode))
+				log.Println(err)
+				pubsub.Close()
+				return false, nil
+			}
+			published = time.Now()
+			res, acked = tokenProvider.waitForAck(ctx, pubsub, timeout)
+		}
+		if acked {
+			captureAckLatency.Observe(time.Since(published).Seconds())
+		}
+		if acked && res.Success {
+			log.Println("Successful mute/deafen using client capture bot!")
+			captureTasksTotal.WithLabelValues(captureResultSuccess).Inc()
 
-				// hooray! we did the mute with a client token!
-				return true
+			// hooray! we did the mute with a client token!
+			return true, nil
+		}
+		if !acked {
+			if ctx.Err() != nil {
+				// the request was abandoned; that's not the capture client's fault
+				captureTasksTotal.WithLabelValues(captureResultCancelled).Inc()
+				return false, nil
 			}
-			err := tokenProvider.BlacklistTokenForDuration(guildID, connectCode, UnresponsiveCaptureBlacklistDuration)
-			if err == nil {
-				log.Printf("No ack from capture clients; blacklisting capture client for gamecode \"%s\" for %s\n", connectCode, UnresponsiveCaptureBlacklistDuration.String())
+			captureTasksTotal.WithLabelValues(captureResultTimeout).Inc()
+			tokenProvider.publishEvent(EventCaptureTimeout, CaptureTimeoutEvent{GuildID: guildID, ConnectCode: connectCode})
+			tokenProvider.blacklistCapture(ctx, guildID, connectCode, UnresponsiveCaptureBlacklistDuration, captureBlacklistUnresponsive, "No ack from capture clients")
+			return false, nil
+		}
+
+		captureTasksTotal.WithLabelValues(captureResultFailed).Inc()
+		switch res.Code {
+		case ack.UserNotInVoice:
+			log.Printf("Capture client reports user %d is not in voice; not attempting other methods\n", request.UserID)
+			return false, &api.UserModifyError{
+				UserID:  request.UserID,
+				Code:    res.Code,
+				Message: res.Message,
 			}
+		case ack.RateLimited:
+			tokenProvider.blacklistCapture(ctx, guildID, connectCode, RateLimitedCaptureBlacklistDuration, captureBlacklistRateLimited, "Capture client is rate-limited")
+		case ack.MissingPermissions:
+			tokenProvider.blacklistCapture(ctx, guildID, connectCode, UnresponsiveCaptureBlacklistDuration, captureBlacklistMissingPermissions, "Capture client is missing permissions")
+		default:
+			tokenProvider.blacklistCapture(ctx, guildID, connectCode, UnresponsiveCaptureBlacklistDuration, captureBlacklistFailed, "Capture client failed the task")
 		}
 	} else {
 		log.Println("Capture client is probably rate-limited. Deferring to main bot instead")
+		captureTasksTotal.WithLabelValues(captureResultSkipped).Inc()
+	}
+	return false, nil
+}
+
+// blacklistCapture skips the capture client for duration. metricReason labels galactus_capture_blacklists_total
+func (tokenProvider *TokenProvider) blacklistCapture(ctx context.Context, guildID, connectCode string, duration time.Duration, metricReason, reason string) {
+	err := tokenProvider.BlacklistTokenForDuration(ctx, guildID, connectCode, duration)
+	if err != nil {
+		log.Println(err)
+	} else {
+		captureBlacklistsTotal.WithLabelValues(metricReason).Inc()
+		tokenProvider.publishEvent(EventCaptureBlacklist, BlacklistEvent{
+			GuildID:     guildID,
+			ConnectCode: connectCode,
+			DurationMs:  duration.Milliseconds(),
+			Reason:      metricReason,
+		})
+		log.Printf("%s; blacklisting capture client for gamecode \"%s\" for %s\n", reason, connectCode, duration.String())
 	}
-	return false
 }
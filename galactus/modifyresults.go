@@ -0,0 +1,74 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/api"
+	"log"
+	"time"
+)
+
+// ModifyResultsChannel is the Redis pubsub channel a connect code's modify results are published on, so automuteus can
+// update its game's embed without waiting on /modify
+func ModifyResultsChannel(connectCode string) string {
+	return "galactus:modify:results:" + connectCode
+}
+
+// ModifyResult is published once all of a modify request's users were attempted
+type ModifyResult struct {
+	GuildID     string `json:"guildID"`
+	ConnectCode string `json:"connectCode"`
+	// unix ms
+	Time       int64 `json:"time"`
+	DurationMs int64 `json:"durationMs"`
+	api.ModifyResponse
+	Users []ModifyResultUser `json:"users"`
+}
+
+// ModifyResultUser is how one user of the request was modified, or why they weren't
+type ModifyResultUser struct {
+	UserID uint64 `json:"userID"`
+	Mute   bool   `json:"mute"`
+	Deaf   bool   `json:"deaf"`
+	// Method is empty if no method was attempted
+	Method  string   `json:"method,omitempty"`
+	Outcome string   `json:"outcome"`
+	Code    ack.Code `json:"code,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// publishModifyResult sends a modify request's results to anyone subscribed to its connect code. Requests without a
+// connect code aren't published, and like other events, nothing waits on it
+func (tokenProvider *TokenProvider) publishModifyResult(guildID, connectCode string, start time.Time, resp api.ModifyResponse, audit []AuditEntry) {
+	if connectCode == "" {
+		return
+	}
+	result := ModifyResult{
+		GuildID:        guildID,
+		ConnectCode:    connectCode,
+		Time:           time.Now().UnixNano() / int64(time.Millisecond),
+		DurationMs:     time.Since(start).Milliseconds(),
+		ModifyResponse: resp,
+		Users:          make([]ModifyResultUser, 0, len(audit)),
+	}
+	for _, entry := range audit {
+		result.Users = append(result.Users, ModifyResultUser{
+			UserID:  entry.UserID,
+			Mute:    entry.Mute,
+			Deaf:    entry.Deaf,
+			Method:  entry.Method,
+			Outcome: entry.Outcome,
+			Code:    entry.Code,
+			Message: entry.Message,
+		})
+	}
+	jBytes, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := tokenProvider.client.Publish(context.Background(), ModifyResultsChannel(connectCode), jBytes).Err(); err != nil {
+		log.Println(err)
+	}
+}
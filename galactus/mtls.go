@@ -0,0 +1,96 @@
+package galactus
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+const ErrorCodeClientCertRequired = "CLIENT_CERT_REQUIRED"
+
+// ClientIdentityFromContext returns the identity of the client certificate the request was made with, if it was
+// verified against the client CA: its common name, or else its first DNS or URI name
+func ClientIdentityFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(clientIdentityKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+func (config ServerConfig) useMTLS() bool {
+	return config.useTLS() && config.TLSClientCAFile != ""
+}
+
+// tlsConfig asks clients for a certificate signed by the client CA, if one is configured. Clients without one can still
+// connect, so capture clients and health checks keep working; serviceAuth turns them away from everything else
+func (config ServerConfig) tlsConfig() (*tls.Config, error) {
+	if !config.useMTLS() {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(config.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading GALACTUS_TLS_CLIENT_CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in GALACTUS_TLS_CLIENT_CA %s", config.TLSClientCAFile)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// grpcTLSConfig serves gRPC with the HTTP API's certificate. Every gRPC method is for workers and bots, so with a client
+// CA configured, gRPC clients have to present a certificate signed by it
+func (config ServerConfig) grpcTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// clientIdentityMiddleware puts the identity of a verified client certificate on the request's context
+func clientIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasClientCert(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := certIdentity(r.TLS.VerifiedChains[0][0])
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIdentityKey, id)))
+	})
+}
+
+// hasClientCert is whether the request was made with a certificate signed by the client CA; the TLS handshake only
+// leaves verified chains for those
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
@@ -0,0 +1,122 @@
+package galactus
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+// NickSessionTTL is how long original nicknames are kept for a connect code, in case the game's restore never comes
+const NickSessionTTL = time.Hour * 24
+
+type NickRequest struct {
+	Nick string `json:"nick"`
+	// ConnectCode is the game the rename belongs to; the user's original nickname is recorded for restoring at its end
+	ConnectCode string `json:"connectCode,omitempty"`
+}
+
+type NickRestoreResponse struct {
+	Restored int `json:"restored"`
+	// Failed maps the users that couldn't be restored to the error; they're kept, so the restore can be retried
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// userID -> the nickname the user had before the game first renamed them. Empty means they had none
+func nickSessionKey(guildID, connectCode string) string {
+	return "galactus:nick:{" + guildID + "}:" + connectCode
+}
+
+// nickHandler changes a member's nickname with the primary bot
+func (tokenProvider *TokenProvider) nickHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		guildID := vars["guildID"]
+		userID := vars["userID"]
+
+		request := NickRequest{}
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		if request.ConnectCode != "" {
+			member, err := tokenProvider.getMember(ctx, guildID, userID)
+			if err != nil {
+				log.Println(err)
+				writeDiscordError(w, r, err)
+				return
+			}
+			// only the first rename in a game records the original
+			key := nickSessionKey(guildID, request.ConnectCode)
+			pipe := tokenProvider.client.TxPipeline()
+			pipe.HSetNX(ctx, key, userID, member.Nick)
+			pipe.Expire(ctx, key, NickSessionTTL)
+			if _, err := pipe.Exec(ctx); err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to record the original nickname")
+				return
+			}
+		}
+
+		err := tokenProvider.retryDiscord(ctx, "", func() error {
+			return tokenProvider.primarySession.GuildMemberNickname(guildID, userID, request.Nick)
+		})
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// nickRestoreHandler reverts every nickname changed for a connect code to what it was before the game
+func (tokenProvider *TokenProvider) nickRestoreHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		guildID := vars["guildID"]
+		key := nickSessionKey(guildID, vars["connectCode"])
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		originals, err := tokenProvider.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the original nicknames")
+			return
+		}
+
+		resp := NickRestoreResponse{}
+		for userID, nick := range originals {
+			if err := ctx.Err(); err != nil {
+				if resp.Failed == nil {
+					resp.Failed = map[string]string{}
+				}
+				resp.Failed[userID] = err.Error()
+				continue
+			}
+			err := tokenProvider.retryDiscord(ctx, "", func() error {
+				return tokenProvider.primarySession.GuildMemberNickname(guildID, userID, nick)
+			})
+			if err == nil {
+				err = tokenProvider.client.HDel(ctx, key, userID).Err()
+			}
+			if err != nil {
+				log.Println(err)
+				if resp.Failed == nil {
+					resp.Failed = map[string]string{}
+				}
+				resp.Failed[userID] = err.Error()
+				continue
+			}
+			resp.Restored++
+		}
+		log.Printf("Restored %d nicknames on guild %s\n", resp.Restored, guildID)
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,209 @@
+package galactus
+
+import (
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/utils/pkg/task"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const OpenAPIVersion = "3.0.3"
+
+var pathParamRegex = regexp.MustCompile(`{([^}]+)}`)
+
+// openAPISpec builds an OpenAPI document from the route table. Request and response schemas are derived from the Go
+// types on each route, so the document can't drift from what the handlers actually decode and encode
+func openAPISpec(versions map[string][]route) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	// not returned directly by any route, but documented for clients consuming job queues and errors
+	schemaFor(reflect.TypeOf(task.Job{}), schemas)
+	schemaFor(reflect.TypeOf(api.ErrorResponse{}), schemas)
+
+	paths := map[string]interface{}{}
+	versionNames := make([]string, 0, len(versions))
+	for v := range versions {
+		versionNames = append(versionNames, v)
+	}
+	sort.Strings(versionNames)
+
+	for _, version := range versionNames {
+		for _, rt := range versions[version] {
+			path := "/" + version + rt.Path
+			if rt.Path == "/" {
+				path = "/" + version + "/"
+			}
+			item, ok := paths[path].(map[string]interface{})
+			if !ok {
+				item = map[string]interface{}{}
+				paths[path] = item
+			}
+			for _, method := range rt.Methods {
+				item[strings.ToLower(method)] = operationFor(version, rt, schemas)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "Galactus",
+			"description": "Mute/deafen proxy and token provider for AutoMuteUs. Routes of the " + LegacyAPIVersion + " API are also served without a version prefix.",
+			"version":     LegacyAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+}
+
+func operationFor(version string, rt route, schemas map[string]interface{}) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary": rt.Summary,
+		"tags":    []string{version},
+	}
+
+	var params []interface{}
+	for _, match := range pathParamRegex.FindAllStringSubmatch(rt.Path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	// the API key roles that can call the route, besides admin
+	if len(rt.Roles) > 0 {
+		op["x-roles"] = rt.Roles
+	}
+
+	if rt.Request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  contentFor(rt.Request, schemas),
+		}
+	}
+
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": schemaFor(reflect.TypeOf(api.ErrorResponse{}), schemas),
+				},
+			},
+		},
+	}
+	ok := map[string]interface{}{"description": "Success"}
+	if rt.Response != nil {
+		ok["content"] = contentFor(rt.Response, schemas)
+	}
+	responses["200"] = ok
+	op["responses"] = responses
+	return op
+}
+
+// contentFor treats string bodies as plain text, and anything else as JSON
+func contentFor(body interface{}, schemas map[string]interface{}) map[string]interface{} {
+	t := reflect.TypeOf(body)
+	if t.Kind() == reflect.String {
+		return map[string]interface{}{
+			"text/plain": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": schemaFor(t, schemas),
+		},
+	}
+}
+
+// schemaFor returns the JSON schema for t. Named structs are added to schemas and referenced by name
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		// any JSON value, not the bytes it's held in
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// placeholder first, in case the type refers to itself
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// interface{} and anything else; any JSON value
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	addStructProperties(t, properties, schemas)
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// addStructProperties follows encoding/json's rules closely enough for our types: embedded structs are flattened, and
+// fields tagged "-" or unexported are skipped
+func addStructProperties(t reflect.Type, properties map[string]interface{}, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructProperties(field.Type, properties, schemas)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaFor(field.Type, schemas)
+	}
+}
+
+func openAPIHandler(spec map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, spec)
+	}
+}
@@ -0,0 +1,164 @@
+package galactus
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultOutageErrorPercent is the share of Discord calls that have to fail for galactus to call it an outage
+	DefaultOutageErrorPercent = 50
+	// DefaultOutageMinRequests keeps a handful of failures on a quiet instance from counting as an outage
+	DefaultOutageMinRequests = 20
+	DefaultOutageWindow      = 30 * time.Second
+	// OutageProbeInterval is how often Discord is checked for recovery during an outage
+	OutageProbeInterval = 5 * time.Second
+	// outageRecoveryProbes is how many probes in a row have to succeed to end an outage
+	outageRecoveryProbes = 2
+)
+
+const ErrorCodeDiscordOutage = "DISCORD_OUTAGE"
+
+var discordOutage = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "galactus_discord_outage",
+	Help: "1 while this instance considers Discord to be down and fails modify requests fast",
+})
+
+// probes skip the sessions, and so the breakers, since they're what's waiting on the answer
+var outageProbeClient = &http.Client{Timeout: OutageProbeInterval}
+
+type outageSettings struct {
+	// 0 disables outage detection
+	errorPercent int64
+	minRequests  int64
+	window       time.Duration
+}
+
+// OutageEvent reports the Discord calls that started an outage
+type OutageEvent struct {
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+}
+
+type outageBucket struct {
+	second   int64
+	calls    int64
+	failures int64
+}
+
+// outageDetector counts the outcome of every Discord REST call this instance makes, across all tokens and shards, in
+// one-second buckets over the window
+type outageDetector struct {
+	lock    sync.Mutex
+	buckets []outageBucket
+	active  bool
+}
+
+func newOutageDetector() *outageDetector {
+	return &outageDetector{}
+}
+
+func (detector *outageDetector) isActive() bool {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	return detector.active
+}
+
+// record counts a call, and returns the window's totals if it started an outage. Calls made during an outage aren't
+// counted; only the probes end it
+func (detector *outageDetector) record(s outageSettings, failed bool, now time.Time) (bool, OutageEvent) {
+	if s.errorPercent == 0 {
+		return false, OutageEvent{}
+	}
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	if detector.active {
+		return false, OutageEvent{}
+	}
+	n := int64(s.window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	if int64(len(detector.buckets)) != n {
+		detector.buckets = make([]outageBucket, n)
+	}
+	sec := now.Unix()
+	bucket := &detector.buckets[sec%n]
+	if bucket.second != sec {
+		*bucket = outageBucket{second: sec}
+	}
+	bucket.calls++
+	if failed {
+		bucket.failures++
+	}
+
+	totals := OutageEvent{}
+	for _, b := range detector.buckets {
+		if sec-b.second < n {
+			totals.Requests += b.calls
+			totals.Failures += b.failures
+		}
+	}
+	if totals.Requests < s.minRequests || totals.Failures*100 < s.errorPercent*totals.Requests {
+		return false, OutageEvent{}
+	}
+	detector.active = true
+	detector.buckets = nil
+	return true, totals
+}
+
+func (detector *outageDetector) end() {
+	detector.lock.Lock()
+	detector.active = false
+	detector.lock.Unlock()
+}
+
+// recordDiscordCall feeds a REST call's outcome to the outage detector, starting degraded mode if Discord is failing
+// most calls
+func (tokenProvider *TokenProvider) recordDiscordCall(failed bool) {
+	started, totals := tokenProvider.outage.record(tokenProvider.getSettings().outage, failed, time.Now())
+	if !started {
+		return
+	}
+	log.Printf("Discord failed %d of the last %d calls; failing modify requests fast until it recovers\n", totals.Failures, totals.Requests)
+	discordOutage.Set(1)
+	tokenProvider.publishEvent(EventDiscordOutage, totals)
+	go tokenProvider.probeUntilRecovered()
+}
+
+// probeUntilRecovered checks Discord's gateway endpoint, which needs no token, until it answers several times in a row
+func (tokenProvider *TokenProvider) probeUntilRecovered() {
+	ticker := time.NewTicker(OutageProbeInterval)
+	defer ticker.Stop()
+	successes := 0
+	for range ticker.C {
+		resp, err := outageProbeClient.Get(discordgo.EndpointGateway)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if isDiscordFailure(resp, err) {
+			successes = 0
+			continue
+		}
+		successes++
+		if successes >= outageRecoveryProbes {
+			break
+		}
+	}
+	tokenProvider.outage.end()
+	discordOutage.Set(0)
+	log.Println("Discord has recovered; resuming modify requests")
+	tokenProvider.publishEvent(EventDiscordRecovered, nil)
+}
+
+// writeOutageError fails a modify request fast during an outage, rather than letting it wait out every method's timeout
+func writeOutageError(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(OutageProbeInterval.Seconds())))
+	writeError(w, r, http.StatusServiceUnavailable, ErrorCodeDiscordOutage, "Discord is failing most requests; modifications are paused until it recovers")
+}
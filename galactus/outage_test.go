@@ -0,0 +1,64 @@
+package galactus
+
+import (
+	"github.com/automuteus/galactus/pkg/config"
+	"testing"
+	"time"
+)
+
+var testOutageSettings = outageSettings{
+	errorPercent: DefaultOutageErrorPercent,
+	minRequests:  DefaultOutageMinRequests,
+	window:       DefaultOutageWindow,
+}
+
+// outageAfter feeds the detector calls 100ms apart that fail as the seeded faults decide, returning the call that
+// started an outage, or -1 if none did
+func outageAfter(t *testing.T, detector *outageDetector, seed, errorPercent int64, calls int) (int, OutageEvent) {
+	t.Helper()
+	rule := config.FaultRule{ErrorPercent: errorPercent}
+	faults := newFaultInjector(config.FaultConfig{Enabled: true, Seed: seed, Discord: rule})
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < calls; i++ {
+		failed := faults.roll(faultTargetDiscord, rule) != ""
+		if started, totals := detector.record(testOutageSettings, failed, start.Add(time.Duration(i)*100*time.Millisecond)); started {
+			return i, totals
+		}
+	}
+	return -1, OutageEvent{}
+}
+
+func TestOutageDetectorWithInjectedFaults(t *testing.T) {
+	detector := newOutageDetector()
+	if i, _ := outageAfter(t, detector, 1, 10, 1000); i != -1 {
+		t.Fatalf("10%% of calls failing started an outage at call %d", i)
+	}
+	if detector.isActive() {
+		t.Fatal("the detector is active without an outage")
+	}
+
+	detector = newOutageDetector()
+	i, totals := outageAfter(t, detector, 1, 80, 1000)
+	if i == -1 {
+		t.Fatal("80% of calls failing didn't start an outage")
+	}
+	if i < DefaultOutageMinRequests-1 || totals.Requests < DefaultOutageMinRequests {
+		t.Fatalf("an outage started after %d calls, with %d in the window; want at least %d", i+1, totals.Requests, DefaultOutageMinRequests)
+	}
+	if totals.Failures*100 < DefaultOutageErrorPercent*totals.Requests {
+		t.Fatalf("an outage started with %d of %d calls failing", totals.Failures, totals.Requests)
+	}
+	if !detector.isActive() {
+		t.Fatal("the detector isn't active during the outage")
+	}
+	// calls during an outage aren't counted; only the probes end it
+	if started, _ := detector.record(testOutageSettings, true, time.Now()); started {
+		t.Fatal("a call during the outage started another one")
+	}
+
+	detector.end()
+	again, _ := outageAfter(t, detector, 1, 80, 1000)
+	if again != i {
+		t.Fatalf("after the outage ended, the same seeded faults started one at call %d, not %d", again, i)
+	}
+}
@@ -0,0 +1,180 @@
+package galactus
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultPermissionCheckInterval = time.Minute * 10
+
+// RequiredTokenPermissions are what a secondary bot needs to be of any use for muting
+const RequiredTokenPermissions = discordgo.PermissionVoiceMuteMembers | discordgo.PermissionVoiceDeafenMembers
+
+// tokenPermissions records which secondary tokens are missing RequiredTokenPermissions on which guilds, so they aren't
+// handed out for requests that would only fail and burn their rate limit
+type tokenPermissions struct {
+	// hashed token -> guild ID -> missing permission bits
+	missing map[string]map[string]int
+	lock    sync.RWMutex
+}
+
+func newTokenPermissions() *tokenPermissions {
+	return &tokenPermissions{
+		missing: make(map[string]map[string]int),
+	}
+}
+
+func (perms *tokenPermissions) set(hashedToken, guildID string, missing int) {
+	perms.lock.Lock()
+	defer perms.lock.Unlock()
+	if missing == 0 {
+		delete(perms.missing[hashedToken], guildID)
+		if len(perms.missing[hashedToken]) == 0 {
+			delete(perms.missing, hashedToken)
+		}
+		return
+	}
+	if perms.missing[hashedToken] == nil {
+		perms.missing[hashedToken] = make(map[string]int)
+	}
+	perms.missing[hashedToken][guildID] = missing
+}
+
+func (perms *tokenPermissions) usable(hashedToken, guildID string) bool {
+	perms.lock.RLock()
+	defer perms.lock.RUnlock()
+	_, missing := perms.missing[hashedToken][guildID]
+	return !missing
+}
+
+// guildPermissions computes the guild-wide permissions of the session's own bot user. GuildCreate includes the bot's
+// own member even without the members intent, so this doesn't need a request to Discord
+func guildPermissions(sess *discordgo.Session, guild *discordgo.Guild) (int, bool) {
+	if sess.State == nil || sess.State.User == nil {
+		return 0, false
+	}
+	return memberPermissions(sess.State.User.ID, guild)
+}
+
+// memberPermissions computes a member's guild-wide permissions from the guild's roles, if the guild includes the member
+func memberPermissions(userID string, guild *discordgo.Guild) (int, bool) {
+	if guild.OwnerID == userID {
+		return discordgo.PermissionAll, true
+	}
+
+	var member *discordgo.Member
+	for _, m := range guild.Members {
+		if m.User != nil && m.User.ID == userID {
+			member = m
+			break
+		}
+	}
+	if member == nil {
+		return 0, false
+	}
+
+	perms := 0
+	for _, role := range guild.Roles {
+		// the @everyone role shares the guild's ID
+		if role.ID == guild.ID {
+			perms |= role.Permissions
+			continue
+		}
+		for _, roleID := range member.Roles {
+			if role.ID == roleID {
+				perms |= role.Permissions
+				break
+			}
+		}
+	}
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll, true
+	}
+	return perms, true
+}
+
+// checkTokenPermissions records whether the token can mute and deafen on the guild. If the bot's permissions can't be
+// determined, the token is left usable
+func (tokenProvider *TokenProvider) checkTokenPermissions(sess *discordgo.Session, hashedToken string, guild *discordgo.Guild) {
+	perms, ok := guildPermissions(sess, guild)
+	if !ok {
+		return
+	}
+	missing := RequiredTokenPermissions &^ perms
+	if missing != 0 && tokenProvider.permissions.usable(hashedToken, guild.ID) {
+		log.Printf("Token %s is missing mute/deafen permissions on guild %s; not using it there\n", hashedToken, guild.ID)
+	}
+	tokenProvider.permissions.set(hashedToken, guild.ID, missing)
+}
+
+// CheckPermissionsPeriodically re-checks every secondary token on every guild, to notice roles that were granted or
+// revoked since the guild was joined
+func (tokenProvider *TokenProvider) CheckPermissionsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for hToken, sess := range tokenProvider.sessions.snapshot() {
+			sess.State.RLock()
+			guilds := make([]*discordgo.Guild, len(sess.State.Guilds))
+			copy(guilds, sess.State.Guilds)
+			sess.State.RUnlock()
+			for _, guild := range guilds {
+				tokenProvider.checkTokenPermissions(sess, hToken, guild)
+			}
+		}
+	}
+}
+
+func PermissionCheckIntervalFromEnv() time.Duration {
+	interval := DefaultPermissionCheckInterval
+	num, err := strconv.ParseInt(os.Getenv("PERMISSION_CHECK_INTERVAL_SEC"), 10, 64)
+	if err == nil && num > 0 {
+		log.Printf("Read from env; using PERMISSION_CHECK_INTERVAL_SEC=%d\n", num)
+		interval = time.Second * time.Duration(num)
+	}
+	return interval
+}
+
+type AdminPermissionsResponse struct {
+	Problems []TokenPermissionProblem `json:"problems"`
+}
+
+type TokenPermissionProblem struct {
+	HashedToken string   `json:"hashedToken"`
+	GuildID     string   `json:"guildID"`
+	Missing     []string `json:"missing"`
+}
+
+var permissionNames = map[int]string{
+	discordgo.PermissionVoiceMuteMembers:   "MUTE_MEMBERS",
+	discordgo.PermissionVoiceDeafenMembers: "DEAFEN_MEMBERS",
+}
+
+func (tokenProvider *TokenProvider) adminPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	problems := []TokenPermissionProblem{}
+	tokenProvider.permissions.lock.RLock()
+	for hToken, guilds := range tokenProvider.permissions.missing {
+		for guildID, missing := range guilds {
+			problems = append(problems, TokenPermissionProblem{
+				HashedToken: hToken,
+				GuildID:     guildID,
+				Missing:     missingPermissionNames(missing),
+			})
+		}
+	}
+	tokenProvider.permissions.lock.RUnlock()
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].HashedToken != problems[j].HashedToken {
+			return problems[i].HashedToken < problems[j].HashedToken
+		}
+		return problems[i].GuildID < problems[j].GuildID
+	})
+
+	writeJSON(w, http.StatusOK, AdminPermissionsResponse{Problems: problems})
+}
@@ -0,0 +1,288 @@
+package galactus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	_ "github.com/lib/pq"
+	"log"
+	// registers the "postgres" driver
+	"strconv"
+	"time"
+)
+
+// postgresMigrationLock is the advisory lock held while migrating, so instances starting together don't race
+const postgresMigrationLock = 7201520
+
+// postgresMigrations are applied in order, once each; never edit one that has shipped, add another instead
+var postgresMigrations = []string{
+	`CREATE TABLE audit_entries (
+		id BIGSERIAL PRIMARY KEY,
+		time TIMESTAMPTZ NOT NULL,
+		guild_id TEXT NOT NULL,
+		user_id BIGINT NOT NULL,
+		connect_code TEXT NOT NULL,
+		mute BOOLEAN NOT NULL,
+		deaf BOOLEAN NOT NULL,
+		method TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		latency_ms BIGINT NOT NULL,
+		code TEXT NOT NULL,
+		message TEXT NOT NULL
+	);
+	CREATE INDEX audit_entries_guild_time ON audit_entries (guild_id, time DESC);`,
+
+	`CREATE TABLE daily_stats (
+		day DATE NOT NULL,
+		guild_id TEXT NOT NULL,
+		worker BIGINT NOT NULL DEFAULT 0,
+		capture BIGINT NOT NULL DEFAULT 0,
+		official BIGINT NOT NULL DEFAULT 0,
+		failed BIGINT NOT NULL DEFAULT 0,
+		superseded BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (day, guild_id)
+	);`,
+
+	`CREATE TABLE token_events (
+		id BIGSERIAL PRIMARY KEY,
+		time TIMESTAMPTZ NOT NULL,
+		hashed_token TEXT NOT NULL,
+		event TEXT NOT NULL,
+		instance_id TEXT NOT NULL,
+		guilds INT NOT NULL,
+		message TEXT NOT NULL
+	);
+	CREATE INDEX token_events_token_time ON token_events (hashed_token, time);`,
+
+	`CREATE TABLE guild_settings (
+		guild_id TEXT PRIMARY KEY,
+		settings JSONB NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL
+	);`,
+}
+
+type postgresStorage struct {
+	db *sql.DB
+}
+
+// newPostgresStorage connects to Postgres and applies any migrations it hasn't seen yet
+func newPostgresStorage(ctx context.Context, cfg config.PostgresConfig) (*postgresStorage, error) {
+	db, err := sql.Open("postgres", cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	storage := &postgresStorage{db: db}
+	if err := storage.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (storage *postgresStorage) migrate(ctx context.Context) error {
+	// advisory locks belong to a connection, so everything has to run on the same one
+	conn, err := storage.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresMigrationLock); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", postgresMigrationLock); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	var applied int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&applied); err != nil {
+		return err
+	}
+
+	for i := applied; i < len(postgresMigrations); i++ {
+		version := i + 1
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, postgresMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		log.Printf("Applied Postgres migration %d\n", version)
+	}
+	return nil
+}
+
+func (storage *postgresStorage) RecordAudit(ctx context.Context, entries []AuditEntry) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO audit_entries
+		(time, guild_id, user_id, connect_code, mute, deaf, method, outcome, latency_ms, code, message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range entries {
+		_, err := stmt.ExecContext(ctx, entry.Time, entry.GuildID, int64(entry.UserID), entry.ConnectCode, entry.Mute,
+			entry.Deaf, entry.Method, entry.Outcome, entry.LatencyMs, string(entry.Code), entry.Message)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *postgresStorage) AuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error) {
+	sqlQuery := `SELECT id, time, guild_id, user_id, connect_code, mute, deaf, method, outcome, latency_ms, code, message
+		FROM audit_entries WHERE guild_id = $1`
+	args := []interface{}{query.GuildID}
+	if query.UserID != 0 {
+		args = append(args, int64(query.UserID))
+		sqlQuery += " AND user_id = $" + strconv.Itoa(len(args))
+	}
+	if !query.Since.IsZero() {
+		args = append(args, query.Since)
+		sqlQuery += " AND time >= $" + strconv.Itoa(len(args))
+	}
+	if !query.Until.IsZero() {
+		args = append(args, query.Until)
+		sqlQuery += " AND time <= $" + strconv.Itoa(len(args))
+	}
+	args = append(args, query.Limit)
+	sqlQuery += " ORDER BY time DESC, id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := storage.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var id, userID int64
+		var code string
+		err := rows.Scan(&id, &entry.Time, &entry.GuildID, &userID, &entry.ConnectCode, &entry.Mute, &entry.Deaf,
+			&entry.Method, &entry.Outcome, &entry.LatencyMs, &code, &entry.Message)
+		if err != nil {
+			return nil, err
+		}
+		entry.ID = strconv.FormatInt(id, 10)
+		entry.UserID = uint64(userID)
+		entry.Code = ack.Code(code)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (storage *postgresStorage) AddDailyStats(ctx context.Context, day time.Time, guildID string, stats ModifyStats) error {
+	_, err := storage.db.ExecContext(ctx, `INSERT INTO daily_stats
+		(day, guild_id, worker, capture, official, failed, superseded) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (day, guild_id) DO UPDATE SET
+			worker = daily_stats.worker + EXCLUDED.worker,
+			capture = daily_stats.capture + EXCLUDED.capture,
+			official = daily_stats.official + EXCLUDED.official,
+			failed = daily_stats.failed + EXCLUDED.failed,
+			superseded = daily_stats.superseded + EXCLUDED.superseded`,
+		day.UTC().Format("2006-01-02"), guildID, stats.Worker, stats.Capture, stats.Official, stats.Failed, stats.Superseded)
+	return err
+}
+
+func (storage *postgresStorage) DailyStats(ctx context.Context, guildID string, since, until time.Time) ([]DailyStats, error) {
+	sqlQuery := `SELECT to_char(day, 'YYYY-MM-DD'), SUM(worker), SUM(capture), SUM(official), SUM(failed), SUM(superseded)
+		FROM daily_stats WHERE day >= $1 AND day <= $2`
+	args := []interface{}{since.UTC().Format("2006-01-02"), until.UTC().Format("2006-01-02")}
+	if guildID != "" {
+		args = append(args, guildID)
+		sqlQuery += " AND guild_id = $3"
+	}
+	sqlQuery += " GROUP BY day ORDER BY day"
+
+	rows, err := storage.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := []DailyStats{}
+	for rows.Next() {
+		var day DailyStats
+		err := rows.Scan(&day.Day, &day.Worker, &day.Capture, &day.Official, &day.Failed, &day.Superseded)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+func (storage *postgresStorage) RecordTokenEvent(ctx context.Context, event TokenEvent) error {
+	_, err := storage.db.ExecContext(ctx, `INSERT INTO token_events
+		(time, hashed_token, event, instance_id, guilds, message) VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.Time, event.HashedToken, event.Event, event.InstanceID, event.Guilds, event.Message)
+	return err
+}
+
+func (storage *postgresStorage) GuildSettings(ctx context.Context, guildID string) (*api.GuildSettings, error) {
+	settings := api.GuildSettings{GuildID: guildID}
+	var raw []byte
+	err := storage.db.QueryRowContext(ctx, "SELECT settings, updated_at FROM guild_settings WHERE guild_id = $1", guildID).
+		Scan(&raw, &settings.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	settings.Settings = raw
+	return &settings, nil
+}
+
+func (storage *postgresStorage) SetGuildSettings(ctx context.Context, settings api.GuildSettings) error {
+	_, err := storage.db.ExecContext(ctx, `INSERT INTO guild_settings (guild_id, settings, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (guild_id) DO UPDATE SET settings = EXCLUDED.settings, updated_at = EXCLUDED.updated_at`,
+		settings.GuildID, []byte(settings.Settings), settings.UpdatedAt)
+	return err
+}
+
+func (storage *postgresStorage) DeleteGuildSettings(ctx context.Context, guildID string) (bool, error) {
+	result, err := storage.db.ExecContext(ctx, "DELETE FROM guild_settings WHERE guild_id = $1", guildID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (storage *postgresStorage) Close() error {
+	return storage.db.Close()
+}
@@ -0,0 +1,80 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/premium"
+	"log"
+	"time"
+)
+
+// tierAllocation is how a premium tier's mute/deafens are served, once its guilds are resolved to it
+type tierAllocation struct {
+	queueWait  time.Duration
+	ackTimeout time.Duration
+}
+
+// tierAllocations fills in the configured tiers' queue waits and ack timeouts with the defaults
+func tierAllocations(cfg config.Config, ackTimeout time.Duration) map[premium.Tier]tierAllocation {
+	allocations := make(map[premium.Tier]tierAllocation, len(cfg.WorkerAllocation))
+	for tier, allocation := range cfg.WorkerAllocation {
+		a := tierAllocation{queueWait: DefaultTierQueueWait, ackTimeout: ackTimeout}
+		if allocation.QueueWait > 0 {
+			a.queueWait = time.Duration(allocation.QueueWait)
+		}
+		if allocation.AckTimeout > 0 {
+			a.ackTimeout = time.Duration(allocation.AckTimeout)
+		}
+		allocations[tier] = a
+	}
+	return allocations
+}
+
+// workerShares is the percent of the worker pool dedicated to each tier that has a share
+func workerShares(cfg config.Config) map[premium.Tier]int {
+	shares := make(map[premium.Tier]int)
+	for tier, allocation := range cfg.WorkerAllocation {
+		if allocation.Share > 0 {
+			shares[tier] = allocation.Share
+		}
+	}
+	return shares
+}
+
+// guildTier resolves a guild's premium tier from the "premium" field automuteus keeps in its settings, rather than
+// trusting the tier a request claims. Guilds without one, or whose settings can't be read, are on the free tier
+func (tokenProvider *TokenProvider) guildTier(ctx context.Context, guildID string) premium.Tier {
+	settings, err := tokenProvider.guildSettings(ctx, guildID)
+	if err != nil {
+		log.Println(err)
+		return premium.FreeTier
+	}
+	if settings == nil {
+		return premium.FreeTier
+	}
+	var tier struct {
+		Premium premium.Tier `json:"premium"`
+	}
+	// settings that aren't shaped like this just have no tier
+	json.Unmarshal(settings.Settings, &tier)
+	if tier.Premium < premium.FreeTier || tier.Premium > premium.SelfHostTier {
+		return premium.FreeTier
+	}
+	return tier.Premium
+}
+
+// queueWait and ackTimeout fall back to the defaults for tiers without an allocation
+func (s settings) queueWait(tier premium.Tier) time.Duration {
+	if allocation, ok := s.tierAllocations[tier]; ok {
+		return allocation.queueWait
+	}
+	return DefaultTierQueueWait
+}
+
+func (s settings) ackTimeout(tier premium.Tier) time.Duration {
+	if allocation, ok := s.tierAllocations[tier]; ok {
+		return allocation.ackTimeout
+	}
+	return s.captureAckTimeout
+}
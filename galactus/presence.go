@@ -0,0 +1,191 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"net/http"
+)
+
+const (
+	presenceKey = "galactus:presence"
+	// published when the presence changes, so every galactus instance applies it to the shards it serves
+	presenceChannel = "galactus:presence:update"
+)
+
+// Presence is the primary bot's status and activity, applied to every shard
+type Presence struct {
+	// Status is one of online, idle, dnd or invisible. Defaults to online
+	Status string `json:"status,omitempty"`
+	// Activity is the text shown under the bot's name, like "Among Us | .au help"
+	Activity string `json:"activity,omitempty"`
+	// ActivityType is one of playing, streaming, listening or watching. Defaults to playing, or streaming with a URL
+	ActivityType string `json:"activityType,omitempty"`
+	// URL is the stream shown for the streaming activity type; Discord only accepts Twitch and YouTube URLs
+	URL string `json:"url,omitempty"`
+}
+
+var presenceStatuses = map[string]bool{
+	string(discordgo.StatusOnline):       true,
+	string(discordgo.StatusIdle):         true,
+	string(discordgo.StatusDoNotDisturb): true,
+	string(discordgo.StatusInvisible):    true,
+}
+
+var presenceActivityTypes = map[string]discordgo.GameType{
+	"playing":   discordgo.GameTypeGame,
+	"streaming": discordgo.GameTypeStreaming,
+	"listening": discordgo.GameTypeListening,
+	"watching":  discordgo.GameTypeWatching,
+}
+
+// normalize fills in the defaults and checks the presence is one Discord accepts
+func (presence *Presence) normalize() error {
+	if presence.Status == "" {
+		presence.Status = string(discordgo.StatusOnline)
+	}
+	if !presenceStatuses[presence.Status] {
+		return fmt.Errorf("unknown status \"%s\"", presence.Status)
+	}
+	if presence.ActivityType == "" {
+		if presence.URL != "" {
+			presence.ActivityType = "streaming"
+		} else {
+			presence.ActivityType = "playing"
+		}
+	}
+	if _, ok := presenceActivityTypes[presence.ActivityType]; !ok {
+		return fmt.Errorf("unknown activity type \"%s\"", presence.ActivityType)
+	}
+	if presence.URL != "" && presence.ActivityType != "streaming" {
+		return fmt.Errorf("a url is only shown for the streaming activity type")
+	}
+	if presence.Activity == "" && (presence.URL != "" || presence.ActivityType != "playing") {
+		return fmt.Errorf("an activity type needs activity text")
+	}
+	return nil
+}
+
+func (presence Presence) statusData() discordgo.UpdateStatusData {
+	usd := discordgo.UpdateStatusData{Status: presence.Status}
+	if presence.Activity != "" {
+		usd.Game = &discordgo.Game{
+			Name: presence.Activity,
+			Type: presenceActivityTypes[presence.ActivityType],
+			URL:  presence.URL,
+		}
+	}
+	return usd
+}
+
+// loadPresence returns the stored presence, or nil if none was ever set
+func (tokenProvider *TokenProvider) loadPresence(ctx context.Context) (*Presence, error) {
+	jBytes, err := tokenProvider.client.Get(ctx, presenceKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var presence Presence
+	if err := json.Unmarshal(jBytes, &presence); err != nil {
+		return nil, err
+	}
+	return &presence, nil
+}
+
+// applyPresence sets the presence on each of sessions, returning how many were updated
+func applyPresence(sessions []*discordgo.Session, presence Presence) int {
+	applied := 0
+	for _, sess := range sessions {
+		if err := sess.UpdateStatusComplex(presence.statusData()); err != nil {
+			log.Printf("Failed to update the presence on shard %d: %s\n", sess.ShardID, err)
+			continue
+		}
+		applied++
+	}
+	return applied
+}
+
+// presenceReadyHandler re-applies the stored presence whenever a shard identifies, since a new gateway session starts
+// out with the default. Resumed sessions keep their presence
+func (tokenProvider *TokenProvider) presenceReadyHandler(s *discordgo.Session, r *discordgo.Ready) {
+	presence, err := tokenProvider.loadPresence(context.Background())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if presence != nil {
+		applyPresence([]*discordgo.Session{s}, *presence)
+	}
+}
+
+// watchPresence applies presence changes made through any galactus instance to this instance's shards
+func (tokenProvider *TokenProvider) watchPresence(ctx context.Context) {
+	pubsub := tokenProvider.client.Subscribe(ctx, presenceChannel)
+	defer pubsub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pubsub.Channel():
+			if !ok {
+				return
+			}
+			var presence Presence
+			if err := json.Unmarshal([]byte(msg.Payload), &presence); err != nil {
+				log.Println(err)
+				continue
+			}
+			applied := applyPresence(tokenProvider.gatewaySessions(), presence)
+			log.Printf("Updated the presence on %d shards\n", applied)
+		}
+	}
+}
+
+// adminPresenceHandler returns (GET) or sets (POST) the primary bot's presence. A new presence is stored, so shards
+// that reconnect and galactus instances that start later pick it up, then published to every instance
+func (tokenProvider *TokenProvider) adminPresenceHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			presence, err := tokenProvider.loadPresence(r.Context())
+			if err != nil {
+				log.Println(err)
+				writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the presence")
+				return
+			}
+			if presence == nil {
+				presence = &Presence{Status: string(discordgo.StatusOnline)}
+			}
+			writeJSON(w, http.StatusOK, presence)
+			return
+		}
+
+		var presence Presence
+		if !readJSONBody(w, r, config, &presence) {
+			return
+		}
+		if err := presence.normalize(); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		jBytes, err := json.Marshal(presence)
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		err = tokenProvider.client.Set(r.Context(), presenceKey, jBytes, 0).Err()
+		if err == nil {
+			err = tokenProvider.client.Publish(r.Context(), presenceChannel, jBytes).Err()
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to store the presence")
+			return
+		}
+		writeJSON(w, http.StatusOK, presence)
+	}
+}
@@ -0,0 +1,194 @@
+package galactus
+
+import (
+	"context"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RouteClass groups endpoints that share an inbound rate limit
+type RouteClass string
+
+const (
+	RouteClassModify  RouteClass = "modify"
+	RouteClassToken   RouteClass = "token"
+	RouteClassDefault RouteClass = "default"
+	RouteClassProxy   RouteClass = "proxy"
+)
+
+const ErrorCodeRateLimited = "RATE_LIMITED"
+
+// RateLimit is a token bucket: PerSecond tokens are added each second, up to Burst. PerSecond <= 0 disables the limit
+type RateLimit struct {
+	PerSecond float64
+	Burst     int64
+}
+
+var DefaultAPIRateLimits = map[RouteClass]RateLimit{
+	RouteClassModify:  {PerSecond: 50, Burst: 100},
+	RouteClassToken:   {PerSecond: 1, Burst: 5},
+	RouteClassDefault: {PerSecond: 20, Burst: 40},
+	// the proxy enforces Discord's own limits, so there's no need for another by default
+	RouteClassProxy: {PerSecond: 0, Burst: 0},
+}
+
+// refills the bucket based on elapsed time, then tries to take a single token.
+// Returns {allowed, remaining tokens, ms until a token is available}
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1]) or burst
+local ts = tonumber(data[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+type APIRateLimiter struct {
+	client redis.UniversalClient
+
+	// replaced as a whole on reload
+	limits map[RouteClass]RateLimit
+	lock   sync.RWMutex
+}
+
+func NewAPIRateLimiter(client redis.UniversalClient, limits map[RouteClass]RateLimit) *APIRateLimiter {
+	return &APIRateLimiter{
+		client: client,
+		limits: limits,
+	}
+}
+
+// apiRateLimits applies the configured overrides to DefaultAPIRateLimits
+func apiRateLimits(cfg config.Config) map[RouteClass]RateLimit {
+	limits := make(map[RouteClass]RateLimit, len(DefaultAPIRateLimits))
+	for class, limit := range DefaultAPIRateLimits {
+		limits[class] = limit
+	}
+	for name, override := range cfg.APIRateLimits {
+		class := RouteClass(name)
+		limit, ok := limits[class]
+		if !ok {
+			log.Printf("Ignoring the rate limit for unknown route class \"%s\"\n", name)
+			continue
+		}
+		if override.PerSecond != nil {
+			limit.PerSecond = *override.PerSecond
+		}
+		if override.Burst != nil {
+			limit.Burst = *override.Burst
+		}
+		limits[class] = limit
+	}
+	return limits
+}
+
+func (limiter *APIRateLimiter) setLimits(limits map[RouteClass]RateLimit) {
+	limiter.lock.Lock()
+	limiter.limits = limits
+	limiter.lock.Unlock()
+}
+
+func (limiter *APIRateLimiter) limitFor(class RouteClass) (RateLimit, bool) {
+	limiter.lock.RLock()
+	defer limiter.lock.RUnlock()
+	limit, ok := limiter.limits[class]
+	return limit, ok
+}
+
+func apiRateLimitKey(class RouteClass, clientKey string) string {
+	return "galactus:ratelimit:api:" + string(class) + ":" + clientKey
+}
+
+// clientKey identifies the caller by API key if the request was authenticated with one, then by client certificate,
+// otherwise by source IP. An unchecked X-API-Key header isn't trusted, or a new random key on each request to a public
+// route would get a fresh bucket each time
+func clientKey(r *http.Request) string {
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		return "key:" + key.ID
+	}
+	if id := ClientIdentityFromContext(r.Context()); id != "" {
+		return "cert:" + hashToken(id)[0:16]
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// take attempts to take a token from the client's bucket for this class, returning whether the request is allowed,
+// how many tokens remain, and how long until another token is available
+func (limiter *APIRateLimiter) take(ctx context.Context, class RouteClass, key string) (bool, int64, time.Duration, error) {
+	limit, _ := limiter.limitFor(class)
+	return takeToken(ctx, limiter.client, apiRateLimitKey(class, key), limit)
+}
+
+// takeToken runs tokenBucketScript against the bucket stored at key
+func takeToken(ctx context.Context, client redis.UniversalClient, key string, limit RateLimit) (bool, int64, time.Duration, error) {
+	res, err := tokenBucketScript.Run(ctx, client, []string{key},
+		limit.PerSecond, limit.Burst, time.Now().UnixNano()/int64(time.Millisecond)).Result()
+	if err != nil {
+		return true, 0, 0, err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 3 {
+		return true, 0, 0, fmt.Errorf("unexpected rate limit script result: %v", res)
+	}
+	allowed, _ := vals[0].(int64)
+	remaining, _ := vals[1].(int64)
+	wait, _ := vals[2].(int64)
+	return allowed == 1, remaining, time.Duration(wait) * time.Millisecond, nil
+}
+
+// limit wraps a handler with the rate limit for the given class. If Redis is unavailable requests are let through;
+// it's better to serve mutes than to fail closed on our own limiter
+func (limiter *APIRateLimiter) limit(class RouteClass, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := limiter.limitFor(class)
+		if !ok || limit.PerSecond <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, remaining, wait, err := limiter.take(r.Context(), class, clientKey(r))
+		if err != nil {
+			log.Println(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// seconds until the bucket is full again
+		reset := int64(math.Ceil(float64(limit.Burst-remaining) / limit.PerSecond))
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(limit.Burst, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		if !allowed {
+			retryAfter := int64(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			writeError(w, r, http.StatusTooManyRequests, ErrorCodeRateLimited,
+				fmt.Sprintf("rate limit exceeded for %s requests; retry in %ds", class, retryAfter))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
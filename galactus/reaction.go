@@ -0,0 +1,51 @@
+package galactus
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+// ChannelReactionRateLimit is Discord's limit on reactions added or removed in a channel by one bot: 1 every 250ms
+var ChannelReactionRateLimit = RateLimit{PerSecond: 4, Burst: 1}
+
+func channelReactionRateLimitKey(channelID string) string {
+	return "galactus:ratelimit:reaction:" + channelID
+}
+
+// reactionHandler adds (PUT) or removes (DELETE) a reaction with the primary bot. Reactions are REST calls, so any
+// session works regardless of which shard the guild is on; the primary session is used so workers don't need a gateway
+// connection of their own. DELETE removes the bot's own reaction, or ?userID='s
+func (tokenProvider *TokenProvider) reactionHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		channelID := vars["channelID"]
+		messageID := vars["messageID"]
+		emoji := vars["emoji"]
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+		if err := tokenProvider.waitForRateLimit(ctx, channelReactionRateLimitKey(channelID), ChannelReactionRateLimit); err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, ErrorCodeRateLimited, "timed out waiting for the channel's reaction rate limit")
+			return
+		}
+
+		var err error
+		if r.Method == http.MethodDelete {
+			userID := r.URL.Query().Get("userID")
+			if userID == "" {
+				userID = "@me"
+			}
+			err = tokenProvider.primarySession.MessageReactionRemove(channelID, messageID, emoji, userID)
+		} else {
+			err = tokenProvider.primarySession.MessageReactionAdd(channelID, messageID, emoji)
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusBadGateway, ErrorCodeDiscord, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
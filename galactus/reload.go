@@ -0,0 +1,184 @@
+package galactus
+
+import (
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/automuteus/utils/pkg/task"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// settings are the parts of the config that can change without restarting galactus. They're replaced as a whole on
+// reload, so a request sees either the old settings or the new ones, never a mix
+type settings struct {
+	// how many users of a single modify request are processed concurrently
+	maxWorkers int
+	// how long to wait for a capture bot to ack a task
+	captureAckTimeout time.Duration
+	// how many secondary bots each premium tier can use
+	premiumBots map[premium.Tier]int
+	// how many modify requests each premium tier's guilds can make
+	guildQuotas map[premium.Tier]guildQuota
+	// the queue waits and ack timeouts of the tiers allocated differently from the rest
+	tierAllocations map[premium.Tier]tierAllocation
+	tokenRateLimit  TokenRateLimit
+	// how long each type of job can wait in the queue before it's skipped
+	jobMaxAges map[task.JobType]time.Duration
+	// about how many modifications are kept in each guild's audit log, and for how long; a max length of 0 disables it
+	auditLogMaxLen    int64
+	auditLogRetention time.Duration
+	breaker           breakerSettings
+	outage            outageSettings
+	// how mute/deafen and nickname calls to Discord are retried
+	retry retryPolicy
+	// the order mute methods are tried in, and whether it's adapted to each guild
+	muteOrder       []string
+	adaptiveRouting bool
+	// the gateway events forwarded to workers, and what guild events are enriched with
+	gatewayEvents gatewayEventSettings
+	// the messages for users returned with error codes, and the locale used when a request's locales have none
+	messages      messageCatalog
+	defaultLocale string
+	// the intents sessions are opened with from now on, and the guilds whose members are requested when they show up
+	intents           config.IntentsConfig
+	memberChunkGuilds []string
+}
+
+func newSettings(cfg config.Config) settings {
+	s := settings{
+		maxWorkers:        DefaultMaxWorkers,
+		captureAckTimeout: DefaultCaptureBotTimeout,
+		premiumBots:       make(map[premium.Tier]int, len(PremiumBotConstraints)),
+		guildQuotas:       guildQuotas(cfg.GuildQuota),
+		tokenRateLimit:    newTokenRateLimit(cfg),
+		jobMaxAges:        jobMaxAges(cfg),
+		auditLogMaxLen:    DefaultAuditLogMaxLen,
+		auditLogRetention: DefaultAuditLogRetention,
+		breaker: breakerSettings{
+			failureThreshold: DefaultBreakerFailureThreshold,
+			openDuration:     DefaultBreakerOpenDuration,
+			halfOpenProbes:   DefaultBreakerHalfOpenProbes,
+		},
+		outage: outageSettings{
+			errorPercent: DefaultOutageErrorPercent,
+			minRequests:  DefaultOutageMinRequests,
+			window:       DefaultOutageWindow,
+		},
+	}
+	s.retry = newRetryPolicy(cfg.Retry)
+	s.intents = cfg.Intents
+	s.memberChunkGuilds = cfg.MemberChunkGuilds
+	s.muteOrder = DefaultMuteOrder
+	if len(cfg.MuteRouting.Order) > 0 {
+		s.muteOrder = cfg.MuteRouting.Order
+	}
+	s.adaptiveRouting = cfg.MuteRouting.Strategy == MuteRoutingAdaptive
+	s.gatewayEvents = newGatewayEventSettings(cfg.GatewayEvents, cfg.Intents.SlashCommandsOnly)
+	s.messages = newMessageCatalog(cfg.Messages)
+	s.defaultLocale = DefaultLocale
+	if cfg.Messages.DefaultLocale != "" {
+		s.defaultLocale = strings.ToLower(cfg.Messages.DefaultLocale)
+	}
+	if cfg.Outage.ErrorPercent != nil {
+		s.outage.errorPercent = *cfg.Outage.ErrorPercent
+	}
+	if cfg.Outage.MinRequests > 0 {
+		s.outage.minRequests = cfg.Outage.MinRequests
+	}
+	if cfg.Outage.Window > 0 {
+		s.outage.window = time.Duration(cfg.Outage.Window)
+	}
+	if cfg.CircuitBreaker.FailureThreshold != nil {
+		s.breaker.failureThreshold = *cfg.CircuitBreaker.FailureThreshold
+	}
+	if cfg.CircuitBreaker.OpenDuration > 0 {
+		s.breaker.openDuration = time.Duration(cfg.CircuitBreaker.OpenDuration)
+	}
+	if cfg.CircuitBreaker.HalfOpenProbes > 0 {
+		s.breaker.halfOpenProbes = cfg.CircuitBreaker.HalfOpenProbes
+	}
+	if cfg.AuditLog.MaxLen != nil {
+		s.auditLogMaxLen = *cfg.AuditLog.MaxLen
+	}
+	if cfg.AuditLog.Retention > 0 {
+		s.auditLogRetention = time.Duration(cfg.AuditLog.Retention)
+	}
+	if cfg.Workers.MaxWorkers > 0 {
+		s.maxWorkers = cfg.Workers.MaxWorkers
+	}
+	if cfg.AckTimeout > 0 {
+		s.captureAckTimeout = time.Duration(cfg.AckTimeout)
+	}
+	s.tierAllocations = tierAllocations(cfg, s.captureAckTimeout)
+	for tier, bots := range PremiumBotConstraints {
+		s.premiumBots[tier] = bots
+	}
+	for tier, bots := range cfg.PremiumBots {
+		s.premiumBots[tier] = bots
+	}
+	return s
+}
+
+func workerPoolSizeFor(cfg config.Config) int {
+	if cfg.Workers.PoolSize > 0 {
+		return cfg.Workers.PoolSize
+	}
+	return DefaultWorkerPoolSize
+}
+
+func (tokenProvider *TokenProvider) getSettings() settings {
+	return tokenProvider.settings.Load().(settings)
+}
+
+// Reload re-reads the config file and applies what it can to the running components: worker counts, the ack timeouts,
+// premium limits, rate limits, guild quotas, job max ages, forwarded gateway events and the message catalog. Gateway sessions are left alone; anything else only changes on restart
+func (tokenProvider *TokenProvider) Reload() error {
+	tokenProvider.reloadLock.Lock()
+	defer tokenProvider.reloadLock.Unlock()
+
+	cfg, err := config.Load(tokenProvider.config.Path)
+	if err != nil {
+		return err
+	}
+	if err := validateIntents(cfg); err != nil {
+		return err
+	}
+	if err := validateGatewayEvents(cfg); err != nil {
+		return err
+	}
+	// the restart-only settings are compared with what galactus is running with, which is the config it started with
+	old := tokenProvider.config
+	oldIntents := tokenProvider.getSettings().intents
+
+	tokenProvider.settings.Store(newSettings(cfg))
+	tokenProvider.workers.resize(workerPoolSizeFor(cfg))
+	tokenProvider.apiLimiter.setLimits(apiRateLimits(cfg))
+
+	if cfg.DiscordBotToken != old.DiscordBotToken || !reflect.DeepEqual(cfg.StandbyBotTokens, old.StandbyBotTokens) ||
+		!reflect.DeepEqual(cfg.Redis, old.Redis) ||
+		cfg.GalactusPort != old.GalactusPort || cfg.BrokerPort != old.BrokerPort || cfg.GRPCPort != old.GRPCPort ||
+		cfg.BindAddr != old.BindAddr || cfg.HTTP != old.HTTP || cfg.Workers.QueueSize != old.Workers.QueueSize ||
+		cfg.JobQueueHighWater != old.JobQueueHighWater || cfg.JobDedupWindow != old.JobDedupWindow ||
+		cfg.NumShards != old.NumShards || cfg.ShardRangeSize != old.ShardRangeSize || cfg.ShardLeaseTTL != old.ShardLeaseTTL ||
+		!reflect.DeepEqual(cfg.CORS, old.CORS) || cfg.RequestSigning != old.RequestSigning || cfg.Sessions != old.Sessions ||
+		cfg.Faults != old.Faults || !reflect.DeepEqual(workerShares(cfg), workerShares(old)) || !reflect.DeepEqual(cfg.EventSinks, old.EventSinks) {
+		log.Println("The bot tokens, ports, Redis, HTTP, CORS, request signing, worker queue, worker share, job queue, shard, session, event sink and fault injection settings only change on restart")
+	}
+	if !reflect.DeepEqual(cfg.Intents, oldIntents) {
+		log.Println("Gateway intents only apply to sessions opened from now on")
+	}
+	log.Println("Reloaded config")
+	return nil
+}
+
+func (tokenProvider *TokenProvider) adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := tokenProvider.Reload(); err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "reload failed: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventArchiveKey is the Redis Stream the archive sink keeps gateway events in, by when they were queued
+const EventArchiveKey = "galactus:gateway:archive"
+
+// the archives events can be replayed from
+const (
+	ReplaySourceStream = "stream"
+	ReplaySourceKafka  = "kafka"
+)
+
+// eventArchivePageSize is how many stream entries a replay reads at a time
+const eventArchivePageSize = 500
+
+var gatewayEventsReplayedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_gateway_events_replayed_total",
+	Help: "Archived gateway events queued for the workers again by /admin/replay, by archive",
+}, []string{"source"})
+
+// RedisStreamEventSink keeps the latest events in a capped Redis Stream, so a window of them can be replayed without
+// running Kafka
+type RedisStreamEventSink struct {
+	client redis.UniversalClient
+	maxLen int64
+}
+
+func NewRedisStreamEventSink(client redis.UniversalClient, maxLen int64) *RedisStreamEventSink {
+	return &RedisStreamEventSink{client: client, maxLen: maxLen}
+}
+
+func (sink *RedisStreamEventSink) Name() string {
+	return ReplaySourceStream
+}
+
+func (sink *RedisStreamEventSink) Send(ctx context.Context, events []api.GatewayEvent) error {
+	pipe := sink.client.Pipeline()
+	for _, event := range events {
+		jBytes, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream:       EventArchiveKey,
+			MaxLenApprox: sink.maxLen,
+			Values:       map[string]interface{}{"event": jBytes},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (sink *RedisStreamEventSink) Close() error {
+	return nil
+}
+
+// replayQuery picks the archived events to replay. until is zero for the latest
+type replayQuery struct {
+	from    time.Time
+	until   time.Time
+	guildID string
+	limit   int
+}
+
+// ReplayResponse reports what /admin/replay queued again. If it was Truncated, replaying again from Next picks up where
+// it left off, once the workers have caught up
+type ReplayResponse struct {
+	Source    string `json:"source"`
+	Replayed  int    `json:"replayed"`
+	Truncated bool   `json:"truncated"`
+	// unix ms
+	Next   int64 `json:"next,omitempty"`
+	DryRun bool  `json:"dryRun,omitempty"`
+}
+
+// nextStreamID is the first stream ID after id
+func nextStreamID(id string) string {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return id
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return id
+	}
+	return id[:i] + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// streamArchivedEvents reads one more event than the limit from the archive stream, so a replay knows whether it was
+// cut short
+func (tokenProvider *TokenProvider) streamArchivedEvents(ctx context.Context, query replayQuery) ([]api.GatewayEvent, error) {
+	start, end := streamID(query.from, "-"), streamID(query.until, "+")
+	var events []api.GatewayEvent
+	for len(events) <= query.limit {
+		msgs, err := tokenProvider.client.XRangeN(ctx, EventArchiveKey, start, end, eventArchivePageSize).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			s, ok := msg.Values["event"].(string)
+			if !ok {
+				continue
+			}
+			var event api.GatewayEvent
+			if err := json.Unmarshal([]byte(s), &event); err != nil {
+				log.Printf("Skipping unreadable archived event %s: %s\n", msg.ID, err)
+				continue
+			}
+			if query.guildID != "" && event.GuildID != query.guildID {
+				continue
+			}
+			events = append(events, event)
+		}
+		if len(msgs) < eventArchivePageSize {
+			break
+		}
+		start = nextStreamID(msgs[len(msgs)-1].ID)
+	}
+	return events, nil
+}
+
+// replaySource picks the archive to replay from: the one named, or the stream if it's kept, then Kafka
+func (tokenProvider *TokenProvider) replaySource(name string) (string, error) {
+	stream, kafka := tokenProvider.archiveSink != nil, tokenProvider.kafkaSink != nil
+	switch {
+	case name == ReplaySourceStream && stream, name == ReplaySourceKafka && kafka:
+		return name, nil
+	case name == "" && stream:
+		return ReplaySourceStream, nil
+	case name == "" && kafka:
+		return ReplaySourceKafka, nil
+	case name == "":
+		return "", fmt.Errorf("no event archive is configured; set EVENT_SINK_ARCHIVE_MAX_LEN or EVENT_SINK_KAFKA_BROKERS")
+	}
+	return "", fmt.Errorf("the %s event archive isn't configured", name)
+}
+
+// adminReplayHandler queues archived gateway events for the workers again, oldest first, like after a worker bug dropped
+// a window of them. Replayed events keep their IDs, so workers can tell what they've already handled, and are marked
+// replayed. At most the gateway event queue's max length are replayed at once, since any more would push each other out
+func (tokenProvider *TokenProvider) adminReplayHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		source, err := tokenProvider.replaySource(params.Get("source"))
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, err.Error())
+			return
+		}
+		maxLen := int(tokenProvider.getSettings().gatewayEvents.maxLen)
+		query := replayQuery{guildID: params.Get("guildID"), limit: maxLen}
+		if query.from, err = parseAuditTime(params.Get("from")); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "from must be unix milliseconds or RFC 3339")
+			return
+		}
+		if until := params.Get("until"); until != "" {
+			if query.until, err = parseAuditTime(until); err != nil || query.until.Before(query.from) {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "until must be unix milliseconds or RFC 3339, after from")
+				return
+			}
+		}
+		if query.guildID != "" {
+			if _, err := strconv.ParseUint(query.guildID, 10, 64); err != nil {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "guildID must be a snowflake")
+				return
+			}
+		}
+		if limit := params.Get("limit"); limit != "" {
+			if query.limit, err = strconv.Atoi(limit); err != nil || query.limit < 1 || query.limit > maxLen {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLen))
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		var events []api.GatewayEvent
+		if source == ReplaySourceStream {
+			events, err = tokenProvider.streamArchivedEvents(ctx, query)
+		} else {
+			events, err = tokenProvider.kafkaSink.archivedEvents(ctx, query)
+		}
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the "+source+" event archive")
+			return
+		}
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Time < events[j].Time
+		})
+		resp := ReplayResponse{Source: source, DryRun: dryRun(r)}
+		if len(events) > query.limit {
+			resp.Truncated = true
+			resp.Next = events[query.limit].Time
+			events = events[:query.limit]
+		}
+		resp.Replayed = len(events)
+		if resp.DryRun || len(events) == 0 {
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		pipe := tokenProvider.client.TxPipeline()
+		for _, event := range events {
+			event.Replayed = true
+			jBytes, err := json.Marshal(event)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			pipe.RPush(ctx, GatewayEventsKey, jBytes)
+		}
+		pipe.LTrim(ctx, GatewayEventsKey, -int64(maxLen), -1)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to queue the replayed events")
+			return
+		}
+		gatewayEventsReplayedTotal.WithLabelValues(source).Add(float64(len(events)))
+		log.Printf("Replayed %d gateway events from the %s archive since %s\n", len(events), source, query.from.UTC().Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
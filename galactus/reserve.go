@@ -0,0 +1,63 @@
+package galactus
+
+import (
+	"errors"
+	"github.com/automuteus/galactus/proxy"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// ReserveRequest asks to spend Count requests on a Discord route, like POST /api/v8/channels/1234/messages. The
+// guild or channel in the path picks the bucket, as Discord's own limits do
+type ReserveRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Count defaults to 1
+	Count int64 `json:"count,omitempty"`
+}
+
+type ReserveResponse struct {
+	Granted bool `json:"granted"`
+	// RetryAfterMs is how long until the requests can be reserved, if they weren't
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+}
+
+// reserveHandler lets workers that call Discord directly draw from the same rate limit buckets as the Discord proxy.
+// The request carries the Authorization header the calls will be made with, so they count against that bot's buckets.
+// Nothing is reserved unless all of Count is
+func (tokenProvider *TokenProvider) reserveHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request ReserveRequest
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		if request.Method == "" || request.Path == "" {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "method and path are required")
+			return
+		}
+		if request.Count == 0 {
+			request.Count = 1
+		}
+
+		wait, err := tokenProvider.discordProxy.Reserve(r.Context(), r.Header.Get("Authorization"), request.Method,
+			request.Path, request.Count)
+		if errors.Is(err, proxy.ErrInvalidReservation) {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "path must be a Discord API path, like "+
+				"/api/v8/..., and count between 1 and "+strconv.Itoa(int(tokenProvider.discordProxy.GlobalRequestsPerSecond)))
+			return
+		} else if err != nil {
+			// like the proxy, a limiter that's down shouldn't hold up calls to Discord; its 429s still protect us
+			log.Println(err)
+			writeJSON(w, http.StatusOK, ReserveResponse{Granted: true})
+			return
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			writeJSON(w, http.StatusTooManyRequests, ReserveResponse{RetryAfterMs: wait.Milliseconds()})
+			return
+		}
+		writeJSON(w, http.StatusOK, ReserveResponse{Granted: true})
+	}
+}
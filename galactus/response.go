@@ -0,0 +1,126 @@
+package galactus
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorCodeInternal   = "INTERNAL_ERROR"
+	ErrorCodeBadRequest = "BAD_REQUEST"
+	ErrorCodeNotFound   = "NOT_FOUND"
+	// Discord rejected the request galactus made on the caller's behalf
+	ErrorCodeDiscord = "DISCORD_ERROR"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	jBytes, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(jBytes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// how many of the latest server-side errors /admin/errors reports
+const recentErrorCount = 50
+
+// RecentError is a 5xx response galactus sent, as listed by /admin/errors
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID,omitempty"`
+	Method    string    `json:"method"`
+	// the route's path template, so tokens in the path aren't kept
+	Route   string `json:"route"`
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// recentErrors is a ring of the latest 5xx responses; next is where the next one is written
+var recentErrors = struct {
+	sync.Mutex
+	errors []RecentError
+	next   int
+}{}
+
+func recordRecentError(e RecentError) {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	if len(recentErrors.errors) < recentErrorCount {
+		recentErrors.errors = append(recentErrors.errors, e)
+		return
+	}
+	recentErrors.errors[recentErrors.next] = e
+	recentErrors.next = (recentErrors.next + 1) % recentErrorCount
+}
+
+// latestErrors returns the recorded errors, most recent first
+func latestErrors() []RecentError {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	n := len(recentErrors.errors)
+	latest := make([]RecentError, 0, n)
+	for i := 1; i <= n; i++ {
+		latest = append(latest, recentErrors.errors[(recentErrors.next-i+n)%n])
+	}
+	return latest
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if status >= http.StatusInternalServerError {
+		recordRecentError(RecentError{
+			Time:      time.Now(),
+			RequestID: RequestIDFromContext(r.Context()),
+			Method:    r.Method,
+			Route:     routeName(r),
+			Status:    status,
+			Code:      code,
+			Message:   message,
+		})
+	}
+	resp := api.ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+	resp.Locale, resp.LocalizedMessage = localizedMessage(r, mux.Vars(r)["guildID"], code)
+	writeJSON(w, status, resp)
+}
+
+// writeDiscordError passes along Discord's 400s, 403s and 404s, which are the caller's to fix, and answers calls an open
+// circuit breaker stopped with a 503. Anything else is a 502
+func writeDiscordError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrCircuitOpen) {
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeCircuitOpen, err.Error())
+		return
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		switch restErr.Response.StatusCode {
+		case http.StatusBadRequest:
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		case http.StatusForbidden:
+			writeError(w, r, http.StatusForbidden, ErrorCodeDiscord, err.Error())
+			return
+		case http.StatusNotFound:
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, err.Error())
+			return
+		}
+	}
+	writeError(w, r, http.StatusBadGateway, ErrorCodeDiscord, err.Error())
+}
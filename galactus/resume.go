@@ -0,0 +1,215 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// GatewayResumeTTL is how long a saved gateway session is tried after a shutdown. Discord invalidates sessions that
+// stay disconnected for long, and a failed resume costs a round trip before falling back to identify
+const GatewayResumeTTL = 2 * time.Minute
+
+// closeServiceRestart closes the gateway without invalidating the session, unlike discordgo's Close, which uses 1000
+const closeServiceRestart = 1012
+
+type gatewayResume struct {
+	SessionID string `json:"sessionID"`
+	Sequence  int64  `json:"sequence"`
+	// the state a READY would have filled in, which a resumed session doesn't get
+	User   *discordgo.User    `json:"user,omitempty"`
+	Guilds []*discordgo.Guild `json:"guilds,omitempty"`
+}
+
+func gatewayResumeKey(hToken string, shardID int) string {
+	return "galactus:gateway:resume:" + hToken + ":" + strconv.Itoa(shardID)
+}
+
+// discordgo keeps the session ID and sequence number unexported, and only resumes sessions it identified itself, so
+// they're read and written through reflection. This relies on discordgo v0.22's field names, so they're checked before
+// they're used: if an upgrade changed them, sessions are identified again instead of resumed
+
+// sessionResumeFieldsErr is why sessions can't be resumed with this discordgo, or nil if they can
+var sessionResumeFieldsErr = checkSessionResumeFields()
+
+func checkSessionResumeFields() error {
+	t := reflect.TypeOf(discordgo.Session{})
+	if field, ok := t.FieldByName("sessionID"); !ok || field.Type.Kind() != reflect.String {
+		return errors.New("discordgo.Session has no sessionID string field")
+	}
+	if field, ok := t.FieldByName("sequence"); !ok || field.Type != reflect.TypeOf((*int64)(nil)) {
+		return errors.New("discordgo.Session has no sequence *int64 field")
+	}
+	return nil
+}
+
+func sessionResumeState(sess *discordgo.Session) gatewayResume {
+	v := reflect.ValueOf(sess).Elem()
+	resume := gatewayResume{SessionID: v.FieldByName("sessionID").String()}
+	if seq := v.FieldByName("sequence"); !seq.IsNil() {
+		resume.Sequence = atomic.LoadInt64((*int64)(unsafe.Pointer(seq.Pointer())))
+	}
+	return resume
+}
+
+func setSessionResumeState(sess *discordgo.Session, resume gatewayResume) {
+	v := reflect.ValueOf(sess).Elem()
+	sessionID := v.FieldByName("sessionID")
+	reflect.NewAt(sessionID.Type(), unsafe.Pointer(sessionID.UnsafeAddr())).Elem().SetString(resume.SessionID)
+	if seq := v.FieldByName("sequence"); !seq.IsNil() {
+		atomic.StoreInt64((*int64)(unsafe.Pointer(seq.Pointer())), resume.Sequence)
+	}
+}
+
+// saveGatewaySession stores a primary bot session's ID and sequence number so the next galactus can resume it, then
+// closes the gateway in a way that leaves the session resumable
+func (tokenProvider *TokenProvider) saveGatewaySession(ctx context.Context, sess *discordgo.Session) {
+	if sessionResumeFieldsErr != nil {
+		log.Printf("Not saving the gateway session for shard %d: %s\n", sess.ShardID, sessionResumeFieldsErr)
+		if err := sess.Close(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	resume := sessionResumeState(sess)
+	if resume.SessionID != "" {
+		resume.User, resume.Guilds = stateSnapshot(sess.State)
+		jBytes, err := json.Marshal(resume)
+		if err == nil {
+			err = tokenProvider.client.Set(ctx, gatewayResumeKey(hashToken(sess.Token), sess.ShardID), jBytes, GatewayResumeTTL).Err()
+		}
+		if err != nil {
+			log.Println(err)
+		} else {
+			log.Printf("Saved gateway session for shard %d at sequence %d\n", sess.ShardID, resume.Sequence)
+		}
+	}
+	err := sess.CloseWithCode(closeServiceRestart)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// restoreGatewaySession sets up a primary bot session to resume the one saved for its shard by the last galactus, if
+// there is one. If Discord rejects the resume, discordgo identifies instead
+func (tokenProvider *TokenProvider) restoreGatewaySession(ctx context.Context, sess *discordgo.Session) {
+	if sessionResumeFieldsErr != nil {
+		return
+	}
+	key := gatewayResumeKey(hashToken(sess.Token), sess.ShardID)
+	jBytes, err := tokenProvider.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// a session is only resumed once; if this attempt fails, the next start shouldn't try it again
+	tokenProvider.client.Del(ctx, key)
+
+	var resume gatewayResume
+	if err := json.Unmarshal(jBytes, &resume); err != nil || resume.SessionID == "" {
+		return
+	}
+	log.Printf("Resuming gateway session for shard %d at sequence %d\n", sess.ShardID, resume.Sequence)
+	setSessionResumeState(sess, resume)
+	sess.AddHandler(func(s *discordgo.Session, r *discordgo.Resumed) {
+		if s.State == nil || s.State.User != nil {
+			return
+		}
+		if resume.User != nil {
+			restoreStateSnapshot(s.State, resume.User, resume.Guilds)
+			log.Printf("Resumed gateway session for shard %d; restored %d guilds\n", s.ShardID, len(resume.Guilds))
+			return
+		}
+		rehydrateResumedState(s)
+	})
+}
+
+// stateSnapshot copies what a resumed session needs of the state: the bot user, and each guild with its roles, channels
+// and voice states. Members aren't kept; they're cached in Redis anyway
+func stateSnapshot(state *discordgo.State) (*discordgo.User, []*discordgo.Guild) {
+	if state == nil {
+		return nil, nil
+	}
+	state.RLock()
+	defer state.RUnlock()
+	guilds := make([]*discordgo.Guild, 0, len(state.Guilds))
+	for _, guild := range state.Guilds {
+		guilds = append(guilds, &discordgo.Guild{
+			ID:          guild.ID,
+			Name:        guild.Name,
+			Icon:        guild.Icon,
+			OwnerID:     guild.OwnerID,
+			JoinedAt:    guild.JoinedAt,
+			MemberCount: guild.MemberCount,
+			Roles:       guild.Roles,
+			Channels:    guild.Channels,
+			VoiceStates: guild.VoiceStates,
+		})
+	}
+	return state.User, guilds
+}
+
+func restoreStateSnapshot(state *discordgo.State, user *discordgo.User, guilds []*discordgo.Guild) {
+	state.Lock()
+	state.User = user
+	state.Unlock()
+	for _, guild := range guilds {
+		for _, channel := range guild.Channels {
+			channel.GuildID = guild.ID
+		}
+		if err := state.GuildAdd(guild); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// rehydrateResumedState fills in the state a READY would have for a session saved without a snapshot: the bot user and
+// guild list are fetched instead. Guilds only have their ID, name and icon until their next GuildCreate
+func rehydrateResumedState(s *discordgo.Session) {
+	user, err := s.User("@me")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.State.Lock()
+	s.State.User = user
+	s.State.Unlock()
+
+	after := ""
+	restored := 0
+	for {
+		guilds, err := s.UserGuilds(100, "", after)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, guild := range guilds {
+			err := s.State.GuildAdd(&discordgo.Guild{
+				ID:   guild.ID,
+				Name: guild.Name,
+				Icon: guild.Icon,
+			})
+			if err != nil {
+				log.Println(err)
+			} else {
+				restored++
+			}
+		}
+		if len(guilds) < 100 {
+			break
+		}
+		after = guilds[len(guilds)-1].ID
+	}
+	log.Printf("Resumed gateway session for shard %d; restored %d guilds\n", s.ShardID, restored)
+}
@@ -0,0 +1,73 @@
+package galactus
+
+import (
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+// resuming relies on discordgo's unexported session fields; this fails if an upgrade renames or retypes them
+func TestSessionResumeFields(t *testing.T) {
+	if err := checkSessionResumeFields(); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gatewayResume{SessionID: "abc123", Sequence: 42}
+	setSessionResumeState(sess, want)
+	if got := sessionResumeState(sess); got.SessionID != want.SessionID || got.Sequence != want.Sequence {
+		t.Fatalf("got session %q at %d, want %q at %d", got.SessionID, got.Sequence, want.SessionID, want.Sequence)
+	}
+}
+
+func TestStateSnapshotRoundTrip(t *testing.T) {
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: "1", Username: "galactus"}
+	err := state.GuildAdd(&discordgo.Guild{
+		ID:       "10",
+		Name:     "guild",
+		Roles:    []*discordgo.Role{{ID: "20", Permissions: discordgo.PermissionVoiceMuteMembers}},
+		Channels: []*discordgo.Channel{{ID: "30", Type: discordgo.ChannelTypeGuildVoice}},
+		VoiceStates: []*discordgo.VoiceState{
+			{UserID: "40", ChannelID: "30", GuildID: "10"},
+		},
+		Members: []*discordgo.Member{{User: &discordgo.User{ID: "40"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, guilds := stateSnapshot(state)
+	jBytes, err := json.Marshal(gatewayResume{SessionID: "abc123", User: user, Guilds: guilds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resume gatewayResume
+	if err := json.Unmarshal(jBytes, &resume); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := discordgo.NewState()
+	restoreStateSnapshot(restored, resume.User, resume.Guilds)
+	if restored.User == nil || restored.User.ID != "1" {
+		t.Fatalf("got user %+v, want 1", restored.User)
+	}
+	if _, err := restored.Role("10", "20"); err != nil {
+		t.Fatalf("role: %s", err)
+	}
+	if channel, err := restored.Channel("30"); err != nil || channel.GuildID != "10" {
+		t.Fatalf("got channel %+v (%v), want one in guild 10", channel, err)
+	}
+	guild, err := restored.Guild("10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(guild.VoiceStates) != 1 || guild.VoiceStates[0].UserID != "40" {
+		t.Fatalf("got voice states %+v, want user 40's", guild.VoiceStates)
+	}
+	if len(guild.Members) != 0 {
+		t.Fatalf("got %d members, want none in the snapshot", len(guild.Members))
+	}
+}
@@ -0,0 +1,141 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultRetryMaxAttempts includes the first attempt
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBaseDelay   = 100 * time.Millisecond
+	DefaultRetryMaxDelay    = time.Second
+)
+
+// DefaultRetryStatusCodes are the Discord responses worth trying again. discordgo already waits out 429s itself
+var DefaultRetryStatusCodes = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+var (
+	discordRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_discord_retries_total",
+		Help: "Discord REST calls retried after a retryable failure",
+	}, []string{"session"})
+	discordRetriesExhaustedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_discord_retries_exhausted_total",
+		Help: "Discord REST calls that still failed after their last attempt",
+	}, []string{"session"})
+)
+
+type retryPolicy struct {
+	// 1 disables retries
+	maxAttempts int64
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	statusCodes map[int]bool
+}
+
+func newRetryPolicy(cfg config.RetryConfig) retryPolicy {
+	policy := retryPolicy{
+		maxAttempts: DefaultRetryMaxAttempts,
+		baseDelay:   DefaultRetryBaseDelay,
+		maxDelay:    DefaultRetryMaxDelay,
+		statusCodes: make(map[int]bool),
+	}
+	if cfg.MaxAttempts > 0 {
+		policy.maxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BaseDelay > 0 {
+		policy.baseDelay = time.Duration(cfg.BaseDelay)
+	}
+	if cfg.MaxDelay > 0 {
+		policy.maxDelay = time.Duration(cfg.MaxDelay)
+	}
+	codes := DefaultRetryStatusCodes
+	if len(cfg.StatusCodes) > 0 {
+		codes = cfg.StatusCodes
+	}
+	for _, code := range codes {
+		policy.statusCodes[code] = true
+	}
+	return policy
+}
+
+// delay is the backoff before the given retry, starting from 1: exponential, with full jitter so calls that failed
+// together don't retry together
+func (policy retryPolicy) delay(retry int64) time.Duration {
+	backoff := policy.maxDelay
+	if retry < 32 {
+		if d := policy.baseDelay << uint(retry-1); d > 0 && d < backoff {
+			backoff = d
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// retryable is whether err is worth trying again: a retryable status, or no response at all. Calls stopped by a
+// breaker or an abandoned request aren't
+func (policy retryPolicy) retryable(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		return restErr.Response != nil && policy.statusCodes[restErr.Response.StatusCode]
+	}
+	return true
+}
+
+// retryDiscord makes an idempotent Discord REST call, trying again on retryable failures until the policy's attempts
+// run out or ctx ends. hashedToken is empty for the primary bot
+func (tokenProvider *TokenProvider) retryDiscord(ctx context.Context, hashedToken string, call func() error) error {
+	policy := tokenProvider.getSettings().retry
+	session := "secondary"
+	if hashedToken == "" {
+		session = "primary"
+	}
+	var err error
+	for attempt := int64(1); ; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err != nil {
+				return err
+			}
+			return ctxErr
+		}
+		err = call()
+		if !policy.retryable(err) {
+			return err
+		}
+		if attempt >= policy.maxAttempts {
+			if policy.maxAttempts > 1 {
+				discordRetriesExhaustedTotal.WithLabelValues(session).Inc()
+			}
+			return err
+		}
+		delay := policy.delay(attempt)
+		log.Printf("Discord call failed (%s); retrying in %s\n", err, delay)
+		discordRetriesTotal.WithLabelValues(session).Inc()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
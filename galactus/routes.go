@@ -0,0 +1,506 @@
+package galactus
+
+import (
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// LegacyAPIVersion's routes are also served without a version prefix, for automuteus deployments that predate
+// versioning
+const LegacyAPIVersion = "v1"
+
+// DiscordProxyPrefix is followed by a Discord API path, like /v1/discord/api/v8/channels/<channelID>/messages
+const DiscordProxyPrefix = "/v1/discord"
+
+type route struct {
+	Path    string
+	Methods []string
+	Class   RouteClass
+	Handler http.HandlerFunc
+	// Public routes are called by capture clients and health checks rather than automuteus workers, so they don't
+	// require a client certificate or signature
+	Public bool
+	// Roles are the API key roles that can call the route, or any role if empty. Admin keys can call every route
+	Roles []Role
+	// Admin routes need the admin key or an admin API key, like the /admin endpoints, even if API keys aren't required
+	Admin bool
+
+	// used to generate /openapi.json. Request and Response are zero values of the body types; strings are plain text
+	Summary  string
+	Request  interface{}
+	Response interface{}
+}
+
+// apiRoutes maps each API version to the routes it serves. Breaking changes to an endpoint's contract belong in a new
+// version, so existing automuteus deployments keep working against the old one
+func (tokenProvider *TokenProvider) apiRoutes(config ServerConfig) map[string][]route {
+	return map[string][]route{
+		"v1": {
+			{
+				Path:     "/modify/{guildID}/{connectCode}",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassModify,
+				Roles:    botRoles,
+				Handler:  tokenProvider.idempotent(config, tokenProvider.modifyHandler(config)),
+				Summary:  "Mute/deafen users in a guild, using secondary bots, capture bots, or the primary bot; ?dryRun=true only reports which would be used",
+				Request:  ModifyRequest{},
+				Response: api.ModifyResponse{},
+			},
+			{
+				Path:     "/modify/batch",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassModify,
+				Roles:    botRoles,
+				Handler:  tokenProvider.idempotent(config, tokenProvider.modifyBatchHandler(config)),
+				Summary:  "Mute/deafen users in several guilds at once, returning one result per guild in request order",
+				Request:  api.BatchModifyRequest{},
+				Response: api.BatchModifyResponse{},
+			},
+			{
+				Path:    "/addtoken",
+				Methods: []string{http.MethodPost},
+				Class:   RouteClassToken,
+				Roles:   adminRoles,
+				Handler: tokenProvider.addTokenHandler(config),
+				Summary: "Register a secondary bot token, sent as the raw request body",
+				Request: "",
+			},
+			{
+				Path:     "/tokens/verify",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassToken,
+				Roles:    adminRoles,
+				Handler:  tokenProvider.tokenVerifyHandler(config),
+				Summary:  "Verify a secondary bot token's owner, intents and guilds with a temporary session, then add it unless ?dryRun=true",
+				Request:  api.TokenVerifyRequest{},
+				Response: api.TokenVerification{},
+			},
+			{
+				Path:     "/game/{connectCode}",
+				Methods:  []string{http.MethodPost, http.MethodGet, http.MethodDelete},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.gameHandler(config),
+				Summary:  "Register or refresh (POST), get, or end (DELETE) the game for a connect code, bound to a guild",
+				Request:  GameRequest{},
+				Response: Game{},
+			},
+			{
+				Path:     "/guild/{guildID}/settings",
+				Methods:  []string{http.MethodGet, http.MethodPut, http.MethodDelete},
+				Class:    RouteClassDefault,
+				Roles:    []Role{RoleWorker, RoleBot},
+				Handler:  tokenProvider.guildSettingsHandler(config),
+				Summary:  "Get, replace (PUT) or delete a guild's settings, a JSON object cached by every galactus instance",
+				Request:  map[string]interface{}{},
+				Response: api.GuildSettings{},
+			},
+			{
+				Path:    "/capture/{connectCode}/event",
+				Methods: []string{http.MethodPost},
+				Class:   RouteClassDefault,
+				Handler: tokenProvider.captureEventHandler(config),
+				Public:  true,
+				Summary: "Queue a capture client's game event for the workers; the connect code must be a registered game, and the capture token sent as a bearer token",
+				Request: CaptureEventRequest{},
+			},
+			{
+				Path:     "/capture/{connectCode}/ws",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.captureSocketHandler(config),
+				Public:   true,
+				Summary:  "WebSocket for a capture client, authenticated with its game's capture token; galactus pushes modify tasks and the client acks them",
+				Response: CaptureMessage{},
+			},
+			{
+				Path:     "/request/job/{connectCode}",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    workerRoles,
+				Handler:  tokenProvider.requestJobHandler,
+				Summary:  "Pop the next queued job for a connect code; 204 if there are none",
+				Response: jobcodec.QueuedJob{},
+			},
+			{
+				Path:     "/request/gateway-event",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    workerRoles,
+				Handler:  tokenProvider.requestGatewayEventHandler,
+				Summary:  "Pop the oldest forwarded gateway event, like a guild join or leave; 204 if there are none",
+				Response: api.GatewayEvent{},
+			},
+			{
+				Path:     "/jobs",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.jobsHandler(config),
+				Summary:  "Pending jobs across connect codes (or ?connectCode=) by type, and whether any queue is above the high-water mark",
+				Response: api.JobsResponse{},
+			},
+			{
+				Path:     "/jobs/peek",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.jobsPeekHandler,
+				Summary:  "The next ?n= jobs (default 10), across connect codes or of ?connectCode=, without popping them",
+				Response: JobsPeekResponse{},
+			},
+			{
+				Path:     "/jobs",
+				Methods:  []string{http.MethodDelete},
+				Class:    RouteClassDefault,
+				Roles:    []Role{RoleWorker, RoleBot},
+				Handler:  tokenProvider.jobsPurgeHandler,
+				Summary:  "Drop the queued jobs of every game registered on ?guildID=",
+				Response: JobsPurgeResponse{},
+			},
+			{
+				Path:     "/jobs/all",
+				Methods:  []string{http.MethodDelete},
+				Class:    RouteClassDefault,
+				Admin:    true,
+				Handler:  tokenProvider.jobsPurgeAllHandler,
+				Summary:  "Drop every queued job; needs the admin key",
+				Response: JobsPurgeResponse{},
+			},
+			{
+				Path:    "/workers/heartbeat",
+				Methods: []string{http.MethodPost},
+				Class:   RouteClassDefault,
+				Roles:   workerRoles,
+				Handler: tokenProvider.workerHeartbeatHandler(config),
+				Summary: "Report a worker's load; workers that stop sending heartbeats drop out of /workers",
+				Request: WorkerHeartbeat{},
+			},
+			{
+				Path:     "/workers",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.workersHandler,
+				Summary:  "The live workers' load and lag, the queue depth trend, and the worker count that keeps up with it",
+				Response: WorkersResponse{},
+			},
+			{
+				Path:     "/discord/reserve",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassProxy,
+				Roles:    workerRoles,
+				Handler:  tokenProvider.reserveHandler(config),
+				Summary:  "Reserve requests on a Discord route for a direct call, from the same rate limit buckets as the Discord proxy",
+				Request:  ReserveRequest{},
+				Response: ReserveResponse{},
+			},
+			{
+				Path:     "/message/{channelID}",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.messageHandler(config),
+				Summary:  "Send a message with the primary bot; add ?async=true to get a job ID instead of waiting",
+				Request:  MessageRequest{},
+				Response: MessageResult{},
+			},
+			{
+				Path:     "/message/{channelID}/{messageID}",
+				Methods:  []string{http.MethodPatch},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.messageHandler(config),
+				Summary:  "Edit a message sent by the primary bot; add ?async=true to get a job ID instead of waiting",
+				Request:  MessageRequest{},
+				Response: MessageResult{},
+			},
+			{
+				Path:     "/message/job/{jobID}",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.messageJobHandler,
+				Summary:  "Get the result of an async message request; 202 while it's still queued",
+				Response: MessageResult{},
+			},
+			{
+				Path:    "/reaction/{channelID}/{messageID}/{emoji}",
+				Methods: []string{http.MethodPut, http.MethodDelete},
+				Class:   RouteClassDefault,
+				Roles:   botRoles,
+				Handler: tokenProvider.reactionHandler(config),
+				Summary: "Add (PUT) or remove (DELETE) a reaction with the primary bot; DELETE takes an optional ?userID=",
+			},
+			{
+				Path:     "/guild/{guildID}/token-audit",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.tokenAuditHandler(config),
+				Summary:  "Whether each of a guild's secondary bots is in it and can mute, with invite links to fix the ones that can't",
+				Response: TokenAuditResponse{},
+			},
+			{
+				Path:     "/guild/{guildID}/member/{userID}",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.memberHandler(config),
+				Summary:  "Get a guild member, from the member cache if possible",
+				Response: CachedMember{},
+			},
+			{
+				Path:     "/guild/{guildID}/members/request",
+				Methods:  []string{http.MethodGet, http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.memberChunkHandler(config),
+				Summary:  "Fill the member cache for a large guild from the gateway (POST), or check its progress (GET)",
+				Response: MemberChunkStatus{},
+			},
+			{
+				Path:    "/guild/{guildID}/member/{userID}/nick",
+				Methods: []string{http.MethodPatch},
+				Class:   RouteClassDefault,
+				Roles:   botRoles,
+				Handler: tokenProvider.nickHandler(config),
+				Summary: "Change a member's nickname, recording the original for the connect code if one is given",
+				Request: NickRequest{},
+			},
+			{
+				Path:     "/guild/{guildID}/nick/restore/{connectCode}",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.nickRestoreHandler(config),
+				Summary:  "Restore every nickname changed for a connect code to what it was before the game",
+				Response: NickRestoreResponse{},
+			},
+			{
+				Path:     "/guild/{guildID}/voice/{channelID}",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.voiceChannelHandler(config),
+				Summary:  "List the users in a voice channel, from the voice state cache",
+				Response: VoiceChannelResponse{},
+			},
+			{
+				Path:     "/commands",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.commandsHandler(config),
+				Summary:  "List the primary bot's global commands, or a guild's with ?guildID=",
+				Response: []ApplicationCommand{},
+			},
+			{
+				Path:     "/commands",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Admin:    true,
+				Handler:  tokenProvider.commandsHandler(config),
+				Summary:  "Create a command, replacing any with the same name; ?guildID= for a guild command; needs the admin key",
+				Request:  ApplicationCommand{},
+				Response: ApplicationCommand{},
+			},
+			{
+				Path:     "/commands",
+				Methods:  []string{http.MethodPut},
+				Class:    RouteClassDefault,
+				Admin:    true,
+				Handler:  tokenProvider.commandsHandler(config),
+				Summary:  "Sync commands to a manifest, deleting any not in it; ?guildID= for a guild's commands; needs the admin key",
+				Request:  []ApplicationCommand{},
+				Response: []ApplicationCommand{},
+			},
+			{
+				Path:     "/commands/{commandID}",
+				Methods:  []string{http.MethodPatch},
+				Class:    RouteClassDefault,
+				Admin:    true,
+				Handler:  tokenProvider.commandHandler(config),
+				Summary:  "Update a command; ?guildID= for a guild command; needs the admin key",
+				Request:  ApplicationCommand{},
+				Response: ApplicationCommand{},
+			},
+			{
+				Path:    "/commands/{commandID}",
+				Methods: []string{http.MethodDelete},
+				Class:   RouteClassDefault,
+				Admin:   true,
+				Handler: tokenProvider.commandHandler(config),
+				Summary: "Delete a command; ?guildID= for a guild command; needs the admin key",
+			},
+			{
+				Path:     "/interaction/{interactionID}/{token}/respond",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.interactionRespondHandler(config),
+				Summary:  "Send an interaction's initial response, or edit the deferred message if galactus already deferred it",
+				Request:  InteractionResponse{},
+				Response: InteractionRespondResult{},
+			},
+			{
+				Path:     "/interaction/{interactionID}/{token}/autodefer",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.interactionAutoDeferHandler(config),
+				Summary:  "Defer the interaction shortly before its deadline, unless a response is sent first",
+				Request:  AutoDeferRequest{},
+				Response: AutoDeferResponse{},
+			},
+			{
+				Path:    "/interaction/{interactionID}/{token}/followup",
+				Methods: []string{http.MethodPost},
+				Class:   RouteClassDefault,
+				Roles:   botRoles,
+				Handler: tokenProvider.interactionFollowupHandler(config),
+				Summary: "Send a followup message for an interaction; responds with Discord's message object",
+				Request: InteractionResponseData{},
+			},
+			{
+				Path:     "/dm/{userID}",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.dmHandler(config),
+				Summary:  "Send a direct message to a user with the primary bot, unless they've opted out",
+				Request:  MessageRequest{},
+				Response: MessageResult{},
+			},
+			{
+				Path:    "/dm/{userID}/optout",
+				Methods: []string{http.MethodPut, http.MethodDelete},
+				Class:   RouteClassDefault,
+				Roles:   botRoles,
+				Handler: tokenProvider.dmOptOutHandler,
+				Summary: "Opt a user out of DMs from galactus (PUT), or back in (DELETE)",
+			},
+			{
+				Path:     "/webhook/{webhookID}/{token}",
+				Methods:  []string{http.MethodPost},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.webhookHandler(config),
+				Summary:  "Execute a Discord webhook within its rate limit, retrying Discord server errors",
+				Request:  WebhookRequest{},
+				Response: MessageResult{},
+			},
+			{
+				Path:     "/events/stream",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.eventStreamHandler(config),
+				Summary:  "Server-Sent Events for queue depth changes, shard connects and disconnects, blacklists and capture timeouts",
+				Response: OpsEvent{},
+			},
+			{
+				Path:     "/stats",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  etagged(tokenProvider.statsHandler),
+				Summary:  "Total users modified by method, jobs processed, and active games",
+				Response: StatsResponse{},
+			},
+			{
+				Path:     "/stats/guild/{guildID}",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  etagged(tokenProvider.guildStatsHandler),
+				Summary:  "Total users modified on a guild, by method",
+				Response: GuildStatsResponse{},
+			},
+			{
+				Path:     "/stats/daily",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  etagged(tokenProvider.dailyStatsHandler),
+				Summary:  "Users modified per day, for all guilds or ?guildID=, between ?since= and ?until=; needs Postgres",
+				Response: DailyStatsResponse{},
+			},
+			{
+				Path:     "/stats/tokens",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  etagged(tokenProvider.tokenUsageHandler),
+				Summary:  "Users each secondary bot modified per ?bucket=hour or day, for ?guildID=, ?token= or both, between ?since= and ?until=",
+				Response: TokenUsageResponse{},
+			},
+			{
+				Path:     "/audit/{guildID}",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.auditHandler,
+				Summary:  "A guild's mute/deafen modifications, most recent first; filter with ?since=&until=&userID=&limit=",
+				Response: AuditResponse{},
+			},
+			{
+				Path:     "/messages",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Roles:    botRoles,
+				Handler:  tokenProvider.messagesHandler,
+				Summary:  "The messages for users of each error code, by locale, that error responses are localized with",
+				Response: MessagesResponse{},
+			},
+			{
+				Path:     "/version",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  versionHandler(config),
+				Public:   true,
+				Summary:  "Version, commit and build date of this deployment, and the optional features it has enabled",
+				Response: VersionResponse{},
+			},
+			{
+				Path:     "/",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  healthHandler,
+				Public:   true,
+				Summary:  "Health check",
+				Response: "",
+			},
+			{
+				Path:     "/ready",
+				Methods:  []string{http.MethodGet},
+				Class:    RouteClassDefault,
+				Handler:  tokenProvider.readyHandler,
+				Public:   true,
+				Summary:  "Readiness check; fails with a 503 until the secondary sessions are opened on startup",
+				Response: WarmupStatus{},
+			},
+		},
+	}
+}
+
+// registerRoutes registers each version's routes under "/<version>", and the legacy version's routes at the root too
+func registerRoutes(r *mux.Router, auth func([]Role, http.Handler) http.Handler, adminAuth func(http.Handler) http.Handler,
+	limiter *APIRateLimiter, versions map[string][]route) {
+	handler := func(rt route) http.Handler {
+		switch {
+		case rt.Public:
+			return limiter.limit(rt.Class, rt.Handler)
+		case rt.Admin:
+			return adminAuth(limiter.limit(rt.Class, rt.Handler))
+		}
+		return auth(rt.Roles, limiter.limit(rt.Class, rt.Handler))
+	}
+	for version, routes := range versions {
+		sub := r.PathPrefix("/" + version).Subrouter()
+		for _, rt := range routes {
+			sub.Handle(rt.Path, handler(rt)).Methods(rt.Methods...)
+		}
+	}
+
+	for _, rt := range versions[LegacyAPIVersion] {
+		r.Handle(rt.Path, handler(rt)).Methods(rt.Methods...)
+	}
+
+	r.Handle("/openapi.json", limiter.limit(RouteClassDefault, openAPIHandler(openAPISpec(versions)))).Methods(http.MethodGet)
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+}
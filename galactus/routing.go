@@ -0,0 +1,149 @@
+package galactus
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MuteRoutingFixed always tries the mute methods in the configured order
+	MuteRoutingFixed = "fixed"
+	// MuteRoutingAdaptive reorders them for each guild by how often and how quickly they've worked there lately
+	MuteRoutingAdaptive = "adaptive"
+)
+
+// DefaultMuteOrder is secondary bots, then the capture bot, then the official bot
+var DefaultMuteOrder = []string{AuditMethodWorker, AuditMethodCapture, AuditMethodOfficial}
+
+const (
+	// mutePathAlpha weighs each new attempt in a path's moving averages
+	mutePathAlpha = 0.2
+	// MinMutePathSamples is how many attempts a path needs on a guild before it's reordered
+	MinMutePathSamples = 5
+	// MinMutePathSuccessRate is the success rate below which a path is skipped, like a capture client that times out
+	// 9 times out of 10. The official bot is never skipped
+	MinMutePathSuccessRate = 0.1
+	// MutePathHealthTTL is how long a path's health is kept without attempts. Skipped paths are tried again once it's
+	// forgotten, so they can recover
+	MutePathHealthTTL = 5 * time.Minute
+)
+
+// mutePathHealth is the recent success rate and latency of one mute method on one guild
+type mutePathHealth struct {
+	successRate float64
+	latencyMs   float64
+	samples     int
+	updated     time.Time
+}
+
+// cost is the expected time spent on the path per successful mute
+func (health *mutePathHealth) cost() float64 {
+	rate := health.successRate
+	if rate < MinMutePathSuccessRate {
+		rate = MinMutePathSuccessRate
+	}
+	return health.latencyMs / rate
+}
+
+// mutePaths tracks the health of each mute method by guild, and the capture method by connect code too
+type mutePaths struct {
+	sync.Mutex
+	health map[string]*mutePathHealth
+	// when health was last pruned of paths past their TTL
+	pruned time.Time
+}
+
+func newMutePaths() *mutePaths {
+	return &mutePaths{health: make(map[string]*mutePathHealth)}
+}
+
+func mutePathKey(method, guildID, connectCode string) string {
+	if method == AuditMethodCapture {
+		return method + ":" + guildID + ":" + connectCode
+	}
+	return method + ":" + guildID
+}
+
+// record adds an attempt on a path to its moving averages
+func (paths *mutePaths) record(method, guildID, connectCode string, success bool, latency time.Duration) {
+	now := time.Now()
+	key := mutePathKey(method, guildID, connectCode)
+	outcome := 0.0
+	if success {
+		outcome = 1
+	}
+	ms := float64(latency) / float64(time.Millisecond)
+
+	paths.Lock()
+	defer paths.Unlock()
+	paths.prune(now)
+	health, ok := paths.health[key]
+	if !ok || now.Sub(health.updated) > MutePathHealthTTL {
+		paths.health[key] = &mutePathHealth{successRate: outcome, latencyMs: ms, samples: 1, updated: now}
+		return
+	}
+	health.successRate += mutePathAlpha * (outcome - health.successRate)
+	health.latencyMs += mutePathAlpha * (ms - health.latencyMs)
+	health.samples++
+	health.updated = now
+}
+
+// prune forgets the paths past their TTL, at most once per TTL
+func (paths *mutePaths) prune(now time.Time) {
+	if now.Sub(paths.pruned) < MutePathHealthTTL {
+		return
+	}
+	paths.pruned = now
+	for key, health := range paths.health {
+		if now.Sub(health.updated) > MutePathHealthTTL {
+			delete(paths.health, key)
+		}
+	}
+}
+
+// order returns the methods to try on a guild, cheapest expected time per mute first. Paths without enough recent
+// attempts keep their place in the configured order, and paths that almost never work are dropped
+func (paths *mutePaths) order(base []string, guildID, connectCode string) []string {
+	now := time.Now()
+	costs := make(map[string]float64, len(base))
+	order := make([]string, 0, len(base))
+	paths.Lock()
+	for _, method := range base {
+		health, ok := paths.health[mutePathKey(method, guildID, connectCode)]
+		if !ok || health.samples < MinMutePathSamples || now.Sub(health.updated) > MutePathHealthTTL {
+			costs[method] = -1
+		} else if health.successRate < MinMutePathSuccessRate && method != AuditMethodOfficial {
+			continue
+		} else {
+			costs[method] = health.cost()
+		}
+		order = append(order, method)
+	}
+	paths.Unlock()
+
+	// only the paths with enough samples trade places; the others stay where they were configured
+	var measured []string
+	var slots []int
+	for i, method := range order {
+		if costs[method] >= 0 {
+			measured = append(measured, method)
+			slots = append(slots, i)
+		}
+	}
+	sort.SliceStable(measured, func(i, j int) bool {
+		return costs[measured[i]] < costs[measured[j]]
+	})
+	for i, slot := range slots {
+		order[slot] = measured[i]
+	}
+	return order
+}
+
+// muteOrder is the order to try the mute methods in for a guild's request
+func (tokenProvider *TokenProvider) muteOrder(settings settings, guildID, connectCode string) []string {
+	if !settings.adaptiveRouting {
+		return settings.muteOrder
+	}
+	return tokenProvider.mutePaths.order(settings.muteOrder, guildID, connectCode)
+}
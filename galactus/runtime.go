@@ -0,0 +1,115 @@
+package galactus
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// how many of the most recent GC pauses /admin/runtime reports
+const recentGCPauses = 10
+
+type AdminRuntimeResponse struct {
+	InstanceID string `json:"instanceID"`
+	// Leader is set on the one instance that runs the singleton background tasks
+	Leader     bool       `json:"leader"`
+	Goroutines int        `json:"goroutines"`
+	Heap       HeapStats  `json:"heap"`
+	GC         GCStats    `json:"gc"`
+	Sessions   int        `json:"sessions"`
+	Maps       MapLengths `json:"maps"`
+}
+
+type HeapStats struct {
+	AllocBytes    uint64 `json:"allocBytes"`
+	InuseBytes    uint64 `json:"inuseBytes"`
+	ObjectCount   uint64 `json:"objectCount"`
+	SysBytes      uint64 `json:"sysBytes"`
+	ReleasedBytes uint64 `json:"releasedBytes"`
+}
+
+type GCStats struct {
+	Count        uint32 `json:"count"`
+	PauseTotalMs int64  `json:"pauseTotalMs"`
+	// most recent first
+	RecentPausesUs []int64   `json:"recentPausesUs"`
+	Last           time.Time `json:"last"`
+}
+
+// MapLengths are the sizes of galactus' long-lived in-memory maps, which should track the number of tokens and active
+// guilds rather than grow forever
+type MapLengths struct {
+	ActiveSessions   int `json:"activeSessions"`
+	LastUsed         int `json:"lastUsed"`
+	PermissionTokens int `json:"permissionTokens"`
+	GuildSequences   int `json:"guildSequences"`
+	ChannelSequences int `json:"channelSequences"`
+}
+
+// pprofHandler serves the standard pprof endpoints under /debug/pprof/. Paths have to be relative to that, so the
+// admin router strips its own prefix first
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func (sequencer *guildSequencer) length() int {
+	sequencer.lock.Lock()
+	defer sequencer.lock.Unlock()
+	return len(sequencer.guilds)
+}
+
+func (tokenProvider *TokenProvider) adminRuntimeHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	gc := GCStats{
+		Count:        mem.NumGC,
+		PauseTotalMs: int64(time.Duration(mem.PauseTotalNs) / time.Millisecond),
+	}
+	if mem.LastGC > 0 {
+		gc.Last = time.Unix(0, int64(mem.LastGC))
+	}
+	// PauseNs is a circular buffer; the latest pause is at (NumGC+255)%256
+	for i := uint32(0); i < recentGCPauses && i < mem.NumGC; i++ {
+		pause := mem.PauseNs[(mem.NumGC-1-i)%uint32(len(mem.PauseNs))]
+		gc.RecentPausesUs = append(gc.RecentPausesUs, int64(time.Duration(pause)/time.Microsecond))
+	}
+
+	resp := AdminRuntimeResponse{
+		InstanceID: tokenProvider.instanceID,
+		Leader:     tokenProvider.leader.isLeader(),
+		Goroutines: runtime.NumGoroutine(),
+		Heap: HeapStats{
+			AllocBytes:    mem.HeapAlloc,
+			InuseBytes:    mem.HeapInuse,
+			ObjectCount:   mem.HeapObjects,
+			SysBytes:      mem.HeapSys,
+			ReleasedBytes: mem.HeapReleased,
+		},
+		GC: gc,
+	}
+
+	resp.Maps.ActiveSessions = tokenProvider.sessions.len()
+	// the primary bot's shards, plus every secondary session
+	resp.Sessions = resp.Maps.ActiveSessions + len(tokenProvider.gatewaySessions())
+
+	tokenProvider.usageLock.Lock()
+	resp.Maps.LastUsed = len(tokenProvider.lastUsed)
+	tokenProvider.usageLock.Unlock()
+
+	tokenProvider.permissions.lock.RLock()
+	resp.Maps.PermissionTokens = len(tokenProvider.permissions.missing)
+	tokenProvider.permissions.lock.RUnlock()
+
+	resp.Maps.GuildSequences = tokenProvider.guildSequencer.length()
+	resp.Maps.ChannelSequences = tokenProvider.channelSequencer.length()
+
+	writeJSON(w, http.StatusOK, resp)
+}
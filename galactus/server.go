@@ -6,23 +6,27 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"github.com/automuteus/galactus/broker"
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/galactus/pkg/redisutil"
+	"github.com/automuteus/galactus/proxy"
 	"github.com/automuteus/utils/pkg/premium"
 	"github.com/automuteus/utils/pkg/rediskey"
-	"github.com/automuteus/utils/pkg/task"
-	"github.com/automuteus/utils/pkg/token"
 	"github.com/bwmarrin/discordgo"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// PremiumBotConstraints are the default number of secondary bots each premium tier can use
 var PremiumBotConstraints = map[premium.Tier]int{
 	0: 0,
 	1: 0,   // Free and Bronze have no premium bots
@@ -37,180 +41,381 @@ const DefaultCaptureBotTimeout = time.Second
 var ctx = context.Background()
 
 type TokenProvider struct {
-	client         *redis.Client
+	client         redis.UniversalClient
 	primarySession *discordgo.Session
+	// other official bots the primary's mutes fail over to, and the shards that are failed over to them
+	standbys []standbyBot
+	failover *failover
+	// the primary bot's other shards in this instance's range, if its shards are split between instances
+	shardSessions []*discordgo.Session
+	shardLease    *shardLease
+	stopHeartbeat context.CancelFunc
+
+	// stop calling Discord with tokens that keep failing
+	breakers *circuitBreakers
+	// pauses modify requests while Discord is failing most calls
+	outage *outageDetector
+
+	// identifies this instance in Redis leases
+	instanceID string
+	leader     *leaderElection
+	stopLeader context.CancelFunc
+	// stops applying presence changes published by other instances
+	stopPresenceWatch context.CancelFunc
+	// stops dropping the cached guild settings other instances change
+	stopGuildSettingsWatch context.CancelFunc
+
+	// nil unless Postgres is configured
+	storage Storage
+	// guild settings read through this instance
+	guildSettingsCache *guildSettingsCache
+	// queues the capture events sent to /capture
+	broker *broker.Broker
+	// capture clients connected to this instance over WebSocket, by connect code, and the tasks pushed to them that
+	// are waiting for an ack, by task ID
+	captureSockets     map[string]*captureSocket
+	pendingCaptureAcks map[string]chan ack.Ack
+	captureSocketsLock sync.Mutex
 
 	// maps hashed tokens to active discord sessions
-	activeSessions      map[string]*discordgo.Session
-	maxRequests5Seconds int64
-	sessionLock         sync.RWMutex
+	sessions *sessionRegistry
+	// guild tokens found without a session, waiting to be removed from Redis by RemoveStaleTokens
+	staleTokens chan staleGuildToken
+	// restarts the sessions that die
+	supervisor *sessionSupervisor
+	warmup     *sessionWarmup
+	// the recent health of each guild's mute methods, for adaptive routing
+	mutePaths *mutePaths
+	// nil unless fault injection is enabled
+	faults *faultInjector
+	// nil unless sessions are opened lazily
+	lazySessions *lazySessions
+
+	// when each hashed token was last picked by getAnySession
+	lastUsed  map[string]time.Time
+	usageLock sync.Mutex
+
+	permissions *tokenPermissions
+	// the primary bot's guilds that will become available without it joining them
+	pendingGuilds *pendingGuilds
+	// get a copy of every gateway event forwarded to the workers
+	eventSinks *eventSinks
+	// the archives gateway events can be replayed from; nil unless configured
+	archiveSink *RedisStreamEventSink
+	kafkaSink   *KafkaEventSink
+
+	// forwards Discord requests under DiscordProxyPrefix, and reserves requests from the same buckets for direct calls
+	discordProxy *proxy.Proxy
+
+	// shared by all requests
+	workers        *tieredWorkerPool
+	guildSequencer *guildSequencer
+	// orders the messages sent to each channel
+	channelSequencer *guildSequencer
+	apiLimiter       *APIRateLimiter
+
+	// the config galactus was started with, which never changes, and the settings from the last reload
+	config     config.Config
+	settings   atomic.Value
+	reloadLock sync.Mutex
 }
 
-func NewTokenProvider(botToken, redisAddr, redisUser, redisPass string, maxReq int64) *TokenProvider {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Username: redisUser,
-		Password: redisPass,
-		DB:       0, // use default DB
-	})
+func NewTokenProvider(cfg config.Config) *TokenProvider {
+	if err := validateIntents(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateGatewayEvents(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Intents.GuildMembers {
+		log.Println("Requesting the guild members intent for the member cache")
+	}
+	tokenProvider := newTokenProvider(cfg, redisutil.NewClient(cfg.Redis))
 
-	token.WaitForToken(rdb, botToken)
-	token.LockForToken(rdb, botToken)
+	// the primary session serves the first shard of the range; REST calls work from any of them
+	firstShard, lastShard := 0, 0
+	if cfg.NumShards > 0 && cfg.ShardRangeSize > 0 {
+		lease, err := acquireShardLease(context.Background(), tokenProvider.client, tokenProvider.instanceID, cfg.NumShards, cfg.ShardRangeSize, shardLeaseTTL(cfg))
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokenProvider.shardLease = lease
+		firstShard, lastShard = lease.start, lease.end-1
+		// renewed from the start, since opening a range of shards can take longer than the lease lasts
+		heartbeatCtx, cancel := context.WithCancel(context.Background())
+		tokenProvider.stopHeartbeat = cancel
+		go lease.heartbeat(heartbeatCtx, func() {
+			log.Fatalf("Lost the lease on shards %d-%d; exiting so they aren't served twice\n", lease.start, lease.end-1)
+		})
+	}
+	botToken := cfg.DiscordBotToken
+	tokenProvider.primarySession = tokenProvider.openPrimarySession(botToken, cfg.NumShards, firstShard)
+	for shardID := firstShard + 1; shardID <= lastShard; shardID++ {
+		tokenProvider.shardSessions = append(tokenProvider.shardSessions, tokenProvider.openPrimarySession(botToken, cfg.NumShards, shardID))
+	}
+	tokenProvider.openStandbyBots(cfg.StandbyBotTokens)
+	tokenProvider.discordProxy.RewriteAuthorization = tokenProvider.proxyAuthorization
 
-	dg, err := discordgo.New("Bot " + botToken)
-	if err != nil {
-		log.Fatal(err)
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	tokenProvider.stopLeader = cancel
+	go tokenProvider.leader.run(leaderCtx)
+
+	presenceCtx, cancel := context.WithCancel(context.Background())
+	tokenProvider.stopPresenceWatch = cancel
+	go tokenProvider.watchPresence(presenceCtx)
+
+	guildSettingsCtx, cancel := context.WithCancel(context.Background())
+	tokenProvider.stopGuildSettingsWatch = cancel
+	go tokenProvider.watchGuildSettings(guildSettingsCtx)
+	return tokenProvider
+}
+
+// newTokenProvider sets up a TokenProvider on rdb, without opening any sessions or starting its background work
+func newTokenProvider(cfg config.Config, rdb redis.UniversalClient) *TokenProvider {
+	faults := newFaultInjector(cfg.Faults)
+	if faults != nil {
+		rdb.AddHook(redisFaultHook{faults: faults})
+	}
+	queueSize := DefaultWorkerQueueSize
+	if cfg.Workers.QueueSize > 0 {
+		queueSize = cfg.Workers.QueueSize
+	}
+
+	tokenProvider := &TokenProvider{
+		client:             rdb,
+		sessions:           newSessionRegistry(),
+		staleTokens:        make(chan staleGuildToken, StaleTokenQueueSize),
+		supervisor:         newSessionSupervisor(),
+		failover:           &failover{shards: make(map[int]bool)},
+		warmup:             &sessionWarmup{},
+		mutePaths:          newMutePaths(),
+		guildSettingsCache: newGuildSettingsCache(),
+		faults:             faults,
+		lastUsed:           make(map[string]time.Time),
+		captureSockets:     make(map[string]*captureSocket),
+		pendingCaptureAcks: make(map[string]chan ack.Ack),
+		permissions:        newTokenPermissions(),
+		pendingGuilds:      newPendingGuilds(),
+		eventSinks:         &eventSinks{},
+		workers:            newTieredWorkerPool(workerPoolSizeFor(cfg), queueSize, workerShares(cfg)),
+		guildSequencer:     newGuildSequencer(),
+		channelSequencer:   newGuildSequencer(),
+		apiLimiter:         NewAPIRateLimiter(rdb, apiRateLimits(cfg)),
+		discordProxy:       proxy.NewProxy(rdb, DiscordProxyPrefix),
+		config:             cfg,
+		instanceID:         newInstanceID(),
+		breakers:           newCircuitBreakers(),
+		outage:             newOutageDetector(),
 	}
-	dg.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsGuilds)
-	shards := os.Getenv("NUM_SHARDS")
-	if shards != "" {
-		n, err := strconv.ParseInt(shards, 10, 64)
+	tokenProvider.settings.Store(newSettings(cfg))
+	tokenProvider.leader = newLeaderElection(rdb, tokenProvider.instanceID, DefaultLeaderLeaseTTL)
+	if cfg.Postgres.URL != "" {
+		storage, err := newPostgresStorage(context.Background(), cfg.Postgres)
 		if err != nil {
-			log.Println(err)
+			log.Fatal(err)
 		}
-		dg.ShardCount = int(n)
-		dg.ShardID = 0
+		tokenProvider.storage = storage
+		log.Println("Storing audit entries, daily stats and token history in Postgres")
+	}
+	if err := tokenProvider.addConfiguredEventSinks(cfg.EventSinks); err != nil {
+		log.Fatal(err)
 	}
-	dg.AddHandler(rateLimitEventCallback)
+	if cfg.Sessions.Lazy {
+		tokenProvider.lazySessions = newLazySessions(time.Duration(cfg.Sessions.IdleTTL))
+	}
+	return tokenProvider
+}
 
-	err = dg.Open()
+// openPrimarySession opens one shard of the primary bot's gateway. numShards of 0 doesn't shard the connection
+func (tokenProvider *TokenProvider) openPrimarySession(botToken string, numShards, shardID int) *discordgo.Session {
+	dg, err := discordgo.New("Bot " + botToken)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	return &TokenProvider{
-		client:              rdb,
-		primarySession:      dg,
-		activeSessions:      make(map[string]*discordgo.Session),
-		maxRequests5Seconds: maxReq,
-		sessionLock:         sync.RWMutex{},
+	dg.Client.Transport = tokenProvider.newBreakerTransport("", dg.Client.Transport)
+	dg.Identify.Intents = discordgo.MakeIntent(primaryIntents(tokenProvider.getSettings().intents))
+	if numShards > 0 {
+		dg.ShardCount = numShards
+		dg.ShardID = shardID
 	}
-}
 
-func rateLimitEventCallback(sess *discordgo.Session, rl *discordgo.RateLimit) {
-	log.Println(rl.Message)
-}
+	dg.AddHandler(tokenProvider.rateLimitHandler(""))
+	tokenProvider.addMemberCacheHandlers(dg)
+	tokenProvider.addMemberChunkHandlers(dg)
+	tokenProvider.addVoiceStateHandlers(dg, true)
+	dg.AddHandler(tokenProvider.presenceReadyHandler)
+	tokenProvider.addShardEventHandlers(dg)
+	tokenProvider.addGatewayEventHandlers(dg)
+	tokenProvider.restoreGatewaySession(context.Background(), dg)
 
-func (tokenProvider *TokenProvider) PopulateAndStartSessions() {
-	keys, err := tokenProvider.client.HGetAll(ctx, rediskey.AllTokensHSet).Result()
+	err = tokenProvider.openSession(dg)
 	if err != nil {
-		log.Println(err)
-		return
+		log.Fatal(err)
 	}
+	return dg
+}
 
-	for _, v := range keys {
-		tokenProvider.openAndStartSessionWithToken(v)
+// openSecondarySession opens a secondary bot's gateway with its configured intents. Its guilds are associated with
+// hToken to be used for requests, and if it has the voice states intent, it feeds the voice state cache too
+func (tokenProvider *TokenProvider) openSecondarySession(botToken, hToken string) (*discordgo.Session, error) {
+	sess, err := discordgo.New("Bot " + botToken)
+	if err != nil {
+		return nil, err
 	}
+	intents := secondaryIntents(tokenProvider.getSettings().intents, hToken)
+	sess.Client.Transport = tokenProvider.newBreakerTransport(hToken, sess.Client.Transport)
+	sess.Identify.Intents = discordgo.MakeIntent(intents)
+	sess.AddHandler(tokenProvider.newGuild(hToken))
+	sess.AddHandler(tokenProvider.guildDelete(hToken))
+	sess.AddHandler(tokenProvider.rateLimitHandler(hToken))
+	if intents&discordgo.IntentsGuildVoiceStates != 0 {
+		tokenProvider.addVoiceStateHandlers(sess, false)
+	}
+	err = tokenProvider.openSession(sess)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
 }
 
-func (tokenProvider *TokenProvider) openAndStartSessionWithToken(botToken string) bool {
-	k := hashToken(botToken)
-	tokenProvider.sessionLock.Lock()
-	defer tokenProvider.sessionLock.Unlock()
+// gatewaySessions are the primary bot's sessions: the primary session, then any other shards this instance serves
+func (tokenProvider *TokenProvider) gatewaySessions() []*discordgo.Session {
+	return append([]*discordgo.Session{tokenProvider.primarySession}, tokenProvider.shardSessions...)
+}
 
-	if _, ok := tokenProvider.activeSessions[k]; !ok {
-		token.WaitForToken(tokenProvider.client, botToken)
-		token.LockForToken(tokenProvider.client, botToken)
-		sess, err := discordgo.New("Bot " + botToken)
-		if err != nil {
-			log.Println(err)
-			return false
-		}
-		sess.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsGuilds)
-		err = sess.Open()
-		if err != nil {
-			log.Println(err)
-			return false
-		}
-		// associates the guilds with this token to be used for requests
-		sess.AddHandler(tokenProvider.newGuild(k))
-		log.Println("Opened session on startup for " + k)
-		tokenProvider.activeSessions[k] = sess
-		return true
+// openAndStartSessionWithToken opens a session for a registered token, unless it already has one
+func (tokenProvider *TokenProvider) openAndStartSessionWithToken(botToken string) error {
+	k := hashToken(botToken)
+	if _, ok := tokenProvider.sessions.get(k); ok {
+		return nil
 	}
-	return false
+	// opened without holding anything, so a slow identify doesn't hold up the sessions being read or added
+	sess, err := tokenProvider.openSecondarySession(botToken, k)
+	if err != nil {
+		return err
+	}
+	if !tokenProvider.sessions.add(k, sess) {
+		// the token was added through /addtoken while this session was opening
+		sess.Close()
+		return nil
+	}
+	log.Println("Opened session for " + k)
+	return nil
 }
 
-func (tokenProvider *TokenProvider) getAllTokensForGuild(guildID string) []string {
-	hTokens, err := tokenProvider.client.SMembers(context.Background(), rediskey.GuildTokensKey(guildID)).Result()
+// getAllTokensForGuild returns the guild's secondary tokens, except those known to lack mute/deafen permissions there
+func (tokenProvider *TokenProvider) getAllTokensForGuild(ctx context.Context, guildID string) []string {
+	hTokens, err := tokenProvider.client.SMembers(ctx, rediskey.GuildTokensKey(guildID)).Result()
 	if err != nil {
 		return nil
 	}
-	return hTokens
+	usable := hTokens[:0]
+	for _, hToken := range hTokens {
+		if tokenProvider.permissions.usable(hToken, guildID) {
+			usable = append(usable, hToken)
+		}
+	}
+	return usable
 }
 
-func (tokenProvider *TokenProvider) getAnySession(guildID string, tokens []string, limit int) (*discordgo.Session, string) {
-	tokenProvider.sessionLock.RLock()
-	defer tokenProvider.sessionLock.RUnlock()
+// getAnySession returns the least loaded of the guild's first limit tokens that isn't rate-limited, so work is spread
+// over all of a guild's secondary bots instead of piling onto whichever one SMEMBERS returns first
+func (tokenProvider *TokenProvider) getAnySession(ctx context.Context, guildID string, tokens []string, limit int) (*discordgo.Session, string) {
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
 
-	for i, hToken := range tokens {
-		if i == limit {
-			return nil, ""
-		}
-		// if this token isn't potentially rate-limited
-		if tokenProvider.IncrAndTestGuildTokenComboLock(guildID, hToken) {
-			sess, ok := tokenProvider.activeSessions[hToken]
-			if ok {
-				return sess, hToken
-			}
-			// remove this key from our records and keep going
-			tokenProvider.client.SRem(context.Background(), rediskey.GuildTokensKey(guildID), hToken)
+	sessions := make(map[string]*discordgo.Session, len(tokens))
+	candidates := make([]string, 0, len(tokens))
+	var stale []string
+	active := tokenProvider.sessions.snapshot()
+	for _, hToken := range tokens {
+		if sess, ok := active[hToken]; ok {
+			sessions[hToken] = sess
+			candidates = append(candidates, hToken)
 		} else {
-			log.Println("Secondary token is potentially rate-limited. Skipping")
+			stale = append(stale, hToken)
 		}
 	}
 
-	return nil, ""
-}
-
-func (tokenProvider *TokenProvider) IncrAndTestGuildTokenComboLock(guildID, hashToken string) bool {
-	i, err := tokenProvider.client.Incr(context.Background(), rediskey.GuildTokenLock(guildID, hashToken)).Result()
-	if err != nil {
-		log.Println(err)
-	}
-	usable := i < tokenProvider.maxRequests5Seconds
-	log.Printf("Token %s on guild %s is at count %d. Using: %v", hashToken, guildID, i, usable)
-	if !usable {
-		return false
+	// removing them from Redis is left to RemoveStaleTokens, so this request doesn't wait on it. While sessions are
+	// still being opened on startup, a token without one may just not have been gotten to yet
+	if tokenProvider.lazySessions != nil {
+		for _, hToken := range stale {
+			tokenProvider.openLazily(guildID, hToken)
+		}
+	} else if tokenProvider.warmup.ready() {
+		for _, hToken := range stale {
+			tokenProvider.queueStaleToken(guildID, hToken)
+		}
 	}
 
-	err = tokenProvider.client.Expire(context.Background(), rediskey.GuildTokenLock(guildID, hashToken), time.Second*5).Err()
-	if err != nil {
-		log.Println(err)
+	breakerSettings := tokenProvider.getSettings().breaker
+	for _, hToken := range tokenProvider.leastLoadedTokens(ctx, guildID, candidates) {
+		if !tokenProvider.supervisor.healthy(hToken) {
+			log.Println("Secondary session looks dead. Skipping")
+			continue
+		}
+		if !tokenProvider.breakers.get(hToken).available(breakerSettings, time.Now()) {
+			log.Println("Secondary token's circuit breaker is open. Skipping")
+			continue
+		}
+		// if this token isn't potentially rate-limited
+		if tokenProvider.TakeGuildTokenRateLimit(ctx, guildID, hToken) {
+			tokenProvider.markTokenUsed(hToken)
+			return sessions[hToken], hToken
+		}
+		log.Println("Secondary token is potentially rate-limited. Skipping")
 	}
 
-	return true
-}
-
-func (tokenProvider *TokenProvider) BlacklistTokenForDuration(guildID, hashToken string, duration time.Duration) error {
-	return tokenProvider.client.Set(context.Background(), rediskey.GuildTokenLock(guildID, hashToken), tokenProvider.maxRequests5Seconds, duration).Err()
+	return nil, ""
 }
 
 const DefaultMaxWorkers = 8
 
 var UnresponsiveCaptureBlacklistDuration = time.Minute * time.Duration(5)
 
-func (tokenProvider *TokenProvider) Run(port string) {
-	r := mux.NewRouter()
+// RateLimitedCaptureBlacklistDuration is shorter; Discord's member-edit limits reset within a few seconds
+var RateLimitedCaptureBlacklistDuration = time.Second * time.Duration(10)
 
-	taskTimeoutms := DefaultCaptureBotTimeout
+func (tokenProvider *TokenProvider) Run(config ServerConfig) {
+	r := mux.NewRouter()
+	// order matters: the access log needs the request ID, and should see the 500 written on a recovered panic, which is
+	// compressed and localized like any other response
+	r.Use(requestIDMiddleware, clientIdentityMiddleware, accessLogMiddleware, gzipMiddleware,
+		tokenProvider.localizeMiddleware, recoveryMiddleware)
+	limiter := tokenProvider.apiLimiter
+	serviceAuth := tokenProvider.serviceAuth(config)
+	auth := func(roles []Role, next http.Handler) http.Handler {
+		return serviceAuth(tokenProvider.requireRoles(config, roles, next))
+	}
+	adminAuth := func(next http.Handler) http.Handler {
+		return serviceAuth(tokenProvider.adminAuth(config.AdminAPIKey, next))
+	}
 
-	taskTimeoutmsStr := os.Getenv("ACK_TIMEOUT_MS")
-	num, err := strconv.ParseInt(taskTimeoutmsStr, 10, 64)
-	if err == nil {
-		log.Printf("Read from env; using ACK_TIMEOUT_MS=%d\n", num)
-		taskTimeoutms = time.Millisecond * time.Duration(num)
+	registerRoutes(r, auth, adminAuth, limiter, tokenProvider.apiRoutes(config))
+	registerAdminRoutes(r, config.AdminAPIKey, adminAuth, limiter, tokenProvider.adminRoutes(config))
+	if config.DiscordProxy {
+		log.Println("Serving the Discord REST proxy at " + DiscordProxyPrefix)
+		r.PathPrefix(DiscordProxyPrefix + "/").Handler(auth(botRoles, limiter.limit(RouteClassProxy, tokenProvider.discordProxy)))
 	}
 
-	maxWorkers := DefaultMaxWorkers
-	maxWorkersStr := os.Getenv("MAX_WORKERS")
-	num, err = strconv.ParseInt(maxWorkersStr, 10, 64)
-	if err == nil {
-		log.Printf("Read from env; using MAX_WORKERS=%d\n", num)
-		maxWorkers = int(num)
+	server, err := config.newServer(corsMiddleware(config.CORS, r))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.useMTLS() {
+		log.Println("Accepting client certificates signed by " + config.TLSClientCAFile + " on worker and admin routes")
 	}
+	if config.useSigning() {
+		log.Println("Accepting requests signed with the shared secret on worker and admin routes")
+	}
+	log.Println("Galactus token service is running on " + config.Addr + "...")
+	log.Fatal(config.listenAndServe(server))
+}
 
-	r.HandleFunc("/modify/{guildID}/{connectCode}", func(w http.ResponseWriter, r *http.Request) {
+func (tokenProvider *TokenProvider) modifyHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		guildID := vars["guildID"]
 		connectCode := vars["connectCode"]
@@ -220,82 +425,53 @@ func (tokenProvider *TokenProvider) Run(port string) {
 			w.Write([]byte("Invalid guildID received. Query should be of the form POST `/modify/<guildID>/<conncode>`"))
 			return
 		}
-
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+		if tokenProvider.outage.isActive() {
+			writeOutageError(w, r)
 			return
 		}
-		defer r.Body.Close()
-
-		userModifications := task.UserModifyRequest{}
-		err = json.Unmarshal(body, &userModifications)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+		if tokenProvider.guildDenied(r.Context(), guildID) {
+			writeError(w, r, http.StatusForbidden, ErrorCodeGuildDenied, "guild "+guildID+" is on the deny list")
 			return
 		}
 
-		limit := PremiumBotConstraints[userModifications.Premium]
-		tokens := tokenProvider.getAllTokensForGuild(guildID)
+		start := time.Now()
+		userModifications := ModifyRequest{}
+		if !readJSONBody(w, r, config, &userModifications) {
+			return
+		}
+		if errs := validateUserModifyRequest(userModifications.UserModifyRequest, ""); len(errs) > 0 {
+			writeValidationError(w, r, errs)
+			return
+		}
 
-		tasksChannel := make(chan task.UserModify, len(userModifications.Users))
-		wg := sync.WaitGroup{}
+		// bound all the Redis and Discord work for this request; if automuteus gives up on us, so do we
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
 
-		mdsc := task.MuteDeafenSuccessCounts{
-			Worker:    0,
-			Capture:   0,
-			Official:  0,
-			RateLimit: 0,
-		}
-		mdscLock := sync.Mutex{}
-
-		// start a handful of workers to handle the tasks
-		for i := 0; i < maxWorkers; i++ {
-			go func() {
-				for request := range tasksChannel {
-					userIDStr := strconv.FormatUint(request.UserID, 10)
-					success := tokenProvider.attemptOnSecondaryTokens(guildID, userIDStr, tokens, limit, request)
-					if success {
-						mdscLock.Lock()
-						mdsc.Worker++
-						mdscLock.Unlock()
-					} else {
-						success = tokenProvider.attemptOnCaptureBot(guildID, connectCode, gid, taskTimeoutms, request)
-						if success {
-							mdscLock.Lock()
-							mdsc.Capture++
-							mdscLock.Unlock()
-						} else {
-							log.Printf("Applying mute=%v, deaf=%v using primary bot\n", request.Mute, request.Deaf)
-							err = task.ApplyMuteDeaf(tokenProvider.primarySession, guildID, userIDStr, request.Mute, request.Deaf)
-							if err != nil {
-								log.Println(err)
-							} else {
-								mdscLock.Lock()
-								mdsc.Official++
-								mdscLock.Unlock()
-							}
-						}
-					}
-					wg.Done()
-				}
-			}()
+		deadline, err := modifyDeadline(r, start, userModifications.MaxDurationMs)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
 		}
 
-		for _, modifyReq := range userModifications.Users {
-			wg.Add(1)
-			tasksChannel <- modifyReq
+		var resp api.ModifyResponse
+		if dryRun(r) {
+			// dry runs don't modify anyone, so they don't count against the guild's quota
+			resp = tokenProvider.dryRunModify(ctx, guildID, gid, connectCode, userModifications.UserModifyRequest)
+		} else {
+			release, quotaErr := tokenProvider.acquireGuildQuota(ctx, guildID, tokenProvider.guildTier(ctx, guildID))
+			if quotaErr != nil {
+				writeGuildQuotaError(w, r, quotaErr)
+				return
+			}
+			defer release()
+			resp = tokenProvider.modifyUsers(ctx, guildID, gid, connectCode, userModifications.UserModifyRequest, deadline)
 		}
-		wg.Wait()
-		close(tasksChannel)
+		localizeModifyErrors(r, guildID, resp.Errors)
 
 		w.WriteHeader(http.StatusOK)
 
-		jbytes, err := json.Marshal(mdsc)
+		jbytes, err := json.Marshal(resp)
 		if err != nil {
 			log.Println(err)
 		} else {
@@ -304,82 +480,84 @@ func (tokenProvider *TokenProvider) Run(port string) {
 				log.Println(err)
 			}
 		}
-	}).Methods("POST")
+	}
+}
 
-	r.HandleFunc("/addtoken", func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadAll(r.Body)
+func (tokenProvider *TokenProvider) addTokenHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readBody(r, config.MaxBodyBytes)
 		if err != nil {
 			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			writeBodyError(w, r, config, err)
 			return
 		}
-		defer r.Body.Close()
 
 		botToken := string(body)
 		log.Println(botToken)
 
 		k := hashToken(botToken)
 		log.Println(k)
-		tokenProvider.sessionLock.RLock()
-		if _, ok := tokenProvider.activeSessions[k]; ok {
+		if _, ok := tokenProvider.sessions.get(k); ok {
 			log.Println("Token already exists on the server")
 			w.WriteHeader(http.StatusAlreadyReported)
 			w.Write([]byte("Token already exists on the server"))
-			tokenProvider.sessionLock.RUnlock()
 			return
 		}
-		tokenProvider.sessionLock.RUnlock()
 
-		token.WaitForToken(tokenProvider.client, botToken)
-		token.LockForToken(tokenProvider.client, botToken)
-		sess, err := discordgo.New("Bot " + botToken)
+		sess, err := tokenProvider.openSecondarySession(botToken, k)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			tokenProvider.recordTokenEvent(k, TokenEventRejected, 0, strings.ReplaceAll(err.Error(), botToken, "<redacted>"))
+			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		sess.AddHandler(tokenProvider.newGuild(k))
-		err = sess.Open()
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(err.Error()))
+
+		if !tokenProvider.registerSession(r.Context(), botToken, k, sess) {
+			log.Println("Token already exists on the server")
+			w.WriteHeader(http.StatusAlreadyReported)
+			w.Write([]byte("Token already exists on the server"))
 			return
 		}
+	}
+}
 
-		tokenProvider.sessionLock.Lock()
-		tokenProvider.activeSessions[k] = sess
-		tokenProvider.sessionLock.Unlock()
+// registerSession keeps a newly opened secondary session and stores its token, associating it with each of its guilds.
+// It returns false, closing the session, if another request registered the same token while this one was opening it
+func (tokenProvider *TokenProvider) registerSession(ctx context.Context, botToken, k string, sess *discordgo.Session) bool {
+	if !tokenProvider.sessions.add(k, sess) {
+		sess.Close()
+		return false
+	}
+	tokenProvider.supervisor.forget(k)
+	tokenProvider.recordTokenEvent(k, TokenEventAdded, len(sess.State.Guilds), "")
 
-		err = tokenProvider.client.HSet(ctx, rediskey.AllTokensHSet, k, botToken).Err()
-		if err != nil {
-			log.Println(err)
-		}
+	err := tokenProvider.client.HSet(ctx, rediskey.AllTokensHSet, k, botToken).Err()
+	if err != nil {
+		log.Println(err)
+	}
 
-		for _, v := range sess.State.Guilds {
-			err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(v.ID), k).Err()
-			if !errors.Is(err, redis.Nil) && err != nil {
-				log.Println(strings.ReplaceAll(err.Error(), botToken, "<redacted>"))
-			} else {
-				log.Println("Added token for guild " + v.ID)
-			}
+	for _, v := range sess.State.Guilds {
+		err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(v.ID), k).Err()
+		if !errors.Is(err, redis.Nil) && err != nil {
+			log.Println(strings.ReplaceAll(err.Error(), botToken, "<redacted>"))
+		} else {
+			log.Println("Added token for guild " + v.ID)
 		}
-	}).Methods("POST")
-
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	}).Methods("GET")
+	}
+	return true
+}
 
-	log.Println("Galactus token service is running on port " + port + "...")
-	http.ListenAndServe(":"+port, r)
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
 }
 
 func (tokenProvider *TokenProvider) rateLimitEventCallback(sess *discordgo.Session, rl *discordgo.RateLimit) {
 	log.Println(rl.Message)
 }
 
-func (tokenProvider *TokenProvider) waitForAck(pubsub *redis.PubSub, waitTime time.Duration, result chan<- bool) {
+// waitForAck returns the ack published by the capture bot, or false if none arrived within waitTime
+func (tokenProvider *TokenProvider) waitForAck(ctx context.Context, pubsub *redis.PubSub, waitTime time.Duration) (ack.Ack, bool) {
 	t := time.NewTimer(waitTime)
 	defer pubsub.Close()
 	channel := pubsub.Channel()
@@ -388,12 +566,13 @@ func (tokenProvider *TokenProvider) waitForAck(pubsub *redis.PubSub, waitTime ti
 		select {
 		case <-t.C:
 			t.Stop()
-			result <- false
-			return
+			return ack.Ack{}, false
+		case <-ctx.Done():
+			t.Stop()
+			return ack.Ack{}, false
 		case val := <-channel:
 			t.Stop()
-			result <- val.Payload == "true"
-			return
+			return ack.Parse(val.Payload), true
 		}
 	}
 }
@@ -405,30 +584,39 @@ func hashToken(token string) string {
 }
 
 func (tokenProvider *TokenProvider) Close() {
-	tokenProvider.sessionLock.Lock()
-	for _, v := range tokenProvider.activeSessions {
+	for _, v := range tokenProvider.sessions.clear() {
 		v.Close()
 	}
-
-	tokenProvider.activeSessions = map[string]*discordgo.Session{}
-	tokenProvider.sessionLock.Unlock()
-	tokenProvider.primarySession.Close()
+	for _, sess := range tokenProvider.gatewaySessions() {
+		tokenProvider.saveGatewaySession(context.Background(), sess)
+	}
+	tokenProvider.closeCaptureSockets()
+	tokenProvider.eventSinks.close()
+	tokenProvider.stopPresenceWatch()
+	tokenProvider.stopGuildSettingsWatch()
+	tokenProvider.stopLeader()
+	tokenProvider.leader.resign(context.Background())
+	if tokenProvider.shardLease != nil {
+		tokenProvider.stopHeartbeat()
+		tokenProvider.shardLease.release(context.Background())
+	}
+	if tokenProvider.storage != nil {
+		if err := tokenProvider.storage.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	accessLogger.Sync()
 }
 
 func (tokenProvider *TokenProvider) newGuild(hashedToken string) func(s *discordgo.Session, m *discordgo.GuildCreate) {
 	return func(s *discordgo.Session, m *discordgo.GuildCreate) {
-		tokenProvider.sessionLock.RLock()
-		for test := range tokenProvider.activeSessions {
-			if hashedToken == test {
-				err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(m.Guild.ID), hashedToken)
-				if err != nil {
-					log.Println(err)
-				} else {
-					log.Println("Token added for running guild " + m.Guild.ID)
-				}
-			}
+		// the session may not be registered yet, if it's still opening, but the token is in the guild either way
+		err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(m.Guild.ID), hashedToken).Err()
+		if err != nil {
+			log.Println(err)
+		} else {
+			log.Println("Token added for running guild " + m.Guild.ID)
 		}
-
-		tokenProvider.sessionLock.RUnlock()
+		tokenProvider.checkTokenPermissions(s, hashedToken, m.Guild)
 	}
 }
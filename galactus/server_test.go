@@ -0,0 +1,205 @@
+package galactus
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTokenProvider is a TokenProvider on a fresh miniredis, without any sessions
+func newTestTokenProvider(t *testing.T, cfg config.Config) (*TokenProvider, *miniredis.Miniredis) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rdb.Close()
+		mr.Close()
+	})
+	return newTokenProvider(cfg, rdb), mr
+}
+
+// fakeMemberEdits points discordgo's guild endpoints at a server that accepts every member edit, returning how many
+// it has accepted
+func fakeMemberEdits(t *testing.T) *int64 {
+	t.Helper()
+	var edits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || !strings.Contains(r.URL.Path, "/members/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt64(&edits, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	guilds := discordgo.EndpointGuilds
+	discordgo.EndpointGuilds = server.URL + "/guilds/"
+	t.Cleanup(func() {
+		discordgo.EndpointGuilds = guilds
+		server.Close()
+	})
+	return &edits
+}
+
+// modify requests run while the secondary sessions are closed and reopened underneath them, and the stale tokens they
+// find are removed in the background; run with -race
+func TestModifyUsersWithSessionChurn(t *testing.T) {
+	cfg := config.Config{}
+	cfg.MuteRouting.Order = []string{AuditMethodWorker}
+	tokenProvider, _ := newTestTokenProvider(t, cfg)
+	edits := fakeMemberEdits(t)
+	tokenProvider.warmup.status.Ready = true
+	go tokenProvider.RemoveStaleTokens()
+
+	ctx := context.Background()
+	guildIDs := []string{"100", "101", "102"}
+	for _, guildID := range guildIDs {
+		err := tokenProvider.storeGuildSettings(ctx, api.GuildSettings{GuildID: guildID, Settings: []byte(`{"premium": 3}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions := make(map[string]*discordgo.Session)
+	for i := 0; i < 4; i++ {
+		sess, err := discordgo.New("Bot fake-secondary-token-" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hToken := hashToken("fake-secondary-token-" + strconv.Itoa(i))
+		sessions[hToken] = sess
+		tokenProvider.sessions.add(hToken, sess)
+		for _, guildID := range guildIDs {
+			if err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(guildID), hToken).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			for hToken, sess := range sessions {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tokenProvider.sessions.remove(hToken, sess)
+				time.Sleep(time.Millisecond)
+				tokenProvider.sessions.add(hToken, sess)
+				// the stale token may have been removed from the guilds in the meantime
+				for _, guildID := range guildIDs {
+					tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey(guildID), hToken)
+				}
+			}
+		}
+	}()
+
+	var worker int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		guildID := guildIDs[i%len(guildIDs)]
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			request := task.UserModifyRequest{Premium: premium.GoldTier}
+			for u := 0; u < 5; u++ {
+				request.Users = append(request.Users, task.UserModify{UserID: uint64(1000*i + u), Mute: true})
+			}
+			gid, _ := strconv.ParseUint(guildID, 10, 64)
+			resp := tokenProvider.modifyUsers(ctx, guildID, gid, "CODE"+strconv.Itoa(i), request, time.Time{})
+			atomic.AddInt64(&worker, resp.Worker)
+		}(i)
+		go func() {
+			defer wg.Done()
+			tokens := tokenProvider.getAllTokensForGuild(ctx, guildID)
+			sess, hToken := tokenProvider.getAnySession(ctx, guildID, tokens, len(tokens))
+			if (sess == nil) != (hToken == "") {
+				t.Errorf("got session %v for token %q", sess, hToken)
+			} else if sess != nil && sessions[hToken] != sess {
+				t.Errorf("got another token's session for %s", hToken)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-churned
+
+	if worker == 0 {
+		t.Fatal("no user was modified with a secondary bot")
+	}
+	// every getAnySession call that found a session edited nothing, so only modifyUsers' edits reached Discord
+	if got := atomic.LoadInt64(edits); got != worker {
+		t.Fatalf("Discord got %d member edits, but %d users were reported modified", got, worker)
+	}
+}
+
+// a request that gives up while queued behind the guild's earlier requests modified nobody, and has to say so
+func TestModifyUsersReportsUsersWhenQueuedTooLong(t *testing.T) {
+	tokenProvider, _ := newTestTokenProvider(t, config.Config{})
+	earlier := tokenProvider.guildSequencer.enqueue("100", nil)
+	defer earlier.finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	request := task.UserModifyRequest{Users: []task.UserModify{{UserID: 1, Mute: true}, {UserID: 2, Mute: true}}}
+	resp := tokenProvider.modifyUsers(ctx, "100", 100, "CODE", request, time.Time{})
+	if len(resp.TimedOut) != 2 || resp.TimedOut[0] != 1 || resp.TimedOut[1] != 2 {
+		t.Fatalf("got timedOut %v, want both users", resp.TimedOut)
+	}
+}
+
+// a guild only gets the secondary bots of the tier in its settings, whatever tier the request claims
+func TestModifyUsersLimitsBotsByResolvedTier(t *testing.T) {
+	cfg := config.Config{}
+	cfg.MuteRouting.Order = []string{AuditMethodWorker}
+	tokenProvider, _ := newTestTokenProvider(t, cfg)
+	fakeMemberEdits(t)
+	tokenProvider.warmup.status.Ready = true
+
+	ctx := context.Background()
+	sess, err := discordgo.New("Bot fake-secondary-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hToken := hashToken("fake-secondary-token")
+	tokenProvider.sessions.add(hToken, sess)
+	if err := tokenProvider.client.SAdd(ctx, rediskey.GuildTokensKey("100"), hToken).Err(); err != nil {
+		t.Fatal(err)
+	}
+	request := task.UserModifyRequest{Premium: premium.GoldTier, Users: []task.UserModify{{UserID: 1, Mute: true}}}
+
+	resp := tokenProvider.modifyUsers(ctx, "100", 100, "CODE", request, time.Time{})
+	if resp.Worker != 0 {
+		t.Fatalf("a free guild claiming gold got %d users modified by a secondary bot, want none", resp.Worker)
+	}
+
+	err = tokenProvider.storeGuildSettings(ctx, api.GuildSettings{GuildID: "100", Settings: []byte(`{"premium": 3}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenProvider.guildSettingsCache.invalidate("100")
+	request.Users[0].UserID = 2
+	resp = tokenProvider.modifyUsers(ctx, "100", 100, "CODE", request, time.Time{})
+	if resp.Worker != 1 {
+		t.Fatalf("a gold guild got %d users modified by a secondary bot, want 1", resp.Worker)
+	}
+}
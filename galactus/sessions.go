@@ -0,0 +1,79 @@
+package galactus
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"sync"
+	"sync/atomic"
+)
+
+// sessionRegistry maps hashed tokens to the secondary bots' sessions. Reads load an immutable snapshot without locking,
+// so a modify request reading sessions never waits on, or holds up, a token being added. Writers copy the map under
+// writeLock and swap it in
+type sessionRegistry struct {
+	// map[string]*discordgo.Session, never modified once stored
+	sessions  atomic.Value
+	writeLock sync.Mutex
+}
+
+func newSessionRegistry() *sessionRegistry {
+	registry := &sessionRegistry{}
+	registry.sessions.Store(map[string]*discordgo.Session{})
+	return registry
+}
+
+// snapshot returns every session as of now. It's shared, so callers must not modify it
+func (registry *sessionRegistry) snapshot() map[string]*discordgo.Session {
+	return registry.sessions.Load().(map[string]*discordgo.Session)
+}
+
+func (registry *sessionRegistry) get(hToken string) (*discordgo.Session, bool) {
+	sess, ok := registry.snapshot()[hToken]
+	return sess, ok
+}
+
+func (registry *sessionRegistry) len() int {
+	return len(registry.snapshot())
+}
+
+// add registers the session for a hashed token, unless one already is; it returns whether sess was added
+func (registry *sessionRegistry) add(hToken string, sess *discordgo.Session) bool {
+	registry.writeLock.Lock()
+	defer registry.writeLock.Unlock()
+	old := registry.snapshot()
+	if _, ok := old[hToken]; ok {
+		return false
+	}
+	sessions := make(map[string]*discordgo.Session, len(old)+1)
+	for k, v := range old {
+		sessions[k] = v
+	}
+	sessions[hToken] = sess
+	registry.sessions.Store(sessions)
+	return true
+}
+
+// remove forgets the session for a hashed token, if it's still sess
+func (registry *sessionRegistry) remove(hToken string, sess *discordgo.Session) {
+	registry.writeLock.Lock()
+	defer registry.writeLock.Unlock()
+	old := registry.snapshot()
+	if old[hToken] != sess {
+		return
+	}
+	sessions := make(map[string]*discordgo.Session, len(old))
+	for k, v := range old {
+		if k != hToken {
+			sessions[k] = v
+		}
+	}
+	registry.sessions.Store(sessions)
+}
+
+// clear forgets every session, returning them so they can be closed
+func (registry *sessionRegistry) clear() map[string]*discordgo.Session {
+	registry.writeLock.Lock()
+	defer registry.writeLock.Unlock()
+	old := registry.snapshot()
+	registry.sessions.Store(map[string]*discordgo.Session{})
+	return old
+}
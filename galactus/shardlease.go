@@ -0,0 +1,137 @@
+package galactus
+
+import (
+	"context"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const DefaultShardLeaseTTL = 30 * time.Second
+
+// ShardLeaseRetryInterval is how often an instance without a shard range checks for one that was released or expired
+const ShardLeaseRetryInterval = 5 * time.Second
+
+// renews a lease only if this instance still holds it
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releases a lease only if this instance still holds it
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// shardLease is this instance's claim on the shards [start, end) of the primary bot. Each galactus instance holds at
+// most one range, so several instances split the shards between them, and an instance that finds every range taken
+// waits to take over the range of one that dies
+type shardLease struct {
+	client     redis.UniversalClient
+	instanceID string
+	numShards  int
+	start      int
+	end        int
+	ttl        time.Duration
+}
+
+func shardLeaseTTL(cfg config.Config) time.Duration {
+	if cfg.ShardLeaseTTL > 0 {
+		return time.Duration(cfg.ShardLeaseTTL)
+	}
+	return DefaultShardLeaseTTL
+}
+
+func shardLeaseKey(numShards, start int) string {
+	return "galactus:shards:lease:" + strconv.Itoa(numShards) + ":" + strconv.Itoa(start)
+}
+
+// newInstanceID identifies this galactus process in the leases it holds
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "galactus"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// acquireShardLease blocks until one of the ranges of rangeSize shards is free, and leases it
+func acquireShardLease(ctx context.Context, client redis.UniversalClient, instanceID string, numShards, rangeSize int, ttl time.Duration) (*shardLease, error) {
+	lease := &shardLease{
+		client:     client,
+		instanceID: instanceID,
+		numShards:  numShards,
+		ttl:        ttl,
+	}
+	for {
+		for start := 0; start < numShards; start += rangeSize {
+			ok, err := client.SetNX(ctx, shardLeaseKey(numShards, start), lease.instanceID, ttl).Result()
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				lease.start = start
+				lease.end = start + rangeSize
+				if lease.end > numShards {
+					lease.end = numShards
+				}
+				log.Printf("Leased shards %d-%d of %d as %s\n", lease.start, lease.end-1, numShards, lease.instanceID)
+				return lease, nil
+			}
+		}
+		log.Printf("All shard ranges are leased; checking again in %s\n", ShardLeaseRetryInterval)
+		t := time.NewTimer(ShardLeaseRetryInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// heartbeat renews the lease until ctx is done. If the lease is lost, whether to another instance or because Redis was
+// unreachable until it expired, onLost is called; by then another instance may be serving the same shards
+func (lease *shardLease) heartbeat(ctx context.Context, onLost func()) {
+	ticker := time.NewTicker(lease.ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		held, err := renewLeaseScript.Run(ctx, lease.client, []string{shardLeaseKey(lease.numShards, lease.start)},
+			lease.instanceID, lease.ttl.Milliseconds()).Int()
+		if err != nil {
+			log.Println(err)
+			if time.Since(renewed) < lease.ttl {
+				continue
+			}
+		} else if held == 1 {
+			renewed = time.Now()
+			continue
+		}
+		onLost()
+		return
+	}
+}
+
+func (lease *shardLease) release(ctx context.Context) {
+	err := releaseLeaseScript.Run(ctx, lease.client, []string{shardLeaseKey(lease.numShards, lease.start)}, lease.instanceID).Err()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Released shards %d-%d\n", lease.start, lease.end-1)
+}
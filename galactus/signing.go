@@ -0,0 +1,90 @@
+package galactus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"github.com/automuteus/galactus/pkg/api"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultSigningWindow is how far a signed request's timestamp can be from galactus' clock
+const DefaultSigningWindow = 5 * time.Minute
+
+const ErrorCodeInvalidSignature = "INVALID_SIGNATURE"
+
+// signatureKey remembers a signature for as long as its timestamp is accepted, so it can't be replayed
+func signatureKey(signature string) string {
+	return "galactus:signature:" + signature
+}
+
+func (config ServerConfig) useSigning() bool {
+	return config.SigningSecret != ""
+}
+
+// verifySignature checks a signed request, returning why it was rejected if it was. The body is read and put back for
+// the handler
+func (tokenProvider *TokenProvider) verifySignature(config ServerConfig, r *http.Request) (int, string) {
+	signature := r.Header.Get(api.SignatureHeader)
+	timestamp, err := strconv.ParseInt(r.Header.Get(api.SignatureTimestampHeader), 10, 64)
+	if signature == "" || err != nil {
+		return http.StatusUnauthorized, "missing or invalid " + api.SignatureHeader + " or " + api.SignatureTimestampHeader
+	}
+	signedAt := time.Unix(0, timestamp*int64(time.Millisecond))
+	if skew := time.Since(signedAt); skew > config.SigningWindow || skew < -config.SigningWindow {
+		return http.StatusUnauthorized, "the signature's timestamp is outside the replay window"
+	}
+
+	body, err := readBody(r, config.MaxBodyBytes)
+	if err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			return http.StatusRequestEntityTooLarge, err.Error()
+		}
+		return http.StatusBadRequest, err.Error()
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	expected := api.Sign([]byte(config.SigningSecret), r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return http.StatusUnauthorized, "invalid signature"
+	}
+
+	// the timestamp is accepted for a window either side of now, so that's how long the signature has to be remembered
+	fresh, err := tokenProvider.client.SetNX(r.Context(), signatureKey(signature), 1, 2*config.SigningWindow).Result()
+	if err != nil {
+		// the signature is still valid; only replays go unchecked while Redis is down
+		log.Println(err)
+	} else if !fresh {
+		return http.StatusUnauthorized, "the signature was already used"
+	}
+	return 0, ""
+}
+
+// serviceAuth only lets through requests from automuteus workers and operators: made with a client certificate signed
+// by the client CA, or signed with the shared secret. Without mTLS or a signing secret, it lets everything through
+func (tokenProvider *TokenProvider) serviceAuth(config ServerConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !config.useMTLS() && !config.useSigning() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.useMTLS() && hasClientCert(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !config.useSigning() {
+				writeError(w, r, http.StatusUnauthorized, ErrorCodeClientCertRequired,
+					"a client certificate signed by the client CA is required")
+				return
+			}
+			if status, message := tokenProvider.verifySignature(config, r); status != 0 {
+				writeError(w, r, status, ErrorCodeInvalidSignature, message)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
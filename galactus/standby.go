@@ -0,0 +1,167 @@
+package galactus
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"sync"
+	"time"
+)
+
+// proxyShard stands in for a shard when failing over proxied calls, which aren't made for a particular guild
+const proxyShard = -1
+
+// standbyBot is another official bot that takes over the primary bot's mutes and proxied calls while the primary's
+// shards are down. It only makes REST calls, so it doesn't need a gateway connection, or shards of its own
+type standbyBot struct {
+	hToken        string
+	authorization string
+	sess          *discordgo.Session
+}
+
+// StandbyBot is a standby bot, as reported by /admin/shards
+type StandbyBot struct {
+	HashedToken string      `json:"hashedToken"`
+	Breaker     BreakerInfo `json:"breaker"`
+}
+
+// openStandbyBots makes a REST session for each standby token, skipping the ones Discord doesn't accept
+func (tokenProvider *TokenProvider) openStandbyBots(tokens []string) {
+	for _, botToken := range tokens {
+		hToken := hashToken(botToken)
+		sess, err := discordgo.New("Bot " + botToken)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sess.Client.Transport = tokenProvider.newBreakerTransport(hToken, sess.Client.Transport)
+		user, err := sess.User("@me")
+		if err != nil {
+			log.Printf("Skipping standby bot %s: %s\n", hToken, err)
+			continue
+		}
+		tokenProvider.standbys = append(tokenProvider.standbys, standbyBot{
+			hToken:        hToken,
+			authorization: "Bot " + botToken,
+			sess:          sess,
+		})
+		log.Printf("Standby bot %s (%s) ready to take over from the primary bot\n", user.Username, hToken)
+	}
+}
+
+// failover tracks which of the primary's shards are failed over to a standby bot, so it's only logged when it changes
+type failover struct {
+	sync.Mutex
+	shards map[int]bool
+}
+
+// set records whether the shard is failed over, returning whether that changed
+func (failover *failover) set(shardID int, failedOver bool) bool {
+	failover.Lock()
+	defer failover.Unlock()
+	if failover.shards[shardID] == failedOver {
+		return false
+	}
+	if failedOver {
+		failover.shards[shardID] = true
+	} else {
+		delete(failover.shards, shardID)
+	}
+	return true
+}
+
+func (failover *failover) active() bool {
+	failover.Lock()
+	defer failover.Unlock()
+	return len(failover.shards) > 0
+}
+
+// primaryShardDown returns the primary's shard for a guild, and whether it can't be relied on: the shard is dead on
+// this instance, or the primary's circuit breaker is open. Guilds on shards served by other instances are only judged
+// by the breaker
+func (tokenProvider *TokenProvider) primaryShardDown(gid uint64) (int, bool) {
+	shardID := 0
+	if count := tokenProvider.primarySession.ShardCount; count > 1 {
+		shardID = int((gid >> 22) % uint64(count))
+	}
+	if !tokenProvider.breakers.get("").available(tokenProvider.getSettings().breaker, time.Now()) {
+		return shardID, true
+	}
+	now := time.Now()
+	for _, sess := range tokenProvider.gatewaySessions() {
+		if sess.ShardID == shardID {
+			return shardID, !sessionAlive(sess, now)
+		}
+	}
+	return shardID, false
+}
+
+// primaryDown reports whether every primary shard on this instance is dead, or the primary's breaker is open
+func (tokenProvider *TokenProvider) primaryDown() bool {
+	if !tokenProvider.breakers.get("").available(tokenProvider.getSettings().breaker, time.Now()) {
+		return true
+	}
+	now := time.Now()
+	for _, sess := range tokenProvider.gatewaySessions() {
+		if sessionAlive(sess, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// standby returns the first standby bot whose breaker is closed, if the primary's shard is down, noting when the shard
+// fails over to the standbys and back. Without one, callers stay on the primary bot
+func (tokenProvider *TokenProvider) standby(shardID int, down bool) (standbyBot, bool) {
+	if !down {
+		if tokenProvider.failover.set(shardID, false) {
+			log.Printf("The primary bot is back on shard %d; failing back to it\n", shardID)
+		}
+		return standbyBot{}, false
+	}
+	breakerSettings := tokenProvider.getSettings().breaker
+	for _, bot := range tokenProvider.standbys {
+		if !tokenProvider.breakers.get(bot.hToken).available(breakerSettings, time.Now()) {
+			continue
+		}
+		if tokenProvider.failover.set(shardID, true) {
+			log.Printf("The primary bot is down on shard %d; failing over to standby bot %s\n", shardID, bot.hToken)
+		}
+		return bot, true
+	}
+	return standbyBot{}, false
+}
+
+// officialSession is the session that makes official mutes on a guild, and its hashed token: the primary bot's, or a
+// standby's while the primary is down
+func (tokenProvider *TokenProvider) officialSession(gid uint64) (*discordgo.Session, string) {
+	if len(tokenProvider.standbys) > 0 {
+		if bot, ok := tokenProvider.standby(tokenProvider.primaryShardDown(gid)); ok {
+			return bot.sess, bot.hToken
+		}
+	}
+	return tokenProvider.primarySession, ""
+}
+
+// proxyAuthorization swaps the primary bot's token for a standby's on proxied calls while the primary is down
+func (tokenProvider *TokenProvider) proxyAuthorization(authorization string) string {
+	if authorization != "Bot "+tokenProvider.config.DiscordBotToken || len(tokenProvider.standbys) == 0 {
+		return authorization
+	}
+	if bot, ok := tokenProvider.standby(proxyShard, tokenProvider.primaryDown()); ok {
+		return bot.authorization
+	}
+	return authorization
+}
+
+func (tokenProvider *TokenProvider) standbyInfo() []StandbyBot {
+	breakerSettings := tokenProvider.getSettings().breaker
+	now := time.Now()
+	standbys := make([]StandbyBot, 0, len(tokenProvider.standbys))
+	for _, bot := range tokenProvider.standbys {
+		standbys = append(standbys, StandbyBot{
+			HashedToken: bot.hToken,
+			Breaker:     tokenProvider.breakers.get(bot.hToken).info(breakerSettings, now),
+		})
+	}
+	return standbys
+}
@@ -0,0 +1,141 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ActiveGameWindow is how recently a game must have been updated to count as active, like the broker's stats
+const ActiveGameWindow = time.Minute * 15
+
+const globalStatsKey = "galactus:stats"
+
+const (
+	statWorker     = "worker"
+	statCapture    = "capture"
+	statOfficial   = "official"
+	statFailed     = "failed"
+	statSuperseded = "superseded"
+	statJobs       = "jobs"
+)
+
+func guildStatsKey(guildID string) string {
+	return "galactus:stats:guild:" + guildID
+}
+
+// ModifyStats counts the users galactus has modified, by the method that succeeded
+type ModifyStats struct {
+	Worker     int64 `json:"worker"`
+	Capture    int64 `json:"capture"`
+	Official   int64 `json:"official"`
+	Failed     int64 `json:"failed"`
+	Superseded int64 `json:"superseded"`
+}
+
+type StatsResponse struct {
+	Modify        ModifyStats `json:"modify"`
+	JobsProcessed int64       `json:"jobsProcessed"`
+	ActiveGames   int64       `json:"activeGames"`
+}
+
+type GuildStatsResponse struct {
+	GuildID string      `json:"guildID"`
+	Modify  ModifyStats `json:"modify"`
+}
+
+// recordModifyStats adds a modify response's counts to the global and guild totals
+func (tokenProvider *TokenProvider) recordModifyStats(guildID string, resp api.ModifyResponse) {
+	counts := map[string]int64{
+		statWorker:     resp.Worker,
+		statCapture:    resp.Capture,
+		statOfficial:   resp.Official,
+		statFailed:     int64(len(resp.Errors)),
+		statSuperseded: resp.Superseded,
+	}
+	ctx := context.Background()
+	pipe := tokenProvider.client.Pipeline()
+	for field, count := range counts {
+		if count == 0 {
+			continue
+		}
+		pipe.HIncrBy(ctx, globalStatsKey, field, count)
+		pipe.HIncrBy(ctx, guildStatsKey(guildID), field, count)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println(err)
+	}
+
+	day := time.Now()
+	tokenProvider.storeInBackground(func(ctx context.Context, storage Storage) error {
+		return storage.AddDailyStats(ctx, day, guildID, ModifyStats{
+			Worker:     resp.Worker,
+			Capture:    resp.Capture,
+			Official:   resp.Official,
+			Failed:     int64(len(resp.Errors)),
+			Superseded: resp.Superseded,
+		})
+	})
+}
+
+func (tokenProvider *TokenProvider) recordJobProcessed(ctx context.Context) {
+	if err := tokenProvider.client.HIncrBy(ctx, globalStatsKey, statJobs, 1).Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+func modifyStatsFrom(fields map[string]string) ModifyStats {
+	get := func(field string) int64 {
+		v, _ := strconv.ParseInt(fields[field], 10, 64)
+		return v
+	}
+	return ModifyStats{
+		Worker:     get(statWorker),
+		Capture:    get(statCapture),
+		Official:   get(statOfficial),
+		Failed:     get(statFailed),
+		Superseded: get(statSuperseded),
+	}
+}
+
+func (tokenProvider *TokenProvider) statsHandler(w http.ResponseWriter, r *http.Request) {
+	fields, err := tokenProvider.client.HGetAll(r.Context(), globalStatsKey).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read stats")
+		return
+	}
+	now := time.Now()
+	active, err := tokenProvider.client.ZCount(r.Context(), rediskey.ActiveGamesZSet,
+		strconv.FormatInt(now.Add(-ActiveGameWindow).Unix(), 10), strconv.FormatInt(now.Unix(), 10)).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read stats")
+		return
+	}
+	jobs, _ := strconv.ParseInt(fields[statJobs], 10, 64)
+	writeJSON(w, http.StatusOK, StatsResponse{
+		Modify:        modifyStatsFrom(fields),
+		JobsProcessed: jobs,
+		ActiveGames:   active,
+	})
+}
+
+func (tokenProvider *TokenProvider) guildStatsHandler(w http.ResponseWriter, r *http.Request) {
+	guildID := mux.Vars(r)["guildID"]
+	fields, err := tokenProvider.client.HGetAll(r.Context(), guildStatsKey(guildID)).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read stats")
+		return
+	}
+	writeJSON(w, http.StatusOK, GuildStatsResponse{
+		GuildID: guildID,
+		Modify:  modifyStatsFrom(fields),
+	})
+}
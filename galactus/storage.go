@@ -0,0 +1,132 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/api"
+	"log"
+	"net/http"
+	"time"
+)
+
+// StorageWriteTimeout bounds the writes made to storage in the background, so a slow database can't pile them up
+const StorageWriteTimeout = 10 * time.Second
+
+// DefaultDailyStatsDays is how many days /stats/daily returns without ?since=
+const DefaultDailyStatsDays = 30
+
+const ErrorCodeStorageDisabled = "STORAGE_DISABLED"
+
+// Storage keeps the data that Redis only holds briefly: audit entries, daily modify stats, the history of secondary
+// bot tokens, and guild settings. It's optional; without one, galactus only keeps what fits in Redis
+type Storage interface {
+	RecordAudit(ctx context.Context, entries []AuditEntry) error
+	AuditEntries(ctx context.Context, query AuditQuery) ([]AuditEntry, error)
+	AddDailyStats(ctx context.Context, day time.Time, guildID string, stats ModifyStats) error
+	// DailyStats sums every guild's stats if guildID is empty
+	DailyStats(ctx context.Context, guildID string, since, until time.Time) ([]DailyStats, error)
+	RecordTokenEvent(ctx context.Context, event TokenEvent) error
+	// GuildSettings returns nil if the guild has none
+	GuildSettings(ctx context.Context, guildID string) (*api.GuildSettings, error)
+	SetGuildSettings(ctx context.Context, settings api.GuildSettings) error
+	// DeleteGuildSettings returns whether the guild had any
+	DeleteGuildSettings(ctx context.Context, guildID string) (bool, error)
+	Close() error
+}
+
+// AuditQuery selects a guild's audit entries. Zero times and UserID don't filter
+type AuditQuery struct {
+	GuildID string
+	UserID  uint64
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+type DailyStats struct {
+	// Day is formatted as 2006-01-02, in UTC
+	Day string `json:"day"`
+	ModifyStats
+}
+
+type DailyStatsResponse struct {
+	GuildID string       `json:"guildID,omitempty"`
+	Days    []DailyStats `json:"days"`
+}
+
+const (
+	TokenEventAdded    = "added"
+	TokenEventRejected = "rejected"
+)
+
+// TokenEvent is a secondary bot token being registered, or failing to be
+type TokenEvent struct {
+	Time        time.Time
+	HashedToken string
+	Event       string
+	InstanceID  string
+	// Guilds is how many guilds the bot was in when it was added
+	Guilds  int
+	Message string
+}
+
+// storeInBackground runs a storage write without holding up the request it's for
+func (tokenProvider *TokenProvider) storeInBackground(write func(ctx context.Context, storage Storage) error) {
+	if tokenProvider.storage == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), StorageWriteTimeout)
+		defer cancel()
+		if err := write(ctx, tokenProvider.storage); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func (tokenProvider *TokenProvider) recordTokenEvent(hashedToken, event string, guilds int, message string) {
+	tokenEvent := TokenEvent{
+		Time:        time.Now(),
+		HashedToken: hashedToken,
+		Event:       event,
+		InstanceID:  tokenProvider.instanceID,
+		Guilds:      guilds,
+		Message:     message,
+	}
+	tokenProvider.storeInBackground(func(ctx context.Context, storage Storage) error {
+		return storage.RecordTokenEvent(ctx, tokenEvent)
+	})
+}
+
+// dailyStatsHandler returns the modify stats for each day, of one guild with ?guildID= or all of them, between ?since=
+// and ?until= (unix ms or RFC 3339). Only served from storage, since Redis only keeps running totals
+func (tokenProvider *TokenProvider) dailyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if tokenProvider.storage == nil {
+		writeError(w, r, http.StatusNotFound, ErrorCodeStorageDisabled, "daily stats need POSTGRES_URL to be configured")
+		return
+	}
+	query := r.URL.Query()
+	until := time.Now()
+	since := until.AddDate(0, 0, -DefaultDailyStatsDays)
+	var err error
+	if u := query.Get("until"); u != "" {
+		if until, err = parseAuditTime(u); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "until must be unix milliseconds or RFC 3339")
+			return
+		}
+	}
+	if s := query.Get("since"); s != "" {
+		if since, err = parseAuditTime(s); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "since must be unix milliseconds or RFC 3339")
+			return
+		}
+	}
+
+	guildID := query.Get("guildID")
+	days, err := tokenProvider.storage.DailyStats(r.Context(), guildID, since, until)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read daily stats")
+		return
+	}
+	writeJSON(w, http.StatusOK, DailyStatsResponse{GuildID: guildID, Days: days})
+}
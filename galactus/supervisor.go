@@ -0,0 +1,231 @@
+package galactus
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionCheckInterval is how often the supervisor checks every secondary session's gateway connection
+	DefaultSessionCheckInterval = 30 * time.Second
+	// SessionStaleAfter is how long a session can go without a heartbeat ack before it's considered dead. Discord asks
+	// for a heartbeat about every 41 seconds
+	SessionStaleAfter = 2 * time.Minute
+	// SessionRestartBaseDelay is the wait after a failed restart, doubled after each one up to SessionRestartMaxDelay
+	SessionRestartBaseDelay = 5 * time.Second
+	SessionRestartMaxDelay  = 5 * time.Minute
+	// MaxSessionRestartAttempts is how many restarts in a row can fail before the session is removed
+	MaxSessionRestartAttempts = 5
+)
+
+const (
+	SessionHealthy = "healthy"
+	// the session is skipped while it's restarted
+	SessionUnhealthy = "unhealthy"
+)
+
+var sessionRestartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_session_restarts_total",
+	Help: "Restarts of dead secondary sessions, by result: restarted, failed, or removed after too many failures",
+}, []string{"result"})
+
+// SessionHealth is a secondary session's gateway connection, as reported by /admin/sessions
+type SessionHealth struct {
+	State            string    `json:"state"`
+	LastHeartbeatAck time.Time `json:"lastHeartbeatAck"`
+	// Restarts counts the times the supervisor restarted the session
+	Restarts int `json:"restarts"`
+	// FailedRestarts counts the restarts that failed since the session was last healthy
+	FailedRestarts int    `json:"failedRestarts,omitempty"`
+	LastError      string `json:"lastError,omitempty"`
+}
+
+// RemovedSession is a secondary session the supervisor gave up on. Its token stays registered, so it's opened again
+// on restart, or when it's added through /addtoken
+type RemovedSession struct {
+	HashedToken string    `json:"hashedToken"`
+	RemovedAt   time.Time `json:"removedAt"`
+	LastError   string    `json:"lastError"`
+}
+
+type sessionState struct {
+	// zero while the session is healthy
+	unhealthySince time.Time
+	nextRestart    time.Time
+	restarts       int
+	failedRestarts int
+	lastError      string
+}
+
+// sessionSupervisor tracks the health of each secondary session by hashed token
+type sessionSupervisor struct {
+	sync.Mutex
+	states  map[string]*sessionState
+	removed map[string]RemovedSession
+}
+
+func newSessionSupervisor() *sessionSupervisor {
+	return &sessionSupervisor{
+		states:  make(map[string]*sessionState),
+		removed: make(map[string]RemovedSession),
+	}
+}
+
+// healthy reports whether the session can be picked; sessions the supervisor hasn't checked yet are
+func (supervisor *sessionSupervisor) healthy(hToken string) bool {
+	supervisor.Lock()
+	defer supervisor.Unlock()
+	state, ok := supervisor.states[hToken]
+	return !ok || state.unhealthySince.IsZero()
+}
+
+func (supervisor *sessionSupervisor) health(hToken string, sess *discordgo.Session) SessionHealth {
+	sess.RLock()
+	health := SessionHealth{State: SessionHealthy, LastHeartbeatAck: sess.LastHeartbeatAck}
+	sess.RUnlock()
+	supervisor.Lock()
+	defer supervisor.Unlock()
+	if state, ok := supervisor.states[hToken]; ok {
+		if !state.unhealthySince.IsZero() {
+			health.State = SessionUnhealthy
+		}
+		health.Restarts = state.restarts
+		health.FailedRestarts = state.failedRestarts
+		health.LastError = state.lastError
+	}
+	return health
+}
+
+func (supervisor *sessionSupervisor) removedSessions() []RemovedSession {
+	supervisor.Lock()
+	defer supervisor.Unlock()
+	removed := make([]RemovedSession, 0, len(supervisor.removed))
+	for _, session := range supervisor.removed {
+		removed = append(removed, session)
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].HashedToken < removed[j].HashedToken
+	})
+	return removed
+}
+
+// forget drops what's known about a token, for a session that was just opened
+func (supervisor *sessionSupervisor) forget(hToken string) {
+	supervisor.Lock()
+	defer supervisor.Unlock()
+	delete(supervisor.states, hToken)
+	delete(supervisor.removed, hToken)
+}
+
+// sessionAlive reports whether the session is connected and Discord is still acking its heartbeats
+func sessionAlive(sess *discordgo.Session, now time.Time) bool {
+	sess.RLock()
+	defer sess.RUnlock()
+	return sess.DataReady && now.Sub(sess.LastHeartbeatAck) < SessionStaleAfter
+}
+
+// restartBackoff is the wait before the next restart, after failures failed restarts in a row
+func restartBackoff(failures int) time.Duration {
+	delay := SessionRestartBaseDelay
+	for i := 1; i < failures && delay < SessionRestartMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > SessionRestartMaxDelay {
+		delay = SessionRestartMaxDelay
+	}
+	return delay
+}
+
+// SuperviseSessions restarts secondary sessions that died without discordgo noticing, like after a network partition
+// or a token reset. A session found dead is skipped right away, then restarted if it's still dead on the next check,
+// with backoff between failed restarts. After MaxSessionRestartAttempts failures it's closed and removed
+func (tokenProvider *TokenProvider) SuperviseSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tokenProvider.checkSessions(time.Now())
+	}
+}
+
+func (tokenProvider *TokenProvider) checkSessions(now time.Time) {
+	supervisor := tokenProvider.supervisor
+	for hToken, sess := range tokenProvider.sessions.snapshot() {
+		alive := sessionAlive(sess, now)
+
+		supervisor.Lock()
+		state, ok := supervisor.states[hToken]
+		if !ok {
+			state = &sessionState{}
+			supervisor.states[hToken] = state
+		}
+		restart := false
+		if alive {
+			state.unhealthySince = time.Time{}
+			state.failedRestarts = 0
+		} else if state.unhealthySince.IsZero() {
+			// give discordgo's own reconnect until the next check
+			state.unhealthySince = now
+			log.Println("Secondary session " + hToken + " looks dead; skipping it")
+		} else {
+			restart = !now.Before(state.nextRestart)
+		}
+		supervisor.Unlock()
+
+		if restart {
+			tokenProvider.restartSession(hToken, sess, now)
+		}
+	}
+}
+
+// restartSession reconnects a dead session's gateway connection, keeping its handlers, or removes it if it failed too
+// many times
+func (tokenProvider *TokenProvider) restartSession(hToken string, sess *discordgo.Session, now time.Time) {
+	log.Println("Restarting secondary session " + hToken)
+	if err := sess.Close(); err != nil {
+		log.Println(err)
+	}
+	err := tokenProvider.openSession(sess)
+
+	supervisor := tokenProvider.supervisor
+	supervisor.Lock()
+	defer supervisor.Unlock()
+	state := supervisor.states[hToken]
+	if state == nil {
+		// the session was replaced while it was restarting
+		return
+	}
+	if err == nil {
+		state.unhealthySince = time.Time{}
+		state.failedRestarts = 0
+		state.restarts++
+		sessionRestartsTotal.WithLabelValues("restarted").Inc()
+		log.Println("Restarted secondary session " + hToken)
+		return
+	}
+
+	state.failedRestarts++
+	state.lastError = err.Error()
+	if state.failedRestarts < MaxSessionRestartAttempts {
+		state.nextRestart = now.Add(restartBackoff(state.failedRestarts))
+		sessionRestartsTotal.WithLabelValues("failed").Inc()
+		log.Printf("Failed to restart secondary session %s (attempt %d): %s\n", hToken, state.failedRestarts, err)
+		return
+	}
+
+	// its guilds' token sets are cleaned up once requests find the token has no session
+	tokenProvider.sessions.remove(hToken, sess)
+	sess.Close()
+	delete(supervisor.states, hToken)
+	supervisor.removed[hToken] = RemovedSession{
+		HashedToken: hToken,
+		RemovedAt:   now,
+		LastError:   state.lastError,
+	}
+	sessionRestartsTotal.WithLabelValues("removed").Inc()
+	log.Printf("Removed secondary session %s after %d failed restarts: %s\n", hToken, state.failedRestarts, err)
+}
@@ -0,0 +1,203 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DiscordAuthorizeURL is where a bot's invite link points
+const DiscordAuthorizeURL = "https://discord.com/oauth2/authorize"
+
+const (
+	// TokenAuditSession means the token was checked against its open gateway session's state
+	TokenAuditSession = "session"
+	// TokenAuditREST means the token had no session open on this instance, so Discord's REST API was asked instead
+	TokenAuditREST = "rest"
+)
+
+// TokenAudit is whether one of a guild's secondary bots can actually mute there, and the link to invite it if it can't
+type TokenAudit struct {
+	HashedToken string `json:"hashedToken"`
+	BotID       string `json:"botID,omitempty"`
+	Source      string `json:"source,omitempty"`
+	InGuild     bool   `json:"inGuild"`
+	// Missing lists the RequiredTokenPermissions the bot doesn't have on the guild
+	Missing []string `json:"missing,omitempty"`
+	// InviteURL adds the bot to the guild with the permissions it needs, or re-grants them if it's already there
+	InviteURL string `json:"inviteURL,omitempty"`
+	// Error is why the bot couldn't be checked; the other fields are then incomplete
+	Error string `json:"error,omitempty"`
+}
+
+type TokenAuditResponse struct {
+	GuildID string `json:"guildID"`
+	// RequiredPermissions are the permission bits every secondary bot needs on the guild
+	RequiredPermissions int          `json:"requiredPermissions"`
+	Tokens              []TokenAudit `json:"tokens"`
+}
+
+// inviteURL is the link that adds a bot to a guild with the permissions it needs
+func inviteURL(botID, guildID string) string {
+	query := url.Values{
+		"client_id":            {botID},
+		"scope":                {"bot"},
+		"permissions":          {strconv.Itoa(RequiredTokenPermissions)},
+		"guild_id":             {guildID},
+		"disable_guild_select": {"true"},
+	}
+	return DiscordAuthorizeURL + "?" + query.Encode()
+}
+
+// missingPermissionNames names the permissions in missing, sorted
+func missingPermissionNames(missing int) []string {
+	var names []string
+	for perm, name := range permissionNames {
+		if missing&perm != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// auditToken checks one of a guild's tokens, from its session on this instance if it has one, or over REST
+func (tokenProvider *TokenProvider) auditToken(ctx context.Context, guildID, hToken string) TokenAudit {
+	audit := TokenAudit{HashedToken: hToken}
+	var guild *discordgo.Guild
+	if sess, ok := tokenProvider.sessions.get(hToken); ok && sess.State != nil && sess.State.User != nil {
+		audit.Source = TokenAuditSession
+		audit.BotID = sess.State.User.ID
+		// the session's state has every guild the bot is in, with the bot's own member
+		guild, _ = sess.State.Guild(guildID)
+	} else {
+		audit.Source = TokenAuditREST
+		var err error
+		guild, err = tokenProvider.restGuildForToken(ctx, guildID, hToken, &audit)
+		if err != nil {
+			audit.Error = err.Error()
+			return audit
+		}
+	}
+	if audit.BotID != "" {
+		audit.InviteURL = inviteURL(audit.BotID, guildID)
+	}
+	if guild == nil {
+		audit.Missing = missingPermissionNames(RequiredTokenPermissions)
+		return audit
+	}
+	audit.InGuild = true
+
+	perms, ok := memberPermissions(audit.BotID, guild)
+	if !ok {
+		audit.Error = "couldn't determine the bot's permissions"
+		return audit
+	}
+	missing := RequiredTokenPermissions &^ perms
+	// fresher than what the periodic check found, so requests use it right away
+	tokenProvider.permissions.set(hToken, guildID, missing)
+	if missing == 0 {
+		// nothing to fix
+		audit.InviteURL = ""
+		return audit
+	}
+	audit.Missing = missingPermissionNames(missing)
+	return audit
+}
+
+// restGuildForToken looks up the guild, with the bot's own member, as the token's bot. It returns a nil guild if the bot
+// isn't in it
+func (tokenProvider *TokenProvider) restGuildForToken(ctx context.Context, guildID, hToken string, audit *TokenAudit) (*discordgo.Guild, error) {
+	botToken, err := tokenProvider.client.HGet(ctx, rediskey.AllTokensHSet, hToken).Result()
+	if err == redis.Nil {
+		return nil, errors.New("the token is associated with the guild, but no longer registered")
+	} else if err != nil {
+		return nil, err
+	}
+	sess, err := discordgo.New("Bot " + botToken)
+	if err != nil {
+		return nil, err
+	}
+	sess.Client.Transport = tokenProvider.newBreakerTransport(hToken, sess.Client.Transport)
+	user, err := sess.User("@me")
+	if err != nil {
+		return nil, err
+	}
+	audit.BotID = user.ID
+
+	guild, err := sess.Guild(guildID)
+	if notInGuild(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	member, err := sess.GuildMember(guildID, user.ID)
+	if notInGuild(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	guild.Members = []*discordgo.Member{member}
+	return guild, nil
+}
+
+// notInGuild returns whether Discord rejected a request for being made by a bot that isn't in the guild
+func notInGuild(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	if !ok || restErr.Message == nil {
+		return false
+	}
+	switch restErr.Message.Code {
+	case discordgo.ErrCodeUnknownGuild, discordgo.ErrCodeUnknownMember, discordgo.ErrCodeMissingAccess:
+		return true
+	}
+	return false
+}
+
+// tokenAuditHandler checks every secondary bot associated with a guild: whether it's in the guild, which permissions
+// it's missing, and the invite link that fixes either
+func (tokenProvider *TokenProvider) tokenAuditHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		guildID := mux.Vars(r)["guildID"]
+		if _, err := strconv.ParseUint(guildID, 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "guildID must be a snowflake")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		hTokens, err := tokenProvider.client.SMembers(ctx, rediskey.GuildTokensKey(guildID)).Result()
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read the guild's tokens")
+			return
+		}
+		sort.Strings(hTokens)
+
+		audits := make([]TokenAudit, len(hTokens))
+		wg := sync.WaitGroup{}
+		for i, hToken := range hTokens {
+			wg.Add(1)
+			go func(i int, hToken string) {
+				defer wg.Done()
+				audits[i] = tokenProvider.auditToken(ctx, guildID, hToken)
+			}(i, hToken)
+		}
+		wg.Wait()
+
+		writeJSON(w, http.StatusOK, TokenAuditResponse{
+			GuildID:             guildID,
+			RequiredPermissions: RequiredTokenPermissions,
+			Tokens:              audits,
+		})
+	}
+}
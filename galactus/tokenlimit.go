@@ -0,0 +1,192 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const DefaultTokenRateLimitWindow = time.Second * 5
+
+// TokenRateLimit is how many member edits a secondary token or capture client may issue per guild: Requests per
+// Window on average, and up to Burst at once
+type TokenRateLimit struct {
+	Window   time.Duration
+	Requests int64
+	Burst    int64
+}
+
+// DefaultMaxRequests5Sec is how many mute/deafens each token issues per guild every 5 seconds. Discord's limits are
+// anywhere from 5 to 10 per 5 seconds, so 7 is a decent heuristic
+const DefaultMaxRequests5Sec int64 = 7
+
+// newTokenRateLimit defaults to MaxRequests5Sec requests per 5 seconds, which is what the old fixed-window counter
+// allowed
+func newTokenRateLimit(cfg config.Config) TokenRateLimit {
+	maxReq := DefaultMaxRequests5Sec
+	if cfg.MaxRequests5Sec > 0 {
+		maxReq = cfg.MaxRequests5Sec
+	}
+	limit := TokenRateLimit{
+		Window:   DefaultTokenRateLimitWindow,
+		Requests: maxReq,
+		Burst:    maxReq,
+	}
+	if cfg.TokenRateLimit.Window > 0 {
+		limit.Window = time.Duration(cfg.TokenRateLimit.Window)
+	}
+	if cfg.TokenRateLimit.Requests > 0 {
+		limit.Requests = cfg.TokenRateLimit.Requests
+	}
+	if cfg.TokenRateLimit.Burst > 0 {
+		limit.Burst = cfg.TokenRateLimit.Burst
+	}
+	return limit
+}
+
+func (limit TokenRateLimit) bucket() RateLimit {
+	return RateLimit{
+		PerSecond: float64(limit.Requests) / limit.Window.Seconds(),
+		Burst:     limit.Burst,
+	}
+}
+
+// the guild ID is the hash tag, so all of a guild's buckets live on the same Redis Cluster slot
+func tokenRateLimitKey(guildID, hashToken string) string {
+	return "galactus:ratelimit:token:{" + guildID + "}:" + hashToken
+}
+
+// TakeGuildTokenRateLimit returns true if the token (or capture client connect code) can issue another request on the
+// guild, and counts the request against its limit
+func (tokenProvider *TokenProvider) TakeGuildTokenRateLimit(ctx context.Context, guildID, hashToken string) bool {
+	blacklisted, err := tokenProvider.client.Exists(ctx, rediskey.GuildTokenLock(guildID, hashToken)).Result()
+	if err != nil {
+		log.Println(err)
+	}
+	if blacklisted == 1 {
+		log.Printf("Token %s on guild %s is blacklisted", hashToken, guildID)
+		return false
+	}
+
+	allowed, remaining, _, err := takeToken(ctx, tokenProvider.client, tokenRateLimitKey(guildID, hashToken), tokenProvider.getSettings().tokenRateLimit.bucket())
+	if err != nil {
+		// same as the old counter; if Redis is down, Discord's own limits are all we have
+		log.Println(err)
+		return true
+	}
+	log.Printf("Token %s on guild %s has %d requests remaining. Using: %v", hashToken, guildID, remaining, allowed)
+	return allowed
+}
+
+// BlacklistTokenForDuration stops a token from being used on a guild for the duration, regardless of its rate limit
+func (tokenProvider *TokenProvider) BlacklistTokenForDuration(ctx context.Context, guildID, hashToken string, duration time.Duration) error {
+	// the value keeps instances that still use the old INCR counter on this key from using the token
+	return tokenProvider.client.Set(ctx, rediskey.GuildTokenLock(guildID, hashToken), tokenProvider.getSettings().tokenRateLimit.Burst, duration).Err()
+}
+
+// guildTokenRateLimitState returns how many requests the token can issue on the guild right now without consuming
+// any, and how much longer it's blacklisted for
+func (tokenProvider *TokenProvider) guildTokenRateLimitState(ctx context.Context, guildID, hashToken string) (int64, time.Duration, error) {
+	ttl, err := tokenProvider.client.PTTL(ctx, rediskey.GuildTokenLock(guildID, hashToken)).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	vals, err := tokenProvider.client.HMGet(ctx, tokenRateLimitKey(guildID, hashToken), "tokens", "ts").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	return tokenProvider.bucketRemaining(vals), ttl, nil
+}
+
+// bucketRemaining refills the HMGET "tokens", "ts" of a bucket the same way tokenBucketScript does, without taking one
+func (tokenProvider *TokenProvider) bucketRemaining(vals []interface{}) int64 {
+	bucket := tokenProvider.getSettings().tokenRateLimit.bucket()
+	if len(vals) != 2 {
+		return bucket.Burst
+	}
+	tokens, err := strconv.ParseFloat(stringOrEmpty(vals[0]), 64)
+	if err != nil {
+		// no bucket yet; it's full
+		return bucket.Burst
+	}
+	ts, _ := strconv.ParseFloat(stringOrEmpty(vals[1]), 64)
+	elapsed := float64(time.Now().UnixNano()/int64(time.Millisecond)) - ts
+	tokens = math.Min(float64(bucket.Burst), tokens+math.Max(0, elapsed)*bucket.PerSecond/1000)
+	return int64(math.Floor(tokens))
+}
+
+func stringOrEmpty(v interface{}) string {
+	str, _ := v.(string)
+	return str
+}
+
+// leastLoadedTokens orders the tokens by how many requests they have left on the guild, most first, breaking ties by
+// which was used least recently on this instance. Blacklisted tokens are left out
+func (tokenProvider *TokenProvider) leastLoadedTokens(ctx context.Context, guildID string, hTokens []string) []string {
+	if len(hTokens) < 2 {
+		return hTokens
+	}
+	remaining, err := tokenProvider.guildTokensRemaining(ctx, guildID, hTokens)
+	if err != nil {
+		// fall back to the order we were given; TakeGuildTokenRateLimit still guards each token
+		log.Println(err)
+		return hTokens
+	}
+
+	ordered := make([]string, 0, len(hTokens))
+	for _, hToken := range hTokens {
+		if _, ok := remaining[hToken]; ok {
+			ordered = append(ordered, hToken)
+		}
+	}
+	tokenProvider.usageLock.Lock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if remaining[ordered[i]] != remaining[ordered[j]] {
+			return remaining[ordered[i]] > remaining[ordered[j]]
+		}
+		return tokenProvider.lastUsed[ordered[i]].Before(tokenProvider.lastUsed[ordered[j]])
+	})
+	tokenProvider.usageLock.Unlock()
+	return ordered
+}
+
+func (tokenProvider *TokenProvider) markTokenUsed(hToken string) {
+	tokenProvider.usageLock.Lock()
+	tokenProvider.lastUsed[hToken] = time.Now()
+	tokenProvider.usageLock.Unlock()
+}
+
+// guildTokensRemaining reads the rate limit state of several tokens on a guild in one round trip, returning how many
+// requests each non-blacklisted token has left
+func (tokenProvider *TokenProvider) guildTokensRemaining(ctx context.Context, guildID string, hTokens []string) (map[string]int64, error) {
+	pipe := tokenProvider.client.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(hTokens))
+	buckets := make([]*redis.SliceCmd, len(hTokens))
+	for i, hToken := range hTokens {
+		ttls[i] = pipe.PTTL(ctx, rediskey.GuildTokenLock(guildID, hToken))
+		buckets[i] = pipe.HMGet(ctx, tokenRateLimitKey(guildID, hToken), "tokens", "ts")
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[string]int64, len(hTokens))
+	for i, hToken := range hTokens {
+		if ttls[i].Val() > 0 {
+			continue
+		}
+		remaining[hToken] = tokenProvider.bucketRemaining(buckets[i].Val())
+	}
+	return remaining, nil
+}
@@ -0,0 +1,200 @@
+package galactus
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	TokenUsageHour = "hour"
+	TokenUsageDay  = "day"
+)
+
+const (
+	// TokenUsageHourRetention and TokenUsageDayRetention are how long each bucket of token usage is kept
+	TokenUsageHourRetention = 7 * 24 * time.Hour
+	TokenUsageDayRetention  = 90 * 24 * time.Hour
+
+	// DefaultTokenUsageHours and DefaultTokenUsageDays are how far back /stats/tokens goes without ?since=
+	DefaultTokenUsageHours = 24
+	DefaultTokenUsageDays  = 30
+)
+
+// a bucket's usage is kept twice: by guild, with a field for each token, and by token, with a field for each guild, so
+// either can be read without scanning every guild
+func guildTokenUsageKey(guildID, bucket string, start time.Time) string {
+	return "galactus:stats:tokens:guild:" + guildID + ":" + bucket + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+func tokenGuildUsageKey(hashedToken, bucket string, start time.Time) string {
+	return "galactus:stats:tokens:token:" + hashedToken + ":" + bucket + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// tokenUsageBucket returns the length and retention of a bucket size, and whether it's one
+func tokenUsageBucket(bucket string) (time.Duration, time.Duration, bool) {
+	switch bucket {
+	case TokenUsageHour:
+		return time.Hour, TokenUsageHourRetention, true
+	case TokenUsageDay:
+		return 24 * time.Hour, TokenUsageDayRetention, true
+	}
+	return 0, 0, false
+}
+
+// TokenUsage is how many users a secondary bot muted or deafened on a guild
+type TokenUsage struct {
+	HashedToken string `json:"hashedToken"`
+	GuildID     string `json:"guildID"`
+	Mutes       int64  `json:"mutes"`
+}
+
+// TokenUsageBucket is the usage within one hour or day, starting at Start (UTC)
+type TokenUsageBucket struct {
+	Start time.Time    `json:"start"`
+	Usage []TokenUsage `json:"usage"`
+}
+
+type TokenUsageResponse struct {
+	GuildID     string             `json:"guildID,omitempty"`
+	HashedToken string             `json:"hashedToken,omitempty"`
+	Bucket      string             `json:"bucket"`
+	Buckets     []TokenUsageBucket `json:"buckets"`
+	// Totals sums each token and guild over every bucket, most used first
+	Totals []TokenUsage `json:"totals"`
+}
+
+// recordTokenUsage counts a user modified by a secondary bot in the current hour and day
+func (tokenProvider *TokenProvider) recordTokenUsage(guildID, hashedToken string) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	pipe := tokenProvider.client.Pipeline()
+	for _, bucket := range []string{TokenUsageHour, TokenUsageDay} {
+		length, retention, _ := tokenUsageBucket(bucket)
+		start := now.Truncate(length)
+		guildKey := guildTokenUsageKey(guildID, bucket, start)
+		tokenKey := tokenGuildUsageKey(hashedToken, bucket, start)
+		pipe.HIncrBy(ctx, guildKey, hashedToken, 1)
+		pipe.HIncrBy(ctx, tokenKey, guildID, 1)
+		// kept for the retention past the end of the bucket
+		expireAt := start.Add(length + retention)
+		pipe.ExpireAt(ctx, guildKey, expireAt)
+		pipe.ExpireAt(ctx, tokenKey, expireAt)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+// tokenUsageHandler returns how many users each secondary bot modified, by hour or day (?bucket=), for a guild
+// (?guildID=), a token (?token=, hashed) or both, between ?since= and ?until= (unix ms or RFC 3339)
+func (tokenProvider *TokenProvider) tokenUsageHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	guildID, hashedToken := query.Get("guildID"), query.Get("token")
+	if guildID == "" && hashedToken == "" {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "guildID or token is required")
+		return
+	}
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = TokenUsageHour
+	}
+	length, retention, ok := tokenUsageBucket(bucket)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "bucket must be hour or day")
+		return
+	}
+
+	until := time.Now()
+	since := until.Add(-DefaultTokenUsageHours * time.Hour)
+	if bucket == TokenUsageDay {
+		since = until.AddDate(0, 0, -DefaultTokenUsageDays)
+	}
+	var err error
+	if u := query.Get("until"); u != "" {
+		if until, err = parseAuditTime(u); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "until must be unix milliseconds or RFC 3339")
+			return
+		}
+	}
+	if s := query.Get("since"); s != "" {
+		if since, err = parseAuditTime(s); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "since must be unix milliseconds or RFC 3339")
+			return
+		}
+	}
+	// older buckets have expired, and bounding the range bounds the reads
+	if oldest := time.Now().Add(-retention - length); since.Before(oldest) {
+		since = oldest
+	}
+	if until.Before(since) {
+		until = since
+	}
+
+	var starts []time.Time
+	for start := since.UTC().Truncate(length); !start.After(until); start = start.Add(length) {
+		starts = append(starts, start)
+	}
+	pipe := tokenProvider.client.Pipeline()
+	reads := make([]func() map[string]string, len(starts))
+	for i, start := range starts {
+		if guildID != "" {
+			reads[i] = pipe.HGetAll(r.Context(), guildTokenUsageKey(guildID, bucket, start)).Val
+		} else {
+			reads[i] = pipe.HGetAll(r.Context(), tokenGuildUsageKey(hashedToken, bucket, start)).Val
+		}
+	}
+	if len(starts) > 0 {
+		if _, err := pipe.Exec(r.Context()); err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read token usage")
+			return
+		}
+	}
+
+	resp := TokenUsageResponse{GuildID: guildID, HashedToken: hashedToken, Bucket: bucket, Buckets: []TokenUsageBucket{}}
+	totals := make(map[TokenUsage]int64)
+	for i, start := range starts {
+		var usage []TokenUsage
+		for field, v := range reads[i]() {
+			u := TokenUsage{HashedToken: field, GuildID: guildID}
+			if guildID == "" {
+				u = TokenUsage{HashedToken: hashedToken, GuildID: field}
+			} else if hashedToken != "" && field != hashedToken {
+				continue
+			}
+			key := u
+			u.Mutes, _ = strconv.ParseInt(v, 10, 64)
+			totals[key] += u.Mutes
+			usage = append(usage, u)
+		}
+		if len(usage) == 0 {
+			continue
+		}
+		sortTokenUsage(usage)
+		resp.Buckets = append(resp.Buckets, TokenUsageBucket{Start: start, Usage: usage})
+	}
+	resp.Totals = make([]TokenUsage, 0, len(totals))
+	for u, mutes := range totals {
+		u.Mutes = mutes
+		resp.Totals = append(resp.Totals, u)
+	}
+	sortTokenUsage(resp.Totals)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// sortTokenUsage orders usage by mutes, most first, then by token and guild so responses are stable
+func sortTokenUsage(usage []TokenUsage) {
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Mutes != usage[j].Mutes {
+			return usage[i].Mutes > usage[j].Mutes
+		}
+		if usage[i].HashedToken != usage[j].HashedToken {
+			return usage[i].HashedToken < usage[j].HashedToken
+		}
+		return usage[i].GuildID < usage[j].GuildID
+	})
+}
@@ -0,0 +1,202 @@
+package galactus
+
+import (
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// the application flags that let a bot request the privileged intents; the limited ones are for bots in fewer than 100
+// guilds, which don't need to be verified
+const (
+	applicationFlagGatewayPresence            = 1 << 12
+	applicationFlagGatewayPresenceLimited     = 1 << 13
+	applicationFlagGatewayGuildMembers        = 1 << 14
+	applicationFlagGatewayGuildMembersLimited = 1 << 15
+)
+
+// addTokenCheck records a check, with its message formatted like fmt.Sprintf
+func addTokenCheck(verification *api.TokenVerification, name string, passed bool, format string, args ...interface{}) {
+	verification.Checks = append(verification.Checks, api.TokenCheck{Name: name, Passed: passed, Message: fmt.Sprintf(format, args...)})
+}
+
+// applicationOwnedBy returns whether the user owns the application, or is an accepted member of its team
+func applicationOwnedBy(app *discordgo.Application, userID string) bool {
+	if app.Owner != nil && app.Owner.ID == userID {
+		return true
+	}
+	if app.Team == nil {
+		return false
+	}
+	if app.Team.OwnerID == userID {
+		return true
+	}
+	for _, member := range app.Team.Members {
+		if member.User != nil && member.User.ID == userID && member.MembershipState == discordgo.MembershipStateAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// missingPrivilegedIntents names the privileged intents requested that the application isn't allowed
+func missingPrivilegedIntents(intents discordgo.Intent, flags int) []string {
+	var missing []string
+	if intents&discordgo.IntentsGuildMembers != 0 &&
+		flags&(applicationFlagGatewayGuildMembers|applicationFlagGatewayGuildMembersLimited) == 0 {
+		missing = append(missing, "guildMembers")
+	}
+	if intents&discordgo.IntentsGuildPresences != 0 &&
+		flags&(applicationFlagGatewayPresence|applicationFlagGatewayPresenceLimited) == 0 {
+		missing = append(missing, "guildPresences")
+	}
+	return missing
+}
+
+// verifyToken checks that a token belongs to a bot galactus can use: that it's a bot, owned by the requested user, that
+// its application allows the intents galactus would request, and that a gateway session opened with them sees at
+// least one of the target guilds. The session is only temporary; nothing is stored
+func (tokenProvider *TokenProvider) verifyToken(request api.TokenVerifyRequest, hToken string) api.TokenVerification {
+	verification := api.TokenVerification{HashedToken: hToken, Checks: []api.TokenCheck{}}
+	redact := func(err error) string {
+		return strings.ReplaceAll(err.Error(), request.Token, "<redacted>")
+	}
+
+	rest, err := discordgo.New("Bot " + request.Token)
+	if err != nil {
+		addTokenCheck(&verification, api.TokenCheckBot, false, "%s", redact(err))
+		return verification
+	}
+	rest.Client.Transport = tokenProvider.newBreakerTransport(hToken, rest.Client.Transport)
+	user, err := rest.User("@me")
+	if err != nil {
+		addTokenCheck(&verification, api.TokenCheckBot, false, "Discord rejected the token: %s", redact(err))
+		return verification
+	}
+	verification.BotID, verification.BotName = user.ID, user.Username
+	if !user.Bot {
+		addTokenCheck(&verification, api.TokenCheckBot, false, "authenticates as %s#%s, which isn't a bot", user.Username, user.Discriminator)
+		return verification
+	}
+	addTokenCheck(&verification, api.TokenCheckBot, true, "authenticates as %s#%s", user.Username, user.Discriminator)
+
+	app, err := rest.Application("@me")
+	if err != nil {
+		addTokenCheck(&verification, api.TokenCheckApplication, false, "failed to read the bot's application: %s", redact(err))
+		return verification
+	}
+	if request.OwnerID != "" {
+		if !applicationOwnedBy(app, request.OwnerID) {
+			addTokenCheck(&verification, api.TokenCheckOwner, false, "the application %s isn't owned by user %s or their team", app.ID, request.OwnerID)
+			return verification
+		}
+		addTokenCheck(&verification, api.TokenCheckOwner, true, "the application %s is owned by user %s or their team", app.ID, request.OwnerID)
+	}
+	intents := secondaryIntents(tokenProvider.getSettings().intents, hToken)
+	if missing := missingPrivilegedIntents(intents, app.Flags); len(missing) > 0 {
+		addTokenCheck(&verification, api.TokenCheckApplication, false,
+			"enable the %s intent(s) for the application in the developer portal", strings.Join(missing, " and "))
+		return verification
+	}
+	if app.BotPublic {
+		addTokenCheck(&verification, api.TokenCheckApplication, true, "the bot is public, so anyone can invite it; consider making it private")
+	} else {
+		addTokenCheck(&verification, api.TokenCheckApplication, true, "the application allows the requested intents")
+	}
+
+	sess, err := discordgo.New("Bot " + request.Token)
+	if err != nil {
+		addTokenCheck(&verification, api.TokenCheckGateway, false, "%s", redact(err))
+		return verification
+	}
+	sess.Client.Transport = tokenProvider.newBreakerTransport(hToken, sess.Client.Transport)
+	sess.Identify.Intents = discordgo.MakeIntent(intents)
+	if err := tokenProvider.openSession(sess); err != nil {
+		addTokenCheck(&verification, api.TokenCheckGateway, false, "failed to open a gateway session: %s", redact(err))
+		return verification
+	}
+	sess.State.RLock()
+	guildIDs := make([]string, 0, len(sess.State.Guilds))
+	for _, guild := range sess.State.Guilds {
+		guildIDs = append(guildIDs, guild.ID)
+	}
+	sess.State.RUnlock()
+	if err := sess.Close(); err != nil {
+		log.Println(err)
+	}
+	addTokenCheck(&verification, api.TokenCheckGateway, true, "opened a session with intents %d", intents)
+
+	if len(request.GuildIDs) == 0 {
+		verification.Guilds = guildIDs
+	} else {
+		targets := make(map[string]bool, len(request.GuildIDs))
+		for _, guildID := range request.GuildIDs {
+			targets[guildID] = true
+		}
+		for _, guildID := range guildIDs {
+			if targets[guildID] {
+				verification.Guilds = append(verification.Guilds, guildID)
+			}
+		}
+	}
+	sort.Strings(verification.Guilds)
+	if len(verification.Guilds) == 0 {
+		addTokenCheck(&verification, api.TokenCheckGuilds, false, "the bot isn't in any of the target guilds; invite it to one first")
+		return verification
+	}
+	addTokenCheck(&verification, api.TokenCheckGuilds, true, "the bot is in %d of the target guilds", len(verification.Guilds))
+	verification.Verified = true
+	return verification
+}
+
+// tokenVerifyHandler verifies a secondary bot token and, unless it's a dry run, adds it like /addtoken does. The report
+// is returned either way, with a 422 if any check failed
+func (tokenProvider *TokenProvider) tokenVerifyHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request api.TokenVerifyRequest
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		request.Token = strings.TrimSpace(strings.TrimPrefix(request.Token, "Bot "))
+		if request.Token == "" {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "token is required")
+			return
+		}
+		k := hashToken(request.Token)
+		if _, ok := tokenProvider.sessions.get(k); ok {
+			writeError(w, r, http.StatusConflict, ErrorCodeConflict, "token "+k+" already exists on the server")
+			return
+		}
+
+		verification := tokenProvider.verifyToken(request, k)
+		if !verification.Verified {
+			failed := verification.Checks[len(verification.Checks)-1]
+			tokenProvider.recordTokenEvent(k, TokenEventRejected, 0, failed.Name+": "+failed.Message)
+			writeJSON(w, http.StatusUnprocessableEntity, verification)
+			return
+		}
+		if dryRun(r) {
+			writeJSON(w, http.StatusOK, verification)
+			return
+		}
+
+		sess, err := tokenProvider.openSecondarySession(request.Token, k)
+		if err != nil {
+			message := strings.ReplaceAll(err.Error(), request.Token, "<redacted>")
+			tokenProvider.recordTokenEvent(k, TokenEventRejected, 0, message)
+			writeError(w, r, http.StatusBadGateway, ErrorCodeDiscord, "verified, but failed to open the bot's session: "+message)
+			return
+		}
+		if !tokenProvider.registerSession(r.Context(), request.Token, k, sess) {
+			writeError(w, r, http.StatusConflict, ErrorCodeConflict, "token "+k+" already exists on the server")
+			return
+		}
+		log.Printf("Verified and added token %s for bot %s\n", k, verification.BotID)
+		verification.Added = true
+		writeJSON(w, http.StatusOK, verification)
+	}
+}
@@ -0,0 +1,165 @@
+package galactus
+
+import (
+	"net/http"
+)
+
+// dashboardHandler serves the admin status page. It's a single page that polls the JSON admin endpoints, so there's
+// nothing to build or deploy alongside galactus
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>galactus</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { margin-bottom: 0; }
+h2 { margin-top: 1.5em; font-size: 1.1em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.6em; text-align: left; font-size: 0.9em; }
+.bad { color: #b00; }
+.good { color: #070; }
+#events { max-height: 20em; overflow-y: auto; font-family: monospace; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>galactus</h1>
+<div id="runtime"></div>
+
+<h2>Shards</h2>
+<table id="shards"></table>
+
+<h2>Job queues</h2>
+<div id="jobs"></div>
+<table id="workers"></table>
+
+<h2>Secondary bot sessions</h2>
+<label>Rate limits on guild <input id="guildID" placeholder="guild ID"></label>
+<table id="sessions"></table>
+
+<h2>Recent errors</h2>
+<table id="errors"></table>
+
+<h2>Live events</h2>
+<div id="events"></div>
+
+<script>
+"use strict";
+
+async function get(path) {
+	const resp = await fetch(path);
+	if (!resp.ok) {
+		throw new Error(path + ": " + resp.status);
+	}
+	return resp.json();
+}
+
+// cells are set with textContent, so names from Discord can't inject markup
+function fillTable(id, headers, rows) {
+	const table = document.getElementById(id);
+	table.replaceChildren();
+	const head = table.insertRow();
+	for (const h of headers) {
+		const th = document.createElement("th");
+		th.textContent = h;
+		head.appendChild(th);
+	}
+	for (const row of rows) {
+		const tr = table.insertRow();
+		for (const cell of row) {
+			const td = tr.insertCell();
+			if (typeof cell === "object" && cell !== null) {
+				td.textContent = cell.text;
+				td.className = cell.className;
+			} else {
+				td.textContent = cell;
+			}
+		}
+	}
+}
+
+function status(ok, yes, no) {
+	return {text: ok ? yes : no, className: ok ? "good" : "bad"};
+}
+
+async function refreshRuntime() {
+	const rt = await get("runtime");
+	document.getElementById("runtime").textContent = "instance " + rt.instanceID + (rt.leader ? " (leader)" : "") +
+		", " + rt.goroutines + " goroutines, " + Math.round(rt.heap.inuseBytes / 1048576) + " MiB heap";
+}
+
+async function refreshShards() {
+	const resp = await get("shards");
+	fillTable("shards", ["Shard", "Gateway", "Guilds", "Heartbeat latency", "Last ack"], resp.shards.map(s => [
+		s.shardID, status(s.connected, "connected", "disconnected"), s.guilds, s.heartbeatLatencyMs + " ms",
+		new Date(s.lastHeartbeatAck).toLocaleTimeString(),
+	]));
+}
+
+async function refreshJobs() {
+	const jobs = await get("../v1/jobs");
+	document.getElementById("jobs").textContent = jobs.pending + " pending jobs in " + jobs.queues + " queues" +
+		(jobs.backpressure ? "; above the high-water mark for " + jobs.backpressured.join(", ") : "");
+	const workers = await get("../v1/workers");
+	document.getElementById("jobs").textContent += "; " + workers.workers.length + " workers, " +
+		workers.desiredWorkers + " desired";
+	fillTable("workers", ["Worker", "In flight", "Jobs/s", "Lag"], workers.workers.map(w => [
+		w.workerID, w.inFlight + (w.concurrency ? " / " + w.concurrency : ""), w.jobsPerSecond.toFixed(2), w.lagMs + " ms",
+	]));
+}
+
+async function refreshSessions() {
+	const guildID = document.getElementById("guildID").value.trim();
+	const resp = await get("sessions" + (guildID ? "?guildID=" + encodeURIComponent(guildID) : ""));
+	fillTable("sessions", ["Token", "Guilds", "Limit", "Remaining", "Blacklisted"], resp.sessions.map(s => [
+		s.hashedToken.slice(0, 12), s.guilds, s.rateLimit.requests + " per " + s.rateLimit.windowMs + " ms",
+		s.rateLimit.remaining === undefined ? "" : s.rateLimit.remaining,
+		s.rateLimit.blacklistedMs ? status(false, "", "for " + s.rateLimit.blacklistedMs + " ms") : "",
+	]));
+}
+
+async function refreshErrors() {
+	const resp = await get("errors");
+	fillTable("errors", ["Time", "Request", "Status", "Code", "Message"], resp.errors.map(e => [
+		new Date(e.time).toLocaleTimeString(), e.method + " " + e.route, e.status, e.code, e.message,
+	]));
+}
+
+async function refresh() {
+	for (const f of [refreshRuntime, refreshShards, refreshJobs, refreshSessions, refreshErrors]) {
+		try {
+			await f();
+		} catch (err) {
+			console.error(err);
+		}
+	}
+}
+
+const events = new EventSource("../v1/events/stream");
+for (const type of ["shardConnect", "shardDisconnect", "tokenBlacklist", "captureBlacklist", "captureTimeout", "discordOutage", "discordRecovered"]) {
+	events.addEventListener(type, e => {
+		const event = JSON.parse(e.data);
+		const line = document.createElement("div");
+		line.textContent = new Date(event.time).toLocaleTimeString() + " " + event.type + " " + JSON.stringify(event.data);
+		const list = document.getElementById("events");
+		list.prepend(line);
+		while (list.childElementCount > 200) {
+			list.lastChild.remove();
+		}
+	});
+}
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
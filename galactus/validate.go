@@ -0,0 +1,60 @@
+package galactus
+
+import (
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/automuteus/utils/pkg/task"
+	"net/http"
+	"strings"
+)
+
+const ErrorCodeValidation = "VALIDATION_FAILED"
+
+// validateUserModifyRequest checks a modify request before any of it is applied. Fields are prefixed with prefix, for
+// requests nested in a batch
+func validateUserModifyRequest(request task.UserModifyRequest, prefix string) []api.FieldError {
+	var errs []api.FieldError
+	if request.Premium < premium.FreeTier || request.Premium > premium.SelfHostTier {
+		errs = append(errs, api.FieldError{
+			Field:   prefix + "premium",
+			Message: fmt.Sprintf("must be between %d and %d", premium.FreeTier, premium.SelfHostTier),
+		})
+	}
+	if len(request.Users) == 0 {
+		errs = append(errs, api.FieldError{Field: prefix + "users", Message: "must not be empty"})
+	}
+	seen := make(map[uint64]int, len(request.Users))
+	for i, user := range request.Users {
+		field := fmt.Sprintf("%susers[%d].userID", prefix, i)
+		if user.UserID == 0 {
+			errs = append(errs, api.FieldError{Field: field, Message: "is required"})
+			continue
+		}
+		if first, ok := seen[user.UserID]; ok {
+			errs = append(errs, api.FieldError{Field: field, Message: fmt.Sprintf("duplicates users[%d]", first)})
+			continue
+		}
+		seen[user.UserID] = i
+	}
+	return errs
+}
+
+// validationMessage joins field errors into one line, for responses that can't list them separately
+func validationMessage(errs []api.FieldError) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Field + " " + err.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// writeValidationError responds with a 422 listing every field error
+func writeValidationError(w http.ResponseWriter, r *http.Request, errs []api.FieldError) {
+	writeJSON(w, http.StatusUnprocessableEntity, api.ErrorResponse{
+		Code:      ErrorCodeValidation,
+		Message:   validationMessage(errs),
+		RequestID: RequestIDFromContext(r.Context()),
+		Fields:    errs,
+	})
+}
@@ -0,0 +1,58 @@
+package galactus
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+)
+
+// BuildInfo describes the running binary. main sets it from values injected with -ldflags
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+type VersionResponse struct {
+	BuildInfo
+	// Features lists the optional functionality this deployment has enabled, for clients to gate on
+	Features []string `json:"features"`
+}
+
+// features combines the features main reported with the ones the HTTP server itself enables
+func (config ServerConfig) features() []string {
+	features := append([]string{}, config.Features...)
+	if config.useTLS() {
+		features = append(features, "tls")
+	}
+	if config.useMTLS() {
+		features = append(features, "mtls")
+	}
+	if config.useSigning() {
+		features = append(features, "request-signing")
+	}
+	if config.AdminAPIKey != "" {
+		features = append(features, "admin")
+	}
+	if config.RequireAPIKeys {
+		features = append(features, "api-keys")
+	}
+	if config.DiscordProxy {
+		features = append(features, "discord-proxy")
+	}
+	sort.Strings(features)
+	return features
+}
+
+func versionHandler(config ServerConfig) http.HandlerFunc {
+	info := config.BuildInfo
+	info.GoVersion = runtime.Version()
+	resp := VersionResponse{
+		BuildInfo: info,
+		Features:  config.features(),
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
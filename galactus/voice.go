@@ -0,0 +1,140 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+// CachedVoiceState is a user's voice state, as of the last update the primary bot received
+type CachedVoiceState struct {
+	UserID    string `json:"userID"`
+	ChannelID string `json:"channelID"`
+	Mute      bool   `json:"mute"`
+	Deaf      bool   `json:"deaf"`
+	SelfMute  bool   `json:"selfMute"`
+	SelfDeaf  bool   `json:"selfDeaf"`
+}
+
+// VoiceChannelResponse is returned from /guild/{guildID}/voice/{channelID}
+type VoiceChannelResponse struct {
+	GuildID   string             `json:"guildID"`
+	ChannelID string             `json:"channelID"`
+	Users     []CachedVoiceState `json:"users"`
+}
+
+// one hash per guild, userID -> voice state, so a user moving channels is a single field update
+func voiceStateKey(guildID string) string {
+	return "galactus:voice:{" + guildID + "}"
+}
+
+// addVoiceStateHandlers keeps the voice state cache up to date from the session's gateway events. Only the primary bot
+// clears a guild's cache when it leaves; a secondary bot leaving doesn't stop the primary one from tracking the guild
+func (tokenProvider *TokenProvider) addVoiceStateHandlers(sess *discordgo.Session, primary bool) {
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildCreate) {
+		tokenProvider.resetVoiceStates(m.ID, m.VoiceStates)
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.GuildDelete) {
+		if !primary || m.Guild == nil || m.Unavailable {
+			return
+		}
+		err := tokenProvider.client.Del(context.Background(), voiceStateKey(m.ID)).Err()
+		if err != nil {
+			log.Println(err)
+		}
+	})
+	sess.AddHandler(func(s *discordgo.Session, m *discordgo.VoiceStateUpdate) {
+		if m.VoiceState == nil {
+			return
+		}
+		var err error
+		if m.ChannelID == "" {
+			err = tokenProvider.client.HDel(context.Background(), voiceStateKey(m.GuildID), m.UserID).Err()
+		} else {
+			var jBytes []byte
+			jBytes, err = json.Marshal(newCachedVoiceState(m.VoiceState))
+			if err == nil {
+				err = tokenProvider.client.HSet(context.Background(), voiceStateKey(m.GuildID), m.UserID, jBytes).Err()
+			}
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func newCachedVoiceState(state *discordgo.VoiceState) CachedVoiceState {
+	return CachedVoiceState{
+		UserID:    state.UserID,
+		ChannelID: state.ChannelID,
+		Mute:      state.Mute,
+		Deaf:      state.Deaf,
+		SelfMute:  state.SelfMute,
+		SelfDeaf:  state.SelfDeaf,
+	}
+}
+
+// resetVoiceStates replaces the guild's cached voice states with the full set sent on GuildCreate, dropping anything
+// left over from before a disconnect
+func (tokenProvider *TokenProvider) resetVoiceStates(guildID string, states []*discordgo.VoiceState) {
+	key := voiceStateKey(guildID)
+	pipe := tokenProvider.client.TxPipeline()
+	pipe.Del(context.Background(), key)
+	for _, state := range states {
+		if state == nil || state.ChannelID == "" {
+			continue
+		}
+		jBytes, err := json.Marshal(newCachedVoiceState(state))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		pipe.HSet(context.Background(), key, state.UserID, jBytes)
+	}
+	_, err := pipe.Exec(context.Background())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (tokenProvider *TokenProvider) voiceChannelUsers(ctx context.Context, guildID, channelID string) ([]CachedVoiceState, error) {
+	states, err := tokenProvider.client.HGetAll(ctx, voiceStateKey(guildID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]CachedVoiceState, 0)
+	for _, v := range states {
+		state := CachedVoiceState{}
+		if err := json.Unmarshal([]byte(v), &state); err != nil {
+			log.Println(err)
+			continue
+		}
+		if state.ChannelID == channelID {
+			users = append(users, state)
+		}
+	}
+	return users, nil
+}
+
+func (tokenProvider *TokenProvider) voiceChannelHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+
+		users, err := tokenProvider.voiceChannelUsers(ctx, vars["guildID"], vars["channelID"])
+		if err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, VoiceChannelResponse{
+			GuildID:   vars["guildID"],
+			ChannelID: vars["channelID"],
+			Users:     users,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package galactus
+
+import (
+	"github.com/automuteus/utils/pkg/rediskey"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultSessionStartupConcurrency is how many secondary sessions are opened at once on startup. Each bot token has
+// its own identify limits, which openSession still waits for, so this only bounds the load on galactus and Redis
+const DefaultSessionStartupConcurrency = 8
+
+// WarmupStatus is the progress of opening the secondary sessions on startup, as reported by /ready
+type WarmupStatus struct {
+	Ready  bool `json:"ready"`
+	Total  int  `json:"total"`
+	Opened int  `json:"opened"`
+	Failed int  `json:"failed"`
+}
+
+// sessionWarmup tracks PopulateAndStartSessions
+type sessionWarmup struct {
+	sync.Mutex
+	status WarmupStatus
+}
+
+func (warmup *sessionWarmup) get() WarmupStatus {
+	warmup.Lock()
+	defer warmup.Unlock()
+	return warmup.status
+}
+
+func (warmup *sessionWarmup) ready() bool {
+	return warmup.get().Ready
+}
+
+// PopulateAndStartSessions opens a session for every registered secondary token, a few at a time. Until it's done,
+// /ready fails, and tokens without a session aren't treated as stale
+func (tokenProvider *TokenProvider) PopulateAndStartSessions() {
+	warmup := tokenProvider.warmup
+	defer func() {
+		warmup.Lock()
+		warmup.status.Ready = true
+		warmup.Unlock()
+	}()
+
+	if tokenProvider.lazySessions != nil {
+		log.Println("Secondary sessions are lazy; they're opened when a guild first needs them")
+		return
+	}
+
+	keys, err := tokenProvider.client.HGetAll(ctx, rediskey.AllTokensHSet).Result()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	concurrency := tokenProvider.config.Sessions.StartupConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultSessionStartupConcurrency
+	}
+	warmup.Lock()
+	warmup.status.Total = len(keys)
+	warmup.Unlock()
+	log.Printf("Opening %d secondary sessions, %d at a time\n", len(keys), concurrency)
+
+	start := time.Now()
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for _, v := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(botToken string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := tokenProvider.openAndStartSessionWithToken(botToken)
+			warmup.Lock()
+			if err != nil {
+				log.Println(err)
+				warmup.status.Failed++
+			} else {
+				warmup.status.Opened++
+			}
+			status := warmup.status
+			warmup.Unlock()
+			log.Printf("Secondary sessions: %d of %d opened, %d failed\n", status.Opened, status.Total, status.Failed)
+		}(v)
+	}
+	wg.Wait()
+	log.Printf("Opened secondary sessions in %s\n", time.Since(start).Round(time.Millisecond))
+}
+
+// readyHandler fails with a 503 until the secondary sessions are opened, so traffic isn't routed to an instance that
+// would fall back to slower mute methods for every guild
+func (tokenProvider *TokenProvider) readyHandler(w http.ResponseWriter, r *http.Request) {
+	status := tokenProvider.warmup.get()
+	if !status.Ready {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,106 @@
+package galactus
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WebhookRateLimit is Discord's limit on executions of one webhook: 5 every 2 seconds
+var WebhookRateLimit = RateLimit{PerSecond: 2.5, Burst: 5}
+
+// WebhookMaxRetries is how many times an execution is retried after a Discord server error. discordgo already retries
+// 429s and 502s on its own
+const WebhookMaxRetries = 3
+
+const webhookRetryBackoff = time.Millisecond * 500
+
+type WebhookRequest struct {
+	Content         string                            `json:"content,omitempty"`
+	Username        string                            `json:"username,omitempty"`
+	AvatarURL       string                            `json:"avatar_url,omitempty"`
+	TTS             bool                              `json:"tts,omitempty"`
+	Embeds          []*discordgo.MessageEmbed         `json:"embeds,omitempty"`
+	AllowedMentions *discordgo.MessageAllowedMentions `json:"allowed_mentions,omitempty"`
+}
+
+func webhookRateLimitKey(webhookID string) string {
+	return "galactus:ratelimit:webhook:" + webhookID
+}
+
+// webhookRetryable is true for network errors and Discord 5xxs
+func webhookRetryable(err error) bool {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		return restErr.Response != nil && restErr.Response.StatusCode >= 500
+	}
+	return true
+}
+
+// executeWebhook executes the webhook within its rate limit, shared by every galactus instance, retrying server errors
+func (tokenProvider *TokenProvider) executeWebhook(ctx context.Context, webhookID, token string, request WebhookRequest) (*discordgo.Message, error) {
+	params := &discordgo.WebhookParams{
+		Content:         request.Content,
+		Username:        request.Username,
+		AvatarURL:       request.AvatarURL,
+		TTS:             request.TTS,
+		Embeds:          request.Embeds,
+		AllowedMentions: request.AllowedMentions,
+	}
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := tokenProvider.waitForRateLimit(ctx, webhookRateLimitKey(webhookID), WebhookRateLimit); err != nil {
+			return nil, err
+		}
+		msg, err := tokenProvider.primarySession.WebhookExecute(webhookID, token, true, params)
+		if err == nil {
+			return msg, nil
+		}
+		if attempt >= WebhookMaxRetries || !webhookRetryable(err) {
+			return nil, err
+		}
+		log.Printf("Executing webhook %s failed, retrying in %s: %s\n", webhookID, backoff, err)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+// webhookHandler executes a Discord webhook, so workers can send notifications without their own rate limiting
+func (tokenProvider *TokenProvider) webhookHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		request := WebhookRequest{}
+		if !readJSONBody(w, r, config, &request) {
+			return
+		}
+		if request.Content == "" && len(request.Embeds) == 0 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "a webhook message needs content or embeds")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), config.RequestTimeout)
+		defer cancel()
+		msg, err := tokenProvider.executeWebhook(ctx, vars["webhookID"], vars["token"], request)
+		if err != nil {
+			log.Println(err)
+			writeDiscordError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, MessageResult{
+			ChannelID: msg.ChannelID,
+			MessageID: msg.ID,
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package galactus
+
+import (
+	"context"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultWorkerPoolSize = 64
+const DefaultWorkerQueueSize = 1024
+
+// DefaultTierQueueWait is how long a premium tier's mute/deafens wait for its dedicated workers by default
+const DefaultTierQueueWait = 250 * time.Millisecond
+
+var (
+	workerPoolSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "galactus_worker_pool_size",
+		Help: "Workers in each mute/deafen worker pool: the shared one, or a premium tier's dedicated one",
+	}, []string{"pool"})
+	workerPoolBusy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "galactus_worker_pool_busy",
+		Help: "Workers currently applying a mute/deafen, by pool",
+	}, []string{"pool"})
+	workerPoolQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "galactus_worker_pool_queue_length",
+		Help: "Mute/deafens waiting for a free worker, by pool",
+	}, []string{"pool"})
+	workerPoolRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_worker_pool_rejected_total",
+		Help: "Mute/deafens dropped because their request ended while waiting for room in the queue, by pool",
+	}, []string{"pool"})
+	workerPoolSpilledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "galactus_worker_pool_spilled_total",
+		Help: "Mute/deafens sent to the shared pool after waiting too long for their premium tier's dedicated workers",
+	}, []string{"pool"})
+)
+
+// workerPool is a set of long-lived workers shared by every request. Its queue is bounded, so when galactus is
+// saturated, submitting blocks and callers slow down instead of piling up goroutines
+type workerPool struct {
+	// name labels the pool's metrics
+	name  string
+	tasks chan func()
+	// each value received stops one worker, once it finishes its current task
+	quit chan struct{}
+
+	lock sync.Mutex
+	size int
+}
+
+func newWorkerPool(name string, size, queueSize int) *workerPool {
+	pool := &workerPool{
+		name:  name,
+		tasks: make(chan func(), queueSize),
+		quit:  make(chan struct{}),
+	}
+	pool.resize(size)
+	return pool
+}
+
+// resize starts or stops workers until there are size of them. The queue's size is fixed
+func (pool *workerPool) resize(size int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for ; pool.size < size; pool.size++ {
+		go pool.work()
+	}
+	for ; pool.size > size; pool.size-- {
+		// busy workers pick this up when they're done, so don't wait for them
+		go func() {
+			pool.quit <- struct{}{}
+		}()
+	}
+	workerPoolSize.WithLabelValues(pool.name).Set(float64(size))
+}
+
+func (pool *workerPool) work() {
+	for {
+		select {
+		case <-pool.quit:
+			return
+		case task, ok := <-pool.tasks:
+			if !ok {
+				return
+			}
+			workerPoolQueueLength.WithLabelValues(pool.name).Set(float64(len(pool.tasks)))
+			workerPoolBusy.WithLabelValues(pool.name).Inc()
+			task()
+			workerPoolBusy.WithLabelValues(pool.name).Dec()
+		}
+	}
+}
+
+// submit queues the task, waiting for room in the queue until the context ends
+func (pool *workerPool) submit(ctx context.Context, task func()) error {
+	if err := pool.offer(ctx, task); err != nil {
+		workerPoolRejectedTotal.WithLabelValues(pool.name).Inc()
+		return err
+	}
+	return nil
+}
+
+// offer is submit, without counting a task that didn't fit as rejected
+func (pool *workerPool) offer(ctx context.Context, task func()) error {
+	select {
+	case pool.tasks <- task:
+		workerPoolQueueLength.WithLabelValues(pool.name).Set(float64(len(pool.tasks)))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tieredWorkerPool sets aside a share of the workers for each premium tier configured to have one. A tier's
+// mute/deafens wait a little for its dedicated workers, then fall back to the shared pool with everyone else's
+type tieredWorkerPool struct {
+	shared *workerPool
+	// the tiers with a share are fixed at startup
+	dedicated map[premium.Tier]*workerPool
+	// percent of the workers each tier's pool gets
+	shares map[premium.Tier]int
+}
+
+func newTieredWorkerPool(size, queueSize int, shares map[premium.Tier]int) *tieredWorkerPool {
+	pools := &tieredWorkerPool{
+		dedicated: make(map[premium.Tier]*workerPool, len(shares)),
+		shares:    shares,
+	}
+	sizes := pools.sizes(size)
+	for tier := range shares {
+		// a short queue, so tasks spill over to the shared pool instead of waiting behind their tier's backlog
+		pools.dedicated[tier] = newWorkerPool(tierPoolName(tier), sizes[tier], sizes[tier])
+	}
+	pools.shared = newWorkerPool("shared", sizes[sharedPoolTier], queueSize)
+	return pools
+}
+
+// sharedPoolTier keys the shared pool's size in sizes; no premium tier is negative
+const sharedPoolTier = premium.Tier(-1)
+
+func tierPoolName(tier premium.Tier) string {
+	return "tier" + strconv.Itoa(int(tier))
+}
+
+// sizes divides size workers between the pools. Every pool keeps at least one worker, so none of them stall
+func (pools *tieredWorkerPool) sizes(size int) map[premium.Tier]int {
+	sizes := make(map[premium.Tier]int, len(pools.shares)+1)
+	remaining := size
+	for tier, share := range pools.shares {
+		sizes[tier] = size * share / 100
+		if sizes[tier] < 1 {
+			sizes[tier] = 1
+		}
+		remaining -= sizes[tier]
+	}
+	if remaining < 1 {
+		remaining = 1
+	}
+	sizes[sharedPoolTier] = remaining
+	return sizes
+}
+
+// resize divides size workers between the pools by their shares
+func (pools *tieredWorkerPool) resize(size int) {
+	sizes := pools.sizes(size)
+	for tier, pool := range pools.dedicated {
+		pool.resize(sizes[tier])
+	}
+	pools.shared.resize(sizes[sharedPoolTier])
+}
+
+// submit queues a task for a guild on tier. Tiers with dedicated workers wait up to queueWait for room in their own
+// pool before using the shared one
+func (pools *tieredWorkerPool) submit(ctx context.Context, tier premium.Tier, queueWait time.Duration, task func()) error {
+	if pool, ok := pools.dedicated[tier]; ok {
+		waitCtx, cancel := context.WithTimeout(ctx, queueWait)
+		err := pool.offer(waitCtx, task)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			workerPoolRejectedTotal.WithLabelValues(pool.name).Inc()
+			return ctx.Err()
+		}
+		workerPoolSpilledTotal.WithLabelValues(pool.name).Inc()
+	}
+	return pools.shared.submit(ctx, task)
+}
@@ -0,0 +1,254 @@
+package galactus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// WorkerHeartbeatTTL is how long a worker is listed after its last heartbeat. Workers should send one every few seconds
+const WorkerHeartbeatTTL = 30 * time.Second
+
+const (
+	// JobDepthSampleInterval is how often the total queue depth is sampled, on the back of worker heartbeats
+	JobDepthSampleInterval = 10 * time.Second
+	// JobDepthSamples are kept for the trend; 30 samples at 10s is a 5 minute window
+	JobDepthSamples = 30
+)
+
+const (
+	// WorkerTargetUtilization is the fraction of the workers' concurrency the desired worker count aims to keep busy
+	WorkerTargetUtilization = 0.7
+	// WorkerBacklogDrainTime is how quickly the desired worker count aims to clear the pending jobs
+	WorkerBacklogDrainTime = time.Minute
+)
+
+const (
+	workersKey         = "galactus:workers"
+	jobDepthKey        = "galactus:workers:depth"
+	jobDepthSampleLock = "galactus:workers:depth:lock"
+)
+
+// WorkerHeartbeat is what a worker reports about its load
+type WorkerHeartbeat struct {
+	WorkerID string `json:"workerID"`
+	// jobs the worker is processing right now, and how many it processes at once
+	InFlight    int64 `json:"inFlight"`
+	Concurrency int64 `json:"concurrency,omitempty"`
+	// jobs processed since the worker started; galactus derives the worker's throughput from it
+	Processed int64 `json:"processed"`
+	// how long the job the worker most recently popped waited in the queue
+	LagMs int64 `json:"lagMs"`
+}
+
+// WorkerStatus is a worker's latest heartbeat, as listed by GET /workers
+type WorkerStatus struct {
+	WorkerHeartbeat
+	JobsPerSecond float64 `json:"jobsPerSecond"`
+	// unix ms of the last heartbeat
+	LastSeen int64 `json:"lastSeen"`
+}
+
+type WorkersResponse struct {
+	Workers []WorkerStatus `json:"workers"`
+	Pending int64          `json:"pending"`
+	// change in pending jobs per second over the sampled window; positive while the queues grow
+	PendingTrend float64 `json:"pendingTrend"`
+	// DesiredWorkers is the worker count that keeps up with the queues, for an autoscaler to consume
+	DesiredWorkers int64 `json:"desiredWorkers"`
+}
+
+type jobDepthSample struct {
+	Time    int64 `json:"t"`
+	Pending int64 `json:"pending"`
+}
+
+func (tokenProvider *TokenProvider) workerHeartbeatHandler(config ServerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var heartbeat WorkerHeartbeat
+		if !readJSONBody(w, r, config, &heartbeat) {
+			return
+		}
+		if heartbeat.WorkerID == "" {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "workerID is required")
+			return
+		}
+		if err := tokenProvider.recordWorkerHeartbeat(r.Context(), heartbeat); err != nil {
+			log.Println(err)
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to record the heartbeat")
+			return
+		}
+		tokenProvider.sampleJobDepth(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (tokenProvider *TokenProvider) recordWorkerHeartbeat(ctx context.Context, heartbeat WorkerHeartbeat) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	status := WorkerStatus{
+		WorkerHeartbeat: heartbeat,
+		LastSeen:        now,
+	}
+	prev, err := tokenProvider.client.HGet(ctx, workersKey, heartbeat.WorkerID).Bytes()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == nil {
+		var last WorkerStatus
+		// a worker that restarted reports fewer processed jobs; its throughput waits for the next heartbeat
+		if json.Unmarshal(prev, &last) == nil && heartbeat.Processed >= last.Processed && now > last.LastSeen {
+			status.JobsPerSecond = float64(heartbeat.Processed-last.Processed) * 1000 / float64(now-last.LastSeen)
+		}
+	}
+	jBytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return tokenProvider.client.HSet(ctx, workersKey, heartbeat.WorkerID, jBytes).Err()
+}
+
+// sampleJobDepth records the total queue depth, at most once per JobDepthSampleInterval across all instances
+func (tokenProvider *TokenProvider) sampleJobDepth(ctx context.Context) {
+	ok, err := tokenProvider.client.SetNX(ctx, jobDepthSampleLock, tokenProvider.instanceID, JobDepthSampleInterval).Result()
+	if err != nil || !ok {
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	pending, err := tokenProvider.pendingJobs(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	jBytes, err := json.Marshal(jobDepthSample{Time: time.Now().UnixNano() / int64(time.Millisecond), Pending: pending})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	pipe := tokenProvider.client.TxPipeline()
+	pipe.LPush(ctx, jobDepthKey, jBytes)
+	pipe.LTrim(ctx, jobDepthKey, 0, JobDepthSamples-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+func (tokenProvider *TokenProvider) pendingJobs(ctx context.Context) (int64, error) {
+	lengths, err := tokenProvider.jobQueueLengths(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	var pending int64
+	for _, length := range lengths {
+		pending += length
+	}
+	return pending, nil
+}
+
+// liveWorkers returns the workers that sent a heartbeat within WorkerHeartbeatTTL, forgetting the rest
+func (tokenProvider *TokenProvider) liveWorkers(ctx context.Context) ([]WorkerStatus, error) {
+	fields, err := tokenProvider.client.HGetAll(ctx, workersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-WorkerHeartbeatTTL).UnixNano() / int64(time.Millisecond)
+	workers := []WorkerStatus{}
+	var gone []string
+	for workerID, v := range fields {
+		var status WorkerStatus
+		if err := json.Unmarshal([]byte(v), &status); err != nil || status.LastSeen < cutoff {
+			gone = append(gone, workerID)
+			continue
+		}
+		workers = append(workers, status)
+	}
+	if len(gone) > 0 {
+		if err := tokenProvider.client.HDel(ctx, workersKey, gone...).Err(); err != nil {
+			log.Println(err)
+		}
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].WorkerID < workers[j].WorkerID
+	})
+	return workers, nil
+}
+
+// pendingTrend is the change in pending jobs per second between the oldest and newest depth samples
+func (tokenProvider *TokenProvider) pendingTrend(ctx context.Context) (float64, error) {
+	vals, err := tokenProvider.client.LRange(ctx, jobDepthKey, 0, -1).Result()
+	if err != nil || len(vals) < 2 {
+		return 0, err
+	}
+	var newest, oldest jobDepthSample
+	if err := json.Unmarshal([]byte(vals[0]), &newest); err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal([]byte(vals[len(vals)-1]), &oldest); err != nil {
+		return 0, err
+	}
+	if newest.Time <= oldest.Time {
+		return 0, nil
+	}
+	return float64(newest.Pending-oldest.Pending) * 1000 / float64(newest.Time-oldest.Time), nil
+}
+
+// desiredWorkers scales the current workers to WorkerTargetUtilization, then adds enough to absorb the queues' growth
+// and clear the pending jobs within WorkerBacklogDrainTime, going by the workers' average throughput
+func desiredWorkers(workers []WorkerStatus, pending int64, trend float64) int64 {
+	if len(workers) == 0 {
+		return 1
+	}
+	var inFlight, concurrency int64
+	var throughput float64
+	for _, worker := range workers {
+		inFlight += worker.InFlight
+		concurrency += worker.Concurrency
+		throughput += worker.JobsPerSecond
+	}
+
+	desired := float64(len(workers))
+	if concurrency > 0 {
+		desired = desired * (float64(inFlight) / float64(concurrency)) / WorkerTargetUtilization
+	}
+	if backlog := trend + float64(pending)/WorkerBacklogDrainTime.Seconds(); backlog > 0 && pending > 0 {
+		if throughput > 0 {
+			desired += backlog / (throughput / float64(len(workers)))
+		} else {
+			// no throughput to go by yet, so grow one at a time
+			desired = math.Max(desired, float64(len(workers)+1))
+		}
+	}
+	return int64(math.Max(1, math.Ceil(desired)))
+}
+
+func (tokenProvider *TokenProvider) workersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workers, err := tokenProvider.liveWorkers(ctx)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read workers")
+		return
+	}
+	pending, err := tokenProvider.pendingJobs(ctx)
+	if err != nil {
+		log.Println(err)
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to read job queues")
+		return
+	}
+	trend, err := tokenProvider.pendingTrend(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	writeJSON(w, http.StatusOK, WorkersResponse{
+		Workers:        workers,
+		Pending:        pending,
+		PendingTrend:   trend,
+		DesiredWorkers: desiredWorkers(workers, pending, trend),
+	})
+}
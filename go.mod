@@ -1,11 +1,20 @@
 module github.com/automuteus/galactus
 
-go 1.15
+go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/automuteus/utils v0.0.4
 	github.com/bwmarrin/discordgo v0.22.0
 	github.com/go-redis/redis/v8 v8.4.2
 	github.com/googollee/go-socket.io v1.4.4
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.1
+	github.com/lib/pq v1.10.9
+	github.com/prometheus/client_golang v1.10.0
+	github.com/segmentio/kafka-go v0.4.47
+	go.uber.org/zap v1.21.0
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,305 @@
+// Package loadtest drives galactus end to end against a fake Discord, so throughput regressions in the worker pool or
+// rate limiters can be caught without touching real guilds
+package loadtest
+
+import (
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultFakeHeartbeatInterval is the heartbeat interval the fake gateway asks for; Discord's is about 41 seconds
+const DefaultFakeHeartbeatInterval = 5 * time.Second
+
+// FakeDiscordConfig shapes how the fake Discord behaves
+type FakeDiscordConfig struct {
+	// Guilds are sent to every bot that identifies, as GUILD_CREATE events
+	Guilds []string
+	// Latency is added to every REST call
+	Latency time.Duration
+	// RateLimitEvery answers every nth member edit with a 429, to exercise galactus' retries. 0 never does
+	RateLimitEvery int64
+	// HeartbeatInterval is sent in the gateway's Hello; DefaultFakeHeartbeatInterval if 0
+	HeartbeatInterval time.Duration
+}
+
+// FakeDiscordStats counts what the fake Discord was asked to do
+type FakeDiscordStats struct {
+	Identifies  int64 `json:"identifies"`
+	MemberEdits int64 `json:"memberEdits"`
+	RateLimited int64 `json:"rateLimited"`
+	// Unhandled counts the REST calls to routes the fake doesn't implement, which get a 404
+	Unhandled int64 `json:"unhandled"`
+}
+
+// FakeDiscord serves enough of Discord's REST API and gateway for galactus to open sessions and mute users: the
+// gateway URL, the current user, member edits, and a gateway that identifies, resumes and acks heartbeats
+type FakeDiscord struct {
+	config   FakeDiscordConfig
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	identifies  int64
+	memberEdits int64
+	rateLimited int64
+	unhandled   int64
+
+	// the discordgo endpoints before Install, for Close to put back
+	restoreLock sync.Mutex
+	restore     func()
+}
+
+// NewFakeDiscord starts a fake Discord on a local port
+func NewFakeDiscord(config FakeDiscordConfig) *FakeDiscord {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultFakeHeartbeatInterval
+	}
+	fake := &FakeDiscord{config: config}
+
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api/v{version}").Subrouter()
+	api.HandleFunc("/gateway", fake.gatewayHandler).Methods(http.MethodGet)
+	api.HandleFunc("/gateway/bot", fake.gatewayBotHandler).Methods(http.MethodGet)
+	api.HandleFunc("/users/@me", fake.currentUserHandler).Methods(http.MethodGet)
+	api.HandleFunc("/guilds/{guildID}/members/{userID}", fake.memberEditHandler).Methods(http.MethodPatch)
+	r.HandleFunc("/gateway/", fake.websocketHandler)
+	r.NotFoundHandler = http.HandlerFunc(fake.notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(fake.notFoundHandler)
+
+	fake.server = httptest.NewServer(r)
+	return fake
+}
+
+// URL is where the fake Discord is listening, like "http://127.0.0.1:41234"
+func (fake *FakeDiscord) URL() string {
+	return fake.server.URL
+}
+
+// Install points discordgo's endpoints at the fake Discord, for every session in the process
+func (fake *FakeDiscord) Install() {
+	fake.restoreLock.Lock()
+	defer fake.restoreLock.Unlock()
+	if fake.restore != nil {
+		return
+	}
+	discord, api := discordgo.EndpointDiscord, discordgo.EndpointAPI
+	guilds, channels, users := discordgo.EndpointGuilds, discordgo.EndpointChannels, discordgo.EndpointUsers
+	gateway, gatewayBot, webhooks := discordgo.EndpointGateway, discordgo.EndpointGatewayBot, discordgo.EndpointWebhooks
+	fake.restore = func() {
+		discordgo.EndpointDiscord, discordgo.EndpointAPI = discord, api
+		discordgo.EndpointGuilds, discordgo.EndpointChannels, discordgo.EndpointUsers = guilds, channels, users
+		discordgo.EndpointGateway, discordgo.EndpointGatewayBot, discordgo.EndpointWebhooks = gateway, gatewayBot, webhooks
+	}
+
+	discordgo.EndpointDiscord = fake.server.URL + "/"
+	discordgo.EndpointAPI = discordgo.EndpointDiscord + "api/v" + discordgo.APIVersion + "/"
+	discordgo.EndpointGuilds = discordgo.EndpointAPI + "guilds/"
+	discordgo.EndpointChannels = discordgo.EndpointAPI + "channels/"
+	discordgo.EndpointUsers = discordgo.EndpointAPI + "users/"
+	discordgo.EndpointGateway = discordgo.EndpointAPI + "gateway"
+	discordgo.EndpointGatewayBot = discordgo.EndpointGateway + "/bot"
+	discordgo.EndpointWebhooks = discordgo.EndpointAPI + "webhooks/"
+}
+
+// Close stops the fake Discord, and points discordgo back at Discord if it was installed
+func (fake *FakeDiscord) Close() {
+	fake.restoreLock.Lock()
+	if fake.restore != nil {
+		fake.restore()
+		fake.restore = nil
+	}
+	fake.restoreLock.Unlock()
+	fake.server.CloseClientConnections()
+	fake.server.Close()
+}
+
+func (fake *FakeDiscord) Stats() FakeDiscordStats {
+	return FakeDiscordStats{
+		Identifies:  atomic.LoadInt64(&fake.identifies),
+		MemberEdits: atomic.LoadInt64(&fake.memberEdits),
+		RateLimited: atomic.LoadInt64(&fake.rateLimited),
+		Unhandled:   atomic.LoadInt64(&fake.unhandled),
+	}
+}
+
+// fakeUser is the bot user for a token, with an ID derived from it so every token is a different bot
+func fakeUser(authorization string) *discordgo.User {
+	h := fnv.New64a()
+	h.Write([]byte(strings.TrimPrefix(authorization, "Bot ")))
+	// snowflakes are positive int64s
+	id := strconv.FormatUint(h.Sum64()>>1, 10)
+	return &discordgo.User{
+		ID:            id,
+		Username:      "fake-" + id[len(id)-6:],
+		Discriminator: "0000",
+		Bot:           true,
+	}
+}
+
+func (fake *FakeDiscord) delay() {
+	if fake.config.Latency > 0 {
+		time.Sleep(fake.config.Latency)
+	}
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func (fake *FakeDiscord) gatewayURL() string {
+	return "ws" + strings.TrimPrefix(fake.server.URL, "http") + "/gateway"
+}
+
+func (fake *FakeDiscord) gatewayHandler(w http.ResponseWriter, r *http.Request) {
+	fake.delay()
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{"url": fake.gatewayURL()})
+}
+
+func (fake *FakeDiscord) gatewayBotHandler(w http.ResponseWriter, r *http.Request) {
+	fake.delay()
+	writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+		"url":    fake.gatewayURL(),
+		"shards": 1,
+		// plenty of concurrency, so identifies are only held back by galactus' own limits
+		"session_start_limit": map[string]int{
+			"total":           1000,
+			"remaining":       1000,
+			"reset_after":     0,
+			"max_concurrency": 16,
+		},
+	})
+}
+
+func (fake *FakeDiscord) currentUserHandler(w http.ResponseWriter, r *http.Request) {
+	fake.delay()
+	writeFakeJSON(w, http.StatusOK, fakeUser(r.Header.Get("Authorization")))
+}
+
+func (fake *FakeDiscord) memberEditHandler(w http.ResponseWriter, r *http.Request) {
+	fake.delay()
+	n := atomic.AddInt64(&fake.memberEdits, 1)
+	if every := fake.config.RateLimitEvery; every > 0 && n%every == 0 {
+		atomic.AddInt64(&fake.rateLimited, 1)
+		writeFakeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"message":     "You are being rate limited.",
+			"retry_after": 50,
+			"global":      false,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fake *FakeDiscord) notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&fake.unhandled, 1)
+	writeFakeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "404: Not Found", "code": 0})
+}
+
+// gatewayPayload is a gateway message in either direction
+type gatewayPayload struct {
+	Op       int             `json:"op"`
+	Data     json.RawMessage `json:"d,omitempty"`
+	Sequence int64           `json:"s,omitempty"`
+	Type     string          `json:"t,omitempty"`
+}
+
+// websocketHandler serves one gateway connection: Hello, then a READY and a GUILD_CREATE for each guild on identify,
+// RESUMED on resume, and an ack for every heartbeat. Everything else a bot sends, like presence updates, is ignored
+func (fake *FakeDiscord) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := fake.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	var seq int64
+	send := func(op int, eventType string, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		payload := gatewayPayload{Op: op, Data: raw}
+		if op == 0 {
+			seq++
+			payload.Sequence = seq
+			payload.Type = eventType
+		}
+		return conn.WriteJSON(payload)
+	}
+
+	hello := map[string]int64{"heartbeat_interval": fake.config.HeartbeatInterval.Milliseconds()}
+	if err := send(10, "", hello); err != nil {
+		return
+	}
+	for {
+		var payload gatewayPayload
+		if err := conn.ReadJSON(&payload); err != nil {
+			return
+		}
+		switch payload.Op {
+		case 1:
+			err = send(11, "", nil)
+		case 2:
+			err = fake.identify(send, payload.Data)
+		case 6:
+			err = send(0, "RESUMED", map[string]interface{}{})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (fake *FakeDiscord) identify(send func(int, string, interface{}) error, data json.RawMessage) error {
+	var identify struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(data, &identify); err != nil {
+		return err
+	}
+	n := atomic.AddInt64(&fake.identifies, 1)
+
+	unavailable := make([]map[string]interface{}, 0, len(fake.config.Guilds))
+	for _, guildID := range fake.config.Guilds {
+		unavailable = append(unavailable, map[string]interface{}{"id": guildID, "unavailable": true})
+	}
+	err := send(0, "READY", map[string]interface{}{
+		"v":          6,
+		"user":       fakeUser(identify.Token),
+		"session_id": "fake-session-" + strconv.FormatInt(n, 10),
+		"guilds":     unavailable,
+	})
+	if err != nil {
+		return err
+	}
+	for _, guildID := range fake.config.Guilds {
+		err := send(0, "GUILD_CREATE", map[string]interface{}{
+			"id":           guildID,
+			"name":         "Fake guild " + guildID,
+			"member_count": 0,
+			"members":      []interface{}{},
+			"channels":     []interface{}{},
+			"roles":        []interface{}{},
+			"voice_states": []interface{}{},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
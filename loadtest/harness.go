@@ -0,0 +1,90 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/automuteus/galactus/galactus"
+	"github.com/automuteus/galactus/pkg/client"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/utils/pkg/premium"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// StartupTimeout is how long Start waits for galactus to open its sessions
+const StartupTimeout = time.Minute
+
+// Harness is galactus running in this process against a fake Discord, with its own Redis
+type Harness struct {
+	Discord       *FakeDiscord
+	TokenProvider *galactus.TokenProvider
+	// Client calls the in-process galactus, without retries so they don't hide failures
+	Client *client.Client
+}
+
+// Start points discordgo at the fake Discord and starts galactus with cfg on a free local port, registering
+// secondaryBots fake secondary tokens. cfg's Redis should be one the test can wipe; galactus' other settings, like
+// rate limits and workers, are used as is, so they're what the load test measures
+func Start(ctx context.Context, cfg config.Config, discord *FakeDiscord, secondaryBots int) (*Harness, error) {
+	discord.Install()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	// galactus opens its own listener; there's a small window for another process to take the port
+	listener.Close()
+
+	cfg.BindAddr = "127.0.0.1"
+	tokenProvider := galactus.NewTokenProvider(cfg)
+	go tokenProvider.PopulateAndStartSessions()
+	go tokenProvider.RemoveStaleTokens()
+	go tokenProvider.SuperviseSessions(galactus.DefaultSessionCheckInterval)
+	go tokenProvider.DisconnectGatewaysPeriodically()
+	go tokenProvider.Run(galactus.NewServerConfig(cfg, port))
+
+	galactusClient := client.NewClient("http://127.0.0.1:" + port)
+	galactusClient.MaxRetries = 0
+	harness := &Harness{
+		Discord:       discord,
+		TokenProvider: tokenProvider,
+		Client:        galactusClient,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StartupTimeout)
+	defer cancel()
+	for galactusClient.Health(ctx) != nil {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("galactus didn't start: %w", ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	for i := 0; i < secondaryBots; i++ {
+		if err := galactusClient.AddToken(ctx, "fake-secondary-token-"+strconv.Itoa(i)); err != nil {
+			return nil, fmt.Errorf("registering secondary bot %d: %w", i, err)
+		}
+	}
+	log.Printf("Galactus is running on port %s against a fake Discord at %s, with %d secondary bots\n", port, discord.URL(), secondaryBots)
+	return harness, nil
+}
+
+// SetPremium puts the guilds on a premium tier in their settings, like automuteus does. Galactus gives guilds the
+// secondary bots and quotas of that tier, not of the one modify requests claim
+func (harness *Harness) SetPremium(ctx context.Context, guildIDs []string, tier premium.Tier) error {
+	for _, guildID := range guildIDs {
+		if _, err := harness.Client.SetGuildSettings(ctx, guildID, map[string]premium.Tier{"premium": tier}); err != nil {
+			return fmt.Errorf("setting guild %s's tier: %w", guildID, err)
+		}
+	}
+	return nil
+}
+
+// Close stops galactus' sessions and the fake Discord. The HTTP server keeps running until the process exits
+func (harness *Harness) Close() {
+	harness.TokenProvider.Close()
+	harness.Discord.Close()
+}
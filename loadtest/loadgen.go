@@ -0,0 +1,265 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/client"
+	"github.com/automuteus/galactus/pkg/jobcodec"
+	"github.com/automuteus/utils/pkg/premium"
+	"github.com/automuteus/utils/pkg/rediskey"
+	"github.com/automuteus/utils/pkg/task"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoadConfig is the traffic the load generator sends
+type LoadConfig struct {
+	Duration time.Duration
+	// Concurrency is how many modify requests are in flight at once
+	Concurrency int
+	Guilds      []string
+	// ConnectCode is sent with every modify request, and its job queue is the one driven
+	ConnectCode     string
+	UsersPerRequest int
+	Premium         premium.Tier
+
+	// JobProducers push jobs straight to Redis, like the broker, while JobConsumers pop them through galactus. Without
+	// consumers, the job queue isn't driven
+	JobProducers int
+	JobConsumers int
+}
+
+// LatencyReport summarizes the latency of one kind of call
+type LatencyReport struct {
+	Count     int64         `json:"count"`
+	Errors    int64         `json:"errors"`
+	PerSecond float64       `json:"perSecond"`
+	P50       time.Duration `json:"p50"`
+	P95       time.Duration `json:"p95"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+}
+
+// ErrorRate is the fraction of calls that failed
+func (report LatencyReport) ErrorRate() float64 {
+	if report.Count == 0 {
+		return 0
+	}
+	return float64(report.Errors) / float64(report.Count)
+}
+
+// Report is the outcome of a load test
+type Report struct {
+	Duration time.Duration `json:"duration"`
+	Modify   LatencyReport `json:"modify"`
+	// Methods adds up how the users of every successful modify request were muted
+	Methods task.MuteDeafenSuccessCounts `json:"methods"`
+	// Users counts the users sent in successful modify requests; the ones not in Methods weren't modified at all
+	Users int64 `json:"users"`
+	// JobsPushed is how many jobs the producers queued; Jobs covers the consumers' calls that got one
+	JobsPushed int64         `json:"jobsPushed"`
+	Jobs       LatencyReport `json:"jobs"`
+}
+
+// Thresholds fail a load test, for catching regressions. Zero values aren't checked
+type Thresholds struct {
+	MinModifyPerSecond float64
+	MaxModifyP99       time.Duration
+	MaxErrorRate       float64
+	MinJobsPerSecond   float64
+}
+
+// Check returns an error describing every threshold the report misses
+func (report Report) Check(thresholds Thresholds) error {
+	var failures []string
+	if thresholds.MinModifyPerSecond > 0 && report.Modify.PerSecond < thresholds.MinModifyPerSecond {
+		failures = append(failures, fmt.Sprintf("%.1f modify requests per second, below %.1f", report.Modify.PerSecond, thresholds.MinModifyPerSecond))
+	}
+	if thresholds.MaxModifyP99 > 0 && report.Modify.P99 > thresholds.MaxModifyP99 {
+		failures = append(failures, fmt.Sprintf("modify p99 of %s, above %s", report.Modify.P99, thresholds.MaxModifyP99))
+	}
+	if thresholds.MaxErrorRate > 0 {
+		if rate := report.Modify.ErrorRate(); rate > thresholds.MaxErrorRate {
+			failures = append(failures, fmt.Sprintf("modify error rate of %.3f, above %.3f", rate, thresholds.MaxErrorRate))
+		}
+		if rate := report.Jobs.ErrorRate(); rate > thresholds.MaxErrorRate {
+			failures = append(failures, fmt.Sprintf("job error rate of %.3f, above %.3f", rate, thresholds.MaxErrorRate))
+		}
+	}
+	if thresholds.MinJobsPerSecond > 0 && report.Jobs.PerSecond < thresholds.MinJobsPerSecond {
+		failures = append(failures, fmt.Sprintf("%.1f jobs per second, below %.1f", report.Jobs.PerSecond, thresholds.MinJobsPerSecond))
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	msg := "load test missed its thresholds:"
+	for _, failure := range failures {
+		msg += "\n  " + failure
+	}
+	return errors.New(msg)
+}
+
+// latencies collects the latency of every call of one kind
+type latencies struct {
+	sync.Mutex
+	samples []time.Duration
+	errors  int64
+}
+
+func (l *latencies) record(latency time.Duration, err error) {
+	l.Lock()
+	defer l.Unlock()
+	if err != nil {
+		l.errors++
+		return
+	}
+	l.samples = append(l.samples, latency)
+}
+
+func (l *latencies) report(elapsed time.Duration) LatencyReport {
+	l.Lock()
+	defer l.Unlock()
+	sort.Slice(l.samples, func(i, j int) bool {
+		return l.samples[i] < l.samples[j]
+	})
+	report := LatencyReport{
+		Count:  int64(len(l.samples)) + l.errors,
+		Errors: l.errors,
+	}
+	if elapsed > 0 {
+		report.PerSecond = float64(len(l.samples)) / elapsed.Seconds()
+	}
+	if n := len(l.samples); n > 0 {
+		percentile := func(p float64) time.Duration {
+			return l.samples[int(p*float64(n-1))]
+		}
+		report.P50, report.P95, report.P99 = percentile(0.5), percentile(0.95), percentile(0.99)
+		report.Max = l.samples[n-1]
+	}
+	return report
+}
+
+// Run sends load to galactus until the duration passes or ctx is done. Modify requests go through galactusClient, which
+// should have retries disabled so they don't hide failures. Jobs are pushed with rdb, which can be nil if no job
+// producers are configured
+func Run(ctx context.Context, galactusClient *client.Client, rdb redis.UniversalClient, config LoadConfig) (Report, error) {
+	if len(config.Guilds) == 0 {
+		return Report{}, errors.New("no guilds to send load to")
+	}
+	if config.JobProducers > 0 && rdb == nil {
+		return Report{}, errors.New("job producers need a Redis client")
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+
+	var report Report
+	var reportLock sync.Mutex
+	modify := &latencies{}
+	jobs := &latencies{}
+	encoder := jobcodec.Encoder{Format: jobcodec.JSON}
+	start := time.Now()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+			for ctx.Err() == nil {
+				guildID := config.Guilds[random.Intn(len(config.Guilds))]
+				request := randomModifyRequest(random, config)
+				sent := time.Now()
+				resp, err := galactusClient.ModifyUsers(ctx, guildID, config.ConnectCode, request)
+				if ctx.Err() != nil {
+					// cut off by the end of the test, not a failure
+					return
+				}
+				modify.record(time.Since(sent), err)
+				if err != nil {
+					continue
+				}
+				reportLock.Lock()
+				report.Users += int64(len(request.Users))
+				report.Methods.Worker += resp.Worker
+				report.Methods.Capture += resp.Capture
+				report.Methods.Official += resp.Official
+				report.Methods.RateLimit += resp.RateLimit
+				reportLock.Unlock()
+			}
+		}(i)
+	}
+
+	for i := 0; i < config.JobProducers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				jBytes, err := encoder.Encode(jobcodec.NewQueuedJob(task.StateJob, strconv.FormatInt(time.Now().UnixNano(), 10), time.Now()))
+				if err == nil {
+					err = rdb.RPush(ctx, rediskey.JobNamespace+config.ConnectCode, jBytes).Err()
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Println(err)
+					}
+					return
+				}
+				reportLock.Lock()
+				report.JobsPushed++
+				reportLock.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < config.JobConsumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				sent := time.Now()
+				job, err := galactusClient.RequestJob(ctx, config.ConnectCode)
+				if ctx.Err() != nil {
+					return
+				}
+				if err == nil && job == nil {
+					// the queue is empty; give the producers a moment
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				jobs.record(time.Since(sent), err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	report.Duration = elapsed
+	report.Modify = modify.report(elapsed)
+	report.Jobs = jobs.report(elapsed)
+	return report, nil
+}
+
+// randomModifyRequest mutes or unmutes distinct random users
+func randomModifyRequest(random *rand.Rand, config LoadConfig) task.UserModifyRequest {
+	users := make([]task.UserModify, 0, config.UsersPerRequest)
+	seen := make(map[uint64]bool, config.UsersPerRequest)
+	for len(users) < config.UsersPerRequest {
+		userID := uint64(random.Int63n(1<<62)) + 1
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		users = append(users, task.UserModify{
+			UserID: userID,
+			Mute:   random.Intn(2) == 0,
+			Deaf:   random.Intn(2) == 0,
+		})
+	}
+	return task.UserModifyRequest{Premium: config.Premium, Users: users}
+}
@@ -0,0 +1,90 @@
+package loadtest
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/automuteus/galactus/pkg/config"
+	"github.com/automuteus/galactus/pkg/redisutil"
+	"github.com/automuteus/utils/pkg/premium"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// well below what galactus manages against the fake Discord on a laptop, so only real regressions fail
+var testThresholds = Thresholds{
+	MinModifyPerSecond: 20,
+	MaxModifyP99:       2 * time.Second,
+	MaxErrorRate:       0.01,
+	MinJobsPerSecond:   100,
+}
+
+// TestThroughput runs galactus against the fake Discord and miniredis, like cmd/loadtest does against a real Redis,
+// and fails if it misses testThresholds
+func TestThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the load test takes several seconds")
+	}
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	cfg := config.Config{DiscordBotToken: "fake-primary-token"}
+	cfg.Redis.Addr = mr.Addr()
+	// every call comes from the same address; the consumers polling an empty queue would hit its limits, not galactus'
+	unlimited := 0.0
+	cfg.APIRateLimits = map[string]config.RateLimitConfig{
+		"default": {PerSecond: &unlimited},
+		"modify":  {PerSecond: &unlimited},
+	}
+	// there's no capture client to ack the capture bot's tasks
+	cfg.MuteRouting.Order = []string{"worker", "official"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	guildIDs := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		guildIDs = append(guildIDs, strconv.Itoa(100000000000000000+i))
+	}
+	discord := NewFakeDiscord(FakeDiscordConfig{
+		Guilds:  guildIDs,
+		Latency: 5 * time.Millisecond,
+	})
+	ctx := context.Background()
+	harness, err := Start(ctx, cfg, discord, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer harness.Close()
+	if err := harness.SetPremium(ctx, guildIDs, premium.GoldTier); err != nil {
+		t.Fatal(err)
+	}
+
+	rdb := redisutil.NewClient(cfg.Redis)
+	defer rdb.Close()
+	report, err := Run(ctx, harness.Client, rdb, LoadConfig{
+		Duration:        3 * time.Second,
+		Concurrency:     8,
+		Guilds:          guildIDs,
+		ConnectCode:     "LOADTEST",
+		UsersPerRequest: 5,
+		Premium:         premium.GoldTier,
+		JobProducers:    1,
+		JobConsumers:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d modify requests (%.1f/s, p99 %s), %d jobs (%.1f/s); Discord stats %+v", report.Modify.Count,
+		report.Modify.PerSecond, report.Modify.P99, report.Jobs.Count, report.Jobs.PerSecond, discord.Stats())
+	thresholds := testThresholds
+	if raceEnabled {
+		thresholds.MinModifyPerSecond, thresholds.MinJobsPerSecond = 0, 0
+	}
+	if err := report.Check(thresholds); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package loadtest
+
+// the race detector slows galactus down several times over, so TestThroughput only checks latency and errors under it
+const raceEnabled = true
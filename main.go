@@ -3,70 +3,91 @@ package main
 import (
 	"github.com/automuteus/galactus/broker"
 	"github.com/automuteus/galactus/galactus"
+	"github.com/automuteus/galactus/pkg/config"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 )
 
 const DefaultGalactusPort = "5858"
 const DefaultBrokerPort = "8123"
-const DefaultMaxRequests5Sec int64 = 7
 
-func main() {
-	botToken := os.Getenv("DISCORD_BOT_TOKEN")
-	if botToken == "" {
-		log.Fatal("No DISCORD_BOT_TOKEN specified. Exiting.")
-	}
+// set with -ldflags by the Dockerfile
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
 
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		log.Fatal("No REDIS_ADDR specified. Exiting.")
+func main() {
+	cfg, err := config.Load(os.Getenv("GALACTUS_CONFIG_FILE"))
+	if err != nil {
+		log.Fatal(err.Error() + ". Exiting.")
 	}
 
-	galactusPort := os.Getenv("GALACTUS_PORT")
+	galactusPort := cfg.GalactusPort
 	if galactusPort == "" {
 		log.Println("No GALACTUS_PORT provided. Defaulting to " + DefaultGalactusPort)
 		galactusPort = DefaultGalactusPort
 	}
-	brokerPort := os.Getenv("BROKER_PORT")
+	brokerPort := cfg.BrokerPort
 	if brokerPort == "" {
 		log.Println("No BROKER_PORT provided. Defaulting to " + DefaultBrokerPort)
 		brokerPort = DefaultBrokerPort
 	}
 
-	redisUser := os.Getenv("REDIS_USER")
-	redisPass := os.Getenv("REDIS_PASS")
-	if redisUser != "" {
-		log.Println("Using REDIS_USER=" + redisUser)
-	} else {
-		log.Println("No REDIS_USER specified.")
-	}
-
-	if redisPass != "" {
-		log.Println("Using REDIS_PASS=<redacted>")
-	} else {
-		log.Println("No REDIS_PASS specified.")
-	}
-
-	maxReq5Sec := os.Getenv("MAX_REQ_5_SEC")
-	maxReq := DefaultMaxRequests5Sec
-	num, err := strconv.ParseInt(maxReq5Sec, 10, 64)
-	if err == nil {
-		maxReq = num
-	}
-
-	tp := galactus.NewTokenProvider(botToken, redisAddr, redisUser, redisPass, maxReq)
-	tp.PopulateAndStartSessions()
-	msgBroker := broker.NewBroker(redisAddr, redisUser, redisPass)
+	tp := galactus.NewTokenProvider(cfg)
+	go tp.PopulateAndStartSessions()
+	go tp.CheckPermissionsPeriodically(galactus.PermissionCheckIntervalFromEnv())
+	go tp.ReconcileGuildTokensPeriodically(galactus.GuildTokenReconcileIntervalFromEnv())
+	go tp.RemoveStaleTokens()
+	go tp.SuperviseSessions(galactus.DefaultSessionCheckInterval)
+	go tp.CloseIdleSessions(galactus.IdleSessionCheckInterval)
+	go tp.ExpireGamesPeriodically(galactus.GameExpiryInterval)
+	go tp.DisconnectGatewaysPeriodically()
+	msgBroker := broker.NewBroker(cfg)
+	tp.SetBroker(msgBroker)
 
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP; reloading config")
+			if err := tp.Reload(); err != nil {
+				log.Println("Failed to reload config: " + err.Error())
+			}
+		}
+	}()
+
 	go msgBroker.Start(brokerPort)
 
-	go tp.Run(galactusPort)
+	serverConfig := galactus.NewServerConfig(cfg, galactusPort)
+	serverConfig.BuildInfo = galactus.BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: date,
+	}
+	serverConfig.Features = []string{"redis-" + cfg.Redis.Mode()}
+	if cfg.Redis.TLS {
+		serverConfig.Features = append(serverConfig.Features, "redis-tls")
+	}
+
+	if len(cfg.StandbyBotTokens) > 0 {
+		serverConfig.Features = append(serverConfig.Features, "standby-bots")
+	}
+
+	if cfg.GRPCPort != "" {
+		serverConfig.Features = append(serverConfig.Features, "grpc")
+		go tp.RunGRPC(serverConfig, cfg.BindAddr+":"+cfg.GRPCPort)
+	} else {
+		log.Println("No GALACTUS_GRPC_PORT provided. gRPC service is disabled")
+	}
+
+	go tp.Run(serverConfig)
 	<-sc
 	tp.Close()
 }
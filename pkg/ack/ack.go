@@ -0,0 +1,88 @@
+// Package ack defines the payload published by the broker when a capture bot completes (or fails) a modify task.
+//
+// Older capture bots (and older brokers) only ever send "true" or "false"; Parse accepts those as well as the JSON form.
+package ack
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Code is a stable identifier for why a capture bot couldn't complete a task
+type Code string
+
+const (
+	// UserNotInVoice means the target user isn't connected to voice, so no other method will succeed either
+	UserNotInVoice Code = "USER_NOT_IN_VOICE"
+	// MissingPermissions means the capture bot can't mute/deafen in this guild
+	MissingPermissions Code = "MISSING_PERMISSIONS"
+	// RateLimited means the capture bot was rate-limited by Discord
+	RateLimited Code = "RATE_LIMITED"
+	// Unknown covers legacy "false" acks and any code we don't recognize
+	Unknown Code = "UNKNOWN"
+)
+
+type Ack struct {
+	TaskID  string `json:"taskID,omitempty"`
+	Success bool   `json:"success"`
+	Code    Code   `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Parse reads an ack payload, accepting either the legacy "true"/"false" strings or the JSON form
+func Parse(payload string) Ack {
+	payload = strings.TrimSpace(payload)
+	switch payload {
+	case "true":
+		return Ack{Success: true}
+	case "false":
+		return Ack{Success: false, Code: Unknown}
+	}
+
+	a := Ack{}
+	err := json.Unmarshal([]byte(payload), &a)
+	if err != nil {
+		return Ack{Success: false, Code: Unknown, Message: payload}
+	}
+	if !a.Success {
+		a.Code = a.Code.normalize()
+	}
+	return a
+}
+
+// FromFailure builds a failed ack from a capture bot's "taskFailed" message, which is either a bare task ID (legacy)
+// or a JSON object containing the task ID and a failure code
+func FromFailure(msg string) Ack {
+	msg = strings.TrimSpace(msg)
+	if !strings.HasPrefix(msg, "{") {
+		return Ack{TaskID: msg, Success: false, Code: Unknown}
+	}
+	a := Ack{}
+	err := json.Unmarshal([]byte(msg), &a)
+	if err != nil {
+		return Ack{TaskID: msg, Success: false, Code: Unknown}
+	}
+	a.Success = false
+	a.Code = a.Code.normalize()
+	return a
+}
+
+func (a Ack) Marshal() string {
+	jBytes, err := json.Marshal(a)
+	if err != nil {
+		// Ack only contains strings and bools; this can't realistically fail
+		if a.Success {
+			return "true"
+		}
+		return "false"
+	}
+	return string(jBytes)
+}
+
+func (c Code) normalize() Code {
+	switch c {
+	case UserNotInVoice, MissingPermissions, RateLimited:
+		return c
+	}
+	return Unknown
+}
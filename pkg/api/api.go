@@ -0,0 +1,34 @@
+// Package api has the request and response bodies of the galactus HTTP API, and the headers it reads, so clients can
+// use them without depending on the server
+package api
+
+const (
+	// APIKeyHeader carries the caller's API key
+	APIKeyHeader = "X-API-Key"
+	// RequestIDHeader is propagated from the caller, or assigned, and echoed on every response
+	RequestIDHeader = "X-Request-ID"
+	// IdempotencyKeyHeader makes a retried request replay the first attempt's result instead of running again
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// ErrorCodeIdempotencyKeyInUse is returned while the first request with the same Idempotency-Key is still running
+const ErrorCodeIdempotencyKeyInUse = "IDEMPOTENCY_KEY_IN_USE"
+
+// ErrorResponse is the JSON body returned for errors that aren't specific to one endpoint
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestID,omitempty"`
+	// Fields lists what's wrong with the request body, for VALIDATION_FAILED
+	Fields []FieldError `json:"fields,omitempty"`
+	// LocalizedMessage is Code's message for users, in Locale, if the message catalog has one. Message is only meant for
+	// logs
+	Locale           string `json:"locale,omitempty"`
+	LocalizedMessage string `json:"localizedMessage,omitempty"`
+}
+
+// FieldError is one problem with a request body. Field is its path in the JSON, like "users[2].userID"
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
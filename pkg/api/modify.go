@@ -0,0 +1,77 @@
+package api
+
+import (
+	"github.com/automuteus/galactus/pkg/ack"
+	"github.com/automuteus/utils/pkg/task"
+)
+
+// DryRunQueryParam makes /modify pick a method and bot for each user, taking from the same rate limits, without
+// calling Discord or the capture bot
+const DryRunQueryParam = "dryRun"
+
+// ModifyResponse is returned from /modify. The success counts are embedded so the payload stays compatible with
+// clients that only decode task.MuteDeafenSuccessCounts
+type ModifyResponse struct {
+	task.MuteDeafenSuccessCounts
+	Errors []UserModifyError `json:"errors,omitempty"`
+	// Superseded counts the users that were skipped because a newer request for the guild modifies them too
+	Superseded int64 `json:"superseded,omitempty"`
+	// TimedOut lists the users that weren't modified because the request's deadline passed, or it was cancelled, before
+	// galactus got to them
+	TimedOut []uint64 `json:"timedOut,omitempty"`
+	// DryRun is how each user would have been modified, for requests made with ?dryRun=true
+	DryRun []DryRunUser `json:"dryRun,omitempty"`
+}
+
+// UserModifyError reports a user that couldn't be modified by any method, for automuteus to surface to the guild
+type UserModifyError struct {
+	UserID  uint64   `json:"userID"`
+	Code    ack.Code `json:"code"`
+	Message string   `json:"message,omitempty"`
+	// LocalizedMessage is Code's message for users, in Locale, if the message catalog has one
+	Locale           string `json:"locale,omitempty"`
+	LocalizedMessage string `json:"localizedMessage,omitempty"`
+}
+
+// DryRunUser is how a dry run would have modified a user
+type DryRunUser struct {
+	UserID uint64 `json:"userID"`
+	// Method is worker, capture or official, or empty if every method was passed over
+	Method string `json:"method,omitempty"`
+	// HashedToken is the secondary or standby bot that would have made the call
+	HashedToken string       `json:"hashedToken,omitempty"`
+	Skipped     []DryRunSkip `json:"skipped,omitempty"`
+}
+
+// DryRunSkip is a method a dry run passed over, and why
+type DryRunSkip struct {
+	Method string `json:"method"`
+	Reason string `json:"reason"`
+}
+
+// BatchModifyRequest is the body of /modify/batch: the modifications for several guilds at once, like every game that
+// changed phase at the same moment
+type BatchModifyRequest struct {
+	Requests []GuildModifyRequest `json:"requests"`
+	// MaxDurationMs is the deadline for the whole batch, like /modify's
+	MaxDurationMs int64 `json:"maxDurationMs,omitempty"`
+}
+
+type GuildModifyRequest struct {
+	GuildID     string `json:"guildID"`
+	ConnectCode string `json:"connectCode"`
+	task.UserModifyRequest
+}
+
+// BatchModifyResponse has one result per request, in the same order
+type BatchModifyResponse struct {
+	Results []GuildModifyResult `json:"results"`
+}
+
+// GuildModifyResult is the /modify response for one guild of a batch, or an error if its request was invalid
+type GuildModifyResult struct {
+	GuildID     string `json:"guildID"`
+	ConnectCode string `json:"connectCode"`
+	Error       string `json:"error,omitempty"`
+	ModifyResponse
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// requests signed with the shared secret carry the HMAC-SHA256 of SignaturePayload, in hex, and the unix ms time they
+// were signed at
+const (
+	SignatureHeader          = "X-Galactus-Signature"
+	SignatureTimestampHeader = "X-Galactus-Timestamp"
+)
+
+// SignaturePayload is what a request's signature covers: its method, path with query string, timestamp and body
+func SignaturePayload(method, requestURI string, timestampMs int64, body []byte) []byte {
+	payload := []byte(method + "\n" + requestURI + "\n" + strconv.FormatInt(timestampMs, 10) + "\n")
+	return append(payload, body...)
+}
+
+// Sign returns the hex HMAC-SHA256 signature of a request, for the SignatureHeader
+func Sign(secret []byte, method, requestURI string, timestampMs int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(SignaturePayload(method, requestURI, timestampMs, body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,41 @@
+package api
+
+// the checks made by POST /tokens/verify, in order
+const (
+	TokenCheckBot         = "bot"
+	TokenCheckOwner       = "owner"
+	TokenCheckApplication = "application"
+	TokenCheckGateway     = "gateway"
+	TokenCheckGuilds      = "guilds"
+)
+
+// TokenVerifyRequest is the body of POST /tokens/verify
+type TokenVerifyRequest struct {
+	Token string `json:"token"`
+	// OwnerID is the Discord user who should own the bot's application, directly or as a member of its team. Not
+	// checked if empty
+	OwnerID string `json:"ownerID,omitempty"`
+	// GuildIDs are the guilds the bot is meant to mute in, and it has to be in at least one of them. If empty, any
+	// guild will do
+	GuildIDs []string `json:"guildIDs,omitempty"`
+}
+
+// TokenCheck is one thing verified about a token. Later checks are skipped once one fails
+type TokenCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// TokenVerification reports everything checked about a token, and whether it was added
+type TokenVerification struct {
+	HashedToken string       `json:"hashedToken"`
+	BotID       string       `json:"botID,omitempty"`
+	BotName     string       `json:"botName,omitempty"`
+	Checks      []TokenCheck `json:"checks"`
+	Verified    bool         `json:"verified"`
+	// Guilds are the bot's guilds among the requested ones, or all of them if none were requested
+	Guilds []string `json:"guilds,omitempty"`
+	// Added is false for dry runs, and for tokens that failed a check
+	Added bool `json:"added"`
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// JobsResponse reports how far behind the workers are. Backpressure is set once any connect code's queue reaches the
+// high-water mark, at which point the broker starts dropping low-priority jobs for it
+type JobsResponse struct {
+	Pending      int64 `json:"pending"`
+	Queues       int64 `json:"queues"`
+	HighWater    int64 `json:"highWater"`
+	Backpressure bool  `json:"backpressure"`
+	// connect codes whose queues are at or above the high-water mark
+	Backpressured []string `json:"backpressured,omitempty"`
+	// ByType breaks Pending down by job type, like "lobby" or "state", to show what kind of traffic is backing up
+	ByType map[string]int64 `json:"byType"`
+}
+
+// GatewayEvent is a gateway event queued for the workers. Data is a GuildEvent for guildCreate and
+// guildDelete, and Discord's message for messageCreate
+type GatewayEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	GuildID string `json:"guildID,omitempty"`
+	ShardID int    `json:"shardID"`
+	// unix ms
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+	// Replayed is set on events queued again from an archive by /admin/replay
+	Replayed bool `json:"replayed,omitempty"`
+}
+
+// GuildSettings are the settings automuteus keeps for a guild, like its language and admin roles. Galactus doesn't
+// interpret them; Settings is whatever JSON object the bot stored
+type GuildSettings struct {
+	GuildID   string          `json:"guildID"`
+	Settings  json.RawMessage `json:"settings"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
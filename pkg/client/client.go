@@ -0,0 +1,355 @@
+// Package client is a Go client for the galactus HTTP API
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/api"
+	"github.com/automuteus/utils/pkg/task"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultTimeout = time.Second * 30
+const DefaultMaxRetries = 2
+const DefaultRetryBackoff = time.Millisecond * 250
+
+// sentinels for errors.Is; every *Error matches one of these based on its status code
+var (
+	ErrBadRequest   = errors.New("galactus: bad request")
+	ErrUnauthorized = errors.New("galactus: unauthorized")
+	ErrNotFound     = errors.New("galactus: not found")
+	ErrTooLarge     = errors.New("galactus: request too large")
+	ErrRateLimited  = errors.New("galactus: rate limited")
+	ErrServer       = errors.New("galactus: server error")
+)
+
+// Error is returned for any non-2xx response
+type Error struct {
+	StatusCode int
+	// Code and RequestID are only set if galactus responded with a JSON error body
+	Code      string
+	Message   string
+	RequestID string
+	// RetryAfter is set on rate limited responses
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("galactus: HTTP %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("galactus: HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrTooLarge:
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+func (e *Error) retryable() bool {
+	// a conflicting idempotency key means the first attempt is still running; retrying will replay its result
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500 ||
+		(e.StatusCode == http.StatusConflict && e.Code == api.ErrorCodeIdempotencyKeyInUse)
+}
+
+type Client struct {
+	// BaseURL is where galactus is reachable, like "http://galactus:5858"
+	BaseURL string
+	// APIKey is sent in the X-API-Key header, if set
+	APIKey string
+	// SigningSecret signs every request, if set, for galactus deployments that require request signing
+	SigningSecret string
+	HTTPClient    *http.Client
+
+	// MaxRetries is how many times a request is retried after a network error, 429 or 5xx. Popping jobs and gateway
+	// events is never retried
+	MaxRetries int
+	// RetryBackoff is doubled after every attempt. A Retry-After from galactus takes precedence
+	RetryBackoff time.Duration
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		HTTPClient:   &http.Client{Timeout: DefaultTimeout},
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+	}
+}
+
+// ModifyUsers mutes/deafens users in a guild. connectCode identifies the game, for routing to capture bots
+func (c *Client) ModifyUsers(ctx context.Context, guildID, connectCode string, request task.UserModifyRequest) (*api.ModifyResponse, error) {
+	jBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp := api.ModifyResponse{}
+	path := "/v1/modify/" + url.PathEscape(guildID) + "/" + url.PathEscape(connectCode)
+	err = c.do(ctx, http.MethodPost, path, "application/json", jBytes, idempotencyHeader(), &resp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ModifyUsersBatch applies the modifications for several guilds in one request
+func (c *Client) ModifyUsersBatch(ctx context.Context, batch api.BatchModifyRequest) (*api.BatchModifyResponse, error) {
+	jBytes, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	resp := api.BatchModifyResponse{}
+	err = c.do(ctx, http.MethodPost, "/v1/modify/batch", "application/json", jBytes, idempotencyHeader(), &resp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AddToken registers a secondary bot token with galactus
+func (c *Client) AddToken(ctx context.Context, botToken string) error {
+	return c.do(ctx, http.MethodPost, "/v1/addtoken", "text/plain", []byte(botToken), nil, nil, nil)
+}
+
+// VerifyToken checks a secondary bot token's owner, intents and guilds, then adds it unless dryRun is set. If a check
+// failed, the report is returned along with an error that matches ErrBadRequest
+func (c *Client) VerifyToken(ctx context.Context, request api.TokenVerifyRequest, dryRun bool) (*api.TokenVerification, error) {
+	jBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	path := "/v1/tokens/verify"
+	if dryRun {
+		path += "?" + api.DryRunQueryParam + "=true"
+	}
+	resp := api.TokenVerification{}
+	err = c.do(ctx, http.MethodPost, path, "application/json", jBytes, nil, &resp, nil)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnprocessableEntity && apiErr.Code == "" {
+		// the report is the body, rather than an error response
+		if json.Unmarshal([]byte(apiErr.Message), &resp) == nil {
+			return &resp, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RequestJob pops the next queued job for a connect code, returning nil if there are none. It's never retried, since
+// the job may have been popped by an attempt whose response was lost
+func (c *Client) RequestJob(ctx context.Context, connectCode string) (*task.Job, error) {
+	job := task.Job{}
+	found := false
+	err := c.doAttempts(ctx, 0, http.MethodPost, "/v1/request/job/"+url.PathEscape(connectCode), "", nil, nil, &job, &found)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// JobCount returns how many jobs are queued for a connect code
+func (c *Client) JobCount(ctx context.Context, connectCode string) (int64, error) {
+	resp := api.JobsResponse{}
+	err := c.do(ctx, http.MethodGet, "/v1/jobs?connectCode="+url.QueryEscape(connectCode), "", nil, nil, &resp, nil)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Pending, nil
+}
+
+// RequestGatewayEvent pops the oldest forwarded gateway event, returning nil if there are none. Like RequestJob, it's
+// never retried
+func (c *Client) RequestGatewayEvent(ctx context.Context) (*api.GatewayEvent, error) {
+	event := api.GatewayEvent{}
+	found := false
+	err := c.doAttempts(ctx, 0, http.MethodPost, "/v1/request/gateway-event", "", nil, nil, &event, &found)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// GuildSettings returns a guild's settings, or nil if it has none. Galactus caches them, so workers can call this
+// instead of reading storage themselves
+func (c *Client) GuildSettings(ctx context.Context, guildID string) (*api.GuildSettings, error) {
+	settings := api.GuildSettings{}
+	err := c.do(ctx, http.MethodGet, "/v1/guild/"+url.PathEscape(guildID)+"/settings", "", nil, nil, &settings, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SetGuildSettings replaces a guild's settings with settings, which must marshal to a JSON object
+func (c *Client) SetGuildSettings(ctx context.Context, guildID string, settings interface{}) (*api.GuildSettings, error) {
+	jBytes, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	resp := api.GuildSettings{}
+	err = c.do(ctx, http.MethodPut, "/v1/guild/"+url.PathEscape(guildID)+"/settings", "application/json", jBytes, nil, &resp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Health returns nil if galactus is up
+func (c *Client) Health(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/v1/", "", nil, nil, nil, nil)
+}
+
+// do performs the request with up to MaxRetries retries, decoding a JSON response into out if it's non-nil. If found is
+// non-nil, it's set to whether the response had a body
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte, header http.Header, out interface{}, found *bool) error {
+	return c.doAttempts(ctx, c.MaxRetries, method, path, contentType, body, header, out, found)
+}
+
+// doAttempts is do with its own number of retries, for requests that aren't safe to repeat
+func (c *Client) doAttempts(ctx context.Context, maxRetries int, method, path, contentType string, body []byte, header http.Header, out interface{}, found *bool) error {
+	backoff := c.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var respBody []byte
+		respBody, err = c.attempt(ctx, method, path, contentType, body, header)
+		if err == nil {
+			if found != nil {
+				*found = len(respBody) > 0
+			}
+			if out != nil && len(respBody) > 0 {
+				return json.Unmarshal(respBody, out)
+			}
+			return nil
+		}
+		if attempt >= maxRetries || !retryable(err) {
+			return err
+		}
+
+		wait := backoff
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			wait = apiErr.RetryAfter
+		}
+		backoff *= 2
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path, contentType string, body []byte, header http.Header) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.APIKey != "" {
+		req.Header.Set(api.APIKeyHeader, c.APIKey)
+	}
+	if c.SigningSecret != "" {
+		// signed on every attempt, since galactus rejects a signature it has already seen
+		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+		req.Header.Set(api.SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(api.SignatureHeader, api.Sign([]byte(c.SigningSecret), method, req.URL.RequestURI(), timestamp, body))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return respBody, nil
+	}
+	return nil, newError(resp, respBody)
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+	errResp := api.ErrorResponse{}
+	if json.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+		e.Code = errResp.Code
+		e.Message = errResp.Message
+		e.RequestID = errResp.RequestID
+	}
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get(api.RequestIDHeader)
+	}
+	if secs, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// idempotencyHeader makes retries of a modify request safe; galactus replays the first attempt's result instead of
+// toggling the users twice
+func idempotencyHeader() http.Header {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil
+	}
+	header := http.Header{}
+	header.Set(api.IdempotencyKeyHeader, hex.EncodeToString(b))
+	return header
+}
+
+// network errors are retried, unless the context itself is done
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.retryable()
+	}
+	return true
+}
@@ -0,0 +1,763 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        (unknown)
+// source: galactus/v1/galactus.proto
+
+package galactuspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type UserModify struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	UserId uint64 `protobuf:"varint,1,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	Mute   bool   `protobuf:"varint,2,opt,name=mute,proto3" json:"mute,omitempty"`
+	Deaf   bool   `protobuf:"varint,3,opt,name=deaf,proto3" json:"deaf,omitempty"`
+}
+
+func (x *UserModify) Reset() {
+	*x = UserModify{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UserModify) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UserModify) ProtoMessage() {}
+
+func (x *UserModify) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UserModify.ProtoReflect.Descriptor instead.
+func (*UserModify) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *UserModify) GetUserId() uint64 {
+	if x != nil {
+		return x.UserId
+	}
+	return 0
+}
+
+func (x *UserModify) GetMute() bool {
+	if x != nil {
+		return x.Mute
+	}
+	return false
+}
+
+func (x *UserModify) GetDeaf() bool {
+	if x != nil {
+		return x.Deaf
+	}
+	return false
+}
+
+type ModifyUsersRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	GuildId     string        `protobuf:"bytes,1,opt,name=guild_id,json=guildId,proto3" json:"guild_id,omitempty"`
+	ConnectCode string        `protobuf:"bytes,2,opt,name=connect_code,json=connectCode,proto3" json:"connect_code,omitempty"`
+	Premium     int32         `protobuf:"varint,3,opt,name=premium,proto3" json:"premium,omitempty"`
+	Users       []*UserModify `protobuf:"bytes,4,rep,name=users,proto3" json:"users,omitempty"`
+}
+
+func (x *ModifyUsersRequest) Reset() {
+	*x = ModifyUsersRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ModifyUsersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ModifyUsersRequest) ProtoMessage() {}
+
+func (x *ModifyUsersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ModifyUsersRequest.ProtoReflect.Descriptor instead.
+func (*ModifyUsersRequest) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ModifyUsersRequest) GetGuildId() string {
+	if x != nil {
+		return x.GuildId
+	}
+	return ""
+}
+
+func (x *ModifyUsersRequest) GetConnectCode() string {
+	if x != nil {
+		return x.ConnectCode
+	}
+	return ""
+}
+
+func (x *ModifyUsersRequest) GetPremium() int32 {
+	if x != nil {
+		return x.Premium
+	}
+	return 0
+}
+
+func (x *ModifyUsersRequest) GetUsers() []*UserModify {
+	if x != nil {
+		return x.Users
+	}
+	return nil
+}
+
+type UserModifyError struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	UserId  uint64 `protobuf:"varint,1,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	Code    string `protobuf:"bytes,2,opt,name=code,proto3" json:"code,omitempty"`
+	Message string `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+}
+
+func (x *UserModifyError) Reset() {
+	*x = UserModifyError{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UserModifyError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UserModifyError) ProtoMessage() {}
+
+func (x *UserModifyError) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UserModifyError.ProtoReflect.Descriptor instead.
+func (*UserModifyError) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *UserModifyError) GetUserId() uint64 {
+	if x != nil {
+		return x.UserId
+	}
+	return 0
+}
+
+func (x *UserModifyError) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *UserModifyError) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type ModifyUsersResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Worker    int64              `protobuf:"varint,1,opt,name=worker,proto3" json:"worker,omitempty"`
+	Capture   int64              `protobuf:"varint,2,opt,name=capture,proto3" json:"capture,omitempty"`
+	Official  int64              `protobuf:"varint,3,opt,name=official,proto3" json:"official,omitempty"`
+	RateLimit int64              `protobuf:"varint,4,opt,name=rate_limit,json=rateLimit,proto3" json:"rate_limit,omitempty"`
+	Errors    []*UserModifyError `protobuf:"bytes,5,rep,name=errors,proto3" json:"errors,omitempty"`
+	// users skipped because a newer request for the guild modifies them too
+	Superseded int64 `protobuf:"varint,6,opt,name=superseded,proto3" json:"superseded,omitempty"`
+	// users that weren't modified because the call's deadline passed first
+	TimedOut []uint64 `protobuf:"varint,7,rep,packed,name=timed_out,json=timedOut,proto3" json:"timed_out,omitempty"`
+}
+
+func (x *ModifyUsersResponse) Reset() {
+	*x = ModifyUsersResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ModifyUsersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ModifyUsersResponse) ProtoMessage() {}
+
+func (x *ModifyUsersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ModifyUsersResponse.ProtoReflect.Descriptor instead.
+func (*ModifyUsersResponse) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ModifyUsersResponse) GetWorker() int64 {
+	if x != nil {
+		return x.Worker
+	}
+	return 0
+}
+
+func (x *ModifyUsersResponse) GetCapture() int64 {
+	if x != nil {
+		return x.Capture
+	}
+	return 0
+}
+
+func (x *ModifyUsersResponse) GetOfficial() int64 {
+	if x != nil {
+		return x.Official
+	}
+	return 0
+}
+
+func (x *ModifyUsersResponse) GetRateLimit() int64 {
+	if x != nil {
+		return x.RateLimit
+	}
+	return 0
+}
+
+func (x *ModifyUsersResponse) GetErrors() []*UserModifyError {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+func (x *ModifyUsersResponse) GetSuperseded() int64 {
+	if x != nil {
+		return x.Superseded
+	}
+	return 0
+}
+
+func (x *ModifyUsersResponse) GetTimedOut() []uint64 {
+	if x != nil {
+		return x.TimedOut
+	}
+	return nil
+}
+
+type Job struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// matches task.JobType
+	Type    int32  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
+	Payload string `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	// unix milliseconds when the broker queued the job; 0 for jobs queued by older brokers
+	EnqueuedAt int64 `protobuf:"varint,3,opt,name=enqueued_at,json=enqueuedAt,proto3" json:"enqueued_at,omitempty"`
+}
+
+func (x *Job) Reset() {
+	*x = Job{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Job) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Job) ProtoMessage() {}
+
+func (x *Job) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Job.ProtoReflect.Descriptor instead.
+func (*Job) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Job) GetType() int32 {
+	if x != nil {
+		return x.Type
+	}
+	return 0
+}
+
+func (x *Job) GetPayload() string {
+	if x != nil {
+		return x.Payload
+	}
+	return ""
+}
+
+func (x *Job) GetEnqueuedAt() int64 {
+	if x != nil {
+		return x.EnqueuedAt
+	}
+	return 0
+}
+
+type PopJobRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ConnectCode string `protobuf:"bytes,1,opt,name=connect_code,json=connectCode,proto3" json:"connect_code,omitempty"`
+}
+
+func (x *PopJobRequest) Reset() {
+	*x = PopJobRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PopJobRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PopJobRequest) ProtoMessage() {}
+
+func (x *PopJobRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PopJobRequest.ProtoReflect.Descriptor instead.
+func (*PopJobRequest) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PopJobRequest) GetConnectCode() string {
+	if x != nil {
+		return x.ConnectCode
+	}
+	return ""
+}
+
+type PopJobResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// unset if there are no queued jobs
+	Job *Job `protobuf:"bytes,1,opt,name=job,proto3" json:"job,omitempty"`
+}
+
+func (x *PopJobResponse) Reset() {
+	*x = PopJobResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PopJobResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PopJobResponse) ProtoMessage() {}
+
+func (x *PopJobResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PopJobResponse.ProtoReflect.Descriptor instead.
+func (*PopJobResponse) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PopJobResponse) GetJob() *Job {
+	if x != nil {
+		return x.Job
+	}
+	return nil
+}
+
+type SubscribeJobsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ConnectCode string `protobuf:"bytes,1,opt,name=connect_code,json=connectCode,proto3" json:"connect_code,omitempty"`
+}
+
+func (x *SubscribeJobsRequest) Reset() {
+	*x = SubscribeJobsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_galactus_v1_galactus_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeJobsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeJobsRequest) ProtoMessage() {}
+
+func (x *SubscribeJobsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_galactus_v1_galactus_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeJobsRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeJobsRequest) Descriptor() ([]byte, []int) {
+	return file_galactus_v1_galactus_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SubscribeJobsRequest) GetConnectCode() string {
+	if x != nil {
+		return x.ConnectCode
+	}
+	return ""
+}
+
+var File_galactus_v1_galactus_proto protoreflect.FileDescriptor
+
+var file_galactus_v1_galactus_proto_rawDesc = []byte{
+	0x0a, 0x1a, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2f, 0x76, 0x31, 0x2f, 0x67, 0x61,
+	0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0b, 0x67, 0x61,
+	0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x22, 0x4d, 0x0a, 0x0a, 0x55, 0x73, 0x65,
+	0x72, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x79, 0x12, 0x17, 0x0a, 0x07, 0x75, 0x73, 0x65, 0x72, 0x5f,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x75, 0x73, 0x65, 0x72, 0x49, 0x64,
+	0x12, 0x12, 0x0a, 0x04, 0x6d, 0x75, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04,
+	0x6d, 0x75, 0x74, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x65, 0x61, 0x66, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x04, 0x64, 0x65, 0x61, 0x66, 0x22, 0x9b, 0x01, 0x0a, 0x12, 0x4d, 0x6f, 0x64,
+	0x69, 0x66, 0x79, 0x55, 0x73, 0x65, 0x72, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x19, 0x0a, 0x08, 0x67, 0x75, 0x69, 0x6c, 0x64, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x07, 0x67, 0x75, 0x69, 0x6c, 0x64, 0x49, 0x64, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f,
+	0x6e, 0x6e, 0x65, 0x63, 0x74, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0b, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x18, 0x0a,
+	0x07, 0x70, 0x72, 0x65, 0x6d, 0x69, 0x75, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07,
+	0x70, 0x72, 0x65, 0x6d, 0x69, 0x75, 0x6d, 0x12, 0x2d, 0x0a, 0x05, 0x75, 0x73, 0x65, 0x72, 0x73,
+	0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75,
+	0x73, 0x2e, 0x76, 0x31, 0x2e, 0x55, 0x73, 0x65, 0x72, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x79, 0x52,
+	0x05, 0x75, 0x73, 0x65, 0x72, 0x73, 0x22, 0x58, 0x0a, 0x0f, 0x55, 0x73, 0x65, 0x72, 0x4d, 0x6f,
+	0x64, 0x69, 0x66, 0x79, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x17, 0x0a, 0x07, 0x75, 0x73, 0x65,
+	0x72, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x75, 0x73, 0x65, 0x72,
+	0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x22, 0xf5, 0x01, 0x0a, 0x13, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x79, 0x55, 0x73, 0x65, 0x72, 0x73,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x6f, 0x72, 0x6b,
+	0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x77, 0x6f, 0x72, 0x6b, 0x65, 0x72,
+	0x12, 0x18, 0x0a, 0x07, 0x63, 0x61, 0x70, 0x74, 0x75, 0x72, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x07, 0x63, 0x61, 0x70, 0x74, 0x75, 0x72, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x6f, 0x66,
+	0x66, 0x69, 0x63, 0x69, 0x61, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x6f, 0x66,
+	0x66, 0x69, 0x63, 0x69, 0x61, 0x6c, 0x12, 0x1d, 0x0a, 0x0a, 0x72, 0x61, 0x74, 0x65, 0x5f, 0x6c,
+	0x69, 0x6d, 0x69, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x72, 0x61, 0x74, 0x65,
+	0x4c, 0x69, 0x6d, 0x69, 0x74, 0x12, 0x34, 0x0a, 0x06, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x18,
+	0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1c, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73,
+	0x2e, 0x76, 0x31, 0x2e, 0x55, 0x73, 0x65, 0x72, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x79, 0x45, 0x72,
+	0x72, 0x6f, 0x72, 0x52, 0x06, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x73,
+	0x75, 0x70, 0x65, 0x72, 0x73, 0x65, 0x64, 0x65, 0x64, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x0a, 0x73, 0x75, 0x70, 0x65, 0x72, 0x73, 0x65, 0x64, 0x65, 0x64, 0x12, 0x1b, 0x0a, 0x09, 0x74,
+	0x69, 0x6d, 0x65, 0x64, 0x5f, 0x6f, 0x75, 0x74, 0x18, 0x07, 0x20, 0x03, 0x28, 0x04, 0x52, 0x08,
+	0x74, 0x69, 0x6d, 0x65, 0x64, 0x4f, 0x75, 0x74, 0x22, 0x54, 0x0a, 0x03, 0x4a, 0x6f, 0x62, 0x12,
+	0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x74,
+	0x79, 0x70, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x1f, 0x0a,
+	0x0b, 0x65, 0x6e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0a, 0x65, 0x6e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x64, 0x41, 0x74, 0x22, 0x32,
+	0x0a, 0x0d, 0x50, 0x6f, 0x70, 0x4a, 0x6f, 0x62, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x43, 0x6f,
+	0x64, 0x65, 0x22, 0x34, 0x0a, 0x0e, 0x50, 0x6f, 0x70, 0x4a, 0x6f, 0x62, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x22, 0x0a, 0x03, 0x6a, 0x6f, 0x62, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x10, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x2e,
+	0x4a, 0x6f, 0x62, 0x52, 0x03, 0x6a, 0x6f, 0x62, 0x22, 0x39, 0x0a, 0x14, 0x53, 0x75, 0x62, 0x73,
+	0x63, 0x72, 0x69, 0x62, 0x65, 0x4a, 0x6f, 0x62, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x5f, 0x63, 0x6f, 0x64, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x43,
+	0x6f, 0x64, 0x65, 0x32, 0xe7, 0x01, 0x0a, 0x08, 0x47, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73,
+	0x12, 0x50, 0x0a, 0x0b, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x79, 0x55, 0x73, 0x65, 0x72, 0x73, 0x12,
+	0x1f, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4d, 0x6f,
+	0x64, 0x69, 0x66, 0x79, 0x55, 0x73, 0x65, 0x72, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x20, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4d,
+	0x6f, 0x64, 0x69, 0x66, 0x79, 0x55, 0x73, 0x65, 0x72, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x41, 0x0a, 0x06, 0x50, 0x6f, 0x70, 0x4a, 0x6f, 0x62, 0x12, 0x1a, 0x2e, 0x67,
+	0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6f, 0x70, 0x4a, 0x6f,
+	0x62, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63,
+	0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6f, 0x70, 0x4a, 0x6f, 0x62, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x46, 0x0a, 0x0d, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69,
+	0x62, 0x65, 0x4a, 0x6f, 0x62, 0x73, 0x12, 0x21, 0x2e, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75,
+	0x73, 0x2e, 0x76, 0x31, 0x2e, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x4a, 0x6f,
+	0x62, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x10, 0x2e, 0x67, 0x61, 0x6c, 0x61,
+	0x63, 0x74, 0x75, 0x73, 0x2e, 0x76, 0x31, 0x2e, 0x4a, 0x6f, 0x62, 0x30, 0x01, 0x42, 0x2f, 0x5a,
+	0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x61, 0x75, 0x74, 0x6f,
+	0x6d, 0x75, 0x74, 0x65, 0x75, 0x73, 0x2f, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x2f,
+	0x70, 0x6b, 0x67, 0x2f, 0x67, 0x61, 0x6c, 0x61, 0x63, 0x74, 0x75, 0x73, 0x70, 0x62, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_galactus_v1_galactus_proto_rawDescOnce sync.Once
+	file_galactus_v1_galactus_proto_rawDescData = file_galactus_v1_galactus_proto_rawDesc
+)
+
+func file_galactus_v1_galactus_proto_rawDescGZIP() []byte {
+	file_galactus_v1_galactus_proto_rawDescOnce.Do(func() {
+		file_galactus_v1_galactus_proto_rawDescData = protoimpl.X.CompressGZIP(file_galactus_v1_galactus_proto_rawDescData)
+	})
+	return file_galactus_v1_galactus_proto_rawDescData
+}
+
+var file_galactus_v1_galactus_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_galactus_v1_galactus_proto_goTypes = []interface{}{
+	(*UserModify)(nil),           // 0: galactus.v1.UserModify
+	(*ModifyUsersRequest)(nil),   // 1: galactus.v1.ModifyUsersRequest
+	(*UserModifyError)(nil),      // 2: galactus.v1.UserModifyError
+	(*ModifyUsersResponse)(nil),  // 3: galactus.v1.ModifyUsersResponse
+	(*Job)(nil),                  // 4: galactus.v1.Job
+	(*PopJobRequest)(nil),        // 5: galactus.v1.PopJobRequest
+	(*PopJobResponse)(nil),       // 6: galactus.v1.PopJobResponse
+	(*SubscribeJobsRequest)(nil), // 7: galactus.v1.SubscribeJobsRequest
+}
+var file_galactus_v1_galactus_proto_depIdxs = []int32{
+	0, // 0: galactus.v1.ModifyUsersRequest.users:type_name -> galactus.v1.UserModify
+	2, // 1: galactus.v1.ModifyUsersResponse.errors:type_name -> galactus.v1.UserModifyError
+	4, // 2: galactus.v1.PopJobResponse.job:type_name -> galactus.v1.Job
+	1, // 3: galactus.v1.Galactus.ModifyUsers:input_type -> galactus.v1.ModifyUsersRequest
+	5, // 4: galactus.v1.Galactus.PopJob:input_type -> galactus.v1.PopJobRequest
+	7, // 5: galactus.v1.Galactus.SubscribeJobs:input_type -> galactus.v1.SubscribeJobsRequest
+	3, // 6: galactus.v1.Galactus.ModifyUsers:output_type -> galactus.v1.ModifyUsersResponse
+	6, // 7: galactus.v1.Galactus.PopJob:output_type -> galactus.v1.PopJobResponse
+	4, // 8: galactus.v1.Galactus.SubscribeJobs:output_type -> galactus.v1.Job
+	6, // [6:9] is the sub-list for method output_type
+	3, // [3:6] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_galactus_v1_galactus_proto_init() }
+func file_galactus_v1_galactus_proto_init() {
+	if File_galactus_v1_galactus_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_galactus_v1_galactus_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UserModify); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ModifyUsersRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UserModifyError); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ModifyUsersResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Job); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PopJobRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PopJobResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_galactus_v1_galactus_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeJobsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_galactus_v1_galactus_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_galactus_v1_galactus_proto_goTypes,
+		DependencyIndexes: file_galactus_v1_galactus_proto_depIdxs,
+		MessageInfos:      file_galactus_v1_galactus_proto_msgTypes,
+	}.Build()
+	File_galactus_v1_galactus_proto = out.File
+	file_galactus_v1_galactus_proto_rawDesc = nil
+	file_galactus_v1_galactus_proto_goTypes = nil
+	file_galactus_v1_galactus_proto_depIdxs = nil
+}
@@ -0,0 +1,205 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package galactuspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// GalactusClient is the client API for Galactus service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type GalactusClient interface {
+	// ModifyUsers mutes/deafens users in a guild, like POST /v1/modify/{guildID}/{connectCode}
+	ModifyUsers(ctx context.Context, in *ModifyUsersRequest, opts ...grpc.CallOption) (*ModifyUsersResponse, error)
+	// PopJob pops the next job for a connect code, like POST /v1/request/job/{connectCode}
+	PopJob(ctx context.Context, in *PopJobRequest, opts ...grpc.CallOption) (*PopJobResponse, error)
+	// SubscribeJobs streams jobs for a connect code as they are queued. Each job is delivered to exactly one subscriber
+	// (or HTTP/PopJob caller).
+	SubscribeJobs(ctx context.Context, in *SubscribeJobsRequest, opts ...grpc.CallOption) (Galactus_SubscribeJobsClient, error)
+}
+
+type galactusClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGalactusClient(cc grpc.ClientConnInterface) GalactusClient {
+	return &galactusClient{cc}
+}
+
+func (c *galactusClient) ModifyUsers(ctx context.Context, in *ModifyUsersRequest, opts ...grpc.CallOption) (*ModifyUsersResponse, error) {
+	out := new(ModifyUsersResponse)
+	err := c.cc.Invoke(ctx, "/galactus.v1.Galactus/ModifyUsers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *galactusClient) PopJob(ctx context.Context, in *PopJobRequest, opts ...grpc.CallOption) (*PopJobResponse, error) {
+	out := new(PopJobResponse)
+	err := c.cc.Invoke(ctx, "/galactus.v1.Galactus/PopJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *galactusClient) SubscribeJobs(ctx context.Context, in *SubscribeJobsRequest, opts ...grpc.CallOption) (Galactus_SubscribeJobsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Galactus_serviceDesc.Streams[0], "/galactus.v1.Galactus/SubscribeJobs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &galactusSubscribeJobsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Galactus_SubscribeJobsClient interface {
+	Recv() (*Job, error)
+	grpc.ClientStream
+}
+
+type galactusSubscribeJobsClient struct {
+	grpc.ClientStream
+}
+
+func (x *galactusSubscribeJobsClient) Recv() (*Job, error) {
+	m := new(Job)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GalactusServer is the server API for Galactus service.
+// All implementations must embed UnimplementedGalactusServer
+// for forward compatibility
+type GalactusServer interface {
+	// ModifyUsers mutes/deafens users in a guild, like POST /v1/modify/{guildID}/{connectCode}
+	ModifyUsers(context.Context, *ModifyUsersRequest) (*ModifyUsersResponse, error)
+	// PopJob pops the next job for a connect code, like POST /v1/request/job/{connectCode}
+	PopJob(context.Context, *PopJobRequest) (*PopJobResponse, error)
+	// SubscribeJobs streams jobs for a connect code as they are queued. Each job is delivered to exactly one subscriber
+	// (or HTTP/PopJob caller).
+	SubscribeJobs(*SubscribeJobsRequest, Galactus_SubscribeJobsServer) error
+	mustEmbedUnimplementedGalactusServer()
+}
+
+// UnimplementedGalactusServer must be embedded to have forward compatible implementations.
+type UnimplementedGalactusServer struct {
+}
+
+func (UnimplementedGalactusServer) ModifyUsers(context.Context, *ModifyUsersRequest) (*ModifyUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ModifyUsers not implemented")
+}
+func (UnimplementedGalactusServer) PopJob(context.Context, *PopJobRequest) (*PopJobResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PopJob not implemented")
+}
+func (UnimplementedGalactusServer) SubscribeJobs(*SubscribeJobsRequest, Galactus_SubscribeJobsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeJobs not implemented")
+}
+func (UnimplementedGalactusServer) mustEmbedUnimplementedGalactusServer() {}
+
+// UnsafeGalactusServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GalactusServer will
+// result in compilation errors.
+type UnsafeGalactusServer interface {
+	mustEmbedUnimplementedGalactusServer()
+}
+
+func RegisterGalactusServer(s grpc.ServiceRegistrar, srv GalactusServer) {
+	s.RegisterService(&_Galactus_serviceDesc, srv)
+}
+
+func _Galactus_ModifyUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ModifyUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GalactusServer).ModifyUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/galactus.v1.Galactus/ModifyUsers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GalactusServer).ModifyUsers(ctx, req.(*ModifyUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Galactus_PopJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PopJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GalactusServer).PopJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/galactus.v1.Galactus/PopJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GalactusServer).PopJob(ctx, req.(*PopJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Galactus_SubscribeJobs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeJobsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GalactusServer).SubscribeJobs(m, &galactusSubscribeJobsServer{stream})
+}
+
+type Galactus_SubscribeJobsServer interface {
+	Send(*Job) error
+	grpc.ServerStream
+}
+
+type galactusSubscribeJobsServer struct {
+	grpc.ServerStream
+}
+
+func (x *galactusSubscribeJobsServer) Send(m *Job) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Galactus_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "galactus.v1.Galactus",
+	HandlerType: (*GalactusServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ModifyUsers",
+			Handler:    _Galactus_ModifyUsers_Handler,
+		},
+		{
+			MethodName: "PopJob",
+			Handler:    _Galactus_PopJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubscribeJobs",
+			Handler:       _Galactus_SubscribeJobs_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "galactus/v1/galactus.proto",
+}
@@ -0,0 +1,224 @@
+// Package jobcodec encodes the jobs galactus queues in Redis for automuteus workers.
+//
+// Legacy jobs are plain JSON, exactly as written by task.PushJob, and always start with '{'. Any other encoding starts
+// with a header byte identifying the format, and whether the rest is gzipped, so a queue can hold a mix of encodings
+// while deployments migrate.
+package jobcodec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/automuteus/galactus/pkg/galactuspb"
+	"github.com/automuteus/utils/pkg/task"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strings"
+	"time"
+)
+
+type Format byte
+
+const (
+	// JSON is the legacy format, readable by any automuteus worker
+	JSON Format = 0
+	// Protobuf encodes the job as a galactuspb.Job, prefixed with the header byte
+	Protobuf Format = 1
+)
+
+// header bytes can't collide with the '{' that starts every legacy job. The low bits hold the Format, and the high bit
+// is set if the remainder is gzipped
+const protobufHeader byte = 0x01
+const gzipFlag byte = 0x80
+
+var ErrUnknownFormat = errors.New("unknown job encoding")
+
+func ParseFormat(str string) (Format, error) {
+	switch strings.ToLower(str) {
+	case "", "json":
+		return JSON, nil
+	case "protobuf", "proto":
+		return Protobuf, nil
+	}
+	return JSON, fmt.Errorf("%w: %s", ErrUnknownFormat, str)
+}
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case Protobuf:
+		return "protobuf"
+	}
+	return "unknown"
+}
+
+// QueuedJob is a task.Job stamped with when it was queued. Legacy workers decoding it as a task.Job ignore the stamp
+type QueuedJob struct {
+	task.Job
+	// EnqueuedAt is in unix milliseconds; 0 for jobs queued before jobs were stamped
+	EnqueuedAt int64 `json:"enqueuedAt,omitempty"`
+}
+
+func NewQueuedJob(jobType task.JobType, payload string, enqueuedAt time.Time) QueuedJob {
+	return QueuedJob{
+		Job: task.Job{
+			JobType: jobType,
+			Payload: payload,
+		},
+		EnqueuedAt: enqueuedAt.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// Age is how long the job has been queued, or 0 if it wasn't stamped
+func (job QueuedJob) Age(now time.Time) time.Duration {
+	if job.EnqueuedAt == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, job.EnqueuedAt*int64(time.Millisecond)))
+}
+
+type Encoder struct {
+	Format Format
+	// CompressThreshold is the encoded size in bytes above which jobs are gzipped. 0 disables compression
+	CompressThreshold int
+}
+
+func (e Encoder) Encode(job QueuedJob) ([]byte, error) {
+	var header byte
+	var body []byte
+	var err error
+	switch e.Format {
+	case JSON:
+		body, err = json.Marshal(job)
+	case Protobuf:
+		header = protobufHeader
+		body, err = proto.Marshal(ToProto(job))
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if e.CompressThreshold > 0 && len(body) > e.CompressThreshold {
+		buf := bytes.Buffer{}
+		buf.WriteByte(header | gzipFlag)
+		zw := gzip.NewWriter(&buf)
+		_, err = zw.Write(body)
+		if err != nil {
+			return nil, err
+		}
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	if e.Format == JSON {
+		// uncompressed JSON is written without a header, so legacy workers can still read it
+		return body, nil
+	}
+	return append([]byte{header}, body...), nil
+}
+
+// Decode reads a job in any format written by Encode
+func Decode(data []byte) (QueuedJob, error) {
+	job := QueuedJob{}
+	if len(data) == 0 {
+		return job, ErrUnknownFormat
+	}
+	if data[0] == '{' {
+		err := json.Unmarshal(data, &job)
+		return job, err
+	}
+
+	header := data[0]
+	body := data[1:]
+	if header&gzipFlag != 0 {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return job, err
+		}
+		body, err = io.ReadAll(zr)
+		if err != nil {
+			return job, err
+		}
+		header &^= gzipFlag
+	}
+
+	switch Format(header) {
+	case JSON:
+		err := json.Unmarshal(body, &job)
+		return job, err
+	case Protobuf:
+		pb := galactuspb.Job{}
+		err := proto.Unmarshal(body, &pb)
+		if err != nil {
+			return job, err
+		}
+		return FromProto(&pb), nil
+	}
+	return job, ErrUnknownFormat
+}
+
+// TypeName names a job type for metrics and reports
+func TypeName(jobType task.JobType) string {
+	switch jobType {
+	case task.ConnectionJob:
+		return "connection"
+	case task.LobbyJob:
+		return "lobby"
+	case task.StateJob:
+		return "state"
+	case task.PlayerJob:
+		return "player"
+	case task.GameOverJob:
+		return "gameover"
+	}
+	return "unknown"
+}
+
+// ParseType is the inverse of TypeName
+func ParseType(name string) (task.JobType, bool) {
+	for jobType := task.ConnectionJob; jobType <= task.GameOverJob; jobType++ {
+		if TypeName(jobType) == name {
+			return jobType, true
+		}
+	}
+	return 0, false
+}
+
+func ToProto(job QueuedJob) *galactuspb.Job {
+	return &galactuspb.Job{
+		Type:       int32(job.JobType),
+		Payload:    PayloadString(job.Job),
+		EnqueuedAt: job.EnqueuedAt,
+	}
+}
+
+func FromProto(pb *galactuspb.Job) QueuedJob {
+	return QueuedJob{
+		Job: task.Job{
+			JobType: task.JobType(pb.Type),
+			Payload: pb.Payload,
+		},
+		EnqueuedAt: pb.EnqueuedAt,
+	}
+}
+
+// PayloadString returns the payload as pushed by the broker. Payloads are always pushed as strings, but anything
+// else is re-encoded as JSON rather than dropped
+func PayloadString(job task.Job) string {
+	if str, ok := job.Payload.(string); ok {
+		return str
+	}
+	jBytes, err := json.Marshal(job.Payload)
+	if err != nil {
+		return ""
+	}
+	return string(jBytes)
+}
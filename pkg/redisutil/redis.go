@@ -0,0 +1,236 @@
+// Package redisutil builds the Redis clients shared by galactus and the broker from one configuration.
+//
+// Galactus can run against Redis Cluster. Every command it issues touches a single key, so there are no CROSSSLOT
+// errors to worry about; any new multi-key command or script must put its keys in the same slot with a hash tag, like
+// "galactus:{<guildID>}:...". Pub/sub works unchanged, since cluster nodes broadcast published messages.
+package redisutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// with Sentinel, commands that land on a demoted master fail with READONLY until the client notices the failover;
+// go-redis retries those, so give it enough attempts to span a typical failover
+const SentinelMaxRetries = 10
+const SentinelMaxRetryBackoff = time.Second
+
+type Config struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// if SentinelMasterName is set, Addr is ignored and the master is discovered through the sentinels
+	SentinelMasterName string   `yaml:"sentinelMaster"`
+	SentinelAddrs      []string `yaml:"sentinelAddrs"`
+	SentinelPassword   string   `yaml:"sentinelPassword"`
+
+	// if ClusterAddrs is set, Addr is ignored and galactus connects to a Redis Cluster through these seed nodes
+	ClusterAddrs []string `yaml:"clusterAddrs"`
+
+	// DB is ignored by Redis Cluster, which only has DB 0
+	DB int `yaml:"db"`
+
+	// 0 uses the go-redis defaults (10 connections per CPU, no idle connections kept open)
+	PoolSize     int `yaml:"poolSize"`
+	MinIdleConns int `yaml:"minIdleConns"`
+
+	TLS                   bool   `yaml:"tls"`
+	TLSCAFile             string `yaml:"tlsCA"`
+	TLSInsecureSkipVerify bool   `yaml:"tlsInsecureSkipVerify"`
+}
+
+// Mode is how galactus connects to Redis: "cluster", "sentinel" or "standalone"
+func (config Config) Mode() string {
+	if len(config.ClusterAddrs) > 0 {
+		return "cluster"
+	}
+	if config.SentinelMasterName != "" {
+		return "sentinel"
+	}
+	return "standalone"
+}
+
+// ApplyEnv overrides the config with any REDIS_* environment variables that are set, so they take precedence over a
+// config file
+func (config *Config) ApplyEnv() error {
+	setString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	setInt := func(name string, dst *int) error {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil
+		}
+		num, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, v)
+		}
+		log.Printf("Read from env; using %s=%d\n", name, num)
+		*dst = int(num)
+		return nil
+	}
+
+	setString("REDIS_ADDR", &config.Addr)
+	setString("REDIS_USER", &config.Username)
+	setString("REDIS_PASS", &config.Password)
+	setString("REDIS_SENTINEL_MASTER", &config.SentinelMasterName)
+	setString("REDIS_SENTINEL_PASS", &config.SentinelPassword)
+	if addrs := splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS")); addrs != nil {
+		config.SentinelAddrs = addrs
+	}
+	if addrs := splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS")); addrs != nil {
+		config.ClusterAddrs = addrs
+	}
+	setString("REDIS_TLS_CA", &config.TLSCAFile)
+	if os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY") == "true" {
+		config.TLSInsecureSkipVerify = true
+	}
+	// providing a CA or skipping verification only makes sense over TLS, so either one implies it
+	config.TLS = config.TLS || os.Getenv("REDIS_TLS") == "true" || config.TLSCAFile != "" || config.TLSInsecureSkipVerify
+
+	if err := setInt("REDIS_DB", &config.DB); err != nil {
+		return err
+	}
+	if err := setInt("REDIS_POOL_SIZE", &config.PoolSize); err != nil {
+		return err
+	}
+	if err := setInt("REDIS_MIN_IDLE_CONNS", &config.MinIdleConns); err != nil {
+		return err
+	}
+
+	if config.Username != "" {
+		log.Println("Using REDIS_USER=" + config.Username)
+	} else {
+		log.Println("No REDIS_USER specified.")
+	}
+
+	if config.Password != "" {
+		log.Println("Using REDIS_PASS=<redacted>")
+	} else {
+		log.Println("No REDIS_PASS specified.")
+	}
+
+	if config.SentinelMasterName != "" {
+		log.Printf("Using REDIS_SENTINEL_MASTER=%s with sentinels %v\n", config.SentinelMasterName, config.SentinelAddrs)
+	}
+	if len(config.ClusterAddrs) > 0 {
+		log.Printf("Using Redis Cluster with REDIS_CLUSTER_ADDRS=%v\n", config.ClusterAddrs)
+	}
+	if config.TLSInsecureSkipVerify {
+		log.Println("Using TLS for Redis WITHOUT verifying the server certificate")
+	} else if config.TLS {
+		log.Println("Using TLS for Redis")
+	}
+	return nil
+}
+
+func splitAddrs(str string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(str, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (config Config) Validate() error {
+	if config.SentinelMasterName != "" && len(config.ClusterAddrs) > 0 {
+		return errors.New("REDIS_SENTINEL_MASTER and REDIS_CLUSTER_ADDRS can't be used together")
+	}
+	if len(config.ClusterAddrs) > 0 {
+		if config.DB != 0 {
+			return errors.New("REDIS_DB can't be used with Redis Cluster, which only supports DB 0")
+		}
+	} else if config.SentinelMasterName != "" {
+		if len(config.SentinelAddrs) == 0 {
+			return errors.New("REDIS_SENTINEL_MASTER is set, but no REDIS_SENTINEL_ADDRS were provided")
+		}
+	} else if config.Addr == "" {
+		return errors.New("no REDIS_ADDR specified")
+	}
+	if config.DB < 0 {
+		return fmt.Errorf("invalid REDIS_DB %d", config.DB)
+	}
+	if config.PoolSize < 0 || config.MinIdleConns < 0 {
+		return errors.New("REDIS_POOL_SIZE and REDIS_MIN_IDLE_CONNS can't be negative")
+	}
+	_, err := config.tlsConfig()
+	return err
+}
+
+// tlsConfig returns nil when TLS is disabled
+func (config Config) tlsConfig() (*tls.Config, error) {
+	if !config.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+	if config.TLSCAFile != "" {
+		pem, err := os.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading REDIS_TLS_CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in REDIS_TLS_CA %s", config.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// NewClient expects a config that passed Validate
+func NewClient(config Config) redis.UniversalClient {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(config.ClusterAddrs) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        config.ClusterAddrs,
+			Username:     config.Username,
+			Password:     config.Password,
+			PoolSize:     config.PoolSize,
+			MinIdleConns: config.MinIdleConns,
+			TLSConfig:    tlsConfig,
+		})
+	}
+	if config.SentinelMasterName != "" {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.SentinelMasterName,
+			SentinelAddrs:    config.SentinelAddrs,
+			SentinelPassword: config.SentinelPassword,
+			Username:         config.Username,
+			Password:         config.Password,
+			DB:               config.DB,
+			MaxRetries:       SentinelMaxRetries,
+			MaxRetryBackoff:  SentinelMaxRetryBackoff,
+			PoolSize:         config.PoolSize,
+			MinIdleConns:     config.MinIdleConns,
+			TLSConfig:        tlsConfig,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:         config.Addr,
+		Username:     config.Username,
+		Password:     config.Password,
+		DB:           config.DB,
+		PoolSize:     config.PoolSize,
+		MinIdleConns: config.MinIdleConns,
+		TLSConfig:    tlsConfig,
+	})
+}
@@ -0,0 +1,38 @@
+package redisutil
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"sync"
+)
+
+const scanCount = 1000
+
+// ScanKeys returns every key matching the pattern. On Redis Cluster, a SCAN only covers the node it's sent to, so every
+// master is scanned
+func ScanKeys(ctx context.Context, client redis.UniversalClient, match string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(ctx, client, match)
+	}
+
+	var keys []string
+	lock := sync.Mutex{}
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		masterKeys, err := scanKeys(ctx, master, match)
+		lock.Lock()
+		keys = append(keys, masterKeys...)
+		lock.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+func scanKeys(ctx context.Context, client redis.Cmdable, match string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, match, scanCount).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
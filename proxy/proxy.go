@@ -0,0 +1,321 @@
+// Package proxy forwards Discord REST requests from AutoMuteUs workers, sharing Discord's rate limits between every
+// worker and galactus instance through Redis, instead of each worker discovering them on its own
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://discord.com"
+
+// DefaultGlobalRequestsPerSecond is Discord's global limit for a bot token
+const DefaultGlobalRequestsPerSecond = 50
+
+// MaxWait is the longest a request waits for a rate limit before it's answered with a 429 instead
+const MaxWait = time.Second * 10
+
+// how long a learned route -> bucket mapping is remembered
+const bucketMappingTTL = time.Hour * 24
+
+var proxyRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_discord_proxy_requests_total",
+	Help: "Requests forwarded to Discord by the proxy, by response status",
+}, []string{"status"})
+
+var proxyRateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "galactus_discord_proxy_rate_limited_total",
+	Help: "429s received from Discord through the proxy, by scope",
+}, []string{"scope"})
+
+// returns 0 if a request can be made on the bucket now, taking one from its remaining count, or the ms until it resets
+var acquireBucketScript = redis.NewScript(`
+local data = redis.call("HMGET", KEYS[1], "remaining", "reset")
+local remaining = tonumber(data[1])
+local reset = tonumber(data[2])
+local now = tonumber(ARGV[1])
+if remaining == nil or reset == nil or reset <= now then
+	return 0
+end
+if remaining > 0 then
+	redis.call("HINCRBY", KEYS[1], "remaining", -1)
+	return 0
+end
+return reset - now
+`)
+
+// refills the global bucket based on elapsed time, then takes one request from it; returns the ms to wait, or 0
+var globalBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1]) or rate
+local ts = tonumber(data[2]) or now
+tokens = math.min(rate, tokens + math.max(0, now - ts) * rate / 1000)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], 2000)
+return wait
+`)
+
+type Proxy struct {
+	client     redis.UniversalClient
+	httpClient *http.Client
+	// BaseURL is where requests are forwarded, normally DefaultBaseURL
+	BaseURL string
+	// Prefix is stripped from incoming paths; the rest, like "/api/v8/channels/1234/messages", is forwarded
+	Prefix                  string
+	GlobalRequestsPerSecond float64
+	// RewriteAuthorization, if set, picks the Authorization header each request is forwarded with, given the one it
+	// arrived with. Rate limits are tracked for the header that's forwarded
+	RewriteAuthorization func(authorization string) string
+}
+
+func NewProxy(client redis.UniversalClient, prefix string) *Proxy {
+	return &Proxy{
+		client:                  client,
+		httpClient:              &http.Client{Timeout: time.Second * 30},
+		BaseURL:                 DefaultBaseURL,
+		Prefix:                  prefix,
+		GlobalRequestsPerSecond: DefaultGlobalRequestsPerSecond,
+	}
+}
+
+// limits are per bot token; don't put the raw token in key names
+func tokenKey(authorization string) string {
+	if authorization == "" {
+		return "anonymous"
+	}
+	h := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(h[:])[0:16]
+}
+
+func globalBlockKey(token string) string {
+	return "galactus:discord:global:block:" + token
+}
+
+func globalBucketKey(token string) string {
+	return "galactus:discord:global:" + token
+}
+
+func routeBucketKey(template string) string {
+	return "galactus:discord:route:" + template
+}
+
+func bucketKey(token, bucket, major string) string {
+	return "galactus:discord:bucket:" + token + ":" + bucket + ":" + major
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, proxy.Prefix)
+	if !strings.HasPrefix(path, "/api/") {
+		http.Error(w, "only Discord API paths, like "+proxy.Prefix+"/api/v8/..., can be proxied", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if proxy.RewriteAuthorization != nil {
+		authorization = proxy.RewriteAuthorization(authorization)
+	}
+	token := tokenKey(authorization)
+	rt := parseRoute(r.Method, path)
+	bucket := proxy.bucketFor(r.Context(), rt)
+
+	wait, err := proxy.acquire(r.Context(), token, bucket, rt.major)
+	if err != nil {
+		// our limiter being down shouldn't take Discord down with it; Discord's 429s still protect us
+		log.Println(err)
+	} else if wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(wait.Seconds())+1, 10))
+		http.Error(w, "rate limited by galactus", http.StatusTooManyRequests)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, proxy.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.URL.RawQuery = r.URL.RawQuery
+	for k, v := range r.Header {
+		if isForwardedHeader(k) {
+			req.Header[k] = v
+		}
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := proxy.httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to reach Discord", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read Discord's response", http.StatusBadGateway)
+		return
+	}
+	proxyRequestsTotal.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+
+	proxy.update(r.Context(), token, rt, resp, respBody)
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, bytes.NewReader(respBody))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func isForwardedHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Content-Type", "User-Agent", "X-Audit-Log-Reason":
+		return true
+	}
+	return false
+}
+
+// bucketFor returns the Discord bucket a route was last seen in, or the route itself until Discord tells us
+func (proxy *Proxy) bucketFor(ctx context.Context, rt route) string {
+	bucket, err := proxy.client.Get(ctx, routeBucketKey(rt.template)).Result()
+	if err != nil {
+		return rt.template
+	}
+	return bucket
+}
+
+// acquire waits for room in the global and route buckets. It returns how long the caller would still have to wait if
+// that's longer than MaxWait
+func (proxy *Proxy) acquire(ctx context.Context, token, bucket, major string) (time.Duration, error) {
+	deadline := time.Now().Add(MaxWait)
+	for {
+		wait, err := proxy.nextWait(ctx, token, bucket, major)
+		if err != nil || wait <= 0 {
+			return 0, err
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return wait, nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (proxy *Proxy) nextWait(ctx context.Context, token, bucket, major string) (time.Duration, error) {
+	blocked, err := proxy.client.PTTL(ctx, globalBlockKey(token)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if blocked > 0 {
+		return blocked, nil
+	}
+	waitMs, err := globalBucketScript.Run(ctx, proxy.client, []string{globalBucketKey(token)}, proxy.GlobalRequestsPerSecond, nowMs()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if waitMs > 0 {
+		return time.Duration(waitMs) * time.Millisecond, nil
+	}
+	waitMs, err = acquireBucketScript.Run(ctx, proxy.client, []string{bucketKey(token, bucket, major)}, nowMs()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(waitMs) * time.Millisecond, nil
+}
+
+type tooManyRequests struct {
+	RetryAfter float64 `json:"retry_after"`
+	Global     bool    `json:"global"`
+}
+
+// update records the rate limit state Discord reported for the route
+func (proxy *Proxy) update(ctx context.Context, token string, rt route, resp *http.Response, body []byte) {
+	bucket := resp.Header.Get("X-RateLimit-Bucket")
+	if bucket != "" {
+		err := proxy.client.Set(ctx, routeBucketKey(rt.template), bucket, bucketMappingTTL).Err()
+		if err != nil {
+			log.Println(err)
+		}
+	} else {
+		bucket = rt.template
+	}
+	key := bucketKey(token, bucket, rt.major)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		tmr := tooManyRequests{}
+		if err := json.Unmarshal(body, &tmr); err != nil {
+			log.Println(err)
+			return
+		}
+		retryAfter := time.Duration(tmr.RetryAfter * float64(time.Second))
+		if tmr.Global || resp.Header.Get("X-RateLimit-Global") == "true" {
+			proxyRateLimitedTotal.WithLabelValues("global").Inc()
+			err := proxy.client.Set(ctx, globalBlockKey(token), "", retryAfter).Err()
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		proxyRateLimitedTotal.WithLabelValues("route").Inc()
+		proxy.setBucket(ctx, key, 0, retryAfter)
+		return
+	}
+
+	remaining, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Remaining"), 10, 64)
+	if err != nil {
+		return
+	}
+	resetAfter, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+	proxy.setBucket(ctx, key, remaining, time.Duration(resetAfter*float64(time.Second)))
+}
+
+func (proxy *Proxy) setBucket(ctx context.Context, key string, remaining int64, resetAfter time.Duration) {
+	reset := nowMs() + resetAfter.Milliseconds()
+	pipe := proxy.client.TxPipeline()
+	pipe.HSet(ctx, key, "remaining", remaining, "reset", reset)
+	pipe.PExpire(ctx, key, resetAfter+time.Second)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"strings"
+	"time"
+)
+
+// ErrInvalidReservation is returned for reservations of less than one request, or more than the global bucket holds
+var ErrInvalidReservation = errors.New("invalid reservation")
+
+// takes ARGV[3] requests from the global bucket if it holds that many after refilling, returning 0; otherwise takes
+// nothing and returns the ms until it will. A negative count puts requests back
+var reserveGlobalScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local count = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1]) or rate
+local ts = tonumber(data[2]) or now
+tokens = math.min(rate, tokens + math.max(0, now - ts) * rate / 1000)
+local wait = 0
+if tokens >= count then
+	tokens = math.min(rate, tokens - count)
+else
+	wait = math.ceil((count - tokens) * 1000 / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], 2000)
+return wait
+`)
+
+// takes ARGV[2] requests from the route bucket if it has that many left, returning 0; otherwise takes nothing and
+// returns the ms until it resets. Buckets Discord hasn't reported on yet are assumed to have room
+var reserveBucketScript = redis.NewScript(`
+local data = redis.call("HMGET", KEYS[1], "remaining", "reset")
+local remaining = tonumber(data[1])
+local reset = tonumber(data[2])
+local now = tonumber(ARGV[1])
+local count = tonumber(ARGV[2])
+if remaining == nil or reset == nil or reset <= now then
+	return 0
+end
+if remaining >= count then
+	redis.call("HINCRBY", KEYS[1], "remaining", -count)
+	return 0
+end
+return reset - now
+`)
+
+// Reserve takes count requests on a Discord route from the same buckets proxied requests use, so workers calling
+// Discord directly share one budget with the proxy. authorization is the Authorization header the calls will be made
+// with, and path a Discord API path like "/api/v8/guilds/1234/members/5678". It returns 0 if the requests were
+// reserved, or how long until they can be, having reserved nothing
+func (proxy *Proxy) Reserve(ctx context.Context, authorization, method, path string, count int64) (time.Duration, error) {
+	if count < 1 || float64(count) > proxy.GlobalRequestsPerSecond {
+		return 0, ErrInvalidReservation
+	}
+	if !strings.HasPrefix(path, "/api/") {
+		return 0, ErrInvalidReservation
+	}
+	token := tokenKey(authorization)
+	rt := parseRoute(strings.ToUpper(method), path)
+	bucket := proxy.bucketFor(ctx, rt)
+
+	blocked, err := proxy.client.PTTL(ctx, globalBlockKey(token)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if blocked > 0 {
+		return blocked, nil
+	}
+	waitMs, err := reserveGlobalScript.Run(ctx, proxy.client, []string{globalBucketKey(token)}, proxy.GlobalRequestsPerSecond, nowMs(), count).Int64()
+	if err != nil || waitMs > 0 {
+		return time.Duration(waitMs) * time.Millisecond, err
+	}
+	// the buckets live on different Redis Cluster slots, so the global requests are put back if the route can't take
+	// them, rather than checking both in one script
+	waitMs, err = reserveBucketScript.Run(ctx, proxy.client, []string{bucketKey(token, bucket, rt.major)}, nowMs(), count).Int64()
+	if err != nil || waitMs > 0 {
+		refundErr := reserveGlobalScript.Run(ctx, proxy.client, []string{globalBucketKey(token)}, proxy.GlobalRequestsPerSecond, nowMs(), -count).Err()
+		if err == nil {
+			err = refundErr
+		}
+		return time.Duration(waitMs) * time.Millisecond, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// route identifies a Discord rate limit route: the method and path with IDs replaced, except for the major parameter,
+// which Discord tracks separately. For example, "POST /channels/:major/messages" with major "1234"
+type route struct {
+	template string
+	major    string
+}
+
+func isSnowflake(str string) bool {
+	if len(str) < 15 {
+		return false
+	}
+	_, err := strconv.ParseUint(str, 10, 64)
+	return err == nil
+}
+
+// parseRoute normalizes a Discord API path like "/api/v8/channels/1234/messages/5678"
+func parseRoute(method, path string) route {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 0 && parts[0] == "api" {
+		parts = parts[1:]
+	}
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v") {
+		if _, err := strconv.Atoi(parts[0][1:]); err == nil {
+			parts = parts[1:]
+		}
+	}
+
+	r := route{}
+	for i, part := range parts {
+		if i == 0 {
+			continue
+		}
+		switch {
+		case i == 1 && (parts[0] == "channels" || parts[0] == "guilds" || parts[0] == "webhooks") && isSnowflake(part):
+			r.major = part
+			parts[i] = ":major"
+		case i == 2 && parts[0] == "webhooks":
+			// the webhook token is part of the major parameter
+			r.major += "/" + part
+			parts[i] = ":token"
+		case parts[i-1] == "reactions":
+			// every emoji shares one bucket
+			parts[i] = ":emoji"
+		case isSnowflake(part):
+			parts[i] = ":id"
+		}
+	}
+	r.template = method + " /" + strings.Join(parts, "/")
+	return r
+}